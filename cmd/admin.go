@@ -0,0 +1,38 @@
+package cmd
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/alphagov/iap/pkg/drain"
+	"github.com/alphagov/iap/pkg/metrics"
+	"github.com/sirupsen/logrus"
+)
+
+// adminServer serves the metrics and health of the servers run by every
+// command on the admin port, which is kept apart from the ports clients are
+// using.
+func (r *runner) adminServer(port uint16) (drain.Server, error) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", metrics.Handler())
+	r.healthHandlers(mux)
+
+	srv := &http.Server{
+		Addr:         fmt.Sprintf(":%d", port),
+		Handler:      mux,
+		ReadTimeout:  5 * time.Second,
+		WriteTimeout: 30 * time.Second,
+	}
+
+	listener, err := drain.Listen("tcp", srv.Addr)
+	if err != nil {
+		return nil, err
+	}
+
+	r.ctx.Logger.WithFields(logrus.Fields{
+		"port": port,
+	}).Info("starting admin server")
+
+	return drain.HTTPServer(srv, listener), nil
+}
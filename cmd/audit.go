@@ -0,0 +1,62 @@
+package cmd
+
+import (
+	"errors"
+
+	"github.com/alphagov/iap/pkg/audit"
+	"github.com/alphagov/iap/pkg/router"
+	"github.com/alphagov/iap/pkg/serviceaccount"
+)
+
+var (
+	// errMissingCredentials is recorded when a proxy request has no credentials.
+	errMissingCredentials = errors.New("Credentials are missing")
+	// errInvalidCredentials is recorded when generated credentials are not valid.
+	errInvalidCredentials = errors.New("Credentials are not valid")
+	// errUnmappedCertificate is recorded when client certificates are
+	// required and the one of a request identifies nobody.
+	errUnmappedCertificate = errors.New("Client certificate does not identify anyone")
+)
+
+// auditCredentials records the outcome of validating the credentials of a
+// user or service account, the source is empty when it is not known.
+func auditCredentials(auditor *audit.Logger, user, source string, err error) {
+	auditor.Record(audit.Event{
+		Type:     audit.CredentialsValidated,
+		User:     user,
+		Source:   source,
+		Decision: audit.Decision(err == nil),
+		Reason:   credentialsReason(err),
+	})
+}
+
+func credentialsReason(err error) string {
+	switch err {
+	case nil:
+		return ""
+	case errMissingCredentials:
+		return "missing_credentials"
+	case errUnmappedCertificate:
+		return "unmapped_certificate"
+	case router.ErrUnlistedUser:
+		return "unlisted_user"
+	case serviceaccount.ErrInvalidKey:
+		return "invalid_key"
+	case serviceaccount.ErrExpired:
+		return "expired"
+	case serviceaccount.ErrSourceNotAllowed:
+		return "source_not_allowed"
+	}
+
+	return "invalid_credentials"
+}
+
+// auditSource returns the IP address of a host:port network address, or the
+// address itself when it has no port.
+func auditSource(addr string) string {
+	if ip := remoteIP(addr); ip != nil {
+		return ip.String()
+	}
+
+	return addr
+}
@@ -0,0 +1,244 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/alphagov/iap/pkg/access"
+	"github.com/alphagov/iap/pkg/cfg"
+	kingpin "gopkg.in/alecthomas/kingpin.v2"
+)
+
+// ConfigValidateInput is a configuration only to be used by this particular command.
+type ConfigValidateInput struct {
+	Path   string
+	Strict bool
+}
+
+// ConfigExplainInput is a configuration only to be used by this particular command.
+type ConfigExplainInput struct {
+	Path            string
+	User            string
+	ServiceAccount  string
+	Unauthenticated bool
+}
+
+// ConfigDiffInput is a configuration only to be used by this particular command.
+type ConfigDiffInput struct {
+	OldPath string
+	NewPath string
+}
+
+// ConfigureConfigCommand should fill in the above input structs with some
+// usable values. Its commands only read configuration files, so they can run
+// in CI without Redis.
+func ConfigureConfigCommand(app *kingpin.Application) {
+	cmd := app.Command("config", "Check and explain configuration files.")
+
+	validateInput := ConfigValidateInput{}
+	validate := cmd.Command("validate", "Validate a configuration file, reporting every problem.")
+	validate.Arg("file", "Configuration file to validate.").
+		Required().
+		StringVar(&validateInput.Path)
+	validate.Flag("strict", "Treat warnings as errors.").
+		BoolVar(&validateInput.Strict)
+	validate.Action(func(c *kingpin.ParseContext) error {
+		return ConfigValidateCommand(os.Stdout, validateInput)
+	})
+
+	explainInput := ConfigExplainInput{}
+	explain := cmd.Command("explain", "Explain which services and hosts a user or service account can access.")
+	explain.Arg("file", "Configuration file, defaults to the one given with --config.").
+		StringVar(&explainInput.Path)
+	explain.Flag("user", "Identifier of the user, as given by the OIDC provider.").
+		StringVar(&explainInput.User)
+	explain.Flag("service-account", "Name of the service account.").
+		StringVar(&explainInput.ServiceAccount)
+	explain.Flag("unauthenticated", "Explain the public paths anyone can access without logging in.").
+		BoolVar(&explainInput.Unauthenticated)
+	explain.Action(func(c *kingpin.ParseContext) error {
+		if explainInput.Path == "" {
+			explainInput.Path = GlobalFlags.ConfigPath
+		}
+		return ConfigExplainCommand(os.Stdout, explainInput)
+	})
+
+	diffInput := ConfigDiffInput{}
+	diff := cmd.Command("diff", "Show the access gained or lost by every user between two configuration files.")
+	diff.Arg("old", "Current configuration file.").
+		Required().
+		StringVar(&diffInput.OldPath)
+	diff.Arg("new", "Changed configuration file.").
+		Required().
+		StringVar(&diffInput.NewPath)
+	diff.Action(func(c *kingpin.ParseContext) error {
+		return ConfigDiffCommand(os.Stdout, diffInput)
+	})
+}
+
+// ConfigValidateCommand prints every error and warning of the configuration
+// along with its YAML path, and fails when there are any errors. In strict
+// mode, warnings are errors.
+func ConfigValidateCommand(w io.Writer, input ConfigValidateInput) error {
+	config, err := readConfig(input.Path, input.Strict)
+
+	var problems cfg.Problems
+	if errors.As(err, &problems) {
+		for _, problem := range problems {
+			fmt.Fprintf(w, "error: %s\n", problem)
+		}
+		return fmt.Errorf("%s is not valid", input.Path)
+	}
+	if err != nil {
+		return err
+	}
+
+	for _, warning := range config.Warnings {
+		fmt.Fprintf(w, "warning: %s\n", warning)
+	}
+	fmt.Fprintf(w, "%s is valid\n", input.Path)
+	return nil
+}
+
+// ConfigExplainCommand prints which services and hosts the user or service
+// account can access, with the roles granting access, and which services
+// they cannot access, with the roles required. Unauthenticated, it prints the
+// public paths anyone can access without logging in.
+func ConfigExplainCommand(w io.Writer, input ConfigExplainInput) error {
+	if input.Path == "" {
+		return fmt.Errorf("A configuration file must be given")
+	}
+	subjects := 0
+	for _, given := range []bool{input.User != "", input.ServiceAccount != "", input.Unauthenticated} {
+		if given {
+			subjects++
+		}
+	}
+	if subjects != 1 {
+		return fmt.Errorf("Either --user, --service-account or --unauthenticated must be given")
+	}
+
+	config, err := readConfig(input.Path, false)
+	if err != nil {
+		return err
+	}
+
+	explanation := access.Explain(config, input.User)
+	switch {
+	case input.ServiceAccount != "":
+		explanation = access.ExplainServiceAccount(config, input.ServiceAccount)
+	case input.Unauthenticated:
+		explanation = access.ExplainUnauthenticated(config)
+	}
+
+	subject := explanation.Subject
+	switch {
+	case subject.Kind == access.Anyone:
+		fmt.Fprintln(w, "Anyone who is not logged in")
+	case !subject.Known && subject.Kind == access.ServiceAccount:
+		return fmt.Errorf("Service account %s is not in the configuration", subject.Identifier)
+	case !subject.Known && config.AllowUnlistedUsers:
+		fmt.Fprintf(w, "%s is not one of the users, so has no roles once logged in\n", subject.Identifier)
+	case !subject.Known:
+		fmt.Fprintf(w, "%s is not one of the users, so cannot access any service\n", subject.Identifier)
+	case len(subject.Roles) == 0:
+		fmt.Fprintf(w, "%s has no roles\n", subject.Identifier)
+	default:
+		fmt.Fprintf(w, "%s has roles %s\n", subject.Identifier, strings.Join(subject.Roles, ", "))
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+
+	if len(explanation.Grants) > 0 {
+		fmt.Fprintln(tw, "\ncan access:")
+	}
+	for _, grant := range explanation.Grants {
+		why := "no roles required"
+		if len(grant.Roles) > 0 {
+			why = "with " + strings.Join(grant.Roles, ", ")
+		}
+		fmt.Fprintf(tw, "  %s\t%s\t%s\n", grant.Service, strings.Join(grant.Hosts, ", "), why)
+	}
+
+	if len(explanation.Denials) > 0 {
+		fmt.Fprintln(tw, "\ncannot access:")
+	}
+	for _, denial := range explanation.Denials {
+		why := "requires being one of the users"
+		if subject.Kind == access.Anyone {
+			why = "requires logging in"
+		} else if len(denial.Roles) > 0 {
+			why = "requires one of " + strings.Join(denial.Roles, ", ")
+		}
+		fmt.Fprintf(tw, "  %s\t%s\t%s\n", denial.Service, strings.Join(denial.Hosts, ", "), why)
+	}
+
+	return tw.Flush()
+}
+
+// ConfigDiffCommand prints the hosts of the services every user and service
+// account can access with the new configuration and not with the old one,
+// prefixed with +, and the other way around, prefixed with -.
+func ConfigDiffCommand(w io.Writer, input ConfigDiffInput) error {
+	previous, err := readConfig(input.OldPath, false)
+	if err != nil {
+		return fmt.Errorf("%s: %s", input.OldPath, err)
+	}
+
+	next, err := readConfig(input.NewPath, false)
+	if err != nil {
+		return fmt.Errorf("%s: %s", input.NewPath, err)
+	}
+
+	changes := access.Diff(previous, next)
+	if len(changes) == 0 {
+		fmt.Fprintln(w, "No access was gained or lost")
+		return nil
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	for _, change := range changes {
+		switch {
+		case change.Kind == access.Anyone:
+			fmt.Fprintln(tw, "anyone, without logging in")
+		case change.Identifier == "":
+			fmt.Fprintln(tw, "anyone who logs in")
+		case change.Kind == access.ServiceAccount:
+			fmt.Fprintf(tw, "service account %s\n", change.Identifier)
+		default:
+			fmt.Fprintf(tw, "user %s\n", change.Identifier)
+		}
+
+		for _, gained := range change.Gained {
+			fmt.Fprintf(tw, "  +\t%s\t%s\n", gained.Service, gained.Host)
+		}
+		for _, lost := range change.Lost {
+			fmt.Fprintf(tw, "  -\t%s\t%s\n", lost.Service, lost.Host)
+		}
+	}
+
+	return tw.Flush()
+}
+
+// readConfig reads and validates a configuration file, which is rejected
+// when it has any warnings in strict mode. The files it refers to are not
+// read, as the secrets are usually only on the hosts running IAP.
+func readConfig(path string, strict bool) (cfg.ValidatedConfig, error) {
+	blob, err := ioutil.ReadFile(path)
+	if err != nil {
+		return cfg.ValidatedConfig{}, fmt.Errorf("Could not read config: %s", err)
+	}
+
+	config, err := cfg.Parse(string(blob))
+	if err != nil {
+		return cfg.ValidatedConfig{}, err
+	}
+
+	config.Strict = config.Strict || strict
+	return config.ValidateStatic()
+}
@@ -0,0 +1,143 @@
+package cmd
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/lithammer/dedent"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	kingpin "gopkg.in/alecthomas/kingpin.v2"
+)
+
+var _ = Describe("Config command", func() {
+	var dir string
+
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "iap-config")
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(dir)
+	})
+
+	// write writes a configuration with the services and the files of its
+	// SSH CA missing, which are only read when serving
+	write := func(services string) string {
+		path := filepath.Join(dir, "config.yaml")
+		Expect(ioutil.WriteFile(path, []byte(dedent.Dedent(`
+    oidc:
+      redirect_uri: https://iap.mydomain.com/oidc/callback
+      auth_uri: https://accounts.google.com/o/oauth2/v2/auth
+      token_uri: https://www.googleapis.com/oauth2/v4/token
+      client_id: foo-0000-1111.apps.googleusercontent.com
+      client_secret: abcd-0000-1111
+    session:
+      cookie_domain: mydomain.com
+    ssh_ca:
+      key_file: `+filepath.Join(dir, "ssh-ca")+`
+    roles: [superuser, auditor]
+    users:
+      fname.lname@mydomain.com:
+        roles: [superuser]
+		`)+dedent.Dedent(services)), 0600)).To(Succeed())
+		return path
+	}
+
+	// run runs the command as it is from the command line, returning the
+	// error which makes it exit with a non-zero status
+	run := func(args ...string) error {
+		app := kingpin.New("iap", "")
+		ConfigureConfigCommand(app)
+
+		_, err := app.Parse(append([]string{"config"}, args...))
+		return err
+	}
+
+	It("Validates a configuration without reading the files it refers to", func() {
+		path := write(`
+    services:
+      my-service:
+        upstream_uri: http://my-service.local
+        matchers:
+          - host: my-service.mydomain.com
+        roles: [superuser, auditor]
+		`)
+
+		var out bytes.Buffer
+		Expect(ConfigValidateCommand(&out, ConfigValidateInput{Path: path})).To(Succeed())
+		Expect(out.String()).To(Equal(path + " is valid\n"))
+	})
+
+	It("Fails printing every error when the configuration is not valid", func() {
+		path := write(`
+    services:
+      my-service:
+        upstream_uri: http://my-service.local
+        matchers:
+          - host: my-service.otherdomain.com
+        roles: [superuser, auditor]
+		`)
+
+		var out bytes.Buffer
+		err := ConfigValidateCommand(&out, ConfigValidateInput{Path: path})
+		Expect(err).To(MatchError(path + " is not valid"))
+		Expect(out.String()).To(ContainSubstring(
+			"error: services.my-service.matchers[0]: Host my-service.otherdomain.com is not within the session CookieDomain mydomain.com",
+		))
+
+		Expect(run("validate", path)).To(MatchError(path + " is not valid"))
+	})
+
+	It("Only fails on warnings in strict mode", func() {
+		path := write(`
+    services:
+      my-service:
+        upstream_uri: http://my-service.local
+        matchers:
+          - host: my-service.mydomain.com
+        roles: [superuser]
+		`)
+
+		var out bytes.Buffer
+		Expect(ConfigValidateCommand(&out, ConfigValidateInput{Path: path})).To(Succeed())
+		Expect(out.String()).To(ContainSubstring(
+			"warning: roles[1]: Role auditor is not required by any service",
+		))
+
+		out.Reset()
+		err := ConfigValidateCommand(&out, ConfigValidateInput{Path: path, Strict: true})
+		Expect(err).To(MatchError(path + " is not valid"))
+		Expect(out.String()).To(ContainSubstring(
+			"error: roles[1]: Role auditor is not required by any service",
+		))
+
+		Expect(run("validate", path)).To(Succeed())
+		Expect(run("validate", "--strict", path)).To(MatchError(path + " is not valid"))
+	})
+
+	It("Explains the public paths anyone can access without logging in", func() {
+		path := write(`
+    services:
+      my-service:
+        upstream_uri: http://my-service.local
+        matchers:
+          - host: my-service.mydomain.com
+        public_paths:
+          - path: /healthcheck
+        roles: [superuser, auditor]
+		`)
+
+		var out bytes.Buffer
+		Expect(ConfigExplainCommand(&out, ConfigExplainInput{Path: path, Unauthenticated: true})).To(Succeed())
+		Expect(out.String()).To(ContainSubstring("Anyone who is not logged in"))
+		Expect(out.String()).To(ContainSubstring("my-service.mydomain.com/healthcheck"))
+
+		err := ConfigExplainCommand(&out, ConfigExplainInput{Path: path, User: "fname.lname@mydomain.com", Unauthenticated: true})
+		Expect(err).To(MatchError("Either --user, --service-account or --unauthenticated must be given"))
+	})
+})
@@ -0,0 +1,129 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/alphagov/iap/internal"
+	"github.com/alphagov/iap/pkg/cfg"
+	"github.com/alphagov/iap/pkg/drain"
+	"github.com/alphagov/iap/pkg/extauthz"
+	"github.com/alphagov/iap/pkg/router"
+	authv3 "github.com/envoyproxy/go-control-plane/envoy/service/auth/v3"
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc"
+	kingpin "gopkg.in/alecthomas/kingpin.v2"
+)
+
+// ExtAuthzCommandInput is a configuration only to be used by this particular command.
+type ExtAuthzCommandInput struct {
+	Host       string
+	Port       uint16
+	ConfigPath string
+}
+
+// ConfigureExtAuthzCommand should fill in the above input struct with some usable values.
+// It is also responsible for creating the context to be used within the app itself.
+func ConfigureExtAuthzCommand(app *kingpin.Application) {
+	input := ExtAuthzCommandInput{}
+	cmd := app.Command("ext-authz", "Run an Envoy external authorization gRPC server.")
+
+	cmd.Flag("host", "Host the gRPC server will be available under.").
+		Short('H').
+		Default("127.0.0.1").
+		OverrideDefaultFromEnvar("HOST").
+		StringVar(&input.Host)
+
+	cmd.Flag("port", "Port the gRPC server will be available under.").
+		Short('p').
+		Default("9001").
+		OverrideDefaultFromEnvar("PORT").
+		Uint16Var(&input.Port)
+
+	cmd.Action(func(c *kingpin.ParseContext) error {
+		ctx := internal.Context{
+			Logger: internal.SetupLogger(GlobalFlags.Debug),
+			Redis:  internal.SetupRedis(GlobalFlags.RedisAddress),
+		}
+		input.ConfigPath = GlobalFlags.ConfigPath
+		return ExtAuthzCommand(ctx, input)
+	})
+}
+
+// ExtAuthzCommand is the main brain behind this commands. It will start the
+// ext_authz v3 gRPC server, which Envoy asks whether requests are allowed.
+// The decisions are the same as the ones of the web command, and follow the
+// configuration when it is reloaded.
+// On SIGTERM or SIGINT, it lets the pending requests finish.
+func ExtAuthzCommand(ctx internal.Context, cfg ExtAuthzCommandInput) error {
+	if cfg.ConfigPath == "" {
+		return fmt.Errorf("The ext-authz command requires a configuration file")
+	}
+
+	r, err := newRunner(ctx, cfg.ConfigPath)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	srv := grpc.NewServer()
+	authv3.RegisterAuthorizationServer(srv, r.extAuthzServer())
+
+	addr := fmt.Sprintf("%s:%d", cfg.Host, cfg.Port)
+	listener, err := drain.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+
+	ctx.Logger.WithFields(logrus.Fields{
+		"address": addr,
+	}).Info("starting ext_authz server")
+
+	return r.Run(grpcServer{srv: srv, listener: listener})
+}
+
+// extAuthzServer makes the decisions with the latest configuration.
+func (r *runner) extAuthzServer() *extauthz.Server {
+	ctx := r.ctx
+	server := extauthz.New(nil, ctx.Logger)
+
+	r.onReload(func(config cfg.ValidatedConfig, gen *generation) {
+		authenticate, _ := r.setupAuthenticator(config, gen, setupSessions(ctx, config))
+		server.Update(router.NewForwardAuth(
+			router.New(config.Services, ctx.Logger),
+			authenticate,
+			loginURL(config.OIDCConfig.RedirectURI),
+			r.audit,
+			ctx.Logger,
+		))
+	})
+
+	return server
+}
+
+// grpcServer lets the pending RPCs finish when shutting down, the ones left
+// when the context is done are cancelled.
+type grpcServer struct {
+	srv      *grpc.Server
+	listener *drain.Listener
+}
+
+func (s grpcServer) Serve() error {
+	return s.srv.Serve(s.listener)
+}
+
+func (s grpcServer) Shutdown(ctx context.Context) error {
+	stopped := make(chan struct{})
+	go func() {
+		s.srv.GracefulStop()
+		close(stopped)
+	}()
+
+	select {
+	case <-stopped:
+		return nil
+	case <-ctx.Done():
+		s.srv.Stop()
+		return ctx.Err()
+	}
+}
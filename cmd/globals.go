@@ -1,13 +1,42 @@
 package cmd
 
 import (
+	"crypto/tls"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/alphagov/iap/internal"
+	"github.com/alphagov/iap/pkg/audit"
+	"github.com/alphagov/iap/pkg/cfg"
+	"github.com/alphagov/iap/pkg/clientcert"
+	"github.com/alphagov/iap/pkg/drain"
+	"github.com/alphagov/iap/pkg/health"
+	"github.com/alphagov/iap/pkg/oidc"
+	"github.com/alphagov/iap/pkg/reload"
+	"github.com/alphagov/iap/pkg/router"
+	"github.com/alphagov/iap/pkg/servertls"
+	"github.com/alphagov/iap/pkg/serviceaccount"
+	"github.com/alphagov/iap/pkg/session"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
 	kingpin "gopkg.in/alecthomas/kingpin.v2"
 )
 
 // GlobalFlags are going to store some data used by all of the commands.
 var GlobalFlags struct {
-	Debug        bool
-	RedisAddress string
+	Debug            bool
+	RedisAddress     string
+	ConfigPath       string
+	ShutdownTimeout  time.Duration
+	DrainDelay       time.Duration
+	AdminPort        uint16
+	OTLPEndpoint     *url.URL
+	TraceSampleRatio float64
 }
 
 // ConfigureGlobals should fill in the above struct with usable data values.
@@ -22,4 +51,338 @@ func ConfigureGlobals(app *kingpin.Application) {
 		Default("127.0.0.1:6379").
 		OverrideDefaultFromEnvar("REDIS_ADDRESS").
 		StringVar(&GlobalFlags.RedisAddress)
+
+	app.Flag("config", "Path to the configuration file with services and users.").
+		Short('c').
+		OverrideDefaultFromEnvar("CONFIG").
+		StringVar(&GlobalFlags.ConfigPath)
+
+	app.Flag("shutdown-timeout", "How long active requests and tunnels are given to finish when shutting down.").
+		Default("30s").
+		OverrideDefaultFromEnvar("SHUTDOWN_TIMEOUT").
+		DurationVar(&GlobalFlags.ShutdownTimeout)
+
+	app.Flag("drain-delay", "How long new requests are still accepted while the healthcheck fails before draining, for load balancers to notice.").
+		Default("0s").
+		OverrideDefaultFromEnvar("DRAIN_DELAY").
+		DurationVar(&GlobalFlags.DrainDelay)
+
+	app.Flag("admin-port", "Port the metrics, liveness and readiness will be available under, disabled when 0. Required by socks5. Give every command on a host its own.").
+		Default("0").
+		OverrideDefaultFromEnvar("ADMIN_PORT").
+		Uint16Var(&GlobalFlags.AdminPort)
+
+	app.Flag("otlp-endpoint", "OTLP/HTTP endpoint of the collector traces are sent to, eg: http://otel-collector:4318.").
+		OverrideDefaultFromEnvar("OTLP_ENDPOINT").
+		URLVar(&GlobalFlags.OTLPEndpoint)
+
+	app.Flag("trace-sample-ratio", "Ratio of the requests which are traced, unless the client already traces them.").
+		Default("1").
+		OverrideDefaultFromEnvar("TRACE_SAMPLE_RATIO").
+		Float64Var(&GlobalFlags.TraceSampleRatio)
+}
+
+// runner holds what the servers of the commands share, so that any of them
+// can run together in a single process.
+type runner struct {
+	ctx        internal.Context
+	configPath string
+	// config is the configuration the servers started with, which the
+	// watcher reloads
+	config  cfg.ValidatedConfig
+	watcher *reload.Watcher
+	drainer *drain.Drainer
+	health  *health.Checker
+	audit   *audit.Logger
+	// auditConfig is the configuration of the audit sinks opened, which are
+	// only opened again when it changes
+	auditConfig []audit.SinkConfig
+	tracer      *sdktrace.TracerProvider
+	// current is what was built from the latest configuration, along with
+	// how to rebuild it, which stops once closed
+	mu       sync.Mutex
+	current  *generation
+	rebuilds []func(cfg.ValidatedConfig, *generation)
+	closed   bool
+	// logger is for the libraries logging with the standard library
+	logger *log.Logger
+	writer *io.PipeWriter
+	// stop is closed once the servers have shut down, eg: to stop reloading
+	// certificates
+	stop chan struct{}
+}
+
+func newRunner(ctx internal.Context, configPath string) (*runner, error) {
+	var (
+		config  cfg.ValidatedConfig
+		watcher *reload.Watcher
+	)
+	if configPath != "" {
+		var err error
+		watcher, err = reload.Load(configPath, ctx.Logger)
+		if err != nil {
+			return nil, err
+		}
+		config = watcher.Config()
+	}
+
+	auditor, err := audit.Open(config.Audit, ctx.Logger)
+	if err != nil {
+		return nil, err
+	}
+
+	tracer, err := setupTracing(ctx)
+	if err != nil {
+		auditor.Close()
+		return nil, err
+	}
+
+	checker := health.New()
+	checker.Add("redis", func() error {
+		return ctx.Redis.Ping().Err()
+	})
+	if watcher != nil {
+		// The servers keep the current configuration when the file cannot
+		// be reloaded, which the readiness reports without failing
+		checker.AddOptional("config", func() error {
+			if status := watcher.Status(); status.LastError != "" {
+				return fmt.Errorf("Could not reload, serving the previous configuration: %s", status.LastError)
+			}
+			return nil
+		})
+	}
+
+	writer := ctx.Logger.Writer()
+
+	return &runner{
+		ctx:         ctx,
+		configPath:  configPath,
+		config:      config,
+		watcher:     watcher,
+		drainer:     drain.New(GlobalFlags.ShutdownTimeout, GlobalFlags.DrainDelay, ctx.Logger),
+		health:      checker,
+		current:     newGeneration(checker),
+		audit:       auditor,
+		auditConfig: config.Audit,
+		tracer:      tracer,
+		logger:      log.New(writer, "", 0),
+		writer:      writer,
+		stop:        make(chan struct{}),
+	}, nil
+}
+
+// Run serves along with the admin server until SIGTERM or SIGINT is received,
+// or any of the servers fails, then drains all of them. Meanwhile the
+// configuration is reloaded when it changes or on SIGHUP.
+func (r *runner) Run(servers ...drain.Server) error {
+	if GlobalFlags.AdminPort != 0 {
+		admin, err := r.adminServer(GlobalFlags.AdminPort)
+		if err != nil {
+			closeServers(servers)
+			return err
+		}
+		servers = append(servers, admin)
+	}
+
+	r.watchConfig()
+	return r.drainer.Run(drain.Signals(), servers...)
+}
+
+// Close stops everything started along with the servers, then closes the
+// audit sinks, sends the remaining spans, closes the Redis client and flushes
+// the logs.
+func (r *runner) Close() {
+	close(r.stop)
+	// The watcher may be reloading, which is skipped once closed
+	r.mu.Lock()
+	r.closed = true
+	close(r.current.stop)
+	r.mu.Unlock()
+	r.audit.Close()
+	shutdownTracing(r.ctx, r.tracer)
+	r.writer.Close()
+	r.ctx.Close()
+}
+
+// setupSessions creates the session store shared by the commands which
+// authenticate users with their session cookie.
+func setupSessions(ctx internal.Context, config cfg.ValidatedConfig) *session.Store {
+	return session.New(ctx.Redis, ctx.Logger, session.Options{
+		CookieName:   config.Session.CookieName,
+		CookieDomain: config.Session.CookieDomain,
+		Secure:       config.OIDCConfig.RedirectURI.Scheme == "https",
+		Expiration:   config.Session.Expiration,
+	})
+}
+
+// setupAuthenticator identifies users by their client certificate when it was
+// issued by IAP or the configuration maps it, service accounts by their API
+// key, users by a bearer token when the OIDC provider has a JWKS URI to verify
+// it, and finally users by their session. The signing keys of the provider are
+// reported along with the health of the servers, without affecting readiness
+// as sessions keep working while the provider is down.
+//
+// It also returns an authenticator only identifying users the OIDC provider
+// did, by their bearer token or session, for the endpoints issuing
+// credentials: these must not renew the credentials they issued, or be used
+// by service accounts to get the credentials of users.
+func (r *runner) setupAuthenticator(config cfg.ValidatedConfig, gen *generation, sessions *session.Store) (authenticate, loggedIn router.Authenticator) {
+	ctx, auditor := r.ctx, r.audit
+	lookup := lookupUsers(config)
+	authenticators := make([]router.Authenticator, 0, 4)
+	oidcAuthenticators := make([]router.Authenticator, 0, 2)
+
+	if sources := certificateSources(ctx, config); len(sources) > 0 {
+		authenticators = append(authenticators, authenticateClientCertificate(sources, lookup, ctx.Logger))
+	}
+
+	if len(config.ServiceAccounts) > 0 {
+		accounts := serviceaccount.New(config.ServiceAccounts, ctx.Logger)
+		authenticators = append(authenticators, authenticateServiceAccount(accounts, auditor))
+	}
+
+	if config.OIDCConfig.JWKSURI != nil {
+		verifier := oidc.NewVerifier(config.OIDCConfig, ctx.Logger)
+		gen.AddOptional("oidc_jwks", verifier.Check)
+		oidcAuthenticators = append(oidcAuthenticators, authenticateBearer(verifier, lookup, ctx.Logger))
+	}
+
+	oidcAuthenticators = append(oidcAuthenticators, authenticateSession(sessions, lookup))
+	authenticators = append(authenticators, oidcAuthenticators...)
+	return router.Chain(authenticators...), router.Chain(oidcAuthenticators...)
+}
+
+// setupIssuer creates the CA issuing client certificates, if the configuration has one.
+func setupIssuer(ctx internal.Context, config cfg.ValidatedConfig) *clientcert.Issuer {
+	if config.ClientCA == nil {
+		return nil
+	}
+
+	return clientcert.NewIssuer(
+		config.ClientCA.Certificate, config.ClientCA.Key, config.ClientCA.Validity, ctx.Logger,
+	)
+}
+
+// certificateSources returns how client certificates identify users, first by
+// the mappings of the configuration, then as issued by IAP.
+func certificateSources(ctx internal.Context, config cfg.ValidatedConfig) clientcert.Sources {
+	sources := make(clientcert.Sources, 0, 2)
+
+	if config.ClientCertificates != nil {
+		sources = append(sources, config.ClientCertificates)
+	}
+
+	if issuer := setupIssuer(ctx, config); issuer != nil {
+		sources = append(sources, issuer.Identities())
+	}
+
+	return sources
+}
+
+// Client certificate verification modes of the TLS listeners
+const (
+	clientAuthNone     = "none"
+	clientAuthOptional = "optional"
+	clientAuthRequire  = "require"
+)
+
+var clientAuthModes = []string{clientAuthNone, clientAuthOptional, clientAuthRequire}
+
+// TLSInput is the configuration of the TLS listener of a command.
+type TLSInput struct {
+	CertFiles  []string
+	KeyFiles   []string
+	SelfSigned bool
+	ClientAuth string
+}
+
+// Enabled returns if the listener should be served over TLS.
+func (i TLSInput) Enabled() bool {
+	return i.SelfSigned || len(i.CertFiles) > 0 || len(i.KeyFiles) > 0
+}
+
+// configureTLSFlags adds the flags of a TLS listener to the command, with the
+// prefix telling them apart when a command has several listeners.
+func configureTLSFlags(cmd *kingpin.CmdClause, input *TLSInput, prefix, server string) {
+	flag := func(name, help string) *kingpin.FlagClause {
+		return cmd.Flag(prefix+name, help).
+			OverrideDefaultFromEnvar(strings.ToUpper(strings.Replace(prefix+name, "-", "_", -1)))
+	}
+
+	flag("tls-cert-file", fmt.Sprintf("Certificate to serve the %s over TLS with, repeat along with the keys to pick by SNI.", server)).
+		StringsVar(&input.CertFiles)
+
+	flag("tls-key-file", fmt.Sprintf("Key of the certificate to serve the %s over TLS with.", server)).
+		StringsVar(&input.KeyFiles)
+
+	flag("tls-self-signed", fmt.Sprintf("Serve the %s over TLS with a self-signed certificate, for development only.", server)).
+		BoolVar(&input.SelfSigned)
+
+	flag("tls-client-auth", fmt.Sprintf("Whether clients connecting to the %s over TLS are asked for a certificate: none, optional or require.", server)).
+		Default(clientAuthOptional).
+		EnumVar(&input.ClientAuth, clientAuthModes...)
+}
+
+// setupServerTLS loads the certificates of a TLS listener, which are reloaded
+// whenever they change on disk until stopped, and asks clients for a
+// certificate issued by the sources depending on the client auth mode. The
+// names are only used for self-signed certificates.
+func setupServerTLS(ctx internal.Context, config cfg.ValidatedConfig, input TLSInput, names []string, stop <-chan struct{}) (*tls.Config, clientcert.Sources, error) {
+	certificates, err := loadServerCertificates(ctx, input, names)
+	if err != nil {
+		return nil, nil, err
+	}
+	go certificates.Watch(servertls.ReloadInterval, stop)
+
+	tlsConfig := certificates.ServerConfig()
+	if input.ClientAuth == clientAuthNone {
+		return tlsConfig, clientcert.Sources{}, nil
+	}
+
+	sources := certificateSources(ctx, config)
+	if input.ClientAuth == clientAuthRequire {
+		if len(sources) == 0 {
+			return nil, nil, fmt.Errorf("Client certificates cannot be required without client_certificates or client_ca configured")
+		}
+
+		tlsConfig = sources.ServerConfig(tlsConfig)
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+		return tlsConfig, sources, nil
+	}
+
+	return sources.ServerConfig(tlsConfig), sources, nil
+}
+
+func loadServerCertificates(ctx internal.Context, input TLSInput, names []string) (*servertls.Certificates, error) {
+	if input.SelfSigned {
+		if len(input.CertFiles) > 0 || len(input.KeyFiles) > 0 {
+			return nil, fmt.Errorf("TLS certificates cannot be given along with a self-signed one")
+		}
+
+		return servertls.SelfSigned(names, ctx.Logger)
+	}
+
+	if len(input.CertFiles) == 0 || len(input.CertFiles) != len(input.KeyFiles) {
+		return nil, fmt.Errorf("Every TLS certificate must be given along with its key")
+	}
+
+	pairs := make([]servertls.KeyPair, 0, len(input.CertFiles))
+	for index := range input.CertFiles {
+		pairs = append(pairs, servertls.KeyPair{
+			CertFile: input.CertFiles[index],
+			KeyFile:  input.KeyFiles[index],
+		})
+	}
+
+	return servertls.Load(pairs, ctx.Logger)
+}
+
+// remoteIP returns the IP address of a host:port network address.
+func remoteIP(addr string) net.IP {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+
+	return net.ParseIP(host)
 }
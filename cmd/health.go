@@ -0,0 +1,90 @@
+package cmd
+
+import (
+	"net/http"
+
+	"github.com/alphagov/iap/internal"
+	"github.com/alphagov/iap/pkg/drain"
+	"github.com/alphagov/iap/pkg/health"
+	"github.com/alphagov/iap/pkg/reload"
+)
+
+type healthcheckResponse struct {
+	Redis    bool `json:"redis"`
+	Draining bool `json:"draining,omitempty"`
+}
+
+type livenessResponse struct {
+	Alive bool `json:"alive"`
+}
+
+type readinessResponse struct {
+	health.Report
+	Draining bool           `json:"draining,omitempty"`
+	Config   *reload.Status `json:"config,omitempty"`
+}
+
+// healthHandlers serves liveness on /livez and readiness on /readyz.
+func (r *runner) healthHandlers(mux *http.ServeMux) {
+	mux.HandleFunc("/livez", livenessHandler(r.ctx))
+	mux.HandleFunc("/readyz", readinessHandler(r.ctx, r.health, r.drainer, r.watcher))
+}
+
+// healthcheckHandler only reports if Redis is reachable, and fails while the
+// server is draining. It is kept for the load balancers which relied on it
+// before readiness, which reports every dependency.
+func healthcheckHandler(ctx internal.Context, drainer *drain.Drainer) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		status := http.StatusOK
+		healthyRedis := true
+
+		_, err := ctx.Redis.Ping().Result()
+		if err != nil {
+			status = http.StatusInternalServerError
+			healthyRedis = false
+		}
+
+		draining := drainer.Draining()
+		if draining {
+			status = http.StatusServiceUnavailable
+		}
+
+		internal.JSONResponse(ctx, w, status, healthcheckResponse{
+			Redis:    healthyRedis,
+			Draining: draining,
+		})
+	}
+}
+
+// livenessHandler reports the process as alive as long as it can respond, its
+// dependencies being down is left to readiness.
+func livenessHandler(ctx internal.Context) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		internal.JSONResponse(ctx, w, http.StatusOK, livenessResponse{Alive: true})
+	}
+}
+
+// readinessHandler reports the result of every check along with its latency
+// and last error, and the hash and reloads of the configuration file when
+// there is one. The server is unavailable when any required check fails, or
+// while it is draining, so that load balancers stop sending it new requests.
+func readinessHandler(ctx internal.Context, checker *health.Checker, drainer *drain.Drainer, watcher *reload.Watcher) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		response := readinessResponse{
+			Report:   checker.Run(),
+			Draining: drainer.Draining(),
+			Config:   watcher.Status(),
+		}
+
+		if response.Draining {
+			response.Ready = false
+		}
+
+		status := http.StatusOK
+		if !response.Ready {
+			status = http.StatusServiceUnavailable
+		}
+
+		internal.JSONResponse(ctx, w, status, response)
+	}
+}
@@ -2,21 +2,32 @@ package cmd
 
 import (
 	"fmt"
-	"log"
+	"net"
 	"net/http"
+	"sync/atomic"
 
 	"github.com/alphagov/iap/internal"
+	"github.com/alphagov/iap/pkg/audit"
 	"github.com/alphagov/iap/pkg/auth"
+	"github.com/alphagov/iap/pkg/cfg"
+	"github.com/alphagov/iap/pkg/clientcert"
+	"github.com/alphagov/iap/pkg/drain"
+	"github.com/alphagov/iap/pkg/metrics"
+	"github.com/alphagov/iap/pkg/serviceaccount"
+	"github.com/alphagov/iap/pkg/tracing"
 	"github.com/elazarl/goproxy"
 	goproxyAuth "github.com/elazarl/goproxy/ext/auth"
 	"github.com/sirupsen/logrus"
 	kingpin "gopkg.in/alecthomas/kingpin.v2"
 )
 
+const proxyRealm = "qwertyuiop"
+
 // ProxyCommandInput is a configuration only to be used by this particular command.
 type ProxyCommandInput struct {
 	Host string
 	Port uint16
+	TLS  TLSInput
 }
 
 // ConfigureProxyCommand should fill in the above input struct with some usable values.
@@ -37,6 +48,8 @@ func ConfigureProxyCommand(app *kingpin.Application) {
 		OverrideDefaultFromEnvar("PORT").
 		Uint16Var(&input.Port)
 
+	configureTLSFlags(cmd, &input.TLS, "", "HTTP proxy")
+
 	cmd.Action(func(c *kingpin.ParseContext) error {
 		ctx := internal.Context{
 			Logger: internal.SetupLogger(GlobalFlags.Debug),
@@ -48,23 +61,189 @@ func ConfigureProxyCommand(app *kingpin.Application) {
 
 // ProxyCommand is the main brain behind this commands. It will start the HTTP Proxy server
 // and hang tight accepting, rejecting and working with requests.
+// On SIGTERM or SIGINT, it stops accepting connections and drains the active
+// requests and CONNECT tunnels.
 func ProxyCommand(ctx internal.Context, cfg ProxyCommandInput) error {
-	client := auth.New(ctx.Redis, ctx.Logger)
+	r, err := newRunner(ctx, GlobalFlags.ConfigPath)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	servers, err := r.proxyServers(cfg)
+	if err != nil {
+		return err
+	}
 
-	w := ctx.Logger.Writer()
-	defer w.Close()
+	return r.Run(servers...)
+}
+
+// proxyServers sets up the HTTP proxy.
+func (r *runner) proxyServers(input ProxyCommandInput) ([]drain.Server, error) {
+	ctx, config := r.ctx, r.config
+	client := auth.New(ctx.Redis, ctx.Logger)
 
 	proxy := goproxy.NewProxyHttpServer()
 	proxy.Verbose = GlobalFlags.Debug
-	proxy.Logger = log.New(w, "", 0)
+	proxy.Logger = r.logger
+
+	// Requests for the proxy itself rather than through it can check its
+	// health, like on the admin port
+	mux := http.NewServeMux()
+	mux.Handle("/", proxy.NonproxyHandler)
+	r.healthHandlers(mux)
+	proxy.NonproxyHandler = mux
+
+	dial := proxy.ConnectDial
+	if dial == nil {
+		dial = net.Dial
+	}
+	proxy.ConnectDial = func(network, addr string) (net.Conn, error) {
+		conn, err := dial(network, addr)
+		if err != nil {
+			return nil, err
+		}
+		return metrics.Tunnel(conn, metrics.CONNECT), nil
+	}
+
+	addr := fmt.Sprintf("%s:%d", input.Host, input.Port)
+	srv := &http.Server{
+		Addr:    addr,
+		Handler: proxy,
+	}
+
+	sources := clientcert.Sources{}
+	if input.TLS.Enabled() {
+		var err error
+		srv.TLSConfig, sources, err = setupServerTLS(ctx, config, input.TLS, []string{"localhost", input.Host}, r.stop)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// The client certificates are checked with the sources of the TLS
+	// listener, so only the users and service accounts are reloaded
+	var credentials atomic.Value
+	r.onReload(func(config cfg.ValidatedConfig, _ *generation) {
+		accounts := serviceaccount.New(config.ServiceAccounts, ctx.Logger)
+		credentials.Store(proxyCredentials(client, accounts, sources, lookupUsers(config), input.TLS.ClientAuth == clientAuthRequire, r.audit, ctx.Logger))
+	})
+	valid := func(req *http.Request) bool {
+		return credentials.Load().(func(*http.Request) bool)(req)
+	}
+
+	// Requests continue the trace of the client, which is propagated to the
+	// upstream, tunnels cannot be traced past the CONNECT request
+	upstream := tracing.RoundTripper("upstream", proxy.Tr)
+	proxy.OnRequest().Do(goproxy.FuncReqHandler(
+		func(req *http.Request, pctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+			req = req.WithContext(tracing.Extract(req.Context(), req.Header))
+			if !valid(req) {
+				return nil, goproxyAuth.BasicUnauthorized(req, proxyRealm)
+			}
 
-	goproxyAuth.ProxyBasic(proxy, "qwertyuiop", client.Valid)
+			pctx.RoundTripper = goproxy.RoundTripperFunc(
+				func(req *http.Request, _ *goproxy.ProxyCtx) (*http.Response, error) {
+					return upstream.RoundTrip(req)
+				},
+			)
+			return req, nil
+		},
+	))
+	proxy.OnRequest().HandleConnect(goproxy.FuncHttpsHandler(
+		func(host string, pctx *goproxy.ProxyCtx) (*goproxy.ConnectAction, string) {
+			req := pctx.Req.WithContext(tracing.Extract(pctx.Req.Context(), pctx.Req.Header))
+			if !valid(req) {
+				pctx.Resp = goproxyAuth.BasicUnauthorized(pctx.Req, proxyRealm)
+				return goproxy.RejectConnect, host
+			}
+			return goproxy.OkConnect, host
+		},
+	))
 
-	addr := fmt.Sprintf("%s:%d", cfg.Host, cfg.Port)
+	listener, err := drain.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
 
 	ctx.Logger.WithFields(logrus.Fields{
-		"address": addr,
+		"address":     addr,
+		"tls":         input.TLS.Enabled(),
+		"client_auth": input.TLS.ClientAuth,
 	}).Info("starting proxy server")
 
-	return http.ListenAndServe(addr, proxy)
+	return []drain.Server{drain.HTTPServer(srv, listener)}, nil
+}
+
+// proxyCredentials checks the client certificate of proxied requests over TLS,
+// which has to identify one of the users unless unlisted users are allowed,
+// otherwise their Basic credentials, which are either generated by the web
+// frontend, or the name and API key of a service account. When certificates
+// are required, the Basic credentials are not accepted. The credentials are
+// never forwarded, and every request is recorded by the auditor.
+func proxyCredentials(client *auth.Client, accounts *serviceaccount.Store, sources clientcert.Sources, lookup userLookup, require bool, auditor *audit.Logger, logger *logrus.Logger) func(*http.Request) bool {
+	return func(req *http.Request) bool {
+		header := req.Header.Get("Proxy-Authorization")
+		req.Header.Del("Proxy-Authorization")
+
+		source := auditSource(req.RemoteAddr)
+		decide := func(user string, err error) bool {
+			auditor.Record(audit.Event{
+				Type:        audit.ProxyRequest,
+				User:        user,
+				Source:      source,
+				Destination: req.Host,
+				Decision:    audit.Decision(err == nil),
+				Reason:      credentialsReason(err),
+			})
+			return err == nil
+		}
+
+		if identifier, ok := sources.FromConnectionState(req.TLS); ok {
+			if _, err := lookup(identifier); err != nil {
+				return decide(identifier, err)
+			}
+
+			logger.WithFields(logrus.Fields{
+				"user": identifier,
+				"host": req.Host,
+			}).Info("proxying request for client certificate")
+			return decide(identifier, nil)
+		}
+		if require {
+			return decide("", errUnmappedCertificate)
+		}
+
+		username, password, ok := (&http.Request{
+			Header: http.Header{"Authorization": {header}},
+		}).BasicAuth()
+		if !ok {
+			return decide("", errMissingCredentials)
+		}
+
+		if _, ok := accounts.Lookup(username); !ok {
+			span := traceCredentials(req.Context(), metrics.Generated)
+			var err error
+			if !client.Valid(username, password) {
+				err = errInvalidCredentials
+			}
+			endCredentials(span, err)
+			auditCredentials(auditor, username, source, err)
+			return decide(username, err)
+		}
+
+		span := traceCredentials(req.Context(), metrics.ServiceAccount)
+		u, err := accounts.Authenticate(username, password, remoteIP(req.RemoteAddr))
+		endCredentials(span, err)
+		auditCredentials(auditor, username, source, err)
+		if err != nil {
+			return decide(username, err)
+		}
+
+		logger.WithFields(logrus.Fields{
+			"user": u.Identifier,
+			"host": req.Host,
+		}).Info("proxying request for service account")
+		return decide(u.Identifier, nil)
+	}
 }
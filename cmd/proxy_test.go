@@ -0,0 +1,111 @@
+package cmd
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net/http/httptest"
+	"time"
+
+	"github.com/alphagov/iap/pkg/cfg"
+	"github.com/alphagov/iap/pkg/clientcert"
+	"github.com/alphagov/iap/pkg/serviceaccount"
+	"github.com/alphagov/iap/pkg/user"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/sirupsen/logrus"
+)
+
+var _ = Describe("Proxy credentials", func() {
+	It("should refuse Basic credentials when client certificates are required", func() {
+		logger := logrus.New()
+		logger.SetOutput(GinkgoWriter)
+
+		keyHash, err := serviceaccount.ParseKeyHash(serviceaccount.HashKey("my-api-key"))
+		Expect(err).NotTo(HaveOccurred())
+
+		accounts := serviceaccount.New(map[string]serviceaccount.ServiceAccount{
+			"deploy-bot": serviceaccount.ServiceAccount{
+				Name:      "deploy-bot",
+				KeyHashes: [][]byte{keyHash},
+			},
+		}, logger)
+
+		req := httptest.NewRequest("GET", "http://my-service.internal/", nil)
+		req.SetBasicAuth("deploy-bot", "my-api-key")
+		req.Header.Set("Proxy-Authorization", req.Header.Get("Authorization"))
+		req.TLS = &tls.ConnectionState{}
+
+		valid := proxyCredentials(nil, accounts, clientcert.Sources{}, nil, false, nil, logger)
+		Expect(valid(req)).To(BeTrue())
+
+		req.Header.Set("Proxy-Authorization", req.Header.Get("Authorization"))
+		valid = proxyCredentials(nil, accounts, clientcert.Sources{}, nil, true, nil, logger)
+		Expect(valid(req)).To(BeFalse())
+	})
+
+	It("should refuse client certificates of unlisted users unless they are allowed", func() {
+		logger := logrus.New()
+		logger.SetOutput(GinkgoWriter)
+
+		ca, caKey := newClientCA()
+		issuer := clientcert.NewIssuer(ca, caKey, time.Hour, logger)
+
+		req := httptest.NewRequest("GET", "http://my-service.internal/", nil)
+		req.TLS = issuedConnection(issuer, ca, "someone@mydomain.com")
+		sources := clientcert.Sources{issuer.Identities()}
+		accounts := serviceaccount.New(nil, logger)
+
+		valid := proxyCredentials(nil, accounts, sources, lookupUsers(cfg.ValidatedConfig{}), true, nil, logger)
+		Expect(valid(req)).To(BeFalse())
+
+		valid = proxyCredentials(nil, accounts, sources, lookupUsers(cfg.ValidatedConfig{AllowUnlistedUsers: true}), true, nil, logger)
+		Expect(valid(req)).To(BeTrue())
+	})
+})
+
+// newClientCA creates a CA for IAP to issue client certificates with.
+func newClientCA() (*x509.Certificate, *ecdsa.PrivateKey) {
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	Expect(err).NotTo(HaveOccurred())
+	caDER, err := x509.CreateCertificate(rand.Reader, &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "IAP client CA"},
+		NotBefore:             time.Now().Add(-time.Minute),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}, &x509.Certificate{Subject: pkix.Name{CommonName: "IAP client CA"}}, &caKey.PublicKey, caKey)
+	Expect(err).NotTo(HaveOccurred())
+	ca, err := x509.ParseCertificate(caDER)
+	Expect(err).NotTo(HaveOccurred())
+
+	return ca, caKey
+}
+
+// issuedConnection is the state of a connection made with a certificate the
+// issuer issued to the user.
+func issuedConnection(issuer *clientcert.Issuer, ca *x509.Certificate, identifier string) *tls.ConnectionState {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	Expect(err).NotTo(HaveOccurred())
+	csrDER, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{}, key)
+	Expect(err).NotTo(HaveOccurred())
+	csr, err := x509.ParseCertificateRequest(csrDER)
+	Expect(err).NotTo(HaveOccurred())
+
+	leafDER, err := issuer.Issue(user.User{Identifier: identifier}, csr)
+	Expect(err).NotTo(HaveOccurred())
+	leaf, err := x509.ParseCertificate(leafDER)
+	Expect(err).NotTo(HaveOccurred())
+
+	return &tls.ConnectionState{
+		PeerCertificates: []*x509.Certificate{leaf},
+		VerifiedChains:   [][]*x509.Certificate{{leaf, ca}},
+	}
+}
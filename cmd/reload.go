@@ -0,0 +1,113 @@
+package cmd
+
+import (
+	"net/http"
+	"reflect"
+	"sync/atomic"
+
+	"github.com/alphagov/iap/pkg/cfg"
+	"github.com/alphagov/iap/pkg/health"
+	"github.com/alphagov/iap/pkg/reload"
+)
+
+// generation is what the servers built from one version of the
+// configuration: the health checks of its dependencies, and the goroutines
+// started along with it, eg: to check the upstreams. The next generation
+// replaces it once the configuration is reloaded.
+type generation struct {
+	health *health.Checker
+	checks map[string]bool
+	stop   chan struct{}
+}
+
+func newGeneration(checker *health.Checker) *generation {
+	return &generation{
+		health: checker,
+		checks: make(map[string]bool),
+		stop:   make(chan struct{}),
+	}
+}
+
+// Add a check which has to be healthy for the servers to be ready.
+func (g *generation) Add(name string, check health.Check) {
+	g.checks[name] = true
+	g.health.Add(name, check)
+}
+
+// AddOptional adds a check which is reported without affecting readiness.
+func (g *generation) AddOptional(name string, check health.Check) {
+	g.checks[name] = true
+	g.health.AddOptional(name, check)
+}
+
+// replacedBy removes the checks which the next generation did not add again,
+// and stops the goroutines.
+func (g *generation) replacedBy(next *generation) {
+	for name := range g.checks {
+		if !next.checks[name] {
+			g.health.Remove(name)
+		}
+	}
+	close(g.stop)
+}
+
+// onReload builds what the servers need from the configuration now, and
+// again whenever it is reloaded so that they can swap it in. Requests and
+// tunnels in flight finish with what they started with.
+func (r *runner) onReload(build func(cfg.ValidatedConfig, *generation)) {
+	build(r.config, r.current)
+	r.rebuilds = append(r.rebuilds, build)
+}
+
+// reload rebuilds everything from the configuration, which the watcher calls
+// with one configuration at a time, unless the runner was closed meanwhile.
+// The audit sinks are opened again when they changed.
+func (r *runner) reload(config cfg.ValidatedConfig) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.closed {
+		return
+	}
+
+	if !reflect.DeepEqual(config.Audit, r.auditConfig) {
+		if err := r.audit.Reopen(config.Audit); err != nil {
+			r.ctx.Logger.WithField("error", err).Error("failed to open the audit sinks, keeping the previous ones")
+		} else {
+			r.auditConfig = config.Audit
+		}
+	}
+
+	previous, next := r.current, newGeneration(r.health)
+	for _, build := range r.rebuilds {
+		build(config, next)
+	}
+
+	r.current = next
+	previous.replacedBy(next)
+}
+
+// watchConfig reloads the configuration when its file changes or on SIGHUP,
+// until the servers have shut down.
+func (r *runner) watchConfig() {
+	if r.watcher == nil {
+		return
+	}
+
+	r.watcher.OnReload(r.reload)
+	go r.watcher.Watch(reload.Interval, reload.Signals(), r.stop)
+}
+
+// reloadableHandler serves requests with the handler built from the latest
+// configuration.
+type reloadableHandler struct {
+	handler atomic.Pointer[http.Handler]
+}
+
+func (h *reloadableHandler) Store(handler http.Handler) {
+	h.handler.Store(&handler)
+}
+
+func (h *reloadableHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	(*h.handler.Load()).ServeHTTP(w, req)
+}
@@ -0,0 +1,46 @@
+package cmd
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/alphagov/iap/internal"
+	"github.com/alphagov/iap/pkg/audit"
+	"github.com/alphagov/iap/pkg/cfg"
+	"github.com/alphagov/iap/pkg/health"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/sirupsen/logrus"
+)
+
+var _ = Describe("Reloading", func() {
+	It("should open the audit sinks again when they change", func() {
+		dir, err := ioutil.TempDir("", "iap-reload")
+		Expect(err).NotTo(HaveOccurred())
+		defer os.RemoveAll(dir)
+
+		logger := logrus.New()
+		logger.SetOutput(GinkgoWriter)
+
+		checker := health.New()
+		r := &runner{
+			ctx:     internal.Context{Logger: logger},
+			health:  checker,
+			current: newGeneration(checker),
+			audit:   audit.New(nil, logger),
+		}
+
+		path := filepath.Join(dir, "audit.log")
+		r.reload(cfg.ValidatedConfig{
+			Audit: []audit.SinkConfig{{Type: audit.File, Path: path, MaxSize: 1024}},
+		})
+		r.audit.Record(audit.Event{Type: audit.Login, Decision: audit.Allow})
+		r.audit.Close()
+
+		blob, err := ioutil.ReadFile(path)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(string(blob)).To(ContainSubstring(`"type":"login"`))
+	})
+})
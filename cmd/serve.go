@@ -0,0 +1,130 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/alphagov/iap/internal"
+	"github.com/alphagov/iap/pkg/drain"
+	kingpin "gopkg.in/alecthomas/kingpin.v2"
+)
+
+// ServeCommandInput is a configuration only to be used by this particular command.
+type ServeCommandInput struct {
+	Web   WebCommandInput
+	Proxy ProxyCommandInput
+	Socks SocksCommandInput
+}
+
+// ConfigureServeCommand should fill in the above input struct with some usable values.
+// It is also responsible for creating the context to be used within the app itself.
+func ConfigureServeCommand(app *kingpin.Application) {
+	input := ServeCommandInput{}
+	cmd := app.Command("serve", "Run the web frontend, HTTP proxy and SOCKS5 proxy together.")
+
+	cmd.Flag("web-port", "Port the web server will be operating on, disabled when 0.").
+		Default("8080").
+		OverrideDefaultFromEnvar("WEB_PORT").
+		Uint16Var(&input.Web.Port)
+
+	cmd.Flag("web-tls-port", "Port the web server will be operating on with TLS, disabled when 0.").
+		Default("0").
+		OverrideDefaultFromEnvar("WEB_TLS_PORT").
+		Uint16Var(&input.Web.TLSPort)
+
+	configureTLSFlags(cmd, &input.Web.TLS, "web-", "web server")
+
+	cmd.Flag("proxy-host", "Host the HTTP proxy will be available under.").
+		Default("127.0.0.1").
+		OverrideDefaultFromEnvar("PROXY_HOST").
+		StringVar(&input.Proxy.Host)
+
+	cmd.Flag("proxy-port", "Port the HTTP proxy will be available under, disabled when 0.").
+		Default("3128").
+		OverrideDefaultFromEnvar("PROXY_PORT").
+		Uint16Var(&input.Proxy.Port)
+
+	configureTLSFlags(cmd, &input.Proxy.TLS, "proxy-", "HTTP proxy")
+
+	cmd.Flag("socks5-host", "Host the SOCKS5 proxy will be available under.").
+		Default("127.0.0.1").
+		OverrideDefaultFromEnvar("SOCKS5_HOST").
+		StringVar(&input.Socks.Host)
+
+	cmd.Flag("socks5-port", "Port the SOCKS5 proxy will be available under, disabled when 0.").
+		Default("1080").
+		OverrideDefaultFromEnvar("SOCKS5_PORT").
+		Uint16Var(&input.Socks.Port)
+
+	configureTLSFlags(cmd, &input.Socks.TLS, "socks5-", "SOCKS5 proxy")
+
+	cmd.Action(func(c *kingpin.ParseContext) error {
+		ctx := internal.Context{
+			Logger: internal.SetupLogger(GlobalFlags.Debug),
+			Redis:  internal.SetupRedis(GlobalFlags.RedisAddress),
+		}
+		input.Web.ConfigPath = GlobalFlags.ConfigPath
+		input.Socks.Protocol = "tcp"
+		return ServeCommand(ctx, input)
+	})
+}
+
+// ServeCommand runs any combination of the web frontend, HTTP proxy and
+// SOCKS5 proxy in a single process, for small deployments and local
+// development. They share the context and configuration, so a single Redis
+// client, and are all shut down as soon as any of them fails, including when
+// setting one up fails once the others are listening.
+func ServeCommand(ctx internal.Context, cfg ServeCommandInput) error {
+	if cfg.Web.Port == 0 && cfg.Proxy.Port == 0 && cfg.Socks.Port == 0 {
+		return fmt.Errorf("At least one of the web, proxy or socks5 ports must be given")
+	}
+
+	if cfg.Web.Port == 0 && cfg.Proxy.Port == 0 && GlobalFlags.AdminPort == 0 {
+		return errSocksAdminPort
+	}
+
+	r, err := newRunner(ctx, cfg.Web.ConfigPath)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	servers := make([]drain.Server, 0, 4)
+
+	if cfg.Web.Port != 0 {
+		web, err := r.webServers(cfg.Web)
+		if err != nil {
+			closeServers(servers)
+			return err
+		}
+		servers = append(servers, web...)
+	}
+
+	if cfg.Proxy.Port != 0 {
+		proxy, err := r.proxyServers(cfg.Proxy)
+		if err != nil {
+			closeServers(servers)
+			return err
+		}
+		servers = append(servers, proxy...)
+	}
+
+	if cfg.Socks.Port != 0 {
+		socks, err := r.socksServers(cfg.Socks)
+		if err != nil {
+			closeServers(servers)
+			return err
+		}
+		servers = append(servers, socks...)
+	}
+
+	return r.Run(servers...)
+}
+
+// closeServers closes the listeners of servers which will never serve, as
+// they would otherwise stay bound until the process exits
+func closeServers(servers []drain.Server) {
+	for _, srv := range servers {
+		srv.Shutdown(context.Background())
+	}
+}
@@ -0,0 +1,80 @@
+package cmd
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/alphagov/iap/internal"
+
+	"github.com/go-redis/redis"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/sirupsen/logrus"
+)
+
+var _ = Describe("Serve command", func() {
+	freePort := func() uint16 {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		Expect(err).NotTo(HaveOccurred())
+		defer listener.Close()
+
+		return uint16(listener.Addr().(*net.TCPAddr).Port)
+	}
+
+	It("should close the listeners already open when a server cannot be set up", func() {
+		busy, err := net.Listen("tcp", "127.0.0.1:0")
+		Expect(err).NotTo(HaveOccurred())
+		defer busy.Close()
+
+		logger := logrus.New()
+		logger.SetOutput(GinkgoWriter)
+
+		input := ServeCommandInput{}
+		input.Web.Port = freePort()
+		input.Proxy.Host = "127.0.0.1"
+		input.Proxy.Port = uint16(busy.Addr().(*net.TCPAddr).Port)
+
+		err = ServeCommand(internal.Context{
+			Logger: logger,
+			Redis:  redis.NewClient(&redis.Options{Addr: "127.0.0.1:0"}),
+		}, input)
+		Expect(err).To(HaveOccurred())
+
+		listener, err := net.Listen("tcp", fmt.Sprintf(":%d", input.Web.Port))
+		Expect(err).NotTo(HaveOccurred())
+		listener.Close()
+	})
+
+	It("should close the listeners already open when the admin server cannot be set up", func() {
+		busy, err := net.Listen("tcp", ":0")
+		Expect(err).NotTo(HaveOccurred())
+		defer busy.Close()
+
+		GlobalFlags.AdminPort = uint16(busy.Addr().(*net.TCPAddr).Port)
+		defer func() { GlobalFlags.AdminPort = 0 }()
+
+		logger := logrus.New()
+		logger.SetOutput(GinkgoWriter)
+
+		input := ServeCommandInput{}
+		input.Web.Port = freePort()
+
+		err = ServeCommand(internal.Context{
+			Logger: logger,
+			Redis:  redis.NewClient(&redis.Options{Addr: "127.0.0.1:0"}),
+		}, input)
+		Expect(err).To(HaveOccurred())
+
+		listener, err := net.Listen("tcp", fmt.Sprintf(":%d", input.Web.Port))
+		Expect(err).NotTo(HaveOccurred())
+		listener.Close()
+	})
+
+	It("should require the admin port when only running the SOCKS5 proxy", func() {
+		input := ServeCommandInput{}
+		input.Socks.Port = freePort()
+
+		err := ServeCommand(internal.Context{}, input)
+		Expect(err).To(Equal(errSocksAdminPort))
+	})
+})
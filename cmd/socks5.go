@@ -1,11 +1,24 @@
 package cmd
 
 import (
+	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
 	"log"
+	"net"
+	"sync/atomic"
+	"time"
 
 	"github.com/alphagov/iap/internal"
+	"github.com/alphagov/iap/pkg/audit"
 	"github.com/alphagov/iap/pkg/auth"
+	"github.com/alphagov/iap/pkg/cfg"
+	"github.com/alphagov/iap/pkg/clientcert"
+	"github.com/alphagov/iap/pkg/drain"
+	"github.com/alphagov/iap/pkg/metrics"
+	"github.com/alphagov/iap/pkg/serviceaccount"
+	"github.com/alphagov/iap/pkg/user"
 	socks5 "github.com/armon/go-socks5"
 	"github.com/sirupsen/logrus"
 	kingpin "gopkg.in/alecthomas/kingpin.v2"
@@ -16,6 +29,7 @@ type SocksCommandInput struct {
 	Host     string
 	Port     uint16
 	Protocol string
+	TLS      TLSInput
 }
 
 // ConfigureSocksCommand should fill in the above input struct with some usable values.
@@ -42,6 +56,8 @@ func ConfigureSocksCommand(app *kingpin.Application) {
 		OverrideDefaultFromEnvar("PROTOCOL").
 		StringVar(&input.Protocol)
 
+	configureTLSFlags(cmd, &input.TLS, "", "SOCKS5 proxy")
+
 	cmd.Action(func(c *kingpin.ParseContext) error {
 		ctx := internal.Context{
 			Logger: internal.SetupLogger(GlobalFlags.Debug),
@@ -53,26 +69,266 @@ func ConfigureSocksCommand(app *kingpin.Application) {
 
 // SocksCommand is the main brain behind this commands. It will start the SOCKS5 Proxy server
 // and hang tight accepting, rejecting and working with requests.
+// On SIGTERM or SIGINT, it stops accepting connections and lets the active
+// tunnels finish. Its liveness and readiness are only served on the admin
+// port, which must be given.
 func SocksCommand(ctx internal.Context, cfg SocksCommandInput) error {
+	if GlobalFlags.AdminPort == 0 {
+		return errSocksAdminPort
+	}
+
+	r, err := newRunner(ctx, GlobalFlags.ConfigPath)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	servers, err := r.socksServers(cfg)
+	if err != nil {
+		return err
+	}
+
+	return r.Run(servers...)
+}
+
+// socksServers sets up the SOCKS5 proxy.
+func (r *runner) socksServers(input SocksCommandInput) ([]drain.Server, error) {
+	ctx, config := r.ctx, r.config
 	client := auth.New(ctx.Redis, ctx.Logger)
 
-	w := ctx.Logger.Writer()
-	defer w.Close()
+	current := &atomic.Pointer[socksConfig]{}
+	r.onReload(func(config cfg.ValidatedConfig, _ *generation) {
+		current.Store(&socksConfig{
+			accounts: serviceaccount.New(config.ServiceAccounts, ctx.Logger),
+			lookup:   lookupUsers(config),
+		})
+	})
 
 	srv, err := socks5.New(&socks5.Config{
-		Logger:      log.New(w, "", 0),
-		Credentials: client,
+		Logger:      r.logger,
+		Credentials: socksCredentials{client: client, config: current, auditor: r.audit},
+		Rules:       socksRules{config: current, auditor: r.audit, logger: ctx.Logger},
+		Dial:        socksDial,
 	})
 	if err != nil {
-		return err
+		return nil, err
+	}
+
+	serve := srv.Serve
+	if input.TLS.Enabled() {
+		tlsConfig, sources, err := setupServerTLS(ctx, config, input.TLS, []string{"localhost", input.Host}, r.stop)
+		if err != nil {
+			return nil, err
+		}
+
+		serve = func(listener net.Listener) error {
+			return serveSocksTLS(ctx, tls.NewListener(listener, tlsConfig), srv, sources, input.TLS.ClientAuth == clientAuthRequire, current, r.audit, r.logger)
+		}
 	}
 
-	addr := fmt.Sprintf("%s:%d", cfg.Host, cfg.Port)
+	addr := fmt.Sprintf("%s:%d", input.Host, input.Port)
+	listener, err := drain.Listen(input.Protocol, addr)
+	if err != nil {
+		return nil, err
+	}
 
 	ctx.Logger.WithFields(logrus.Fields{
-		"address":  addr,
-		"protocol": cfg.Protocol,
+		"address":     addr,
+		"protocol":    input.Protocol,
+		"tls":         input.TLS.Enabled(),
+		"client_auth": input.TLS.ClientAuth,
 	}).Info("starting socks5 server")
 
-	return srv.ListenAndServe(cfg.Protocol, addr)
+	return []drain.Server{drain.ListenerServer(serve, listener)}, nil
+}
+
+// errSocksAdminPort is returned when the SOCKS5 proxy would run without any
+// server for /livez and /readyz.
+var errSocksAdminPort = errors.New("--admin-port must be given for the SOCKS5 proxy to serve /livez and /readyz")
+
+// socksHandshakeTimeout is how long clients have to finish the TLS
+// handshake, so that they cannot hold connections open without starting it.
+const socksHandshakeTimeout = 10 * time.Second
+
+// serveSocksTLS serves SOCKS5 over TLS. Clients with a client certificate
+// mapped to a user do not need a username and password, everyone else does,
+// unless certificates are required, when they are refused.
+func serveSocksTLS(ctx internal.Context, listener net.Listener, srv *socks5.Server, sources clientcert.Sources, require bool, current *atomic.Pointer[socksConfig], auditor *audit.Logger, logger *log.Logger) error {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return err
+		}
+
+		go func(conn *tls.Conn) {
+			conn.SetDeadline(time.Now().Add(socksHandshakeTimeout))
+			if err := conn.Handshake(); err != nil {
+				ctx.Logger.WithFields(logrus.Fields{
+					"source": conn.RemoteAddr().String(),
+					"error":  err,
+				}).Warn("socks5 TLS handshake failed")
+				conn.Close()
+				return
+			}
+			conn.SetDeadline(time.Time{})
+
+			state := conn.ConnectionState()
+			identifier, ok := sources.FromConnectionState(&state)
+			if !ok && require {
+				ctx.Logger.WithFields(logrus.Fields{
+					"source": conn.RemoteAddr().String(),
+				}).Info("refused socks5 client certificate which does not identify anyone")
+				conn.Close()
+				return
+			}
+			if !ok {
+				srv.ServeConn(conn)
+				return
+			}
+
+			u, err := current.Load().lookup(identifier)
+			if err != nil {
+				ctx.Logger.WithFields(logrus.Fields{
+					"source": conn.RemoteAddr().String(),
+					"user":   identifier,
+				}).Info("refused socks5 client certificate of unlisted user")
+				conn.Close()
+				return
+			}
+
+			// The identity is only known for this connection, so it gets a
+			// server of its own which does not ask for credentials
+			certSrv, err := socks5.New(&socks5.Config{
+				Logger:      logger,
+				AuthMethods: []socks5.Authenticator{socks5.NoAuthAuthenticator{}},
+				Dial:        socksDial,
+				Rules: socksIdentityRules{
+					user:    u,
+					auditor: auditor,
+					logger:  ctx.Logger,
+				},
+			})
+			if err != nil {
+				conn.Close()
+				return
+			}
+
+			certSrv.ServeConn(conn)
+		}(conn.(*tls.Conn))
+	}
+}
+
+// socksDial connects to the destination of a tunnel, which is counted until
+// the tunnel is closed.
+func socksDial(ctx context.Context, network, addr string) (net.Conn, error) {
+	conn, err := (&net.Dialer{}).DialContext(ctx, network, addr)
+	if err != nil {
+		return nil, err
+	}
+	return metrics.Tunnel(conn, metrics.SOCKS5), nil
+}
+
+// socksConfig is what the SOCKS5 proxy uses of the configuration, which is
+// swapped when it is reloaded.
+type socksConfig struct {
+	accounts *serviceaccount.Store
+	lookup   userLookup
+}
+
+// socksCredentials accepts the credentials generated by the web frontend, or
+// the name and API key of a service account. The source address is not known
+// when the credentials are checked, so it is missing from the audit log.
+type socksCredentials struct {
+	client  *auth.Client
+	config  *atomic.Pointer[socksConfig]
+	auditor *audit.Logger
+}
+
+func (c socksCredentials) Valid(user, password string) bool {
+	accounts := c.config.Load().accounts
+	valid, kind := c.client.Valid, metrics.Generated
+	if _, ok := accounts.Lookup(user); ok {
+		valid, kind = accounts.Valid, metrics.ServiceAccount
+	}
+
+	// The SOCKS5 protocol has no way to continue the trace of the client
+	span := traceCredentials(context.Background(), kind)
+
+	var err error
+	if !valid(user, password) {
+		err = errInvalidCredentials
+	}
+	endCredentials(span, err)
+	auditCredentials(c.auditor, user, "", err)
+
+	return err == nil
+}
+
+// socksRules restricts service accounts to their source CIDRs, which cannot
+// be checked along with the credentials as the address is not known then.
+type socksRules struct {
+	config  *atomic.Pointer[socksConfig]
+	auditor *audit.Logger
+	logger  *logrus.Logger
+}
+
+func (r socksRules) Allow(ctx context.Context, req *socks5.Request) (context.Context, bool) {
+	if req.AuthContext == nil {
+		auditSocksConnect(r.auditor, req, "", "missing_credentials")
+		return ctx, false
+	}
+
+	username := req.AuthContext.Payload["Username"]
+	account, ok := r.config.Load().accounts.Lookup(username)
+	if !ok {
+		auditSocksConnect(r.auditor, req, username, "")
+		return ctx, true
+	}
+
+	logger := r.logger.WithFields(logrus.Fields{
+		"user":        account.User().Identifier,
+		"source":      req.RemoteAddr.String(),
+		"destination": req.DestAddr.String(),
+	})
+
+	if !account.AllowsSource(req.RemoteAddr.IP) {
+		logger.Warn("denied service account connection from an address which is not allowed")
+		auditSocksConnect(r.auditor, req, account.User().Identifier, "source_not_allowed")
+		return ctx, false
+	}
+
+	logger.Info("allowed service account connection")
+	auditSocksConnect(r.auditor, req, account.User().Identifier, "")
+	return ctx, true
+}
+
+// socksIdentityRules records the user identified by their client certificate
+// along with every connection they make.
+type socksIdentityRules struct {
+	user    user.User
+	auditor *audit.Logger
+	logger  *logrus.Logger
+}
+
+func (r socksIdentityRules) Allow(ctx context.Context, req *socks5.Request) (context.Context, bool) {
+	r.logger.WithFields(logrus.Fields{
+		"user":        r.user.Identifier,
+		"source":      req.RemoteAddr.String(),
+		"destination": req.DestAddr.String(),
+	}).Info("allowed client certificate connection")
+	auditSocksConnect(r.auditor, req, r.user.Identifier, "")
+	return ctx, true
+}
+
+// auditSocksConnect records a SOCKS5 connection, which is allowed unless
+// there is a reason to deny it.
+func auditSocksConnect(auditor *audit.Logger, req *socks5.Request, user, reason string) {
+	auditor.Record(audit.Event{
+		Type:        audit.SOCKSConnect,
+		User:        user,
+		Source:      req.RemoteAddr.IP.String(),
+		Destination: req.DestAddr.String(),
+		Decision:    audit.Decision(reason == ""),
+		Reason:      reason,
+	})
 }
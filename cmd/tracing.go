@@ -0,0 +1,74 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/alphagov/iap/internal"
+	"github.com/alphagov/iap/pkg/oidc"
+	"github.com/alphagov/iap/pkg/serviceaccount"
+	"github.com/alphagov/iap/pkg/tracing"
+	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/attribute"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// traceCredentials starts the span of validating credentials of the kind.
+func traceCredentials(ctx context.Context, kind string) trace.Span {
+	_, span := tracing.Start(ctx, "credentials.validate", attribute.String("iap.credentials", kind))
+	return span
+}
+
+// endCredentials ends the span of validating credentials, credentials which
+// are not valid are not a failure of the span.
+func endCredentials(span trace.Span, err error) {
+	switch err {
+	case nil, errInvalidCredentials, oidc.ErrInvalidToken,
+		serviceaccount.ErrInvalidKey, serviceaccount.ErrExpired, serviceaccount.ErrSourceNotAllowed:
+		span.SetAttributes(attribute.Bool("iap.valid", err == nil))
+		tracing.End(span, nil)
+	default:
+		tracing.End(span, err)
+	}
+}
+
+// setupTracing sends spans to the OTLP endpoint when one is given, otherwise
+// the traceparent of requests is only propagated.
+func setupTracing(ctx internal.Context) (*sdktrace.TracerProvider, error) {
+	if GlobalFlags.OTLPEndpoint == nil {
+		return nil, nil
+	}
+
+	if GlobalFlags.TraceSampleRatio < 0 || GlobalFlags.TraceSampleRatio > 1 {
+		return nil, fmt.Errorf("Trace sample ratio must be between 0 and 1")
+	}
+
+	exporter, err := tracing.NewExporter(*GlobalFlags.OTLPEndpoint)
+	if err != nil {
+		return nil, fmt.Errorf("Could not create the OTLP exporter: %s", err)
+	}
+
+	ctx.Logger.WithFields(logrus.Fields{
+		"endpoint":     GlobalFlags.OTLPEndpoint.String(),
+		"sample_ratio": GlobalFlags.TraceSampleRatio,
+	}).Info("sending traces")
+
+	return tracing.Setup(exporter, GlobalFlags.TraceSampleRatio), nil
+}
+
+// shutdownTracing sends the remaining spans, giving up after a while so that
+// an unreachable collector does not hold up shutting down.
+func shutdownTracing(ctx internal.Context, provider *sdktrace.TracerProvider) {
+	if provider == nil {
+		return
+	}
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if err := provider.Shutdown(shutdownCtx); err != nil {
+		ctx.Logger.WithField("error", err).Error("failed to send remaining spans")
+	}
+}
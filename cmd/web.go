@@ -3,16 +3,27 @@ package cmd
 import (
 	"fmt"
 	"net/http"
+	"net/url"
 	"time"
 
 	"github.com/alphagov/iap/internal"
+	"github.com/alphagov/iap/pkg/cfg"
+	"github.com/alphagov/iap/pkg/drain"
+	"github.com/alphagov/iap/pkg/oidc"
+	"github.com/alphagov/iap/pkg/router"
+	"github.com/alphagov/iap/pkg/service"
+	"github.com/alphagov/iap/pkg/sshca"
+	"github.com/alphagov/iap/pkg/tracing"
 	"github.com/sirupsen/logrus"
 	kingpin "gopkg.in/alecthomas/kingpin.v2"
 )
 
 // WebCommandInput is a configuration only to be used by this particular command.
 type WebCommandInput struct {
-	Port uint16
+	Port       uint16
+	ConfigPath string
+	TLSPort    uint16
+	TLS        TLSInput
 }
 
 // ConfigureWebCommand should fill in the above input struct with some usable values.
@@ -27,11 +38,19 @@ func ConfigureWebCommand(app *kingpin.Application) {
 		OverrideDefaultFromEnvar("PORT").
 		Uint16Var(&input.Port)
 
+	cmd.Flag("tls-port", "Port the web server will be operating on with TLS, disabled when 0.").
+		Default("0").
+		OverrideDefaultFromEnvar("TLS_PORT").
+		Uint16Var(&input.TLSPort)
+
+	configureTLSFlags(cmd, &input.TLS, "", "web server")
+
 	cmd.Action(func(c *kingpin.ParseContext) error {
 		ctx := internal.Context{
 			Logger: internal.SetupLogger(GlobalFlags.Debug),
 			Redis:  internal.SetupRedis(GlobalFlags.RedisAddress),
 		}
+		input.ConfigPath = GlobalFlags.ConfigPath
 		return WebCommand(ctx, input)
 	})
 }
@@ -40,22 +59,154 @@ func ConfigureWebCommand(app *kingpin.Application) {
 // and hang tight accepting, rejecting and working with requests.
 // It will take the job of authenticating with OIDC and generating bunch of secrets
 // for the IAP users.
+// When a configuration file is given, users log in with OIDC, requests for the
+// hosts of the configured services are reverse proxied to their upstreams, and
+// other reverse proxies can ask IAP to authorize requests on /auth/forward.
+// When the configuration has an SSH CA, logged in users can submit their public
+// key on /ssh/sign for a short-lived SSH certificate. Likewise with a client CA,
+// they can submit a certificate request on /certificates/sign for a short-lived
+// client certificate, which the proxies accept.
+// On the TLS port, clients can also authenticate with a client certificate
+// when the configuration maps them to users. Its certificates are picked by
+// SNI and reloaded when they change on disk.
+// The configuration is reloaded when it changes or on SIGHUP, except for the
+// TLS listeners which need a restart.
+// On SIGTERM or SIGINT, the healthcheck and readiness start failing, new
+// requests are still served for the drain delay, then the active requests
+// are drained.
 func WebCommand(ctx internal.Context, cfg WebCommandInput) error {
-	mux := http.DefaultServeMux
-	mux.HandleFunc("/healthcheck", healthcheckHandler(ctx))
-	mux.HandleFunc("/socks5/generate", generateSOCKS5Credentials(ctx))
+	r, err := newRunner(ctx, cfg.ConfigPath)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	servers, err := r.webServers(cfg)
+	if err != nil {
+		return err
+	}
+
+	return r.Run(servers...)
+}
+
+// webServers sets up the web frontend on its plain and TLS ports.
+func (r *runner) webServers(input WebCommandInput) ([]drain.Server, error) {
+	ctx, config := r.ctx, r.config
+
+	names := []string{"localhost"}
+	if r.configPath != "" {
+		names = append(names, config.OIDCConfig.RedirectURI.Hostname())
+	}
+
+	current := &reloadableHandler{}
+	r.onReload(func(config cfg.ValidatedConfig, gen *generation) {
+		current.Store(r.webHandler(config, gen))
+	})
+	handler := tracing.Handler("web", current)
 
 	srv := &http.Server{
-		Addr:         fmt.Sprintf(":%d", cfg.Port),
-		Handler:      mux,
+		Addr:         fmt.Sprintf(":%d", input.Port),
+		Handler:      handler,
 		ReadTimeout:  5 * time.Second,
 		WriteTimeout: 1 * time.Minute,
 		IdleTimeout:  15 * time.Second,
 	}
 
+	servers := make([]drain.Server, 0, 2)
+
+	if input.TLSPort != 0 {
+		tlsConfig, _, err := setupServerTLS(ctx, config, input.TLS, names, r.stop)
+		if err != nil {
+			return nil, err
+		}
+
+		tlsSrv := &http.Server{
+			Addr:         fmt.Sprintf(":%d", input.TLSPort),
+			Handler:      handler,
+			TLSConfig:    tlsConfig,
+			ReadTimeout:  srv.ReadTimeout,
+			WriteTimeout: srv.WriteTimeout,
+			IdleTimeout:  srv.IdleTimeout,
+		}
+
+		tlsListener, err := drain.Listen("tcp", tlsSrv.Addr)
+		if err != nil {
+			return nil, err
+		}
+		servers = append(servers, drain.HTTPServer(tlsSrv, tlsListener))
+
+		ctx.Logger.WithFields(logrus.Fields{
+			"port":        input.TLSPort,
+			"client_auth": input.TLS.ClientAuth,
+		}).Info("starting web server with TLS")
+	}
+
+	listener, err := drain.Listen("tcp", srv.Addr)
+	if err != nil {
+		closeServers(servers)
+		return nil, err
+	}
+	servers = append(servers, drain.HTTPServer(srv, listener))
+
 	ctx.Logger.WithFields(logrus.Fields{
-		"port": cfg.Port,
+		"port": input.Port,
 	}).Info("starting web server")
 
-	return srv.ListenAndServe()
+	return servers, nil
+}
+
+// webHandler routes the requests of the web frontend for one version of the
+// configuration.
+func (r *runner) webHandler(config cfg.ValidatedConfig, gen *generation) http.Handler {
+	ctx := r.ctx
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthcheck", healthcheckHandler(ctx, r.drainer))
+	r.healthHandlers(mux)
+	mux.HandleFunc("/socks5/generate", generateSOCKS5Credentials(ctx, r.audit))
+
+	if r.configPath == "" {
+		return mux
+	}
+
+	rtr := router.New(config.Services, ctx.Logger)
+	rtr.RunHealthChecks(gen.stop)
+	for identifier, svc := range config.Services {
+		if len(svc.Upstreams) > 0 {
+			identifier := identifier
+			gen.AddOptional("upstream:"+identifier, func() error {
+				return rtr.CheckUpstreams(identifier)
+			})
+		}
+	}
+
+	sessions := setupSessions(ctx, config)
+	client := oidc.New(config.OIDCConfig, ctx.Logger)
+	authenticate, loggedIn := r.setupAuthenticator(config, gen, sessions)
+	login := loginURL(config.OIDCConfig.RedirectURI)
+
+	allowed := func(rd *url.URL) bool {
+		_, err := rtr.Match(rd.Host, rd.Path)
+		return err == nil || rd.Host == config.OIDCConfig.RedirectURI.Host
+	}
+
+	mux.HandleFunc("/oidc/login", oidcLogin(ctx, sessions, client, allowed))
+	mux.HandleFunc(config.OIDCConfig.RedirectURI.Path, oidcCallback(ctx, sessions, client, r.audit))
+	mux.Handle("/auth/forward", router.NewForwardAuth(rtr, authenticate, login, r.audit, ctx.Logger))
+
+	if config.SSHCA != nil {
+		authority := sshca.New(config.SSHCA.Signer, config.SSHCA.Validity, ctx.Logger)
+		gen.Add("ssh_ca", authority.Check)
+		mux.HandleFunc("/ssh/sign", signSSHCertificate(ctx, authority, loggedIn, r.audit))
+		mux.HandleFunc("/ssh/ca.pub", sshCAPublicKey(authority))
+	}
+
+	if issuer := setupIssuer(ctx, config); issuer != nil {
+		gen.Add("client_ca", issuer.Check)
+		mux.HandleFunc("/certificates/sign", issueClientCertificate(ctx, issuer, loggedIn, r.audit))
+		mux.HandleFunc("/certificates/ca.pem", clientCACertificate(issuer))
+	}
+
+	proxy := router.NewProxy(rtr, router.NewAuthorizer(authenticate, login, r.audit, ctx.Logger), config.Session.CookieName, r.audit, ctx.Logger)
+	return proxyHandler(proxy, mux, service.NormalizeHost(config.OIDCConfig.RedirectURI.Host))
 }
@@ -1,40 +1,59 @@
 package cmd
 
 import (
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
 	"net/http"
+	"net/url"
+	"strings"
+	"time"
 
 	"github.com/alphagov/iap/internal"
+	"github.com/alphagov/iap/pkg/audit"
 	"github.com/alphagov/iap/pkg/auth"
+	"github.com/alphagov/iap/pkg/cfg"
+	"github.com/alphagov/iap/pkg/clientcert"
+	"github.com/alphagov/iap/pkg/metrics"
+	"github.com/alphagov/iap/pkg/oidc"
+	"github.com/alphagov/iap/pkg/router"
+	"github.com/alphagov/iap/pkg/service"
+	"github.com/alphagov/iap/pkg/serviceaccount"
+	"github.com/alphagov/iap/pkg/session"
+	"github.com/alphagov/iap/pkg/sshca"
+	"github.com/alphagov/iap/pkg/user"
 	"github.com/sirupsen/logrus"
+	"golang.org/x/crypto/ssh"
 )
 
-type healthcheckResponse struct {
-	Redis bool `json:"redis"`
-}
-
 type credentialResponse struct {
 	Username string `json:"username"`
 	Password string `json:"password"`
 }
 
-func healthcheckHandler(ctx internal.Context) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		status := http.StatusOK
-		healthyRedis := true
+type sshCertificateRequest struct {
+	PublicKey string `json:"public_key"`
+}
 
-		_, err := ctx.Redis.Ping().Result()
-		if err != nil {
-			status = http.StatusInternalServerError
-			healthyRedis = false
-		}
+type clientCertificateRequest struct {
+	CSR string `json:"csr"`
+}
 
-		internal.JSONResponse(ctx, w, status, healthcheckResponse{
-			Redis: healthyRedis,
-		})
-	}
+type clientCertificateResponse struct {
+	Certificate string    `json:"certificate"`
+	CA          string    `json:"ca"`
+	ExpiresAt   time.Time `json:"expires_at"`
+}
+
+type sshCertificateResponse struct {
+	Certificate string    `json:"certificate"`
+	Principals  []string  `json:"principals"`
+	ExpiresAt   time.Time `json:"expires_at"`
 }
 
-func generateSOCKS5Credentials(ctx internal.Context) http.HandlerFunc {
+func generateSOCKS5Credentials(ctx internal.Context, auditor *audit.Logger) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		client := auth.New(ctx.Redis, ctx.Logger)
 		username, password, err := client.Generate()
@@ -51,6 +70,14 @@ func generateSOCKS5Credentials(ctx internal.Context) http.HandlerFunc {
 		ctx.Logger.WithFields(logrus.Fields{
 			"username": username,
 		}).Debug("generated new socks5 user")
+		auditor.Record(audit.Event{
+			Type:        audit.CredentialsGenerated,
+			User:        audit.Anonymous,
+			Source:      auditSource(r.RemoteAddr),
+			Decision:    audit.Allow,
+			Reason:      "socks5_credentials",
+			Credentials: username,
+		})
 
 		internal.JSONResponse(ctx, w, http.StatusOK, credentialResponse{
 			Username: username,
@@ -58,3 +85,430 @@ func generateSOCKS5Credentials(ctx internal.Context) http.HandlerFunc {
 		})
 	}
 }
+
+// proxyHandler sends requests matching configured services through the
+// reverse proxy, and everything else to the IAP endpoints. The endpoints of
+// IAP on its own host, the one of the OIDC redirect URI, are never proxied so
+// that a service matching the host cannot take over logging in.
+func proxyHandler(proxy *router.Proxy, mux *http.ServeMux, host string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if _, pattern := mux.Handler(r); service.NormalizeHost(r.Host) == host && pattern != "" {
+			mux.ServeHTTP(w, r)
+			return
+		}
+
+		if proxy.Handles(r) {
+			proxy.ServeHTTP(w, r)
+			return
+		}
+
+		mux.ServeHTTP(w, r)
+	}
+}
+
+// authenticateSession identifies users by their session cookie, with the
+// roles given to them in the configuration.
+func authenticateSession(sessions *session.Store, lookup userLookup) router.Authenticator {
+	return func(r *http.Request) (user.User, error) {
+		identifier, err := sessions.FromRequest(r)
+		if err == session.ErrNotFound {
+			return user.User{}, router.ErrUnauthenticated
+		}
+		if err != nil {
+			return user.User{}, err
+		}
+
+		return lookup(identifier)
+	}
+}
+
+// authenticateBearer identifies users by a token in the Authorization header,
+// signed by the OIDC provider, with the roles given to them in the configuration.
+func authenticateBearer(verifier *oidc.Verifier, lookup userLookup, logger *logrus.Logger) router.Authenticator {
+	return func(r *http.Request) (user.User, error) {
+		token := router.BearerToken(r)
+		if token == "" {
+			return user.User{}, router.ErrUnauthenticated
+		}
+
+		span := traceCredentials(r.Context(), "bearer_token")
+		identifier, err := verifier.Verify(token)
+		endCredentials(span, err)
+		if err == oidc.ErrInvalidToken {
+			logger.WithField("host", r.Host).Info("refused invalid bearer token")
+			return user.User{}, router.ErrUnauthenticated
+		}
+		if err != nil {
+			return user.User{}, err
+		}
+
+		return lookup(identifier)
+	}
+}
+
+// authenticateServiceAccount identifies service accounts by an API key given as
+// a bearer token, other bearer tokens are left to the next authenticator.
+func authenticateServiceAccount(accounts *serviceaccount.Store, auditor *audit.Logger) router.Authenticator {
+	return func(r *http.Request) (user.User, error) {
+		token := router.BearerToken(r)
+		if token == "" {
+			return user.User{}, router.ErrUnauthenticated
+		}
+
+		span := traceCredentials(r.Context(), metrics.ServiceAccount)
+		u, err := accounts.Authenticate("", token, remoteIP(r.RemoteAddr))
+		endCredentials(span, err)
+		auditCredentials(auditor, u.Identifier, auditSource(r.RemoteAddr), err)
+		if err != nil {
+			return user.User{}, router.ErrUnauthenticated
+		}
+
+		return u, nil
+	}
+}
+
+// authenticateClientCertificate identifies users by the client certificate
+// verified during the TLS handshake, with the roles given to them in the configuration.
+func authenticateClientCertificate(sources clientcert.Sources, lookup userLookup, logger *logrus.Logger) router.Authenticator {
+	return func(r *http.Request) (user.User, error) {
+		if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+			return user.User{}, router.ErrUnauthenticated
+		}
+
+		identifier, ok := sources.FromConnectionState(r.TLS)
+		if !ok {
+			logger.WithField(
+				"subject", r.TLS.VerifiedChains[0][0].Subject.String(),
+			).Info("client certificate does not match any mapping")
+			return user.User{}, router.ErrUnauthenticated
+		}
+
+		return lookup(identifier)
+	}
+}
+
+// userLookup returns the configured user with the identifier.
+type userLookup func(identifier string) (user.User, error)
+
+// lookupUsers finds the users of the configuration. Anyone else is refused
+// with router.ErrUnlistedUser, unless the configuration allows unlisted users
+// who then have no roles.
+func lookupUsers(config cfg.ValidatedConfig) userLookup {
+	users, allowUnlisted := config.Users, config.AllowUnlistedUsers
+
+	return func(identifier string) (user.User, error) {
+		if u, ok := users[identifier]; ok {
+			return u, nil
+		}
+
+		if allowUnlisted {
+			return user.User{Identifier: identifier}, nil
+		}
+		return user.User{Identifier: identifier}, router.ErrUnlistedUser
+	}
+}
+
+// loginURL points at the login endpoint on the same host as the OIDC callback.
+func loginURL(redirectURI url.URL) router.LoginURL {
+	return func(original string) string {
+		login := url.URL{
+			Scheme:   redirectURI.Scheme,
+			Host:     redirectURI.Host,
+			Path:     "/oidc/login",
+			RawQuery: url.Values{"rd": {original}}.Encode(),
+		}
+		return login.String()
+	}
+}
+
+// oidcLogin sends the user to the OIDC provider, remembering where they should
+// return to. Only IAP itself and the hosts of the services can be returned to.
+// The state is also set in a cookie, so that only this browser can finish
+// logging in with it.
+func oidcLogin(ctx internal.Context, sessions *session.Store, client *oidc.Client, allowed func(*url.URL) bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		returnTo := "/"
+		if rd, err := url.Parse(r.URL.Query().Get("rd")); err == nil && rd.IsAbs() && allowed(rd) {
+			returnTo = rd.String()
+		}
+
+		state, err := sessions.CreateState(returnTo)
+		if err != nil {
+			ctx.Logger.WithFields(logrus.Fields{
+				"error": err,
+			}).Error("failed to create oidc state")
+			internal.JSONResponse(ctx, w, http.StatusInternalServerError, map[string]string{
+				"error": "unable to log in",
+			})
+			return
+		}
+
+		http.SetCookie(w, sessions.StateCookie(state))
+		http.Redirect(w, r, client.AuthCodeURL(state), http.StatusFound)
+	}
+}
+
+// oidcCallback finishes logging the user in and starts their session.
+func oidcCallback(ctx internal.Context, sessions *session.Store, client *oidc.Client, auditor *audit.Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		record := func(identifier, reason string) {
+			auditor.Record(audit.Event{
+				Type:     audit.Login,
+				User:     identifier,
+				Source:   auditSource(r.RemoteAddr),
+				Decision: audit.Decision(reason == ""),
+				Reason:   reason,
+			})
+		}
+
+		// Otherwise anyone could log a victim in as themselves, by sending
+		// them the callback of a login they started
+		state := r.URL.Query().Get("state")
+		if !sessions.MatchesState(r, state) {
+			metrics.LoginFailures.WithLabelValues("state_mismatch").Inc()
+			record("", "state_mismatch")
+			internal.JSONResponse(ctx, w, http.StatusBadRequest, map[string]string{
+				"error": "login was not started in this browser, please try again",
+			})
+			return
+		}
+		http.SetCookie(w, sessions.ClearStateCookie())
+
+		returnTo, err := sessions.ConsumeState(state)
+		if err != nil {
+			metrics.LoginFailures.WithLabelValues("expired_state").Inc()
+			record("", "expired_state")
+			internal.JSONResponse(ctx, w, http.StatusBadRequest, map[string]string{
+				"error": "login has expired, please try again",
+			})
+			return
+		}
+
+		identifier, err := client.Exchange(r.Context(), r.URL.Query().Get("code"), state)
+		if err != nil {
+			ctx.Logger.WithFields(logrus.Fields{
+				"error": err,
+			}).Warn("failed to log in")
+			metrics.LoginFailures.WithLabelValues("exchange_failed").Inc()
+			record("", "exchange_failed")
+			internal.JSONResponse(ctx, w, http.StatusUnauthorized, map[string]string{
+				"error": "unable to log in",
+			})
+			return
+		}
+
+		token, err := sessions.Create(identifier)
+		if err != nil {
+			ctx.Logger.WithFields(logrus.Fields{
+				"error": err,
+			}).Error("failed to create session")
+			metrics.LoginFailures.WithLabelValues("session_failed").Inc()
+			record(identifier, "session_failed")
+			internal.JSONResponse(ctx, w, http.StatusInternalServerError, map[string]string{
+				"error": "unable to log in",
+			})
+			return
+		}
+
+		ctx.Logger.WithFields(logrus.Fields{
+			"user": identifier,
+		}).Info("user logged in")
+		metrics.Logins.Inc()
+		record(identifier, "")
+
+		http.SetCookie(w, sessions.Cookie(token))
+		http.Redirect(w, r, returnTo, http.StatusFound)
+	}
+}
+
+// signSSHCertificate issues an SSH certificate for the public key submitted by
+// the user, who has to be logged in.
+func signSSHCertificate(ctx internal.Context, authority *sshca.Authority, authenticate router.Authenticator, auditor *audit.Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		u, ok := authenticatedPost(ctx, w, r, authenticate)
+		if !ok {
+			return
+		}
+
+		req := sshCertificateRequest{}
+		if err := json.NewDecoder(io.LimitReader(r.Body, 16*1024)).Decode(&req); err != nil {
+			internal.JSONResponse(ctx, w, http.StatusBadRequest, map[string]string{
+				"error": "request must be JSON with a public_key",
+			})
+			return
+		}
+
+		publicKey, _, _, _, err := ssh.ParseAuthorizedKey([]byte(req.PublicKey))
+		if err == nil {
+			err = sshca.ValidatePublicKey(publicKey)
+		}
+		if err != nil {
+			internal.JSONResponse(ctx, w, http.StatusBadRequest, map[string]string{
+				"error": fmt.Sprintf("public_key is not valid: %s", err),
+			})
+			return
+		}
+
+		cert, err := authority.Sign(u, publicKey)
+		if err == sshca.ErrNoPrincipals {
+			internal.JSONResponse(ctx, w, http.StatusForbidden, map[string]string{
+				"error": "no roles to log in as",
+			})
+			return
+		}
+		if err != nil {
+			ctx.Logger.WithFields(logrus.Fields{
+				"user":  u.Identifier,
+				"error": err,
+			}).Error("failed to issue ssh certificate")
+			internal.JSONResponse(ctx, w, http.StatusInternalServerError, map[string]string{
+				"error": "unable to issue certificate",
+			})
+			return
+		}
+
+		auditor.Record(audit.Event{
+			Type:     audit.CredentialsGenerated,
+			User:     u.Identifier,
+			Source:   auditSource(r.RemoteAddr),
+			Decision: audit.Allow,
+			Reason:   "ssh_certificate",
+		})
+
+		internal.JSONResponse(ctx, w, http.StatusOK, sshCertificateResponse{
+			Certificate: strings.TrimSpace(string(ssh.MarshalAuthorizedKey(cert))),
+			Principals:  cert.ValidPrincipals,
+			ExpiresAt:   time.Unix(int64(cert.ValidBefore), 0).UTC(),
+		})
+	}
+}
+
+// sshCAPublicKey responds with the public key of the SSH CA, in the format
+// expected by TrustedUserCAKeys.
+func sshCAPublicKey(authority *sshca.Authority) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Write(ssh.MarshalAuthorizedKey(authority.PublicKey()))
+	}
+}
+
+// issueClientCertificate issues a client certificate for the PEM encoded
+// certificate request submitted by the user, who has to be logged in.
+func issueClientCertificate(ctx internal.Context, issuer *clientcert.Issuer, authenticate router.Authenticator, auditor *audit.Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		u, ok := authenticatedPost(ctx, w, r, authenticate)
+		if !ok {
+			return
+		}
+
+		req := clientCertificateRequest{}
+		if err := json.NewDecoder(io.LimitReader(r.Body, 16*1024)).Decode(&req); err != nil {
+			internal.JSONResponse(ctx, w, http.StatusBadRequest, map[string]string{
+				"error": "request must be JSON with a csr",
+			})
+			return
+		}
+
+		block, _ := pem.Decode([]byte(req.CSR))
+		if block == nil || block.Type != "CERTIFICATE REQUEST" {
+			internal.JSONResponse(ctx, w, http.StatusBadRequest, map[string]string{
+				"error": "csr must be a PEM encoded certificate request",
+			})
+			return
+		}
+
+		csr, err := x509.ParseCertificateRequest(block.Bytes)
+		if err != nil {
+			internal.JSONResponse(ctx, w, http.StatusBadRequest, map[string]string{
+				"error": fmt.Sprintf("csr is not valid: %s", err),
+			})
+			return
+		}
+
+		der, err := issuer.Issue(u, csr)
+		if err == clientcert.ErrInvalidRequest {
+			internal.JSONResponse(ctx, w, http.StatusBadRequest, map[string]string{
+				"error": "csr is not valid",
+			})
+			return
+		}
+		if err != nil {
+			ctx.Logger.WithFields(logrus.Fields{
+				"user":  u.Identifier,
+				"error": err,
+			}).Error("failed to issue client certificate")
+			internal.JSONResponse(ctx, w, http.StatusInternalServerError, map[string]string{
+				"error": "unable to issue certificate",
+			})
+			return
+		}
+
+		cert, err := x509.ParseCertificate(der)
+		if err != nil {
+			internal.JSONResponse(ctx, w, http.StatusInternalServerError, map[string]string{
+				"error": "unable to issue certificate",
+			})
+			return
+		}
+
+		auditor.Record(audit.Event{
+			Type:     audit.CredentialsGenerated,
+			User:     u.Identifier,
+			Source:   auditSource(r.RemoteAddr),
+			Decision: audit.Allow,
+			Reason:   "client_certificate",
+		})
+
+		internal.JSONResponse(ctx, w, http.StatusOK, clientCertificateResponse{
+			Certificate: string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})),
+			CA:          string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: issuer.CA().Raw})),
+			ExpiresAt:   cert.NotAfter.UTC(),
+		})
+	}
+}
+
+// clientCACertificate responds with the PEM encoded certificate of the CA
+// issuing client certificates.
+func clientCACertificate(issuer *clientcert.Issuer) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/x-pem-file")
+		pem.Encode(w, &pem.Block{Type: "CERTIFICATE", Bytes: issuer.CA().Raw})
+	}
+}
+
+// authenticatedPost returns the user making the POST request, otherwise it
+// responds with the error
+func authenticatedPost(ctx internal.Context, w http.ResponseWriter, r *http.Request, authenticate router.Authenticator) (user.User, bool) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		internal.JSONResponse(ctx, w, http.StatusMethodNotAllowed, map[string]string{
+			"error": "method not allowed",
+		})
+		return user.User{}, false
+	}
+
+	u, err := authenticate(r)
+	if err == router.ErrUnauthenticated {
+		internal.JSONResponse(ctx, w, http.StatusUnauthorized, map[string]string{
+			"error": "authentication required",
+		})
+		return user.User{}, false
+	}
+	if err == router.ErrUnlistedUser {
+		internal.JSONResponse(ctx, w, http.StatusForbidden, map[string]string{
+			"error": "access denied",
+		})
+		return user.User{}, false
+	}
+	if err != nil {
+		ctx.Logger.WithFields(logrus.Fields{
+			"error": err,
+		}).Error("failed to authenticate request")
+		internal.JSONResponse(ctx, w, http.StatusInternalServerError, map[string]string{
+			"error": "unable to authenticate request",
+		})
+		return user.User{}, false
+	}
+
+	return u, true
+}
@@ -1,11 +1,24 @@
 package cmd
 
 import (
+	"bytes"
+	"encoding/json"
+	"fmt"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"syscall"
 	"time"
 
 	"github.com/alphagov/iap/internal"
+	"github.com/alphagov/iap/pkg/audit"
+	"github.com/alphagov/iap/pkg/cfg"
+	"github.com/alphagov/iap/pkg/drain"
+	"github.com/alphagov/iap/pkg/health"
+	"github.com/alphagov/iap/pkg/router"
+	"github.com/alphagov/iap/pkg/service"
 
 	"github.com/alicebob/miniredis"
 	"github.com/go-redis/redis"
@@ -45,12 +58,33 @@ var _ = Describe("Web server", func() {
 		mr.Close()
 	})
 
+	redisCheck := func(ctx internal.Context) *health.Checker {
+		checker := health.New()
+		checker.Add("redis", func() error {
+			return ctx.Redis.Ping().Err()
+		})
+		return checker
+	}
+
+	It("should be alive", func() {
+		req, err := http.NewRequest("GET", "/livez", nil)
+		Expect(err).NotTo(HaveOccurred())
+
+		rr := httptest.NewRecorder()
+		handler := http.HandlerFunc(livenessHandler(ctx))
+
+		handler.ServeHTTP(rr, req)
+
+		Expect(rr.Code).To(Equal(http.StatusOK))
+		Expect(rr.Body.String()).To(MatchJSON(`{"alive": true}`))
+	})
+
 	It("should pass the healthcheck", func() {
 		req, err := http.NewRequest("GET", "/healthcheck", nil)
 		Expect(err).NotTo(HaveOccurred())
 
 		rr := httptest.NewRecorder()
-		handler := http.HandlerFunc(healthcheckHandler(ctx))
+		handler := http.HandlerFunc(healthcheckHandler(ctx, drain.New(time.Second, 0, ctx.Logger)))
 
 		handler.ServeHTTP(rr, req)
 
@@ -69,7 +103,7 @@ var _ = Describe("Web server", func() {
 				Addr:        "0.0.0.0:56789",
 				DialTimeout: time.Second * 1,
 			}),
-		}))
+		}, drain.New(time.Second, 0, ctx.Logger)))
 
 		handler.ServeHTTP(rr, req)
 
@@ -77,17 +111,164 @@ var _ = Describe("Web server", func() {
 		Expect(rr.Body.String()).To(MatchJSON(`{"redis": false}`))
 	})
 
+	It("should fail the healthcheck while draining", func() {
+		req, err := http.NewRequest("GET", "/healthcheck", nil)
+		Expect(err).NotTo(HaveOccurred())
+
+		drainer := drain.New(time.Second, 0, ctx.Logger)
+		signals := make(chan os.Signal, 1)
+		signals <- syscall.SIGTERM
+		Expect(drainer.Run(signals)).To(Succeed())
+
+		rr := httptest.NewRecorder()
+		handler := http.HandlerFunc(healthcheckHandler(ctx, drainer))
+
+		handler.ServeHTTP(rr, req)
+
+		Expect(rr.Code).To(Equal(http.StatusServiceUnavailable))
+		Expect(rr.Body.String()).To(MatchJSON(`{"redis": true, "draining": true}`))
+	})
+
+	It("should be ready", func() {
+		req, err := http.NewRequest("GET", "/readyz", nil)
+		Expect(err).NotTo(HaveOccurred())
+
+		rr := httptest.NewRecorder()
+		handler := http.HandlerFunc(readinessHandler(ctx, redisCheck(ctx), drain.New(time.Second, 0, ctx.Logger), nil))
+
+		handler.ServeHTTP(rr, req)
+
+		Expect(rr.Code).To(Equal(http.StatusOK))
+		Expect(rr.Body.String()).To(ContainSubstring(`"ready":true`))
+		Expect(rr.Body.String()).To(ContainSubstring(`"redis":{"healthy":true`))
+	})
+
+	It("should not be ready due to lack of redis conectivity", func() {
+		req, err := http.NewRequest("GET", "/readyz", nil)
+		Expect(err).NotTo(HaveOccurred())
+
+		rr := httptest.NewRecorder()
+		handler := http.HandlerFunc(readinessHandler(ctx, redisCheck(internal.Context{
+			Logger: ctx.Logger,
+			Redis: redis.NewClient(&redis.Options{
+				Addr:        "0.0.0.0:56789",
+				DialTimeout: time.Second * 1,
+			}),
+		}), drain.New(time.Second, 0, ctx.Logger), nil))
+
+		handler.ServeHTTP(rr, req)
+
+		Expect(rr.Code).To(Equal(http.StatusServiceUnavailable))
+		Expect(rr.Body.String()).To(ContainSubstring(`"ready":false`))
+		Expect(rr.Body.String()).To(ContainSubstring(`"redis":{"healthy":false`))
+	})
+
+	It("should not be ready while draining", func() {
+		req, err := http.NewRequest("GET", "/readyz", nil)
+		Expect(err).NotTo(HaveOccurred())
+
+		drainer := drain.New(time.Second, 0, ctx.Logger)
+		signals := make(chan os.Signal, 1)
+		signals <- syscall.SIGTERM
+		Expect(drainer.Run(signals)).To(Succeed())
+
+		rr := httptest.NewRecorder()
+		handler := http.HandlerFunc(readinessHandler(ctx, redisCheck(ctx), drainer, nil))
+
+		handler.ServeHTTP(rr, req)
+
+		Expect(rr.Code).To(Equal(http.StatusServiceUnavailable))
+		Expect(rr.Body.String()).To(ContainSubstring(`"ready":false`))
+		Expect(rr.Body.String()).To(ContainSubstring(`"draining":true`))
+	})
+
 	It("should generate a new set of credentials for user", func() {
 		req, err := http.NewRequest("GET", "/socks5/generate", nil)
 		Expect(err).NotTo(HaveOccurred())
 
+		events := &bytes.Buffer{}
+		auditor := audit.New([]audit.Sink{audit.NewWriterSink(events)}, ctx.Logger)
+
 		rr := httptest.NewRecorder()
-		handler := http.HandlerFunc(generateSOCKS5Credentials(ctx))
+		handler := http.HandlerFunc(generateSOCKS5Credentials(ctx, auditor))
 
 		handler.ServeHTTP(rr, req)
 
 		Expect(rr.Code).To(Equal(http.StatusOK))
 		Expect(rr.Body.String()).To(ContainSubstring(`"username"`))
 		Expect(rr.Body.String()).To(ContainSubstring(`"password"`))
+
+		var credentials credentialResponse
+		Expect(json.Unmarshal(rr.Body.Bytes(), &credentials)).To(Succeed())
+
+		var event audit.Event
+		Expect(json.Unmarshal(events.Bytes(), &event)).To(Succeed())
+		Expect(event.User).To(Equal(audit.Anonymous))
+		Expect(event.Credentials).To(Equal(credentials.Username))
+	})
+
+	It("should not proxy the endpoints of IAP on its own host", func() {
+		upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprint(w, "upstream")
+		}))
+		defer upstream.Close()
+
+		upstreamURI, err := url.Parse(upstream.URL)
+		Expect(err).NotTo(HaveOccurred())
+
+		rtr := router.New(map[string]service.Service{
+			"my-service": service.Service{
+				Identifier:  "my-service",
+				UpstreamURI: *upstreamURI,
+				Matchers:    []service.Matcher{service.Matcher{Host: "iap.mydomain.com"}},
+			},
+		}, ctx.Logger)
+		proxy := router.NewProxy(rtr, func(w http.ResponseWriter, r *http.Request, svc *service.Service) bool {
+			return true
+		}, "iap_session", nil, ctx.Logger)
+
+		mux := http.NewServeMux()
+		mux.HandleFunc("/oidc/callback", func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprint(w, "iap")
+		})
+		handler := proxyHandler(proxy, mux, "iap.mydomain.com")
+
+		serve := func(target string) string {
+			rr := httptest.NewRecorder()
+			handler.ServeHTTP(rr, httptest.NewRequest("GET", target, nil))
+			return rr.Body.String()
+		}
+
+		Expect(serve("https://iap.mydomain.com/oidc/callback")).To(Equal("iap"))
+		Expect(serve("https://IAP.mydomain.com:443/oidc/callback")).To(Equal("iap"))
+		Expect(serve("https://iap.mydomain.com/dashboards")).To(Equal("upstream"))
+	})
+
+	It("should not issue client certificates to users identified by their client certificate", func() {
+		ca, caKey := newClientCA()
+		config := cfg.ValidatedConfig{
+			AllowUnlistedUsers: true,
+			ClientCA: &cfg.ValidatedClientCAConfig{
+				Certificate: ca,
+				Key:         caKey,
+				Validity:    time.Hour,
+			},
+		}
+		issuer := setupIssuer(ctx, config)
+
+		r := &runner{ctx: ctx}
+		authenticate, loggedIn := r.setupAuthenticator(config, newGeneration(health.New()), setupSessions(ctx, config))
+
+		req := httptest.NewRequest("POST", "/certificates/sign", strings.NewReader(`{"csr": ""}`))
+		req.TLS = issuedConnection(issuer, ca, "someone@mydomain.com")
+
+		u, err := authenticate(req)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(u.Identifier).To(Equal("someone@mydomain.com"))
+
+		rr := httptest.NewRecorder()
+		issueClientCertificate(ctx, issuer, loggedIn, nil).ServeHTTP(rr, req)
+
+		Expect(rr.Code).To(Equal(http.StatusUnauthorized))
 	})
 })
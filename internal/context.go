@@ -1,6 +1,8 @@
 package internal
 
 import (
+	"os"
+
 	"github.com/go-redis/redis"
 	log "github.com/sirupsen/logrus"
 )
@@ -9,3 +11,19 @@ type Context struct {
 	Logger *log.Logger
 	Redis  *redis.Client
 }
+
+// Close releases the Redis client once the command is done, and makes sure
+// every log line has been written.
+func (c Context) Close() {
+	if c.Redis != nil {
+		if err := c.Redis.Close(); err != nil {
+			c.Logger.WithFields(log.Fields{
+				"error": err,
+			}).Error("failed to close redis client")
+		}
+	}
+
+	if out, ok := c.Logger.Out.(*os.File); ok {
+		out.Sync()
+	}
+}
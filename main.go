@@ -29,6 +29,9 @@ func run(args []string, exit func(int)) {
 	cmd.ConfigureWebCommand(app)
 	cmd.ConfigureProxyCommand(app)
 	cmd.ConfigureSocksCommand(app)
+	cmd.ConfigureExtAuthzCommand(app)
+	cmd.ConfigureServeCommand(app)
+	cmd.ConfigureConfigCommand(app)
 
 	kingpin.MustParse(app.Parse(args))
 }
@@ -0,0 +1,256 @@
+package access
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/alphagov/iap/pkg/cfg"
+	"github.com/alphagov/iap/pkg/service"
+)
+
+// Kinds of subjects accessing services
+const (
+	User           = "user"
+	ServiceAccount = "service_account"
+	// Anyone is anyone who is not logged in, who can only access the public
+	// paths of services
+	Anyone = "anyone"
+)
+
+// Subject is a user or service account, along with its roles.
+type Subject struct {
+	Kind       string
+	Identifier string
+	Roles      []string
+	// Known is false for users missing from the configuration, who can only
+	// access services when unlisted users are allowed, and then have no roles
+	Known bool
+}
+
+// Grant is a service a subject can access, and why.
+type Grant struct {
+	Service string
+	// Hosts are the hosts and path prefixes of the service, or only its
+	// public paths for anyone who is not logged in
+	Hosts []string
+	// Roles are the roles of the subject the service requires, empty when
+	// the service does not require any
+	Roles []string
+}
+
+// Denial is a service a subject cannot access, along with the roles it
+// requires.
+type Denial struct {
+	Service string
+	Hosts   []string
+	Roles   []string
+}
+
+// Explanation is every service a subject can or cannot access.
+type Explanation struct {
+	Subject Subject
+	Grants  []Grant
+	Denials []Denial
+}
+
+// Explain which services the user with the identifier can access. Users
+// missing from the configuration cannot access any, unless unlisted users are
+// allowed to access the services which do not require any role.
+func Explain(config cfg.ValidatedConfig, identifier string) Explanation {
+	subject := Subject{Kind: User, Identifier: identifier}
+	if u, ok := config.Users[identifier]; ok {
+		subject.Roles, subject.Known = u.Roles, true
+	}
+
+	return explain(config, subject, subject.Known || config.AllowUnlistedUsers)
+}
+
+// ExplainServiceAccount explains which services the service account can
+// access.
+func ExplainServiceAccount(config cfg.ValidatedConfig, name string) Explanation {
+	subject := Subject{Kind: ServiceAccount, Identifier: name}
+	if account, ok := config.ServiceAccounts[name]; ok {
+		subject.Roles, subject.Known = account.Roles, true
+	}
+
+	return explain(config, subject, subject.Known)
+}
+
+// ExplainUnauthenticated explains which public paths of services anyone can
+// access without logging in.
+func ExplainUnauthenticated(config cfg.ValidatedConfig) Explanation {
+	explanation := Explanation{
+		Subject: Subject{Kind: Anyone, Known: true},
+		Grants:  make([]Grant, 0),
+		Denials: make([]Denial, 0),
+	}
+
+	for _, identifier := range serviceIdentifiers(config) {
+		svc := config.Services[identifier]
+		if paths := publicPaths(config, svc); len(paths) > 0 {
+			explanation.Grants = append(explanation.Grants, Grant{
+				Service: identifier,
+				Hosts:   paths,
+				Roles:   []string{},
+			})
+			continue
+		}
+
+		explanation.Denials = append(explanation.Denials, Denial{
+			Service: identifier,
+			Hosts:   hosts(config, svc),
+			Roles:   svc.Roles,
+		})
+	}
+
+	return explanation
+}
+
+// explain which services the subject can access, none unless allowed.
+func explain(config cfg.ValidatedConfig, subject Subject, allowed bool) Explanation {
+	explanation := Explanation{
+		Subject: subject,
+		Grants:  make([]Grant, 0),
+		Denials: make([]Denial, 0),
+	}
+
+	for _, identifier := range serviceIdentifiers(config) {
+		svc := config.Services[identifier]
+		if !allowed || !svc.IsAccessible(subject.Roles) {
+			explanation.Denials = append(explanation.Denials, Denial{
+				Service: identifier,
+				Hosts:   hosts(config, svc),
+				Roles:   svc.Roles,
+			})
+			continue
+		}
+
+		explanation.Grants = append(explanation.Grants, Grant{
+			Service: identifier,
+			Hosts:   hosts(config, svc),
+			Roles:   intersect(subject.Roles, svc.Roles),
+		})
+	}
+
+	return explanation
+}
+
+func serviceIdentifiers(config cfg.ValidatedConfig) []string {
+	identifiers := make([]string, 0, len(config.Services))
+	for identifier := range config.Services {
+		identifiers = append(identifiers, identifier)
+	}
+	sort.Strings(identifiers)
+	return identifiers
+}
+
+// hosts returns the host and path prefix of every matcher of the service,
+// along with the matchers of other services taking precedence over it.
+func hosts(config cfg.ValidatedConfig, svc service.Service) []string {
+	hosts := make([]string, 0, len(svc.Matchers))
+	for _, matcher := range svc.Matchers {
+		hosts = append(hosts, matcher.String()+except(config, svc.Identifier, matcher, matcher.PathPrefix))
+	}
+	return hosts
+}
+
+// publicPaths returns every public path of the service under the host and
+// path prefix of each matcher, eg: status.mydomain.com/api/* (GET, HEAD)
+func publicPaths(config cfg.ValidatedConfig, svc service.Service) []string {
+	paths := make([]string, 0)
+	for _, matcher := range svc.Matchers {
+		host := strings.TrimSuffix(matcher.String(), matcher.PathPrefix)
+
+		for _, publicPath := range svc.PublicPaths {
+			var path, prefix string
+			switch {
+			case publicPath.Path != "" && matcher.MatchesPath(publicPath.Path):
+				path, prefix = publicPath.Path, publicPath.Path
+			case publicPath.Path != "":
+				continue
+			case matcher.MatchesPath(publicPath.Prefix):
+				path, prefix = strings.TrimSuffix(publicPath.Prefix, "/")+"/*", publicPath.Prefix
+			case service.HasPathPrefix(matcher.PathPrefix, publicPath.Prefix):
+				path, prefix = strings.TrimSuffix(matcher.PathPrefix, "/")+"/*", matcher.PathPrefix
+			default:
+				continue
+			}
+
+			if len(publicPath.Methods) > 0 {
+				path += " (" + strings.Join(publicPath.Methods, ", ") + ")"
+			}
+			paths = append(paths, host+path+except(config, svc.Identifier, matcher, prefix))
+		}
+	}
+	return paths
+}
+
+// except lists the matchers of other services which the router tries before
+// the matcher for some of its hosts and the paths under the prefix, eg:
+// " (except tools.mydomain.com/grafana of grafana)", as they are not sent to
+// the service.
+func except(config cfg.ValidatedConfig, identifier string, matcher service.Matcher, prefix string) string {
+	scoped := matcher
+	scoped.PathPrefix = prefix
+
+	shadows := make([]string, 0)
+	for _, other := range serviceIdentifiers(config) {
+		if other == identifier {
+			continue
+		}
+
+		for _, first := range config.Services[other].Matchers {
+			if precedes(other, first, identifier, matcher) && overlaps(first, scoped) {
+				shadows = append(shadows, first.String()+" of "+other)
+			}
+		}
+	}
+
+	if len(shadows) == 0 {
+		return ""
+	}
+	return " (except " + strings.Join(shadows, ", ") + ")"
+}
+
+// precedes follows the order of the router: exact hosts before patterns, then
+// the longest path prefix, then the services by identifier.
+func precedes(identifier string, matcher service.Matcher, otherIdentifier string, other service.Matcher) bool {
+	if matcher.IsPattern() != other.IsPattern() {
+		return !matcher.IsPattern()
+	}
+	if len(matcher.PathPrefix) != len(other.PathPrefix) {
+		return len(matcher.PathPrefix) > len(other.PathPrefix)
+	}
+	return identifier < otherIdentifier
+}
+
+// overlaps tells if any host and path is matched by both matchers.
+func overlaps(a, b service.Matcher) bool {
+	if !service.HasPathPrefix(a.PathPrefix, b.PathPrefix) && !service.HasPathPrefix(b.PathPrefix, a.PathPrefix) {
+		return false
+	}
+
+	switch {
+	case a.IsPattern() && b.IsPattern():
+		return service.PatternsOverlap(a.Pattern, b.Pattern)
+	case a.IsPattern():
+		_, ok := a.Match(b.Host)
+		return ok
+	default:
+		_, ok := b.Match(a.Host)
+		return ok
+	}
+}
+
+func intersect(roles, required []string) []string {
+	found := make([]string, 0)
+	for _, role := range roles {
+		for _, other := range required {
+			if role == other {
+				found = append(found, role)
+				break
+			}
+		}
+	}
+	return found
+}
@@ -0,0 +1,307 @@
+package access_test
+
+import (
+	"github.com/alphagov/iap/pkg/access"
+	"github.com/alphagov/iap/pkg/cfg"
+	"github.com/lithammer/dedent"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+const oidc = `
+oidc:
+  redirect_uri: https://iap.mydomain.com/oidc/callback
+  auth_uri: https://accounts.google.com/o/oauth2/v2/auth
+  token_uri: https://www.googleapis.com/oauth2/v4/token
+  client_id: foo-0000-1111.apps.googleusercontent.com
+  client_secret: abcd-0000-1111
+session:
+  cookie_domain: mydomain.com
+`
+
+func parse(config string) cfg.ValidatedConfig {
+	validated, err := cfg.ParseAndValidateConfig(oidc + dedent.Dedent(config))
+	Expect(err).NotTo(HaveOccurred())
+	return validated
+}
+
+var _ = Describe("Access", func() {
+	var config cfg.ValidatedConfig
+
+	BeforeEach(func() {
+		config = parse(`
+		roles: [superuser, readonlyuser, deployer]
+		services:
+		  grafana:
+		    upstream_uri: http://grafana.local
+		    matchers:
+		      - host: grafana.mydomain.com
+		      - host: tools.mydomain.com
+		        path_prefix: /grafana
+		    roles: [superuser, readonlyuser]
+		  prometheus:
+		    upstream_uri: http://prometheus.local
+		    matchers:
+		      - host: prometheus.mydomain.com
+		    roles: [superuser]
+		  status:
+		    upstream_uri: http://status.local
+		    matchers:
+		      - host: status.mydomain.com
+		  ci:
+		    upstream_uri: http://ci.local
+		    matchers:
+		      - host: ci.mydomain.com
+		    roles: [deployer]
+		users:
+		  fname.lname@mydomain.com:
+		    roles: [readonlyuser]
+		allow_unlisted_users: true
+		service_accounts:
+		  deploy-bot:
+		    roles: [deployer]
+		    api_key_hashes: ["sha256:3e245e375abacce2c31f9db9b063994b9a73c5c19d839a3ce21e77983111bd34"]
+		`)
+	})
+
+	It("Explains which services a user can access and why", func() {
+		explanation := access.Explain(config, "fname.lname@mydomain.com")
+
+		Expect(explanation.Subject).To(Equal(access.Subject{
+			Kind:       access.User,
+			Identifier: "fname.lname@mydomain.com",
+			Roles:      []string{"readonlyuser"},
+			Known:      true,
+		}))
+		Expect(explanation.Grants).To(Equal([]access.Grant{
+			{Service: "grafana", Hosts: []string{"grafana.mydomain.com", "tools.mydomain.com/grafana"}, Roles: []string{"readonlyuser"}},
+			{Service: "status", Hosts: []string{"status.mydomain.com"}, Roles: []string{}},
+		}))
+		Expect(explanation.Denials).To(Equal([]access.Denial{
+			{Service: "ci", Hosts: []string{"ci.mydomain.com"}, Roles: []string{"deployer"}},
+			{Service: "prometheus", Hosts: []string{"prometheus.mydomain.com"}, Roles: []string{"superuser"}},
+		}))
+	})
+
+	It("Explains which hosts and paths of a service other services take precedence over", func() {
+		config = parse(`
+		services:
+		  grafana:
+		    upstream_uri: http://grafana.local
+		    matchers:
+		      - host: tools.mydomain.com
+		        path_prefix: /grafana
+		  tools:
+		    upstream_uri: http://tools.local
+		    matchers:
+		      - host: tools.mydomain.com
+		    public_paths:
+		      - prefix: /grafana/public/
+		      - path: /health
+		  previews:
+		    upstream_uri: http://$1.previews.local
+		    matchers:
+		      - host: "*.mydomain.com"
+		allow_unlisted_users: true
+		`)
+
+		Expect(access.Explain(config, "someone@mydomain.com").Grants).To(Equal([]access.Grant{
+			{Service: "grafana", Hosts: []string{"tools.mydomain.com/grafana"}, Roles: []string{}},
+			{
+				Service: "previews",
+				Hosts: []string{
+					`^([a-z0-9-]+)\.mydomain\.com$ (except tools.mydomain.com/grafana of grafana, tools.mydomain.com of tools)`,
+				},
+				Roles: []string{},
+			},
+			{
+				Service: "tools",
+				Hosts:   []string{"tools.mydomain.com (except tools.mydomain.com/grafana of grafana)"},
+				Roles:   []string{},
+			},
+		}))
+
+		Expect(access.ExplainUnauthenticated(config).Grants).To(Equal([]access.Grant{{
+			Service: "tools",
+			Hosts: []string{
+				"tools.mydomain.com/grafana/public/* (except tools.mydomain.com/grafana of grafana)",
+				"tools.mydomain.com/health",
+			},
+			Roles: []string{},
+		}}))
+	})
+
+	It("Explains that users who are not in the configuration have no roles", func() {
+		explanation := access.Explain(config, "someone@mydomain.com")
+
+		Expect(explanation.Subject.Known).To(BeFalse())
+		Expect(explanation.Grants).To(HaveLen(1))
+		Expect(explanation.Grants[0].Service).To(Equal("status"))
+	})
+
+	It("Explains that users who are not in the configuration cannot access any service unless allowed", func() {
+		config.AllowUnlistedUsers = false
+		explanation := access.Explain(config, "someone@mydomain.com")
+
+		Expect(explanation.Subject.Known).To(BeFalse())
+		Expect(explanation.Grants).To(BeEmpty())
+		Expect(explanation.Denials).To(HaveLen(4))
+	})
+
+	It("Explains which services a service account can access", func() {
+		explanation := access.ExplainServiceAccount(config, "deploy-bot")
+
+		Expect(explanation.Subject.Kind).To(Equal(access.ServiceAccount))
+		Expect(explanation.Subject.Known).To(BeTrue())
+		Expect(explanation.Grants).To(HaveLen(2))
+		Expect(explanation.Grants[0].Service).To(Equal("ci"))
+		Expect(explanation.Grants[0].Roles).To(Equal([]string{"deployer"}))
+	})
+
+	It("Finds no changes between the same configurations", func() {
+		Expect(access.Diff(config, config)).To(BeEmpty())
+	})
+
+	It("Shows the access gained or lost by every user", func() {
+		next := parse(`
+		roles: [superuser, readonlyuser, deployer]
+		services:
+		  grafana:
+		    upstream_uri: http://grafana.local
+		    matchers:
+		      - host: grafana.mydomain.com
+		    roles: [superuser, readonlyuser]
+		  prometheus:
+		    upstream_uri: http://prometheus.local
+		    matchers:
+		      - host: prometheus.mydomain.com
+		    roles: [superuser]
+		  status:
+		    upstream_uri: http://status.local
+		    matchers:
+		      - host: status.mydomain.com
+		    roles: [superuser, readonlyuser]
+		  ci:
+		    upstream_uri: http://ci.local
+		    matchers:
+		      - host: ci.mydomain.com
+		    roles: [deployer]
+		users:
+		  fname.lname@mydomain.com:
+		    roles: [readonlyuser, deployer]
+		  admin@mydomain.com:
+		    roles: [superuser]
+		allow_unlisted_users: true
+		service_accounts:
+		  deploy-bot:
+		    roles: [deployer]
+		    api_key_hashes: ["sha256:3e245e375abacce2c31f9db9b063994b9a73c5c19d839a3ce21e77983111bd34"]
+		`)
+
+		Expect(access.Diff(config, next)).To(Equal([]access.Change{
+			{
+				Kind:       access.User,
+				Identifier: "",
+				Gained:     []access.Access{},
+				Lost:       []access.Access{{Service: "status", Host: "status.mydomain.com"}},
+			},
+			{
+				Kind:       access.User,
+				Identifier: "admin@mydomain.com",
+				Gained: []access.Access{
+					{Service: "grafana", Host: "grafana.mydomain.com"},
+					{Service: "prometheus", Host: "prometheus.mydomain.com"},
+				},
+				Lost: []access.Access{},
+			},
+			{
+				Kind:       access.User,
+				Identifier: "fname.lname@mydomain.com",
+				Gained:     []access.Access{{Service: "ci", Host: "ci.mydomain.com"}},
+				Lost:       []access.Access{{Service: "grafana", Host: "tools.mydomain.com/grafana"}},
+			},
+			{
+				Kind:       access.ServiceAccount,
+				Identifier: "deploy-bot",
+				Gained:     []access.Access{},
+				Lost:       []access.Access{{Service: "status", Host: "status.mydomain.com"}},
+			},
+		}))
+	})
+
+	It("Explains which public paths anyone can access without logging in", func() {
+		config = parse(`
+		roles: [superuser]
+		services:
+		  grafana:
+		    upstream_uri: http://grafana.local
+		    matchers:
+		      - host: grafana.mydomain.com
+		      - host: tools.mydomain.com
+		        path_prefix: /grafana
+		    public_paths:
+		      - path: /api/health
+		      - prefix: /grafana/public/
+		        methods: [GET]
+		    roles: [superuser]
+		  prometheus:
+		    upstream_uri: http://prometheus.local
+		    matchers:
+		      - host: prometheus.mydomain.com
+		    roles: [superuser]
+		users:
+		  fname.lname@mydomain.com:
+		    roles: [superuser]
+		`)
+
+		explanation := access.ExplainUnauthenticated(config)
+
+		Expect(explanation.Subject.Kind).To(Equal(access.Anyone))
+		Expect(explanation.Grants).To(Equal([]access.Grant{{
+			Service: "grafana",
+			Hosts: []string{
+				"grafana.mydomain.com/api/health",
+				"grafana.mydomain.com/grafana/public/* (GET)",
+				"tools.mydomain.com/grafana/public/* (GET)",
+			},
+			Roles: []string{},
+		}}))
+		Expect(explanation.Denials).To(Equal([]access.Denial{
+			{Service: "prometheus", Hosts: []string{"prometheus.mydomain.com"}, Roles: []string{"superuser"}},
+		}))
+
+		next := parse(`
+		roles: [superuser]
+		services:
+		  grafana:
+		    upstream_uri: http://grafana.local
+		    matchers:
+		      - host: grafana.mydomain.com
+		      - host: tools.mydomain.com
+		        path_prefix: /grafana
+		    roles: [superuser]
+		  prometheus:
+		    upstream_uri: http://prometheus.local
+		    matchers:
+		      - host: prometheus.mydomain.com
+		    public_paths:
+		      - path: /-/healthy
+		    roles: [superuser]
+		users:
+		  fname.lname@mydomain.com:
+		    roles: [superuser]
+		`)
+
+		Expect(access.Diff(config, next)).To(Equal([]access.Change{
+			{
+				Kind:   access.Anyone,
+				Gained: []access.Access{{Service: "prometheus", Host: "prometheus.mydomain.com/-/healthy"}},
+				Lost: []access.Access{
+					{Service: "grafana", Host: "grafana.mydomain.com/api/health"},
+					{Service: "grafana", Host: "grafana.mydomain.com/grafana/public/* (GET)"},
+					{Service: "grafana", Host: "tools.mydomain.com/grafana/public/* (GET)"},
+				},
+			},
+		}))
+	})
+})
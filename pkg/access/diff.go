@@ -0,0 +1,120 @@
+package access
+
+import (
+	"sort"
+
+	"github.com/alphagov/iap/pkg/cfg"
+)
+
+// Access is a host of a service a subject can access.
+type Access struct {
+	Service string
+	Host    string
+}
+
+// Change is the access a subject gained or lost between two configurations.
+type Change struct {
+	Kind       string
+	Identifier string
+	Gained     []Access
+	Lost       []Access
+}
+
+// Diff returns the access gained or lost by the users and service accounts
+// of either configuration. Hosts of a service are compared one by one, so
+// that changing its matchers is reported too. Anyone who can log in with OIDC
+// without being one of the users, when allowed, is reported with an empty
+// identifier, after the public paths anyone can access without logging in.
+func Diff(previous, next cfg.ValidatedConfig) []Change {
+	changes := make([]Change, 0)
+
+	users := make(map[string]bool)
+	for identifier := range previous.Users {
+		users[identifier] = true
+	}
+	for identifier := range next.Users {
+		users[identifier] = true
+	}
+
+	accounts := make(map[string]bool)
+	for name := range previous.ServiceAccounts {
+		accounts[name] = true
+	}
+	for name := range next.ServiceAccounts {
+		accounts[name] = true
+	}
+
+	if change := diff(ExplainUnauthenticated(previous), ExplainUnauthenticated(next)); change != nil {
+		changes = append(changes, *change)
+	}
+
+	// Anyone who can log in without being one of the users
+	if change := diff(Explain(previous, ""), Explain(next, "")); change != nil {
+		changes = append(changes, *change)
+	}
+
+	for _, identifier := range sortedKeys(users) {
+		if change := diff(Explain(previous, identifier), Explain(next, identifier)); change != nil {
+			changes = append(changes, *change)
+		}
+	}
+
+	for _, name := range sortedKeys(accounts) {
+		if change := diff(ExplainServiceAccount(previous, name), ExplainServiceAccount(next, name)); change != nil {
+			changes = append(changes, *change)
+		}
+	}
+
+	return changes
+}
+
+func diff(previous, next Explanation) *Change {
+	before, after := accesses(previous), accesses(next)
+
+	change := Change{
+		Kind:       next.Subject.Kind,
+		Identifier: next.Subject.Identifier,
+		Gained:     subtract(after, before),
+		Lost:       subtract(before, after),
+	}
+
+	if len(change.Gained) == 0 && len(change.Lost) == 0 {
+		return nil
+	}
+	return &change
+}
+
+func accesses(explanation Explanation) []Access {
+	accesses := make([]Access, 0)
+	for _, grant := range explanation.Grants {
+		for _, host := range grant.Hosts {
+			accesses = append(accesses, Access{Service: grant.Service, Host: host})
+		}
+	}
+	return accesses
+}
+
+// subtract returns the accesses which are not in the others, in order.
+func subtract(accesses, others []Access) []Access {
+	excluded := make(map[Access]bool, len(others))
+	for _, access := range others {
+		excluded[access] = true
+	}
+
+	remaining := make([]Access, 0)
+	for _, access := range accesses {
+		if !excluded[access] {
+			remaining = append(remaining, access)
+		}
+	}
+	return remaining
+}
+
+func sortedKeys(set map[string]bool) []string {
+	keys := make([]string, 0, len(set))
+	for key := range set {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
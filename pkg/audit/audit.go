@@ -0,0 +1,216 @@
+package audit
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Types of events
+const (
+	Login                = "login"
+	CredentialsGenerated = "credentials_generated"
+	CredentialsValidated = "credentials_validated"
+	SOCKSConnect         = "socks_connect"
+	ProxyRequest         = "proxy_request"
+	ReverseProxyRequest  = "reverse_proxy_request"
+	ForwardAuth          = "forward_auth"
+)
+
+// Decisions
+const (
+	Allow = "allow"
+	Deny  = "deny"
+)
+
+// Anonymous is the user of events for requests which are not authenticated.
+const Anonymous = "anonymous"
+
+// Types of sinks
+const (
+	Stdout  = "stdout"
+	File    = "file"
+	Syslog  = "syslog"
+	Webhook = "webhook"
+)
+
+// Event records a single authentication or authorization decision.
+// Credentials is the username of the credentials generated, when it is not
+// the user's.
+type Event struct {
+	Time        time.Time `json:"time"`
+	Type        string    `json:"type"`
+	User        string    `json:"user,omitempty"`
+	Source      string    `json:"source,omitempty"`
+	Destination string    `json:"destination,omitempty"`
+	Service     string    `json:"service,omitempty"`
+	Decision    string    `json:"decision"`
+	Reason      string    `json:"reason,omitempty"`
+	Credentials string    `json:"credentials,omitempty"`
+}
+
+// Decision returns the decision of a check.
+func Decision(allowed bool) string {
+	if allowed {
+		return Allow
+	}
+	return Deny
+}
+
+// Sink stores audit events, eg: in a file or a remote service.
+type Sink interface {
+	Write(event Event) error
+	Close() error
+}
+
+// SinkConfig represents where audit events should be stored. Only the fields
+// of its Type are set.
+type SinkConfig struct {
+	Type string
+
+	// File
+	Path       string
+	MaxSize    int64
+	MaxBackups int
+
+	// Syslog
+	Network string
+	Address string
+	Tag     string
+
+	// Webhook
+	URL     url.URL
+	Timeout time.Duration
+}
+
+// Logger sends every audit event to all of its sinks. A nil Logger discards
+// the events, so that auditing is optional.
+type Logger struct {
+	// mu is held for writing while the sinks are replaced, so that no event
+	// is being written to the ones closed
+	mu     sync.RWMutex
+	sinks  []Sink
+	logger *logrus.Logger
+	now    func() time.Time
+}
+
+// New will construct the Logger writing to the sinks.
+func New(sinks []Sink, logger *logrus.Logger) *Logger {
+	return &Logger{
+		sinks:  sinks,
+		logger: logger,
+		now:    time.Now,
+	}
+}
+
+// Open the sinks of the configuration.
+func Open(configs []SinkConfig, logger *logrus.Logger) (*Logger, error) {
+	sinks, err := openSinks(configs, logger)
+	if err != nil {
+		return nil, err
+	}
+
+	return New(sinks, logger), nil
+}
+
+// Reopen replaces the sinks with the ones of the configuration, eg: once it
+// was reloaded, then closes the previous ones. They are kept when any of the
+// new ones cannot be opened.
+func (l *Logger) Reopen(configs []SinkConfig) error {
+	if l == nil {
+		return nil
+	}
+
+	sinks, err := openSinks(configs, l.logger)
+	if err != nil {
+		return err
+	}
+
+	l.mu.Lock()
+	previous := l.sinks
+	l.sinks = sinks
+	l.mu.Unlock()
+
+	closeSinks(previous, l.logger)
+	return nil
+}
+
+func openSinks(configs []SinkConfig, logger *logrus.Logger) ([]Sink, error) {
+	sinks := make([]Sink, 0, len(configs))
+
+	for _, config := range configs {
+		sink, err := open(config, logger)
+		if err != nil {
+			for _, opened := range sinks {
+				opened.Close()
+			}
+			return nil, fmt.Errorf("Could not open the %s audit sink: %s", config.Type, err)
+		}
+		sinks = append(sinks, sink)
+	}
+
+	return sinks, nil
+}
+
+func open(config SinkConfig, logger *logrus.Logger) (Sink, error) {
+	switch config.Type {
+	case Stdout:
+		return NewWriterSink(os.Stdout), nil
+	case File:
+		return NewFileSink(config.Path, config.MaxSize, config.MaxBackups)
+	case Syslog:
+		return NewSyslogSink(config.Network, config.Address, config.Tag)
+	case Webhook:
+		return NewWebhookSink(config.URL, config.Timeout, logger), nil
+	}
+
+	return nil, fmt.Errorf("unknown type")
+}
+
+// Record sends the event to every sink, a sink failing does not prevent the
+// others from receiving it.
+func (l *Logger) Record(event Event) {
+	if l == nil {
+		return
+	}
+
+	if event.Time.IsZero() {
+		event.Time = l.now().UTC()
+	}
+
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	for _, sink := range l.sinks {
+		if err := sink.Write(event); err != nil {
+			l.logger.WithFields(logrus.Fields{
+				"type":  event.Type,
+				"error": err,
+			}).Error("failed to write audit event")
+		}
+	}
+}
+
+// Close every sink, once no more events will be recorded.
+func (l *Logger) Close() {
+	if l == nil {
+		return
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	closeSinks(l.sinks, l.logger)
+}
+
+func closeSinks(sinks []Sink, logger *logrus.Logger) {
+	for _, sink := range sinks {
+		if err := sink.Close(); err != nil {
+			logger.WithField("error", err).Error("failed to close audit sink")
+		}
+	}
+}
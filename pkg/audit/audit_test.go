@@ -0,0 +1,264 @@
+package audit_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/alphagov/iap/pkg/audit"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/sirupsen/logrus"
+)
+
+type failingSink struct{}
+
+func (failingSink) Write(audit.Event) error {
+	return errors.New("broken")
+}
+
+func (failingSink) Close() error {
+	return nil
+}
+
+var _ = Describe("Audit", func() {
+	var logger *logrus.Logger
+
+	BeforeEach(func() {
+		logger = logrus.New()
+		logger.SetOutput(GinkgoWriter)
+	})
+
+	It("Writes every event as a line of JSON", func() {
+		buffer := &bytes.Buffer{}
+		auditor := audit.New([]audit.Sink{audit.NewWriterSink(buffer)}, logger)
+
+		auditor.Record(audit.Event{
+			Type:        audit.SOCKSConnect,
+			User:        "jane@example.com",
+			Source:      "10.0.0.1",
+			Destination: "db.internal:5432",
+			Decision:    audit.Allow,
+		})
+		auditor.Record(audit.Event{
+			Type:     audit.Login,
+			Decision: audit.Deny,
+			Reason:   "expired_state",
+		})
+
+		lines := strings.Split(strings.TrimSpace(buffer.String()), "\n")
+		Expect(lines).To(HaveLen(2))
+
+		event := audit.Event{}
+		Expect(json.Unmarshal([]byte(lines[0]), &event)).To(Succeed())
+		Expect(event.Time).To(BeTemporally("~", time.Now(), time.Minute))
+		Expect(event.User).To(Equal("jane@example.com"))
+		Expect(event.Destination).To(Equal("db.internal:5432"))
+
+		Expect(lines[1]).To(ContainSubstring(`"type":"login"`))
+		Expect(lines[1]).To(ContainSubstring(`"decision":"deny"`))
+		Expect(lines[1]).To(ContainSubstring(`"reason":"expired_state"`))
+		Expect(lines[1]).NotTo(ContainSubstring(`"user"`))
+	})
+
+	It("Keeps writing to the other sinks when one fails", func() {
+		buffer := &bytes.Buffer{}
+		auditor := audit.New([]audit.Sink{failingSink{}, audit.NewWriterSink(buffer)}, logger)
+
+		auditor.Record(audit.Event{Type: audit.Login, Decision: audit.Allow})
+
+		Expect(buffer.String()).To(ContainSubstring(`"type":"login"`))
+	})
+
+	It("Discards events without a Logger", func() {
+		var auditor *audit.Logger
+
+		Expect(func() {
+			auditor.Record(audit.Event{Type: audit.Login})
+			auditor.Close()
+		}).NotTo(Panic())
+	})
+
+	It("Returns the decision of a check", func() {
+		Expect(audit.Decision(true)).To(Equal(audit.Allow))
+		Expect(audit.Decision(false)).To(Equal(audit.Deny))
+	})
+
+	Context("With a file", func() {
+		var dir string
+
+		BeforeEach(func() {
+			var err error
+			dir, err = ioutil.TempDir("", "audit")
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		AfterEach(func() {
+			os.RemoveAll(dir)
+		})
+
+		It("Rotates the file once it would grow over its maximum size", func() {
+			path := filepath.Join(dir, "audit.log")
+			sink, err := audit.NewFileSink(path, 200, 2)
+			Expect(err).NotTo(HaveOccurred())
+
+			for i := 0; i < 8; i++ {
+				Expect(sink.Write(audit.Event{Type: audit.Login, Decision: audit.Allow})).To(Succeed())
+			}
+			Expect(sink.Close()).To(Succeed())
+
+			files, err := filepath.Glob(path + "*")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(files).To(ConsistOf(path, path+".1", path+".2"))
+
+			for _, file := range files {
+				info, err := os.Stat(file)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(info.Size()).To(BeNumerically("<=", 200))
+			}
+		})
+
+		It("Keeps writing to the file when it cannot be rotated", func() {
+			path := filepath.Join(dir, "audit.log")
+			Expect(os.MkdirAll(filepath.Join(path+".1", "busy"), 0700)).To(Succeed())
+
+			sink, err := audit.NewFileSink(path, 200, 1)
+			Expect(err).NotTo(HaveOccurred())
+
+			failed := false
+			for i := 0; i < 4; i++ {
+				if err := sink.Write(audit.Event{Type: audit.Login, Decision: audit.Allow}); err != nil {
+					failed = true
+				}
+			}
+			Expect(failed).To(BeTrue())
+			Expect(sink.Close()).To(Succeed())
+
+			blob, err := ioutil.ReadFile(path)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(strings.Count(string(blob), `"type":"login"`)).To(Equal(4))
+		})
+
+		It("Writes to the sinks it was opened again with", func() {
+			previous := filepath.Join(dir, "previous.log")
+			next := filepath.Join(dir, "next.log")
+
+			auditor, err := audit.Open([]audit.SinkConfig{
+				{Type: audit.File, Path: previous, MaxSize: 1024},
+			}, logger)
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(auditor.Reopen([]audit.SinkConfig{
+				{Type: audit.File, Path: "/nonexistent/audit.log", MaxSize: 1024},
+			})).To(MatchError(ContainSubstring("Could not open the file audit sink")))
+			auditor.Record(audit.Event{Type: audit.Login, Decision: audit.Allow})
+
+			Expect(auditor.Reopen([]audit.SinkConfig{
+				{Type: audit.File, Path: next, MaxSize: 1024},
+			})).To(Succeed())
+			auditor.Record(audit.Event{Type: audit.ForwardAuth, Decision: audit.Allow})
+			auditor.Close()
+
+			blob, err := ioutil.ReadFile(previous)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(string(blob)).To(ContainSubstring(`"type":"login"`))
+			Expect(string(blob)).NotTo(ContainSubstring(`"type":"forward_auth"`))
+
+			blob, err = ioutil.ReadFile(next)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(string(blob)).To(ContainSubstring(`"type":"forward_auth"`))
+		})
+
+		It("Appends to an existing file", func() {
+			path := filepath.Join(dir, "audit.log")
+			Expect(ioutil.WriteFile(path, []byte("{}\n"), 0600)).To(Succeed())
+
+			sink, err := audit.NewFileSink(path, 1024, 1)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(sink.Write(audit.Event{Type: audit.Login, Decision: audit.Allow})).To(Succeed())
+			Expect(sink.Close()).To(Succeed())
+
+			blob, err := ioutil.ReadFile(path)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(string(blob)).To(HavePrefix("{}\n"))
+			Expect(string(blob)).To(ContainSubstring(`"type":"login"`))
+		})
+	})
+
+	Context("With a webhook", func() {
+		var (
+			server *httptest.Server
+			bodies chan []byte
+		)
+
+		BeforeEach(func() {
+			bodies = make(chan []byte, 10)
+			server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				blob, _ := ioutil.ReadAll(r.Body)
+				bodies <- blob
+				w.WriteHeader(http.StatusNoContent)
+			}))
+		})
+
+		AfterEach(func() {
+			server.Close()
+		})
+
+		It("POSTs every event before closing", func() {
+			u, err := url.Parse(server.URL)
+			Expect(err).NotTo(HaveOccurred())
+
+			sink := audit.NewWebhookSink(*u, time.Second, logger)
+			Expect(sink.Write(audit.Event{Type: audit.ProxyRequest, Decision: audit.Deny})).To(Succeed())
+			Expect(sink.Write(audit.Event{Type: audit.ProxyRequest, Decision: audit.Allow})).To(Succeed())
+			Expect(sink.Close()).To(Succeed())
+
+			Expect(bodies).To(HaveLen(2))
+			Expect(string(<-bodies)).To(ContainSubstring(`"decision":"deny"`))
+			Expect(string(<-bodies)).To(ContainSubstring(`"decision":"allow"`))
+		})
+
+		It("Drops the events written once closed", func() {
+			u, err := url.Parse(server.URL)
+			Expect(err).NotTo(HaveOccurred())
+
+			sink := audit.NewWebhookSink(*u, time.Second, logger)
+			Expect(sink.Close()).To(Succeed())
+
+			Expect(sink.Write(audit.Event{Type: audit.ProxyRequest})).To(MatchError(ContainSubstring("closed")))
+			Expect(sink.Close()).To(Succeed())
+			Consistently(bodies, 50*time.Millisecond).Should(BeEmpty())
+		})
+
+		It("Opens the sinks of the configuration", func() {
+			u, err := url.Parse(server.URL)
+			Expect(err).NotTo(HaveOccurred())
+
+			auditor, err := audit.Open([]audit.SinkConfig{
+				{Type: audit.Webhook, URL: *u, Timeout: time.Second},
+			}, logger)
+			Expect(err).NotTo(HaveOccurred())
+
+			auditor.Record(audit.Event{Type: audit.ForwardAuth, Service: "grafana", Decision: audit.Allow})
+			auditor.Close()
+
+			Expect(string(<-bodies)).To(ContainSubstring(`"service":"grafana"`))
+		})
+	})
+
+	It("Does not open a file sink in a missing directory", func() {
+		_, err := audit.Open([]audit.SinkConfig{
+			{Type: audit.File, Path: "/nonexistent/audit.log", MaxSize: 1024},
+		}, logger)
+
+		Expect(err).To(MatchError(ContainSubstring("Could not open the file audit sink")))
+	})
+})
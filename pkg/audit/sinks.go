@@ -0,0 +1,290 @@
+package audit
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/syslog"
+	"net/http"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// WriterSink writes every event as a line of JSON, eg: to stdout.
+type WriterSink struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+// NewWriterSink will construct the WriterSink.
+func NewWriterSink(w io.Writer) *WriterSink {
+	return &WriterSink{w: w}
+}
+
+// Write the event as a line of JSON.
+func (s *WriterSink) Write(event Event) error {
+	blob, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	_, err = s.w.Write(append(blob, '\n'))
+	return err
+}
+
+// Close does nothing, the writer belongs to the caller.
+func (s *WriterSink) Close() error {
+	return nil
+}
+
+// FileSink writes every event as a line of JSON to a file, which is rotated
+// once it would grow over its maximum size. The rotated files are suffixed
+// with .1, .2 and so on, the oldest being removed.
+type FileSink struct {
+	mu         sync.Mutex
+	path       string
+	maxSize    int64
+	maxBackups int
+	file       *os.File
+	size       int64
+}
+
+// NewFileSink opens the file, appending to it when it exists.
+func NewFileSink(path string, maxSize int64, maxBackups int) (*FileSink, error) {
+	s := &FileSink{
+		path:       path,
+		maxSize:    maxSize,
+		maxBackups: maxBackups,
+	}
+
+	if err := s.open(); err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+func (s *FileSink) open() error {
+	file, err := os.OpenFile(s.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	s.file = file
+	s.size = info.Size()
+	return nil
+}
+
+// Write the event as a line of JSON, rotating the file first when needed.
+func (s *FileSink) Write(event Event) error {
+	blob, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	blob = append(blob, '\n')
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// The event is still written when the file cannot be rotated, to the
+	// file which was reopened
+	var rotateErr error
+	if s.size > 0 && s.size+int64(len(blob)) > s.maxSize {
+		rotateErr = s.rotate()
+	}
+
+	n, err := s.file.Write(blob)
+	s.size += int64(n)
+	if rotateErr != nil {
+		return rotateErr
+	}
+	return err
+}
+
+// rotate reopens the file whatever fails, so that it is never left closed.
+func (s *FileSink) rotate() error {
+	err := s.file.Close()
+	if err == nil {
+		err = s.shift()
+	}
+
+	if openErr := s.open(); openErr != nil {
+		return openErr
+	}
+	return err
+}
+
+func (s *FileSink) shift() error {
+	backup := func(index int) string {
+		return fmt.Sprintf("%s.%d", s.path, index)
+	}
+
+	if s.maxBackups > 0 {
+		os.Remove(backup(s.maxBackups))
+		for index := s.maxBackups - 1; index > 0; index-- {
+			os.Rename(backup(index), backup(index+1))
+		}
+		return os.Rename(s.path, backup(1))
+	}
+
+	return os.Remove(s.path)
+}
+
+// Close the file.
+func (s *FileSink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.file.Close()
+}
+
+// SyslogSink sends every event as JSON to syslog, with the auth facility.
+type SyslogSink struct {
+	writer *syslog.Writer
+}
+
+// NewSyslogSink connects to the syslog daemon at the address, or the local
+// one when the network and address are empty.
+func NewSyslogSink(network, address, tag string) (*SyslogSink, error) {
+	writer, err := syslog.Dial(network, address, syslog.LOG_INFO|syslog.LOG_AUTH, tag)
+	if err != nil {
+		return nil, err
+	}
+
+	return &SyslogSink{writer: writer}, nil
+}
+
+// Write the event as JSON.
+func (s *SyslogSink) Write(event Event) error {
+	blob, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	return s.writer.Info(string(blob))
+}
+
+// Close the connection to syslog.
+func (s *SyslogSink) Close() error {
+	return s.writer.Close()
+}
+
+// webhookQueueSize is how many events can wait to be sent to the webhook,
+// more are dropped rather than slowing down requests.
+const webhookQueueSize = 1024
+
+// WebhookSink POSTs every event as JSON to a URL, in the background so that
+// requests are never held up by the webhook. The events channel is never
+// closed, as requests still in flight may write to it while closing.
+type WebhookSink struct {
+	url       url.URL
+	client    *http.Client
+	logger    *logrus.Logger
+	events    chan Event
+	closing   chan struct{}
+	closeOnce sync.Once
+	done      chan struct{}
+}
+
+// NewWebhookSink starts sending events to the URL.
+func NewWebhookSink(u url.URL, timeout time.Duration, logger *logrus.Logger) *WebhookSink {
+	s := &WebhookSink{
+		url:     u,
+		client:  &http.Client{Timeout: timeout},
+		logger:  logger,
+		events:  make(chan Event, webhookQueueSize),
+		closing: make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+
+	go s.run()
+	return s
+}
+
+// Write queues the event, unless the sink is closed.
+func (s *WebhookSink) Write(event Event) error {
+	select {
+	case <-s.closing:
+		return fmt.Errorf("webhook sink is closed, dropped the event")
+	default:
+	}
+
+	select {
+	case s.events <- event:
+		return nil
+	default:
+		return fmt.Errorf("webhook queue is full, dropped the event")
+	}
+}
+
+// run sends the events until closed, then sends the ones left in the queue.
+func (s *WebhookSink) run() {
+	defer close(s.done)
+
+	for {
+		select {
+		case event := <-s.events:
+			s.deliver(event)
+		case <-s.closing:
+			for {
+				select {
+				case event := <-s.events:
+					s.deliver(event)
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+func (s *WebhookSink) deliver(event Event) {
+	if err := s.send(event); err != nil {
+		s.logger.WithFields(logrus.Fields{
+			"type":  event.Type,
+			"error": err,
+		}).Error("failed to send audit event to webhook")
+	}
+}
+
+func (s *WebhookSink) send(event Event) error {
+	blob, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	resp, err := s.client.Post(s.url.String(), "application/json", bytes.NewReader(blob))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= http.StatusBadRequest {
+		return fmt.Errorf("webhook responded with %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// Close sends the queued events, then stops. Events written afterwards are
+// dropped.
+func (s *WebhookSink) Close() error {
+	s.closeOnce.Do(func() {
+		close(s.closing)
+	})
+	<-s.done
+	return nil
+}
@@ -6,6 +6,7 @@ import (
 	"strings"
 	"time"
 
+	"github.com/alphagov/iap/pkg/metrics"
 	"github.com/go-redis/redis"
 	"github.com/sirupsen/logrus"
 )
@@ -45,6 +46,7 @@ func (a Client) Generate() (string, string, error) {
 	if err != nil {
 		return "", "", err
 	}
+	metrics.CredentialsGenerated.Inc()
 
 	return username, password, nil
 }
@@ -56,10 +58,13 @@ func (a Client) Valid(user, password string) bool {
 	pass, err := a.store.Get(fmt.Sprintf(UserSOCKS5Key, user)).Result()
 	if err != nil {
 		a.logger.WithField("user", user).Warningln("user not found")
+		metrics.CredentialsValidated.WithLabelValues(metrics.Generated, metrics.Failure).Inc()
 		return false
 	}
 
-	return password == pass
+	valid := password == pass
+	metrics.CredentialsValidated.WithLabelValues(metrics.Generated, metrics.Result(valid)).Inc()
+	return valid
 }
 
 func randomString(length int, variety ...string) string {
@@ -0,0 +1,133 @@
+package cfg
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/goware/urlx"
+
+	"github.com/alphagov/iap/pkg/audit"
+)
+
+// Example configuration file
+// ---
+// audit:
+//   sinks:
+//     - type: stdout
+//     - type: file
+//       path: /var/log/iap/audit.log
+//       max_size_mb: 100 # default
+//       max_backups: 5 # default
+//     - type: syslog
+//       network: udp # the local syslog daemon when empty
+//       address: syslog.internal:514
+//       tag: iap # default
+//     - type: webhook
+//       url: https://audit.internal/events
+//       timeout: 5s # default
+//
+// Every login, credential generation and validation, SOCKS5 connection, proxy
+// request and reverse proxy request is recorded as a JSON event.
+
+// AuditConfig represents an unvalidated audit configuration
+type AuditConfig struct {
+	Sinks []AuditSinkConfig `json:"sinks"`
+}
+
+// Validate does validation of AuditConfig
+func (c *AuditConfig) Validate() ([]audit.SinkConfig, error) {
+	sinks := make([]audit.SinkConfig, 0, len(c.Sinks))
+
+	for _, sinkConfig := range c.Sinks {
+		sink, err := sinkConfig.Validate()
+		if err != nil {
+			return nil, err
+		}
+		sinks = append(sinks, sink)
+	}
+
+	return sinks, nil
+}
+
+// AuditSinkConfig represents an unvalidated audit sink configuration
+type AuditSinkConfig struct {
+	Type string `json:"type"`
+
+	Path       string `json:"path"`
+	MaxSizeMB  int    `json:"max_size_mb"`
+	MaxBackups *int   `json:"max_backups"`
+
+	Network string `json:"network"`
+	Address string `json:"address"`
+	Tag     string `json:"tag"`
+
+	URL     string `json:"url"`
+	Timeout string `json:"timeout"`
+}
+
+// Validate does validation of AuditSinkConfig
+func (c *AuditSinkConfig) Validate() (audit.SinkConfig, error) {
+	cfg := audit.SinkConfig{Type: c.Type}
+
+	switch c.Type {
+	case audit.Stdout:
+		return cfg, nil
+
+	case audit.File:
+		if c.Path == "" {
+			return cfg, fmt.Errorf("Audit Sink Path must be given for file sinks")
+		}
+
+		maxSize, err := parseThreshold(c.MaxSizeMB, 100)
+		if err != nil {
+			return cfg, fmt.Errorf("Audit Sink MaxSizeMB %s", err)
+		}
+
+		maxBackups := 5
+		if c.MaxBackups != nil {
+			maxBackups = *c.MaxBackups
+		}
+
+		if maxBackups < 0 {
+			return cfg, fmt.Errorf("Audit Sink MaxBackups cannot be negative")
+		}
+
+		cfg.Path = c.Path
+		cfg.MaxSize = int64(maxSize) * 1024 * 1024
+		cfg.MaxBackups = maxBackups
+		return cfg, nil
+
+	case audit.Syslog:
+		if (c.Network == "") != (c.Address == "") {
+			return cfg, fmt.Errorf("Audit Sink Network and Address must be given together")
+		}
+
+		cfg.Network = c.Network
+		cfg.Address = c.Address
+		cfg.Tag = c.Tag
+		if cfg.Tag == "" {
+			cfg.Tag = "iap"
+		}
+		return cfg, nil
+
+	case audit.Webhook:
+		uri, err := urlx.ParseWithDefaultScheme(c.URL, "https")
+		if c.URL == "" || err != nil {
+			return cfg, fmt.Errorf("Audit Sink URL must be a valid URI")
+		}
+
+		timeout, err := parseDuration(c.Timeout, 5*time.Second)
+		if err != nil {
+			return cfg, fmt.Errorf("Audit Sink Timeout %s", err)
+		}
+
+		cfg.URL = *uri
+		cfg.Timeout = timeout
+		return cfg, nil
+	}
+
+	return cfg, fmt.Errorf(
+		"Audit Sink Type must be one of %s, %s, %s or %s",
+		audit.Stdout, audit.File, audit.Syslog, audit.Webhook,
+	)
+}
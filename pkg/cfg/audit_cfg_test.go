@@ -0,0 +1,77 @@
+package cfg
+
+import (
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/alphagov/iap/pkg/audit"
+)
+
+var _ = Describe("Audit Config", func() {
+	It("Parses a valid configuration and provides defaults", func() {
+		cfg := AuditConfig{Sinks: []AuditSinkConfig{
+			{Type: "stdout"},
+			{Type: "file", Path: "/var/log/iap/audit.log"},
+			{Type: "syslog"},
+			{Type: "webhook", URL: "audit.internal/events"},
+		}}
+		sinks, err := cfg.Validate()
+
+		Expect(err).NotTo(HaveOccurred())
+		Expect(sinks).To(HaveLen(4))
+		Expect(sinks[0].Type).To(Equal(audit.Stdout))
+		Expect(sinks[1].Path).To(Equal("/var/log/iap/audit.log"))
+		Expect(sinks[1].MaxSize).To(Equal(int64(100 * 1024 * 1024)))
+		Expect(sinks[1].MaxBackups).To(Equal(5))
+		Expect(sinks[2].Tag).To(Equal("iap"))
+		Expect(sinks[3].URL.String()).To(Equal("https://audit.internal/events"))
+		Expect(sinks[3].Timeout).To(Equal(5 * time.Second))
+	})
+
+	It("Keeps no backups when asked to", func() {
+		backups := 0
+		cfg := AuditSinkConfig{Type: "file", Path: "audit.log", MaxSizeMB: 10, MaxBackups: &backups}
+		sink, err := cfg.Validate()
+
+		Expect(err).NotTo(HaveOccurred())
+		Expect(sink.MaxSize).To(Equal(int64(10 * 1024 * 1024)))
+		Expect(sink.MaxBackups).To(Equal(0))
+	})
+
+	It("Does not validate an unknown type", func() {
+		cfg := AuditSinkConfig{Type: "kafka"}
+		_, err := cfg.Validate()
+
+		Expect(err).To(MatchError(ContainSubstring("Audit Sink Type must be one of stdout, file, syslog or webhook")))
+	})
+
+	It("Does not validate a file sink without a path", func() {
+		cfg := AuditSinkConfig{Type: "file"}
+		_, err := cfg.Validate()
+
+		Expect(err).To(MatchError(ContainSubstring("Audit Sink Path must be given for file sinks")))
+	})
+
+	It("Does not validate a syslog address without its network", func() {
+		cfg := AuditSinkConfig{Type: "syslog", Address: "syslog.internal:514"}
+		_, err := cfg.Validate()
+
+		Expect(err).To(MatchError(ContainSubstring("Audit Sink Network and Address must be given together")))
+	})
+
+	It("Does not validate a webhook without a URL", func() {
+		cfg := AuditSinkConfig{Type: "webhook"}
+		_, err := cfg.Validate()
+
+		Expect(err).To(MatchError(ContainSubstring("Audit Sink URL must be a valid URI")))
+	})
+
+	It("Does not validate an invalid webhook timeout", func() {
+		cfg := AuditSinkConfig{Type: "webhook", URL: "https://audit.internal", Timeout: "soon"}
+		_, err := cfg.Validate()
+
+		Expect(err).To(MatchError(ContainSubstring("Audit Sink Timeout")))
+	})
+})
@@ -1,17 +1,23 @@
 package cfg
 
 import (
+	"errors"
 	"fmt"
 
 	"github.com/ghodss/yaml"
 
+	"github.com/alphagov/iap/pkg/audit"
+	"github.com/alphagov/iap/pkg/clientcert"
 	"github.com/alphagov/iap/pkg/service"
+	"github.com/alphagov/iap/pkg/serviceaccount"
 	"github.com/alphagov/iap/pkg/user"
 )
 
 // Example configuration file ---
 // oidc: <oidc config>
 //
+// session: <session config>
+//
 // roles: [role1, role2]
 //
 // services:
@@ -19,79 +25,256 @@ import (
 //
 // users:
 //   user-identifier-1: <user config>
+//
+// allow_unlisted_users: false
+//
+// service_accounts:
+//   service-account-1: <service account config>
+//
+// client_certificates: <client certificates config>
+//
+// ssh_ca: <ssh ca config>
+//
+// client_ca: <client ca config>
+//
+// audit: <audit config>
+//
+// strict: true # warnings are errors
 
 // Config represents an unvalidated configuration
 type Config struct {
 	OIDCConfig OIDCConfig               `json:"oidc"`
+	Session    SessionConfig            `json:"session"`
 	Roles      []string                 `json:"roles"`
 	Services   map[string]ServiceConfig `json:"services"`
 	Users      map[string]UserConfig    `json:"users"`
+
+	// AllowUnlistedUsers lets anyone the OIDC provider or a client
+	// certificate identifies access the services which do not require any
+	// role, when they are not one of the users
+	AllowUnlistedUsers bool `json:"allow_unlisted_users"`
+
+	ServiceAccounts    map[string]ServiceAccountConfig `json:"service_accounts"`
+	ClientCertificates *ClientCertificatesConfig       `json:"client_certificates"`
+	SSHCA              *SSHCAConfig                    `json:"ssh_ca"`
+	ClientCA           *ClientCAConfig                 `json:"client_ca"`
+	Audit              *AuditConfig                    `json:"audit"`
+
+	// Strict rejects the configuration when it has any warnings
+	Strict bool `json:"strict"`
 }
 
 // ValidatedConfig represents a validated configuration
+//
+// Warnings contains problems which do not prevent the configuration from
+// being used, but should be reported to the operator, along with their YAML
+// path.
 type ValidatedConfig struct {
 	OIDCConfig ValidatedOIDCConfig
+	Session    ValidatedSessionConfig
 	Roles      []string
 	Services   map[string]service.Service
 	Users      map[string]user.User
+	Warnings   []string
+
+	// AllowUnlistedUsers is false when only the users can access services
+	AllowUnlistedUsers bool
+
+	ServiceAccounts map[string]serviceaccount.ServiceAccount
+
+	// ClientCertificates is nil when users cannot authenticate with certificates
+	ClientCertificates *clientcert.Identities
+
+	// SSHCA is nil when IAP does not issue SSH certificates
+	SSHCA *ValidatedSSHCAConfig
+
+	// ClientCA is nil when IAP does not issue client certificates
+	ClientCA *ValidatedClientCAConfig
+
+	// Audit is empty when decisions are not audited
+	Audit []audit.SinkConfig
 }
 
-// Validate does validation of MatcherConfig
+// Validate does validation of the whole configuration, returning every
+// problem found as Problems rather than only the first one. Warnings are
+// returned as problems too in strict mode.
 func (c *Config) Validate() (ValidatedConfig, error) {
-	cfg := ValidatedConfig{}
+	return c.validate(true)
+}
+
+// ValidateStatic does validation of the whole configuration without reading
+// any of the files it refers to, such as keys and certificates, so that it
+// can be checked where they are not available, eg: in CI. The validated
+// configuration is only good for explaining access, as it has none of them.
+func (c *Config) ValidateStatic() (ValidatedConfig, error) {
+	return c.validate(false)
+}
+
+func (c *Config) validate(load bool) (ValidatedConfig, error) {
+	problems := make(Problems, 0)
+	fail := func(path string, err error) {
+		var nested Problems
+		if errors.As(err, &nested) {
+			problems = append(problems, nested...)
+			return
+		}
+		problems = append(problems, Problem{Path: path, Message: err.Error()})
+	}
 
 	validatedOIDCConfig, err := c.OIDCConfig.Validate()
 	if err != nil {
-		return cfg, err
+		fail("oidc", err)
 	}
+	oidcValid := err == nil
+
+	validatedSessionConfig, err := c.Session.Validate()
+	if err != nil {
+		fail("session", err)
+	}
+	sessionValid := err == nil
 
 	validatedServices := make(map[string]service.Service)
 	for serviceIdentifier, serviceConfig := range c.Services {
-		validatedServiceConfig, err := serviceConfig.Validate(serviceIdentifier)
+		validatedServiceConfig, err := serviceConfig.validate(serviceIdentifier, load)
 
 		if err != nil {
-			return cfg, fmt.Errorf(
+			fail(yamlPath("services", serviceIdentifier), fmt.Errorf(
 				"Service %s is not valid %s", serviceIdentifier, err,
-			)
+			))
+			continue
 		}
 
 		validatedServices[serviceIdentifier] = validatedServiceConfig
 	}
 
+	problems = append(problems, matcherProblems(validatedServices)...)
+
+	if oidcValid && sessionValid {
+		problems = append(problems, cookieDomainProblems(
+			validatedOIDCConfig, validatedSessionConfig, validatedServices,
+		)...)
+	}
+
 	validatedUsers := make(map[string]user.User)
 	for userIdentifier, userConfig := range c.Users {
 		validatedUserConfig, err := userConfig.Validate(userIdentifier)
 
 		if err != nil {
-			return cfg, fmt.Errorf(
+			fail(yamlPath("users", userIdentifier), fmt.Errorf(
 				"User %s is not valid %s", userIdentifier, err,
-			)
+			))
+			continue
 		}
 
 		validatedUsers[userIdentifier] = validatedUserConfig
 	}
 
+	validatedServiceAccounts := make(map[string]serviceaccount.ServiceAccount)
+	for name, serviceAccountConfig := range c.ServiceAccounts {
+		validatedServiceAccount, err := serviceAccountConfig.validate(name, load)
+
+		if err != nil {
+			fail(yamlPath("service_accounts", name), fmt.Errorf(
+				"Service Account %s is not valid %s", name, err,
+			))
+			continue
+		}
+
+		validatedServiceAccounts[name] = validatedServiceAccount
+	}
+
+	var clientCertificates *clientcert.Identities
+	if c.ClientCertificates != nil {
+		clientCertificates, err = c.ClientCertificates.validate(load)
+		if err != nil {
+			fail("client_certificates", err)
+		}
+	}
+
+	var sshCA *ValidatedSSHCAConfig
+	if c.SSHCA != nil {
+		validatedSSHCA, err := c.SSHCA.validate(load)
+		if err != nil {
+			fail("ssh_ca", err)
+		}
+		sshCA = &validatedSSHCA
+	}
+
+	var clientCA *ValidatedClientCAConfig
+	if c.ClientCA != nil {
+		validatedClientCA, err := c.ClientCA.validate(load)
+		if err != nil {
+			fail("client_ca", err)
+		}
+		clientCA = &validatedClientCA
+	}
+
+	var auditSinks []audit.SinkConfig
+	if c.Audit != nil {
+		auditSinks, err = c.Audit.Validate()
+		if err != nil {
+			fail("audit", err)
+		}
+	}
+
+	warnings := append(
+		publicPathWarnings(validatedServices),
+		insecureTLSWarnings(validatedServices)...,
+	)
+	warnings = append(warnings, expiredServiceAccountWarnings(validatedServiceAccounts)...)
+	warnings = append(warnings, roleWarnings(c.Roles, validatedServices, validatedUsers, validatedServiceAccounts)...)
+
+	if c.Strict {
+		problems = append(problems, warnings...)
+		warnings = Problems{}
+	}
+
+	if len(problems) > 0 {
+		problems.sort()
+		return ValidatedConfig{}, problems
+	}
+
+	warnings.sort()
+
 	return ValidatedConfig{
 		OIDCConfig: validatedOIDCConfig,
+		Session:    validatedSessionConfig,
 		Roles:      c.Roles,
 		Services:   validatedServices,
 		Users:      validatedUsers,
+		Warnings:   warnings.Strings(),
+
+		AllowUnlistedUsers: c.AllowUnlistedUsers,
+
+		ServiceAccounts:    validatedServiceAccounts,
+		ClientCertificates: clientCertificates,
+		SSHCA:              sshCA,
+		ClientCA:           clientCA,
+		Audit:              auditSinks,
 	}, nil
 }
 
-// ParseAndValidateConfig parses and validates configuration from a string
-func ParseAndValidateConfig(config string) (ValidatedConfig, error) {
+// Parse reads the configuration from a string without validating it.
+func Parse(config string) (Config, error) {
 	cfg := Config{}
-	err := yaml.Unmarshal([]byte(config), &cfg)
+	if err := yaml.Unmarshal([]byte(config), &cfg); err != nil {
+		return Config{}, fmt.Errorf("Could not unmarshal config: %s", err)
+	}
 
+	return cfg, nil
+}
+
+// ParseAndValidateConfig parses and validates configuration from a string
+func ParseAndValidateConfig(config string) (ValidatedConfig, error) {
+	cfg, err := Parse(config)
 	if err != nil {
-		return ValidatedConfig{}, fmt.Errorf("Could not unmarshal config: %s", err)
+		return ValidatedConfig{}, err
 	}
 
 	validatedCfg, err := cfg.Validate()
 
 	if err != nil {
-		return ValidatedConfig{}, fmt.Errorf("Could not validate config: %s", err)
+		return ValidatedConfig{}, fmt.Errorf("Could not validate config: %w", err)
 	}
 
 	return validatedCfg, nil
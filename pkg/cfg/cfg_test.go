@@ -1,6 +1,8 @@
 package cfg
 
 import (
+	"errors"
+
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
 
@@ -35,6 +37,8 @@ var _ = Describe("Config", func() {
 				ClientSecret: "my-client-secret",
 			},
 
+			Session: SessionConfig{CookieDomain: "mydomain.com"},
+
 			Roles: []string{"superuser", "readonlyuser"},
 
 			Services: map[string]ServiceConfig{
@@ -92,6 +96,8 @@ var _ = Describe("Config from String", func() {
       identifier_claim: email
       client_id: foo-0000-1111.apps.googleusercontent.com
       client_secret: abcd-0000-1111
+    session:
+      cookie_domain: mydomain.com
     roles:
       - superuser
       - readonlyuser
@@ -129,3 +135,263 @@ var _ = Describe("Config from String", func() {
 		Expect(validatedCfg.Users).To(HaveLen(2))
 	})
 })
+
+var _ = Describe("Config matchers", func() {
+	validate := func(services map[string]ServiceConfig) (ValidatedConfig, error) {
+		cfg := Config{
+			OIDCConfig: OIDCConfig{
+				RedirectURI: "https://iap.mydomain.com/oidc/callback",
+
+				AuthURI:  "https://accounts.google.com/o/oauth2/v2/auth",
+				TokenURI: "https://www.googleapis.com/oauth2/v4/token",
+
+				ClientID:     "my-client-id",
+				ClientSecret: "my-client-secret",
+			},
+			Session:  SessionConfig{CookieDomain: "mydomain.com"},
+			Services: services,
+		}
+
+		return cfg.Validate()
+	}
+
+	It("Accepts an exact host which is also matched by a pattern", func() {
+		_, err := validate(map[string]ServiceConfig{
+			"previews": ServiceConfig{
+				UpstreamURI: "http://$1.previews.internal",
+				Matchers:    []MatcherConfig{MatcherConfig{Host: "*.preview.mydomain.com"}},
+			},
+			"docs": ServiceConfig{
+				UpstreamURI: "http://docs.internal",
+				Matchers:    []MatcherConfig{MatcherConfig{Host: "docs.preview.mydomain.com"}},
+			},
+		})
+
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	It("Rejects the same host in different services", func() {
+		_, err := validate(map[string]ServiceConfig{
+			"my-service": ServiceConfig{
+				UpstreamURI: "http://my-service.local",
+				Matchers:    []MatcherConfig{MatcherConfig{Host: "my-service.mydomain.com"}},
+			},
+			"my-other-service": ServiceConfig{
+				UpstreamURI: "http://my-other-service.local",
+				Matchers:    []MatcherConfig{MatcherConfig{Host: "My-Service.mydomain.com"}},
+			},
+		})
+
+		Expect(err).To(MatchError(ContainSubstring(
+			"Host my-service.mydomain.com is matched by both services",
+		)))
+	})
+
+	It("Rejects overlapping patterns", func() {
+		_, err := validate(map[string]ServiceConfig{
+			"previews": ServiceConfig{
+				UpstreamURI: "http://$1.previews.internal",
+				Matchers:    []MatcherConfig{MatcherConfig{Host: "*.preview.mydomain.com"}},
+			},
+			"review-apps": ServiceConfig{
+				UpstreamURI: "http://pr-$1.internal",
+				Matchers: []MatcherConfig{
+					MatcherConfig{HostPattern: `pr-(\d+)\.preview\.mydomain\.com`},
+				},
+			},
+		})
+
+		Expect(err).To(MatchError(ContainSubstring(
+			`services.review-apps.matchers[0]: Host pattern ^(?i:pr-(\d+)\.preview\.mydomain\.com)$ of service review-apps ` +
+				`overlaps with ^([a-z0-9-]+)\.preview\.mydomain\.com$ of service previews`,
+		)))
+	})
+
+	It("Rejects patterns which only overlap on some hosts", func() {
+		_, err := validate(map[string]ServiceConfig{
+			"a-apps": ServiceConfig{
+				UpstreamURI: "http://a.internal",
+				Matchers:    []MatcherConfig{MatcherConfig{HostPattern: `a.*\.mydomain\.com`}},
+			},
+			"b-apps": ServiceConfig{
+				UpstreamURI: "http://b.internal",
+				Matchers:    []MatcherConfig{MatcherConfig{HostPattern: `.*b\.mydomain\.com`}},
+			},
+		})
+
+		Expect(err).To(MatchError(ContainSubstring("overlaps with")))
+	})
+
+	It("Reports a pattern overlapping with several others once", func() {
+		_, err := validate(map[string]ServiceConfig{
+			"previews": ServiceConfig{
+				UpstreamURI: "http://$1.previews.internal",
+				Matchers:    []MatcherConfig{MatcherConfig{Host: "*.preview.mydomain.com"}},
+			},
+			"review-apps": ServiceConfig{
+				UpstreamURI: "http://pr-$1.internal",
+				Matchers: []MatcherConfig{
+					MatcherConfig{HostPattern: `pr-(\d+)\.preview\.mydomain\.com`},
+				},
+			},
+			"staging-apps": ServiceConfig{
+				UpstreamURI: "http://pr-$1.staging.internal",
+				Matchers: []MatcherConfig{
+					MatcherConfig{HostPattern: `pr-(\d+)\.preview\.mydomain\.com`},
+				},
+			},
+		})
+
+		var problems Problems
+		Expect(errors.As(err, &problems)).To(BeTrue())
+		Expect(problems).To(HaveLen(2))
+		Expect(problems[1].Path).To(Equal("services.staging-apps.matchers[0]"))
+		Expect(problems[1].Message).To(ContainSubstring("of service previews, "))
+		Expect(problems[1].Message).To(ContainSubstring("of service review-apps"))
+	})
+
+	It("Accepts patterns which do not overlap", func() {
+		_, err := validate(map[string]ServiceConfig{
+			"previews": ServiceConfig{
+				UpstreamURI: "http://$1.previews.internal",
+				Matchers:    []MatcherConfig{MatcherConfig{Host: "*.preview.mydomain.com"}},
+			},
+			"review-apps": ServiceConfig{
+				UpstreamURI: "http://pr-$1.internal",
+				Matchers: []MatcherConfig{
+					MatcherConfig{HostPattern: `pr-(\d+)\.review\.mydomain\.com`},
+				},
+			},
+		})
+
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	It("Accepts services sharing a host under different path prefixes", func() {
+		_, err := validate(map[string]ServiceConfig{
+			"tools": ServiceConfig{
+				UpstreamURI: "http://tools.local",
+				Matchers:    []MatcherConfig{MatcherConfig{Host: "tools.mydomain.com"}},
+			},
+			"grafana": ServiceConfig{
+				UpstreamURI: "http://grafana.local",
+				Matchers: []MatcherConfig{
+					MatcherConfig{Host: "tools.mydomain.com", PathPrefix: "/grafana"},
+				},
+			},
+		})
+
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	It("Rejects services sharing a host under the same path prefix", func() {
+		_, err := validate(map[string]ServiceConfig{
+			"tools": ServiceConfig{
+				UpstreamURI: "http://tools.local",
+				Matchers: []MatcherConfig{
+					MatcherConfig{Host: "tools.mydomain.com", PathPrefix: "/grafana/"},
+				},
+			},
+			"grafana": ServiceConfig{
+				UpstreamURI: "http://grafana.local",
+				Matchers: []MatcherConfig{
+					MatcherConfig{Host: "tools.mydomain.com", PathPrefix: "/grafana"},
+				},
+			},
+		})
+
+		Expect(err).To(MatchError(ContainSubstring(
+			"Host tools.mydomain.com/grafana is matched by both services",
+		)))
+	})
+})
+
+var _ = Describe("Config public paths", func() {
+	It("Warns when a public path makes the whole service public", func() {
+		config := dedent.Dedent(`
+    oidc:
+      redirect_uri: https://iap.mydomain.com/oidc/callback
+      auth_uri: https://accounts.google.com/o/oauth2/v2/auth
+      token_uri: https://www.googleapis.com/oauth2/v4/token
+      client_id: foo-0000-1111.apps.googleusercontent.com
+      client_secret: abcd-0000-1111
+    session:
+      cookie_domain: mydomain.com
+    services:
+      my-service:
+        upstream_uri: http://my-service.local
+        matchers:
+          - host: my-service.mydomain.com
+        public_paths:
+          - path: /healthcheck
+          - prefix: /
+		`)
+
+		validatedCfg, err := ParseAndValidateConfig(config)
+
+		Expect(err).NotTo(HaveOccurred())
+		Expect(validatedCfg.Services["my-service"].PublicPaths).To(HaveLen(2))
+		Expect(validatedCfg.Warnings).To(ConsistOf(
+			"services.my-service.public_paths[1]: Service my-service Public Path 1 makes every path public",
+		))
+	})
+})
+
+var _ = Describe("Config without reading files", func() {
+	config := dedent.Dedent(`
+    oidc:
+      redirect_uri: https://iap.mydomain.com/oidc/callback
+      auth_uri: https://accounts.google.com/o/oauth2/v2/auth
+      token_uri: https://www.googleapis.com/oauth2/v4/token
+      client_id: foo-0000-1111.apps.googleusercontent.com
+      client_secret: abcd-0000-1111
+    session:
+      cookie_domain: mydomain.com
+    services:
+      my-service:
+        upstream_uri: https://my-service.internal
+        matchers:
+          - host: my-service.mydomain.com
+        tls:
+          ca_file: /nonexistent/internal-ca.pem
+          cert_file: /nonexistent/iap-client.pem
+          key_file: /nonexistent/iap-client-key.pem
+    service_accounts:
+      deploy-bot:
+        api_key_file: /nonexistent/deploy-bot.keys
+    client_certificates:
+      ca_file: /nonexistent/client-ca.pem
+      mappings:
+        - field: email_san
+    ssh_ca:
+      key_file: /nonexistent/ssh-ca
+    client_ca:
+      cert_file: /nonexistent/client-ca.pem
+      key_file: /nonexistent/client-ca-key.pem
+	`)
+
+	It("Reads the files when validating", func() {
+		parsed, err := Parse(config)
+		Expect(err).NotTo(HaveOccurred())
+
+		_, err = parsed.Validate()
+		Expect(err).To(MatchError(ContainSubstring("ssh_ca: SSH CA KeyFile could not be read")))
+		Expect(err).To(MatchError(ContainSubstring("client_ca: Client CA could not be loaded")))
+		Expect(err).To(MatchError(ContainSubstring("Service Account APIKeyFile could not be read")))
+		Expect(err).To(MatchError(ContainSubstring("TLS CAFile could not be read")))
+	})
+
+	It("Only checks the files are given when validating statically", func() {
+		parsed, err := Parse(config)
+		Expect(err).NotTo(HaveOccurred())
+
+		validatedCfg, err := parsed.ValidateStatic()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(validatedCfg.SSHCA.Signer).To(BeNil())
+		Expect(validatedCfg.ClientCA.Key).To(BeNil())
+
+		parsed.SSHCA.KeyFile = ""
+		_, err = parsed.ValidateStatic()
+		Expect(err).To(MatchError(ContainSubstring("ssh_ca: SSH CA KeyFile must be given")))
+	})
+})
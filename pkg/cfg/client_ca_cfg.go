@@ -0,0 +1,91 @@
+package cfg
+
+import (
+	"crypto"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"time"
+
+	"github.com/alphagov/iap/pkg/clientcert"
+)
+
+// Example configuration file
+// ---
+// client_ca:
+//   cert_file: /etc/iap/client-ca.pem
+//   key_file: /etc/iap/client-ca-key.pem
+//   validity: 1h # at most 8h
+//
+// Logged in users can get a client certificate from this CA, which the proxy
+// and socks5 commands accept in place of a username and password.
+
+// ClientCAConfig represents an unvalidated client certificate CA configuration
+type ClientCAConfig struct {
+	CertFile string `json:"cert_file"`
+	KeyFile  string `json:"key_file"`
+	Validity string `json:"validity"`
+}
+
+// ValidatedClientCAConfig represents a validated client certificate CA configuration
+type ValidatedClientCAConfig struct {
+	Certificate *x509.Certificate
+	Key         crypto.Signer
+	Validity    time.Duration
+}
+
+// Validate does validation of ClientCAConfig, loading the CA
+func (c *ClientCAConfig) Validate() (ValidatedClientCAConfig, error) {
+	return c.validate(true)
+}
+
+// validate does validation of ClientCAConfig, without a Certificate and Key
+// unless the CA is loaded
+func (c *ClientCAConfig) validate(load bool) (ValidatedClientCAConfig, error) {
+	cfg := ValidatedClientCAConfig{}
+
+	if c.CertFile == "" || c.KeyFile == "" {
+		return cfg, fmt.Errorf("Client CA CertFile and KeyFile must be given")
+	}
+
+	var (
+		certificate *x509.Certificate
+		key         crypto.Signer
+	)
+	if load {
+		keyPair, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+		if err != nil {
+			return cfg, fmt.Errorf("Client CA could not be loaded: %s", err)
+		}
+
+		certificate, err = x509.ParseCertificate(keyPair.Certificate[0])
+		if err != nil {
+			return cfg, fmt.Errorf("Client CA could not be loaded: %s", err)
+		}
+
+		if !certificate.IsCA {
+			return cfg, fmt.Errorf("Client CA CertFile must be a CA certificate")
+		}
+
+		var ok bool
+		key, ok = keyPair.PrivateKey.(crypto.Signer)
+		if !ok {
+			return cfg, fmt.Errorf("Client CA KeyFile must contain a signing key")
+		}
+	}
+
+	validity, err := parseDuration(c.Validity, time.Hour)
+	if err != nil {
+		return cfg, fmt.Errorf("Client CA Validity %s", err)
+	}
+
+	if validity > clientcert.MaxValidity {
+		return cfg, fmt.Errorf("Client CA Validity cannot be longer than %s", clientcert.MaxValidity)
+	}
+
+	return ValidatedClientCAConfig{
+		Certificate: certificate,
+		Key:         key,
+		Validity:    validity,
+	}, nil
+}
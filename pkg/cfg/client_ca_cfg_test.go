@@ -0,0 +1,67 @@
+package cfg
+
+import (
+	"io/ioutil"
+	"os"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Client CA Config", func() {
+	var (
+		dir      string
+		certFile string
+		keyFile  string
+	)
+
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "iap-client-ca")
+		Expect(err).NotTo(HaveOccurred())
+
+		certFile, keyFile = writeCertificate(dir)
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(dir)
+	})
+
+	It("Parses a valid configuration with defaults", func() {
+		cfg := ClientCAConfig{CertFile: certFile, KeyFile: keyFile}
+		validatedCfg, err := cfg.Validate()
+
+		Expect(err).NotTo(HaveOccurred())
+		Expect(validatedCfg.Certificate.IsCA).To(BeTrue())
+		Expect(validatedCfg.Key).NotTo(BeNil())
+		Expect(validatedCfg.Validity).To(Equal(time.Hour))
+	})
+
+	It("Does not validate a validity longer than the credentials", func() {
+		cfg := ClientCAConfig{CertFile: certFile, KeyFile: keyFile, Validity: "24h"}
+		_, err := cfg.Validate()
+
+		Expect(err).To(MatchError(ContainSubstring("Client CA Validity cannot be longer than 8h0m0s")))
+	})
+
+	It("Does not validate a CA without its key", func() {
+		cfg := ClientCAConfig{CertFile: certFile}
+		_, err := cfg.Validate()
+
+		Expect(err).To(MatchError(ContainSubstring("Client CA CertFile and KeyFile must be given")))
+	})
+
+	It("Does not validate a key which does not match the certificate", func() {
+		otherDir, err := ioutil.TempDir("", "iap-client-ca")
+		Expect(err).NotTo(HaveOccurred())
+		defer os.RemoveAll(otherDir)
+
+		_, otherKeyFile := writeCertificate(otherDir)
+
+		cfg := ClientCAConfig{CertFile: certFile, KeyFile: otherKeyFile}
+		_, err = cfg.Validate()
+
+		Expect(err).To(MatchError(ContainSubstring("Client CA could not be loaded")))
+	})
+})
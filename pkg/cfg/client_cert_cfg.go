@@ -0,0 +1,142 @@
+package cfg
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"regexp"
+
+	"github.com/alphagov/iap/pkg/clientcert"
+)
+
+// Example configuration file
+// ---
+// client_certificates:
+//   ca_file: /etc/iap/clients-ca.pem
+//   mappings:
+//     - field: email_san # common_name, dns_san, email_san or uri_san
+//     - field: dns_san
+//       pattern: (.+)\.machines\.mydomain\.com
+//       identifier: $1@machines.mydomain.com
+//
+// The identifier of the first matching mapping is looked up in users for its
+// roles, like the identifiers given by the OIDC provider.
+
+// ClientCertificateMappingConfig represents an unvalidated Mapping configuration
+type ClientCertificateMappingConfig struct {
+	Field      string `json:"field"`
+	Pattern    string `json:"pattern"`
+	Identifier string `json:"identifier"`
+}
+
+// Validate does validation of ClientCertificateMappingConfig
+func (c *ClientCertificateMappingConfig) Validate() (clientcert.Mapping, error) {
+	cfg := clientcert.Mapping{}
+
+	switch c.Field {
+	case clientcert.CommonName, clientcert.DNSName, clientcert.EmailAddress, clientcert.URI:
+	default:
+		return cfg, fmt.Errorf(
+			"Mapping Field must be one of %s, %s, %s or %s",
+			clientcert.CommonName, clientcert.DNSName, clientcert.EmailAddress, clientcert.URI,
+		)
+	}
+
+	if c.Pattern == "" && c.Identifier != "" {
+		return cfg, fmt.Errorf("Mapping Identifier requires a Pattern")
+	}
+
+	var pattern *regexp.Regexp
+	if c.Pattern != "" {
+		var err error
+		pattern, err = regexp.Compile(c.Pattern)
+		if err != nil {
+			return cfg, fmt.Errorf("Mapping Pattern must be a valid regular expression: %s", err)
+		}
+	}
+
+	return clientcert.Mapping{
+		Field:      c.Field,
+		Pattern:    pattern,
+		Identifier: c.Identifier,
+	}, nil
+}
+
+// ClientCertificatesConfig represents an unvalidated client certificate configuration
+type ClientCertificatesConfig struct {
+	CAFile   string                           `json:"ca_file"`
+	Mappings []ClientCertificateMappingConfig `json:"mappings"`
+}
+
+// Validate does validation of ClientCertificatesConfig, loading the CAs
+func (c *ClientCertificatesConfig) Validate() (*clientcert.Identities, error) {
+	return c.validate(true)
+}
+
+// validate does validation of ClientCertificatesConfig, without the CAs
+// unless they are loaded
+func (c *ClientCertificatesConfig) validate(load bool) (*clientcert.Identities, error) {
+	if c.CAFile == "" {
+		return nil, fmt.Errorf("Client Certificates CAFile must be given")
+	}
+
+	var cas []*x509.Certificate
+	if load {
+		var err error
+		cas, err = readCertificates(c.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("Client Certificates CAFile %s", err)
+		}
+	}
+
+	if len(c.Mappings) == 0 {
+		return nil, fmt.Errorf("Client Certificates must have at least one Mapping")
+	}
+
+	mappings := make([]clientcert.Mapping, 0, len(c.Mappings))
+	for index, mappingConfig := range c.Mappings {
+		mapping, err := mappingConfig.Validate()
+		if err != nil {
+			return nil, fmt.Errorf("Client Certificates Mapping %d %s", index, err)
+		}
+		mappings = append(mappings, mapping)
+	}
+
+	return &clientcert.Identities{
+		CAs:      cas,
+		Mappings: mappings,
+	}, nil
+}
+
+// readCertificates reads every PEM certificate of the file
+func readCertificates(path string) ([]*x509.Certificate, error) {
+	blob, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not be read: %s", err)
+	}
+
+	certificates := make([]*x509.Certificate, 0)
+	for {
+		var block *pem.Block
+		block, blob = pem.Decode(blob)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+
+		certificate, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("contains an invalid certificate: %s", err)
+		}
+		certificates = append(certificates, certificate)
+	}
+
+	if len(certificates) == 0 {
+		return nil, fmt.Errorf("does not contain any PEM certificates")
+	}
+
+	return certificates, nil
+}
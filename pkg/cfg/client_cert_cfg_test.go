@@ -0,0 +1,86 @@
+package cfg
+
+import (
+	"io/ioutil"
+	"os"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/alphagov/iap/pkg/clientcert"
+)
+
+var _ = Describe("Client Certificates Config", func() {
+	var (
+		dir    string
+		caFile string
+	)
+
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "iap-client-certs")
+		Expect(err).NotTo(HaveOccurred())
+
+		caFile, _ = writeCertificate(dir)
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(dir)
+	})
+
+	It("Parses a valid configuration", func() {
+		cfg := ClientCertificatesConfig{
+			CAFile: caFile,
+			Mappings: []ClientCertificateMappingConfig{
+				{Field: "email_san"},
+				{Field: "dns_san", Pattern: `(.+)\.machines\.mydomain\.com`, Identifier: "$1"},
+			},
+		}
+
+		identities, err := cfg.Validate()
+
+		Expect(err).NotTo(HaveOccurred())
+		Expect(identities.CAs).To(HaveLen(1))
+		Expect(identities.Mappings).To(HaveLen(2))
+		Expect(identities.Mappings[0].Field).To(Equal(clientcert.EmailAddress))
+		Expect(identities.Mappings[0].Pattern).To(BeNil())
+		Expect(identities.Mappings[1].Pattern.String()).To(Equal(`(.+)\.machines\.mydomain\.com`))
+	})
+
+	It("Does not validate a configuration without a CA file", func() {
+		cfg := ClientCertificatesConfig{
+			Mappings: []ClientCertificateMappingConfig{{Field: "email_san"}},
+		}
+		_, err := cfg.Validate()
+
+		Expect(err).To(MatchError(ContainSubstring("Client Certificates CAFile must be given")))
+	})
+
+	It("Does not validate a configuration without mappings", func() {
+		cfg := ClientCertificatesConfig{CAFile: caFile}
+		_, err := cfg.Validate()
+
+		Expect(err).To(MatchError(ContainSubstring(
+			"Client Certificates must have at least one Mapping",
+		)))
+	})
+
+	It("Does not validate an unknown field", func() {
+		cfg := ClientCertificatesConfig{
+			CAFile:   caFile,
+			Mappings: []ClientCertificateMappingConfig{{Field: "serial_number"}},
+		}
+		_, err := cfg.Validate()
+
+		Expect(err).To(MatchError(ContainSubstring(
+			"Client Certificates Mapping 0 Mapping Field must be one of",
+		)))
+	})
+
+	It("Does not validate an identifier without a pattern", func() {
+		cfg := ClientCertificateMappingConfig{Field: "common_name", Identifier: "$1"}
+		_, err := cfg.Validate()
+
+		Expect(err).To(MatchError(ContainSubstring("Mapping Identifier requires a Pattern")))
+	})
+})
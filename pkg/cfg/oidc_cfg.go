@@ -3,6 +3,8 @@ package cfg
 import (
 	"fmt"
 	"net/url"
+	"path"
+	"strings"
 
 	"github.com/goware/urlx"
 )
@@ -18,6 +20,13 @@ import (
 //   scopes: [openid, email]
 //   identifier_claim: email
 //
+//   # Bearer tokens are accepted when the JWKS URI is given, along with the
+//   # issuer they must have been issued by, which ID tokens are checked
+//   # against too when given
+//   jwks_uri: https://www.googleapis.com/oauth2/v3/certs
+//   issuer: https://accounts.google.com
+//   audiences: [my-audience] # defaults to the client id
+//
 //   client_id: foo-0000-1111.apps.googleusercontent.com
 //   client_secret: abcd00001111
 
@@ -31,6 +40,10 @@ type OIDCConfig struct {
 	Scopes          []string `json:"scopes"`
 	IdentifierClaim string   `json:"identifier_claim"`
 
+	JWKSURI   string   `json:"jwks_uri"`
+	Issuer    string   `json:"issuer"`
+	Audiences []string `json:"audiences"`
+
 	ClientID     string `json:"client_id"`
 	ClientSecret string `json:"client_secret"`
 }
@@ -45,27 +58,68 @@ type ValidatedOIDCConfig struct {
 	Scopes          []string
 	IdentifierClaim string
 
+	// JWKSURI is nil when bearer tokens are not accepted
+	JWKSURI   *url.URL
+	Issuer    string
+	Audiences []string
+
 	ClientID     string
 	ClientSecret string
 }
 
-// Validate does validation of OIDCConfig
+// reservedPaths are served by IAP itself, so cannot be the path of the
+// callback. The ones ending with a slash reserve every path below them too.
+var reservedPaths = []string{
+	"/healthcheck", "/livez", "/readyz",
+	"/oidc/login", "/auth/forward", "/socks5/generate",
+	"/ssh/", "/certificates/",
+}
+
+func isReservedPath(p string) bool {
+	p = path.Clean(p)
+	for _, reserved := range reservedPaths {
+		if p == strings.TrimSuffix(reserved, "/") ||
+			(strings.HasSuffix(reserved, "/") && strings.HasPrefix(p, reserved)) {
+			return true
+		}
+	}
+	return false
+}
+
+// Validate does validation of OIDCConfig, returning a problem for every field
+// which is not valid
 func (c *OIDCConfig) Validate() (ValidatedOIDCConfig, error) {
-	cfg := ValidatedOIDCConfig{}
+	problems := make(Problems, 0)
+	fail := func(field, format string, args ...interface{}) {
+		problems = append(problems, Problem{
+			Path:    yamlPath("oidc", field),
+			Message: fmt.Sprintf(format, args...),
+		})
+	}
 
 	redirectURI, err := urlx.Parse(c.RedirectURI)
 	if err != nil {
-		return cfg, fmt.Errorf("OIDC RedirectURI must be a valid URI: %s", err)
+		fail("redirect_uri", "OIDC RedirectURI must be a valid URI: %s", err)
+	} else if redirectURI.Path == "" || redirectURI.Path == "/" {
+		fail("redirect_uri", "OIDC RedirectURI must have a path for the callback")
+	} else if isReservedPath(redirectURI.Path) {
+		fail("redirect_uri", "OIDC RedirectURI path %s is already served by IAP", redirectURI.Path)
+	} else if strings.ContainsAny(redirectURI.Path, "{}") {
+		fail("redirect_uri", "OIDC RedirectURI path must not contain { or }")
 	}
 
 	authURI, err := urlx.Parse(c.AuthURI)
 	if err != nil {
-		return cfg, fmt.Errorf("OIDC AuthURI must be a valid URI: %s", err)
+		fail("auth_uri", "OIDC AuthURI must be a valid URI: %s", err)
 	}
 
+	// The signature of the ID token is not verified, as it is trusted for
+	// coming straight from the token endpoint
 	tokenURI, err := urlx.Parse(c.TokenURI)
 	if err != nil {
-		return cfg, fmt.Errorf("OIDC TokenURI must be a valid URI: %s", err)
+		fail("token_uri", "OIDC TokenURI must be a valid URI: %s", err)
+	} else if tokenURI.Scheme != "https" {
+		fail("token_uri", "OIDC TokenURI must be https")
 	}
 
 	scopes := c.Scopes
@@ -79,11 +133,34 @@ func (c *OIDCConfig) Validate() (ValidatedOIDCConfig, error) {
 	}
 
 	if c.ClientID == "" {
-		return cfg, fmt.Errorf("OIDC ClientID must be present")
+		fail("client_id", "OIDC ClientID must be present")
 	}
 
 	if c.ClientSecret == "" {
-		return cfg, fmt.Errorf("OIDC ClientSecret must be present")
+		fail("client_secret", "OIDC ClientSecret must be present")
+	}
+
+	var jwksURI *url.URL
+	if c.JWKSURI != "" {
+		jwksURI, err = urlx.Parse(c.JWKSURI)
+		if err != nil {
+			fail("jwks_uri", "OIDC JWKSURI must be a valid URI: %s", err)
+		}
+
+		// Any token signed by the provider would be accepted otherwise,
+		// including the ones it issues for other tenants
+		if c.Issuer == "" {
+			fail("issuer", "OIDC Issuer must be present when JWKSURI is")
+		}
+	}
+
+	if len(problems) > 0 {
+		return ValidatedOIDCConfig{}, problems
+	}
+
+	audiences := c.Audiences
+	if len(audiences) == 0 {
+		audiences = []string{c.ClientID}
 	}
 
 	return ValidatedOIDCConfig{
@@ -95,6 +172,10 @@ func (c *OIDCConfig) Validate() (ValidatedOIDCConfig, error) {
 		Scopes:          scopes,
 		IdentifierClaim: identifierClaim,
 
+		JWKSURI:   jwksURI,
+		Issuer:    c.Issuer,
+		Audiences: audiences,
+
 		ClientID:     c.ClientID,
 		ClientSecret: c.ClientSecret,
 	}, nil
@@ -57,6 +57,94 @@ var _ = Describe("OIDC Config", func() {
 
 		Expect(err).NotTo(HaveOccurred())
 		Expect(validatedCfg.Scopes).To(ConsistOf("openid", "email"))
+		Expect(validatedCfg.JWKSURI).To(BeNil())
+		Expect(validatedCfg.Audiences).To(ConsistOf("my-client-id"))
+	})
+
+	It("Parses the settings for bearer tokens", func() {
+		cfg := OIDCConfig{
+			RedirectURI: "https://iap.mydomain.com/oidc/callback",
+
+			AuthURI:  "https://accounts.google.com/o/oauth2/v2/auth",
+			TokenURI: "https://www.googleapis.com/oauth2/v4/token",
+
+			JWKSURI:   "https://www.googleapis.com/oauth2/v3/certs",
+			Issuer:    "https://accounts.google.com",
+			Audiences: []string{"my-audience"},
+
+			ClientID:     "my-client-id",
+			ClientSecret: "my-client-secret",
+		}
+
+		validatedCfg, err := cfg.Validate()
+
+		Expect(err).NotTo(HaveOccurred())
+		Expect(validatedCfg.JWKSURI.String()).To(Equal("https://www.googleapis.com/oauth2/v3/certs"))
+		Expect(validatedCfg.Issuer).To(Equal("https://accounts.google.com"))
+		Expect(validatedCfg.Audiences).To(ConsistOf("my-audience"))
+	})
+
+	It("Does not validate bearer tokens without an issuer", func() {
+		cfg := OIDCConfig{
+			RedirectURI: "https://iap.mydomain.com/oidc/callback",
+
+			AuthURI:  "https://accounts.google.com/o/oauth2/v2/auth",
+			TokenURI: "https://www.googleapis.com/oauth2/v4/token",
+
+			JWKSURI: "https://www.googleapis.com/oauth2/v3/certs",
+
+			ClientID:     "my-client-id",
+			ClientSecret: "my-client-secret",
+		}
+
+		_, err := cfg.Validate()
+
+		Expect(err).To(MatchError(
+			ContainSubstring("OIDC Issuer must be present when JWKSURI is"),
+		))
+	})
+
+	It("Does not validate a configuration with a redirect uri without a path", func() {
+		cfg := OIDCConfig{
+			RedirectURI: "https://iap.mydomain.com",
+
+			AuthURI:  "https://accounts.google.com/o/oauth2/v2/auth",
+			TokenURI: "https://www.googleapis.com/oauth2/v4/token",
+
+			ClientID:     "my-client-id",
+			ClientSecret: "my-client-secret",
+		}
+
+		_, err := cfg.Validate()
+
+		Expect(err).To(MatchError(
+			ContainSubstring("OIDC RedirectURI must have a path for the callback"),
+		))
+	})
+
+	It("Does not validate a configuration with a redirect uri path served by IAP", func() {
+		for _, redirectURI := range []string{
+			"https://iap.mydomain.com/livez",
+			"https://iap.mydomain.com/oidc/login",
+			"https://iap.mydomain.com/ssh/callback",
+			"https://iap.mydomain.com/certificates",
+		} {
+			cfg := OIDCConfig{
+				RedirectURI: redirectURI,
+
+				AuthURI:  "https://accounts.google.com/o/oauth2/v2/auth",
+				TokenURI: "https://www.googleapis.com/oauth2/v4/token",
+
+				ClientID:     "my-client-id",
+				ClientSecret: "my-client-secret",
+			}
+
+			_, err := cfg.Validate()
+
+			Expect(err).To(MatchError(
+				ContainSubstring("is already served by IAP"),
+			), redirectURI)
+		}
 	})
 
 	It("Does not validate a configuration with an invalid redirect uri", func() {
@@ -97,6 +185,24 @@ var _ = Describe("OIDC Config", func() {
 		))
 	})
 
+	It("Does not validate a configuration with a token uri which is not https", func() {
+		cfg := OIDCConfig{
+			RedirectURI: "https://iap.mydomain.com/oidc/callback",
+
+			AuthURI:  "https://accounts.google.com/o/oauth2/v2/auth",
+			TokenURI: "http://www.googleapis.com/oauth2/v4/token",
+
+			ClientID:     "my-client-id",
+			ClientSecret: "my-client-secret",
+		}
+
+		_, err := cfg.Validate()
+
+		Expect(err).To(MatchError(
+			ContainSubstring("OIDC TokenURI must be https"),
+		))
+	})
+
 	It("Does not validate a configuration with an invalid token uri", func() {
 		cfg := OIDCConfig{
 			RedirectURI: "https://iap.mydomain.com/oidc/callback",
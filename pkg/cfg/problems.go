@@ -0,0 +1,72 @@
+package cfg
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// Problem is an error or warning found in the configuration, along with the
+// YAML path of what it is about, eg: services.my-service.roles[0]
+type Problem struct {
+	Path    string
+	Message string
+}
+
+func (p Problem) String() string {
+	if p.Path == "" {
+		return p.Message
+	}
+	return fmt.Sprintf("%s: %s", p.Path, p.Message)
+}
+
+// Problems is every problem which prevents the configuration from being
+// used, sorted by path.
+type Problems []Problem
+
+func (p Problems) Error() string {
+	return strings.Join(p.Strings(), "; ")
+}
+
+// Strings returns every problem along with its path.
+func (p Problems) Strings() []string {
+	strs := make([]string, 0, len(p))
+	for _, problem := range p {
+		strs = append(strs, problem.String())
+	}
+	return strs
+}
+
+func (p Problems) sort() {
+	sort.SliceStable(p, func(i, j int) bool {
+		if p[i].Path != p[j].Path {
+			return p[i].Path < p[j].Path
+		}
+		return p[i].Message < p[j].Message
+	})
+}
+
+var plainKey = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// yamlPath joins the keys of a YAML path, quoting the keys which are not
+// plain, eg: users["fname.lname@mydomain.com"]
+func yamlPath(keys ...string) string {
+	var path strings.Builder
+	for _, key := range keys {
+		switch {
+		case path.Len() == 0:
+			path.WriteString(key)
+		case plainKey.MatchString(key):
+			path.WriteString("." + key)
+		default:
+			fmt.Fprintf(&path, "[%q]", key)
+		}
+	}
+	return path.String()
+}
+
+// yamlIndex returns the path of an item of a YAML list.
+func yamlIndex(path string, index int) string {
+	return fmt.Sprintf("%s[%d]", path, index)
+}
@@ -0,0 +1,86 @@
+package cfg
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/alphagov/iap/pkg/service"
+)
+
+// Example configuration file
+// ---
+// services:
+//   my-service:
+//     upstream_uri: http://my-service.local/app
+//     matchers:
+//       - host: my-service.mydomain.com
+//         path_prefix: /my-service
+//     path_rewrite:
+//       strip_prefix: /my-service # /my-service/users -> /app/users
+//       add_prefix: /v2           # /app/users -> /app/v2/users
+//       pattern: ^/users/([0-9]+)$
+//       replacement: /people/$1
+//
+// Redirects and cookies of the upstream are rewritten back to the external
+// path, so that upstreams do not need to know where they are mounted.
+
+// PathRewriteConfig represents an unvalidated PathRewrite configuration
+type PathRewriteConfig struct {
+	StripPrefix string `json:"strip_prefix"`
+	AddPrefix   string `json:"add_prefix"`
+	Pattern     string `json:"pattern"`
+	Replacement string `json:"replacement"`
+}
+
+// Validate does validation of PathRewriteConfig
+func (c *PathRewriteConfig) Validate() (service.PathRewrite, error) {
+	cfg := service.PathRewrite{}
+
+	stripPrefix, err := validatePathPrefix(c.StripPrefix)
+	if err != nil {
+		return cfg, fmt.Errorf("Path Rewrite StripPrefix %s", err)
+	}
+
+	addPrefix, err := validatePathPrefix(c.AddPrefix)
+	if err != nil {
+		return cfg, fmt.Errorf("Path Rewrite AddPrefix %s", err)
+	}
+
+	if c.Pattern == "" && c.Replacement != "" {
+		return cfg, fmt.Errorf("Path Rewrite Replacement requires a Pattern")
+	}
+
+	var pattern *regexp.Regexp
+	if c.Pattern != "" {
+		pattern, err = regexp.Compile(c.Pattern)
+		if err != nil {
+			return cfg, fmt.Errorf("Path Rewrite Pattern must be a valid regular expression: %s", err)
+		}
+	}
+
+	return service.PathRewrite{
+		StripPrefix: stripPrefix,
+		AddPrefix:   addPrefix,
+		Pattern:     pattern,
+		Replacement: c.Replacement,
+	}, nil
+}
+
+// validatePathPrefix returns the prefix without its trailing slash, so that
+// /app and /app/ are the same prefix
+func validatePathPrefix(prefix string) (string, error) {
+	if prefix == "" {
+		return "", nil
+	}
+
+	if !strings.HasPrefix(prefix, "/") {
+		return "", fmt.Errorf("must start with /")
+	}
+
+	if service.CleanPath(prefix) != prefix {
+		return "", fmt.Errorf("must not contain dot segments")
+	}
+
+	return strings.TrimSuffix(prefix, "/"), nil
+}
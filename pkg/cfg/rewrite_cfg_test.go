@@ -0,0 +1,71 @@
+package cfg
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Path Rewrite Config", func() {
+	It("Parses a valid configuration", func() {
+		cfg := PathRewriteConfig{
+			StripPrefix: "/grafana/",
+			AddPrefix:   "/v2",
+			Pattern:     `^/users/([0-9]+)$`,
+			Replacement: "/people/$1",
+		}
+		validatedCfg, err := cfg.Validate()
+
+		Expect(err).NotTo(HaveOccurred())
+		Expect(validatedCfg.StripPrefix).To(Equal("/grafana"))
+		Expect(validatedCfg.AddPrefix).To(Equal("/v2"))
+		Expect(validatedCfg.Rewrite("", "/grafana/users/1")).To(Equal("/v2/people/1"))
+	})
+
+	It("Does not validate a prefix which does not start with a slash", func() {
+		cfg := PathRewriteConfig{StripPrefix: "grafana"}
+		_, err := cfg.Validate()
+
+		Expect(err).To(MatchError(ContainSubstring("Path Rewrite StripPrefix must start with /")))
+	})
+
+	It("Does not validate a prefix with dot segments", func() {
+		cfg := PathRewriteConfig{AddPrefix: "/v2/../admin"}
+		_, err := cfg.Validate()
+
+		Expect(err).To(MatchError(ContainSubstring("Path Rewrite AddPrefix must not contain dot segments")))
+	})
+
+	It("Does not validate an invalid pattern", func() {
+		cfg := PathRewriteConfig{Pattern: "("}
+		_, err := cfg.Validate()
+
+		Expect(err).To(MatchError(ContainSubstring("Path Rewrite Pattern must be a valid regular expression")))
+	})
+
+	It("Does not validate a replacement without a pattern", func() {
+		cfg := PathRewriteConfig{Replacement: "/people"}
+		_, err := cfg.Validate()
+
+		Expect(err).To(MatchError(ContainSubstring("Path Rewrite Replacement requires a Pattern")))
+	})
+})
+
+var _ = Describe("Matcher Config path prefixes", func() {
+	It("Parses a path prefix", func() {
+		cfg := MatcherConfig{Host: "tools.mydomain.com", PathPrefix: "/grafana/"}
+		validatedCfg, err := cfg.Validate()
+
+		Expect(err).NotTo(HaveOccurred())
+		Expect(validatedCfg.PathPrefix).To(Equal("/grafana"))
+		Expect(validatedCfg.MatchesPath("/grafana/dashboards")).To(Equal(true))
+		Expect(validatedCfg.MatchesPath("/prometheus")).To(Equal(false))
+	})
+
+	It("Does not validate a path prefix which does not start with a slash", func() {
+		cfg := MatcherConfig{Host: "tools.mydomain.com", PathPrefix: "grafana"}
+		_, err := cfg.Validate()
+
+		Expect(err).To(MatchError(ContainSubstring("Matcher PathPrefix must start with /")))
+	})
+
+})
@@ -0,0 +1,91 @@
+package cfg
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/alphagov/iap/pkg/service"
+	"github.com/alphagov/iap/pkg/serviceaccount"
+	"github.com/alphagov/iap/pkg/user"
+)
+
+// Example configuration ---
+// roles:
+//   - superuser
+//   - readonlyuser
+//
+// Every role required by a service or given to a user or service account
+// should be declared, a typo would otherwise lock people out or grant nothing.
+
+// roleWarnings cross-references the declared roles with the ones required by
+// services and given to users and service accounts. It warns about roles
+// which are not declared, declared roles which no service requires, and
+// services which nobody can access.
+func roleWarnings(roles []string, services map[string]service.Service, users map[string]user.User, accounts map[string]serviceaccount.ServiceAccount) Problems {
+	warnings := make(Problems, 0)
+
+	declared := make(map[string]bool, len(roles))
+	for _, role := range roles {
+		declared[role] = true
+	}
+
+	undeclared := func(path, owner string, roles []string) {
+		for index, role := range roles {
+			if !declared[role] {
+				warnings = append(warnings, Problem{
+					Path:    yamlIndex(yamlPath(path, "roles"), index),
+					Message: fmt.Sprintf("%s has role %s which is not declared", owner, role),
+				})
+			}
+		}
+	}
+
+	granted := make(map[string]bool)
+	for identifier, u := range users {
+		undeclared(yamlPath("users", identifier), "User "+identifier, u.Roles)
+		for _, role := range u.Roles {
+			granted[role] = true
+		}
+	}
+
+	for name, account := range accounts {
+		undeclared(yamlPath("service_accounts", name), "Service Account "+name, account.Roles)
+		for _, role := range account.Roles {
+			granted[role] = true
+		}
+	}
+
+	required := make(map[string]bool)
+	for identifier, svc := range services {
+		path := yamlPath("services", identifier)
+		undeclared(path, "Service "+identifier, svc.Roles)
+
+		reachable := len(svc.Roles) == 0
+		for _, role := range svc.Roles {
+			required[role] = true
+			reachable = reachable || granted[role]
+		}
+
+		if !reachable {
+			warnings = append(warnings, Problem{
+				Path: yamlPath(path, "roles"),
+				Message: fmt.Sprintf(
+					"Service %s cannot be accessed as no user or service account has any of the roles %s",
+					identifier, strings.Join(svc.Roles, ", "),
+				),
+			})
+		}
+	}
+
+	for index, role := range roles {
+		if !required[role] {
+			warnings = append(warnings, Problem{
+				Path:    yamlIndex("roles", index),
+				Message: fmt.Sprintf("Role %s is not required by any service", role),
+			})
+		}
+	}
+
+	warnings.sort()
+	return warnings
+}
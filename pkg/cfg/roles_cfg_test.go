@@ -0,0 +1,159 @@
+package cfg
+
+import (
+	"errors"
+
+	"github.com/lithammer/dedent"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/alphagov/iap/pkg/service"
+	"github.com/alphagov/iap/pkg/serviceaccount"
+	"github.com/alphagov/iap/pkg/user"
+)
+
+var _ = Describe("Config roles", func() {
+	config := dedent.Dedent(`
+    oidc:
+      redirect_uri: https://iap.mydomain.com/oidc/callback
+      auth_uri: https://accounts.google.com/o/oauth2/v2/auth
+      token_uri: https://www.googleapis.com/oauth2/v4/token
+      client_id: foo-0000-1111.apps.googleusercontent.com
+      client_secret: abcd-0000-1111
+    session:
+      cookie_domain: mydomain.com
+    roles:
+      - superuser
+      - readonlyuser
+      - auditor
+    services:
+      grafana:
+        upstream_uri: http://grafana.local
+        matchers:
+          - host: grafana.mydomain.com
+        roles:
+          - superuser
+          - readonlyuser
+      prometheus:
+        upstream_uri: http://prometheus.local
+        matchers:
+          - host: prometheus.mydomain.com
+        roles:
+          - supreuser
+      status:
+        upstream_uri: http://status.local
+        matchers:
+          - host: status.mydomain.com
+    users:
+      fname.lname@mydomain.com:
+        roles:
+          - superuser
+      another-user:
+        roles:
+          - readonly
+	`)
+
+	It("Warns about undeclared and unused roles and unreachable services", func() {
+		validatedCfg, err := ParseAndValidateConfig(config)
+
+		Expect(err).NotTo(HaveOccurred())
+		Expect(validatedCfg.Warnings).To(Equal([]string{
+			"roles[2]: Role auditor is not required by any service",
+			"services.prometheus.roles: Service prometheus cannot be accessed as no user or service account has any of the roles supreuser",
+			"services.prometheus.roles[0]: Service prometheus has role supreuser which is not declared",
+			"users.another-user.roles[0]: User another-user has role readonly which is not declared",
+		}))
+	})
+
+	It("Rejects the configuration with the warnings in strict mode", func() {
+		_, err := ParseAndValidateConfig(config + "strict: true\n")
+
+		var problems Problems
+		Expect(errors.As(err, &problems)).To(BeTrue())
+		Expect(problems).To(HaveLen(4))
+		Expect(problems[0]).To(Equal(Problem{
+			Path:    "roles[2]",
+			Message: "Role auditor is not required by any service",
+		}))
+	})
+
+	It("Quotes the keys which are not plain in the paths", func() {
+		warnings := roleWarnings(nil, nil, map[string]user.User{
+			"fname.lname@mydomain.com": user.User{Roles: []string{"superuser"}},
+		}, nil)
+
+		Expect(warnings.Strings()).To(ConsistOf(
+			`users["fname.lname@mydomain.com"].roles[0]: User fname.lname@mydomain.com has role superuser which is not declared`,
+		))
+	})
+
+	It("Counts the roles of service accounts towards reaching services", func() {
+		warnings := roleWarnings([]string{"deployer"}, map[string]service.Service{
+			"ci": service.Service{Identifier: "ci", Roles: []string{"deployer"}},
+		}, nil, map[string]serviceaccount.ServiceAccount{
+			"deploy-bot": serviceaccount.ServiceAccount{Name: "deploy-bot", Roles: []string{"deployer"}},
+		})
+
+		Expect(warnings).To(BeEmpty())
+	})
+})
+
+var _ = Describe("Config problems", func() {
+	It("Reports every problem along with its path", func() {
+		_, err := ParseAndValidateConfig(dedent.Dedent(`
+    oidc:
+      redirect_uri: https://iap.mydomain.com/oidc/callback
+      auth_uri: https://accounts.google.com/o/oauth2/v2/auth
+      token_uri: https://www.googleapis.com/oauth2/v4/token
+      client_id: foo-0000-1111.apps.googleusercontent.com
+      client_secret: abcd-0000-1111
+    session:
+      cookie_domain: mydomain.com
+    services:
+      grafana:
+        upstream_uri: http://grafana.local
+        matchers:
+          - host: tools.mydomain.com
+      prometheus:
+        upstream_uri: http://prometheus.local
+        matchers:
+          - host: prometheus.mydomain.com
+          - host: tools.mydomain.com
+      broken:
+        upstream_uri: ""
+    users:
+      "":
+        roles: []
+		`))
+
+		var problems Problems
+		Expect(errors.As(err, &problems)).To(BeTrue())
+		Expect(problems).To(HaveLen(3))
+		Expect(problems[0].Path).To(Equal("services.broken"))
+		Expect(problems[1].Path).To(Equal("services.prometheus.matchers[1]"))
+		Expect(problems[1].Message).To(Equal("Host tools.mydomain.com is matched by both services grafana and prometheus"))
+		Expect(problems[2].Path).To(Equal(`users[""]`))
+		Expect(err.Error()).To(ContainSubstring("; "))
+	})
+
+	It("Reports every problem of the OIDC and session configuration along with its field", func() {
+		_, err := ParseAndValidateConfig(dedent.Dedent(`
+    oidc:
+      redirect_uri: https://iap.mydomain.com
+      auth_uri: https://accounts.google.com/o/oauth2/v2/auth
+      token_uri: https://www.googleapis.com/oauth2/v4/token
+      client_secret: abcd-0000-1111
+    session:
+      cookie_name: iap session
+      expiration: forever
+		`))
+
+		var problems Problems
+		Expect(errors.As(err, &problems)).To(BeTrue())
+		Expect(problems).To(HaveLen(4))
+		Expect(problems[0].Path).To(Equal("oidc.client_id"))
+		Expect(problems[1].Path).To(Equal("oidc.redirect_uri"))
+		Expect(problems[2].Path).To(Equal("session.cookie_name"))
+		Expect(problems[3].Path).To(Equal("session.expiration"))
+	})
+})
@@ -0,0 +1,129 @@
+package cfg
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/alphagov/iap/pkg/serviceaccount"
+)
+
+// Example configuration file
+// ---
+// service_accounts:
+//   deploy-bot:
+//     roles:
+//       - superuser
+//     api_key_hashes: # echo -n "$API_KEY" | sha256sum
+//       - sha256:2c26b46b68ffc68ff99b453c1d30413413422d706483bfa0f98a5e886266e7ae
+//     api_key_file: /etc/iap/deploy-bot.keys # one hash per line
+//     expires_at: 2030-01-01T00:00:00Z
+//     source_cidrs:
+//       - 10.0.0.0/8
+
+var serviceAccountName = regexp.MustCompile(`^[a-z0-9][a-z0-9._-]*$`)
+
+// ServiceAccountConfig represents an unvalidated ServiceAccount configuration
+//
+// API keys are never written in the configuration, only their SHA-256 hashes,
+// either inline or in a file which can be managed separately.
+type ServiceAccountConfig struct {
+	Roles        []string `json:"roles"`
+	APIKeyHashes []string `json:"api_key_hashes"`
+	APIKeyFile   string   `json:"api_key_file"`
+	ExpiresAt    string   `json:"expires_at"`
+	SourceCIDRs  []string `json:"source_cidrs"`
+}
+
+// Validate does validation of ServiceAccountConfig, reading the API key file
+func (c *ServiceAccountConfig) Validate(name string) (serviceaccount.ServiceAccount, error) {
+	return c.validate(name, true)
+}
+
+// validate does validation of ServiceAccountConfig, with only the inline API
+// key hashes unless the API key file is read
+func (c *ServiceAccountConfig) validate(name string, load bool) (serviceaccount.ServiceAccount, error) {
+	cfg := serviceaccount.ServiceAccount{}
+
+	if !serviceAccountName.MatchString(name) {
+		return cfg, fmt.Errorf("Service Account Name must be lowercase letters, digits, dots, dashes or underscores")
+	}
+
+	hashes := c.APIKeyHashes
+	if c.APIKeyFile != "" && load {
+		blob, err := ioutil.ReadFile(c.APIKeyFile)
+		if err != nil {
+			return cfg, fmt.Errorf("Service Account APIKeyFile could not be read: %s", err)
+		}
+
+		for _, line := range strings.Split(string(blob), "\n") {
+			line = strings.TrimSpace(line)
+			if line != "" && !strings.HasPrefix(line, "#") {
+				hashes = append(hashes, line)
+			}
+		}
+	}
+
+	if len(hashes) == 0 && (c.APIKeyFile == "" || load) {
+		return cfg, fmt.Errorf("Service Account must have at least one API key hash")
+	}
+
+	keyHashes := make([][]byte, 0, len(hashes))
+	for _, hash := range hashes {
+		digest, err := serviceaccount.ParseKeyHash(hash)
+		if err != nil {
+			return cfg, fmt.Errorf("Service Account %s", err)
+		}
+		keyHashes = append(keyHashes, digest)
+	}
+
+	var expiresAt time.Time
+	if c.ExpiresAt != "" {
+		parsed, err := time.Parse(time.RFC3339, c.ExpiresAt)
+		if err != nil {
+			return cfg, fmt.Errorf("Service Account ExpiresAt must be an RFC 3339 time: %s", err)
+		}
+		expiresAt = parsed
+	}
+
+	sourceCIDRs := make([]*net.IPNet, 0, len(c.SourceCIDRs))
+	for _, cidr := range c.SourceCIDRs {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return cfg, fmt.Errorf("Service Account SourceCIDRs must be valid CIDRs: %s", err)
+		}
+		sourceCIDRs = append(sourceCIDRs, network)
+	}
+
+	return serviceaccount.ServiceAccount{
+		Name:        name,
+		Roles:       c.Roles,
+		KeyHashes:   keyHashes,
+		ExpiresAt:   expiresAt,
+		SourceCIDRs: sourceCIDRs,
+	}, nil
+}
+
+// expiredServiceAccountWarnings returns a warning for every service account
+// which can no longer be used
+func expiredServiceAccountWarnings(accounts map[string]serviceaccount.ServiceAccount) Problems {
+	warnings := make(Problems, 0)
+
+	for name, account := range accounts {
+		if account.Expired(time.Now()) {
+			warnings = append(warnings, Problem{
+				Path: yamlPath("service_accounts", name, "expires_at"),
+				Message: fmt.Sprintf(
+					"Service Account %s expired at %s",
+					name, account.ExpiresAt.Format(time.RFC3339),
+				),
+			})
+		}
+	}
+
+	warnings.sort()
+	return warnings
+}
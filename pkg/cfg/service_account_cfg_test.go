@@ -0,0 +1,111 @@
+package cfg
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/alphagov/iap/pkg/serviceaccount"
+)
+
+var _ = Describe("Service Account Config", func() {
+	hash := serviceaccount.HashKey("my-api-key")
+
+	It("Parses a valid configuration", func() {
+		cfg := ServiceAccountConfig{
+			Roles:        []string{"superuser"},
+			APIKeyHashes: []string{hash},
+			ExpiresAt:    "2030-01-01T00:00:00Z",
+			SourceCIDRs:  []string{"10.0.0.0/8"},
+		}
+		account, err := cfg.Validate("deploy-bot")
+
+		Expect(err).NotTo(HaveOccurred())
+		Expect(account.Name).To(Equal("deploy-bot"))
+		Expect(account.Roles).To(Equal(cfg.Roles))
+		Expect(account.HasKey("my-api-key")).To(BeTrue())
+		Expect(account.ExpiresAt).To(Equal(time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC)))
+		Expect(account.AllowsSource(net.ParseIP("10.1.2.3"))).To(BeTrue())
+		Expect(account.AllowsSource(net.ParseIP("192.168.1.1"))).To(BeFalse())
+	})
+
+	It("Reads the API key hashes from a file", func() {
+		file, err := ioutil.TempFile("", "iap-keys")
+		Expect(err).NotTo(HaveOccurred())
+		defer os.Remove(file.Name())
+
+		_, err = file.WriteString("# rotated on 2026-10-01\n" + serviceaccount.HashKey("my-new-key") + "\n\n")
+		Expect(err).NotTo(HaveOccurred())
+		file.Close()
+
+		cfg := ServiceAccountConfig{
+			APIKeyHashes: []string{hash},
+			APIKeyFile:   file.Name(),
+		}
+		account, err := cfg.Validate("deploy-bot")
+
+		Expect(err).NotTo(HaveOccurred())
+		Expect(account.KeyHashes).To(HaveLen(2))
+		Expect(account.HasKey("my-api-key")).To(BeTrue())
+		Expect(account.HasKey("my-new-key")).To(BeTrue())
+	})
+
+	It("Does not validate a configuration without API keys", func() {
+		cfg := ServiceAccountConfig{Roles: []string{"superuser"}}
+		_, err := cfg.Validate("deploy-bot")
+
+		Expect(err).To(MatchError(ContainSubstring(
+			"Service Account must have at least one API key hash",
+		)))
+	})
+
+	It("Does not validate an API key which is not hashed", func() {
+		cfg := ServiceAccountConfig{APIKeyHashes: []string{"my-api-key"}}
+		_, err := cfg.Validate("deploy-bot")
+
+		Expect(err).To(MatchError(ContainSubstring(
+			"API key hash must start with sha256:",
+		)))
+	})
+
+	It("Does not validate an invalid name", func() {
+		cfg := ServiceAccountConfig{APIKeyHashes: []string{hash}}
+		_, err := cfg.Validate("Deploy Bot")
+
+		Expect(err).To(MatchError(ContainSubstring(
+			"Service Account Name must be lowercase",
+		)))
+	})
+
+	It("Does not validate an invalid expiry", func() {
+		cfg := ServiceAccountConfig{APIKeyHashes: []string{hash}, ExpiresAt: "tomorrow"}
+		_, err := cfg.Validate("deploy-bot")
+
+		Expect(err).To(MatchError(ContainSubstring(
+			"Service Account ExpiresAt must be an RFC 3339 time",
+		)))
+	})
+
+	It("Does not validate an invalid source CIDR", func() {
+		cfg := ServiceAccountConfig{APIKeyHashes: []string{hash}, SourceCIDRs: []string{"10.0.0.1"}}
+		_, err := cfg.Validate("deploy-bot")
+
+		Expect(err).To(MatchError(ContainSubstring(
+			"Service Account SourceCIDRs must be valid CIDRs",
+		)))
+	})
+
+	It("Warns about expired service accounts", func() {
+		warnings := expiredServiceAccountWarnings(map[string]serviceaccount.ServiceAccount{
+			"old-bot":    serviceaccount.ServiceAccount{Name: "old-bot", ExpiresAt: time.Now().Add(-time.Hour)},
+			"deploy-bot": serviceaccount.ServiceAccount{Name: "deploy-bot"},
+		})
+
+		Expect(warnings).To(HaveLen(1))
+		Expect(warnings[0]).To(ContainSubstring("Service Account old-bot expired at"))
+	})
+})
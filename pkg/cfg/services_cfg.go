@@ -1,7 +1,13 @@
 package cfg
 
 import (
+	"crypto/tls"
 	"fmt"
+	"net/url"
+	"regexp"
+	"regexp/syntax"
+	"sort"
+	"strings"
 
 	"github.com/goware/urlx"
 
@@ -27,46 +33,187 @@ import (
 //       - host: my-other-service.mydomain.com
 //     roles: [] # everyone can access
 //
+//   review-apps:
+//     upstream_uri: http://pr-$1.internal
+//     matchers:
+//       - host_pattern: pr-(\d+)\.preview\.mydomain\.com
+//
+//   previews:
+//     upstream_uri: http://$1.previews.internal
+//     matchers:
+//       - host: "*.previews.mydomain.com"
+//
+//   my-app:
+//     upstream_uri: http://my-app.local
+//     matchers:
+//       - host: my-app.mydomain.com
+//     public_paths:
+//       - path: /healthcheck
+//       - prefix: /.well-known/
+//       - path: /webhooks/github
+//         methods: [POST]
+//     forward_authorization: true # keep bearer tokens in upstream requests
+//
+//   grafana:
+//     upstream_uri: http://grafana.local
+//     matchers:
+//       - host: tools.mydomain.com
+//         path_prefix: /grafana
+//     path_rewrite:
+//       strip_prefix: /grafana
+//
 
 // MatcherConfig represents an unvalidated Matcher configuration
+//
+// Host is either an exact host or a wildcard host such as *.mydomain.com,
+// where the wildcard matches a single label and is available as $1.
+// HostPattern is a regular expression which has to match the whole host,
+// its capture groups are available as $1, $2 etc.
+// PathPrefix restricts the matcher to the requests under it, so that several
+// services can share a host.
 type MatcherConfig struct {
-	Host string
+	Host        string `json:"host"`
+	HostPattern string `json:"host_pattern"`
+	PathPrefix  string `json:"path_prefix"`
 }
 
 // Validate does validation of MatcherConfig
 func (c *MatcherConfig) Validate() (service.Matcher, error) {
 	cfg := service.Matcher{}
 
-	if c.Host == "" {
+	if c.Host == "" && c.HostPattern == "" {
 		return cfg, fmt.Errorf("Matcher Host cannot be empty")
 	}
 
+	if c.Host != "" && c.HostPattern != "" {
+		return cfg, fmt.Errorf("Matcher cannot have both a Host and a HostPattern")
+	}
+
+	pathPrefix, err := validatePathPrefix(c.PathPrefix)
+	if err != nil {
+		return cfg, fmt.Errorf("Matcher PathPrefix %s", err)
+	}
+
+	if c.HostPattern != "" {
+		pattern, err := regexp.Compile(anchorPattern(c.HostPattern))
+		if err != nil {
+			return cfg, fmt.Errorf("Matcher HostPattern must be a valid regular expression: %s", err)
+		}
+
+		return service.Matcher{
+			Pattern:    pattern,
+			PathPrefix: pathPrefix,
+		}, nil
+	}
+
+	if !strings.Contains(c.Host, "*") {
+		return service.Matcher{
+			Host:       service.NormalizeHost(c.Host),
+			PathPrefix: pathPrefix,
+		}, nil
+	}
+
+	if !strings.HasPrefix(c.Host, "*.") || strings.Count(c.Host, "*") > 1 {
+		return cfg, fmt.Errorf("Matcher Host can only have a wildcard as the first label")
+	}
+
+	domain := service.NormalizeHost(strings.TrimPrefix(c.Host, "*."))
+
 	return service.Matcher{
-		Host: c.Host,
+		Pattern:    regexp.MustCompile(`^([a-z0-9-]+)\.` + regexp.QuoteMeta(domain) + `$`),
+		PathPrefix: pathPrefix,
+	}, nil
+}
+
+func anchorPattern(pattern string) string {
+	return "^(?i:" + strings.TrimSuffix(strings.TrimPrefix(pattern, "^"), "$") + ")$"
+}
+
+// PublicPathConfig represents an unvalidated PublicPath configuration
+type PublicPathConfig struct {
+	Path    string   `json:"path"`
+	Prefix  string   `json:"prefix"`
+	Methods []string `json:"methods"`
+}
+
+// Validate does validation of PublicPathConfig
+func (c *PublicPathConfig) Validate() (service.PublicPath, error) {
+	cfg := service.PublicPath{}
+
+	if c.Path == "" && c.Prefix == "" {
+		return cfg, fmt.Errorf("Public Path must have a Path or a Prefix")
+	}
+
+	if c.Path != "" && c.Prefix != "" {
+		return cfg, fmt.Errorf("Public Path cannot have both a Path and a Prefix")
+	}
+
+	for _, p := range []string{c.Path, c.Prefix} {
+		if p != "" && !strings.HasPrefix(p, "/") {
+			return cfg, fmt.Errorf("Public Path %s must start with /", p)
+		}
+
+		if p != "" && service.CleanPath(p) != p {
+			return cfg, fmt.Errorf("Public Path %s must not contain dot segments", p)
+		}
+	}
+
+	methods := make([]string, 0)
+	for _, method := range c.Methods {
+		if method == "" {
+			return cfg, fmt.Errorf("Public Path Methods cannot contain an empty method")
+		}
+		methods = append(methods, strings.ToUpper(method))
+	}
+
+	return service.PublicPath{
+		Path:    c.Path,
+		Prefix:  c.Prefix,
+		Methods: methods,
 	}, nil
 }
 
 // ServiceConfig represents an unvalidated Service configuration
+//
+// Either a single UpstreamURI or a list of Upstreams can be given, see
+// upstreams_cfg.go for load balancing and health checking of the latter.
 type ServiceConfig struct {
-	UpstreamURI string            `json:"upstream_uri"`
-	Matchers    []MatcherConfig   `json:"matchers"`
-	Headers     map[string]string `json:"headers"`
-	Roles       []string          `json:"roles"`
+	UpstreamURI string             `json:"upstream_uri"`
+	Matchers    []MatcherConfig    `json:"matchers"`
+	Headers     map[string]string  `json:"headers"`
+	PublicPaths []PublicPathConfig `json:"public_paths"`
+	Roles       []string           `json:"roles"`
+
+	Upstreams        []UpstreamConfig        `json:"upstreams"`
+	LoadBalancing    string                  `json:"load_balancing"`
+	HealthCheck      *HealthCheckConfig      `json:"health_check"`
+	OutlierDetection *OutlierDetectionConfig `json:"outlier_detection"`
+
+	Timeouts       TimeoutsConfig        `json:"timeouts"`
+	Retries        int                   `json:"retries"`
+	CircuitBreaker *CircuitBreakerConfig `json:"circuit_breaker"`
+
+	TLS *UpstreamTLSConfig `json:"tls"`
+
+	PathRewrite PathRewriteConfig `json:"path_rewrite"`
+
+	ForwardAuthorization bool `json:"forward_authorization"`
 }
 
 // Validate does validation of ServiceConfig
 func (c *ServiceConfig) Validate(identifier string) (service.Service, error) {
+	return c.validate(identifier, true)
+}
+
+// validate does validation of ServiceConfig, loading the files of its TLS
+// configuration when asked to
+func (c *ServiceConfig) validate(identifier string, load bool) (service.Service, error) {
 	cfg := service.Service{}
 
 	if identifier == "" {
 		return cfg, fmt.Errorf("Service Identifier cannot be empty")
 	}
 
-	upstreamURI, err := urlx.ParseWithDefaultScheme(c.UpstreamURI, "https")
-	if err != nil {
-		return cfg, fmt.Errorf("Service Upstream URI must be a valid URI")
-	}
-
 	validatedMatchers := make([]service.Matcher, 0)
 
 	for index, matcher := range c.Matchers {
@@ -79,11 +226,319 @@ func (c *ServiceConfig) Validate(identifier string) (service.Service, error) {
 		validatedMatchers = append(validatedMatchers, validatedMatcher)
 	}
 
+	validatedPublicPaths := make([]service.PublicPath, 0)
+
+	for index, publicPath := range c.PublicPaths {
+		validatedPublicPath, err := publicPath.Validate()
+		if err != nil {
+			return cfg, fmt.Errorf(
+				"Service Public Path %d was not valid: %s", index, err,
+			)
+		}
+		validatedPublicPaths = append(validatedPublicPaths, validatedPublicPath)
+	}
+
+	if c.UpstreamURI != "" && len(c.Upstreams) > 0 {
+		return cfg, fmt.Errorf("Service cannot have both an Upstream URI and Upstreams")
+	}
+
+	validatedUpstreams := make([]service.Upstream, 0)
+
+	for index, upstream := range c.Upstreams {
+		validatedUpstream, err := upstream.Validate()
+		if err != nil {
+			return cfg, fmt.Errorf(
+				"Service Upstream %d was not valid: %s", index, err,
+			)
+		}
+		validatedUpstreams = append(validatedUpstreams, validatedUpstream)
+	}
+
+	upstreamURI := url.URL{}
+	upstreamTemplate := ""
+
+	if len(validatedUpstreams) > 0 {
+		upstreamURI = validatedUpstreams[0].URI
+	} else {
+		references := service.UpstreamReferences(c.UpstreamURI)
+
+		if references > 0 {
+			upstreamTemplate = c.UpstreamURI
+
+			for index, matcher := range validatedMatchers {
+				if !matcher.IsPattern() || matcher.Pattern.NumSubexp() < references {
+					return cfg, fmt.Errorf(
+						"Service Matcher %d does not capture $%d used by the Upstream URI", index, references,
+					)
+				}
+			}
+		}
+
+		// Capture groups are replaced by a placeholder so the rest of the URI
+		// can still be validated
+		parsedURI, err := urlx.ParseWithDefaultScheme(
+			service.ExpandUpstream(c.UpstreamURI, upstreamPlaceholders(references)),
+			"https",
+		)
+		if err != nil {
+			return cfg, fmt.Errorf("Service Upstream URI must be a valid URI")
+		}
+		upstreamURI = *parsedURI
+
+		if upstreamTemplate != "" && !strings.Contains(upstreamTemplate, "://") {
+			upstreamTemplate = upstreamURI.Scheme + "://" + upstreamTemplate
+		}
+
+		if upstreamTemplate == "" {
+			validatedUpstreams = append(validatedUpstreams, service.Upstream{
+				URI:    upstreamURI,
+				Weight: 1,
+			})
+		}
+	}
+
+	loadBalancing, err := validateLoadBalancing(c.LoadBalancing)
+	if err != nil {
+		return cfg, err
+	}
+
+	var healthCheck *service.HealthCheck
+	if c.HealthCheck != nil {
+		validatedHealthCheck, err := c.HealthCheck.Validate()
+		if err != nil {
+			return cfg, fmt.Errorf("Service Health Check was not valid: %s", err)
+		}
+		healthCheck = &validatedHealthCheck
+	}
+
+	var outlierDetection *service.OutlierDetection
+	if c.OutlierDetection != nil {
+		validatedOutlierDetection, err := c.OutlierDetection.Validate()
+		if err != nil {
+			return cfg, fmt.Errorf("Service Outlier Detection was not valid: %s", err)
+		}
+		outlierDetection = &validatedOutlierDetection
+	}
+
+	timeouts, err := c.Timeouts.Validate()
+	if err != nil {
+		return cfg, fmt.Errorf("Service Timeouts were not valid: %s", err)
+	}
+
+	if c.Retries < 0 {
+		return cfg, fmt.Errorf("Service Retries cannot be negative")
+	}
+
+	var circuitBreaker *service.CircuitBreaker
+	if c.CircuitBreaker != nil {
+		validatedCircuitBreaker, err := c.CircuitBreaker.Validate()
+		if err != nil {
+			return cfg, fmt.Errorf("Service Circuit Breaker was not valid: %s", err)
+		}
+		circuitBreaker = &validatedCircuitBreaker
+	}
+
+	var upstreamTLS *tls.Config
+	if c.TLS != nil {
+		upstreamTLS, err = c.TLS.validate(load)
+		if err != nil {
+			return cfg, fmt.Errorf("Service TLS was not valid: %s", err)
+		}
+	}
+
+	pathRewrite, err := c.PathRewrite.Validate()
+	if err != nil {
+		return cfg, fmt.Errorf("Service Path Rewrite was not valid: %s", err)
+	}
+
+	if upstreamTemplate != "" && (healthCheck != nil || outlierDetection != nil) {
+		return cfg, fmt.Errorf("Service with capture groups in the Upstream URI cannot be health checked")
+	}
+
 	return service.Service{
 		Identifier:  identifier,
-		UpstreamURI: *upstreamURI,
+		UpstreamURI: upstreamURI,
 		Matchers:    validatedMatchers,
 		Headers:     c.Headers,
+		PublicPaths: validatedPublicPaths,
 		Roles:       c.Roles,
+
+		Upstreams:        validatedUpstreams,
+		LoadBalancing:    loadBalancing,
+		HealthCheck:      healthCheck,
+		OutlierDetection: outlierDetection,
+		Retries:          c.Retries,
+		Timeouts:         timeouts,
+		CircuitBreaker:   circuitBreaker,
+		TLS:              upstreamTLS,
+		PathRewrite:      pathRewrite,
+		UpstreamTemplate: upstreamTemplate,
+
+		ForwardAuthorization: c.ForwardAuthorization,
 	}, nil
 }
+
+// insecureTLSWarnings returns a warning for every service which does not
+// verify the certificates of its upstreams
+func insecureTLSWarnings(services map[string]service.Service) Problems {
+	warnings := make(Problems, 0)
+
+	for identifier, svc := range services {
+		if svc.TLS != nil && svc.TLS.InsecureSkipVerify {
+			warnings = append(warnings, Problem{
+				Path: yamlPath("services", identifier, "tls", "insecure_skip_verify"),
+				Message: fmt.Sprintf(
+					"Service %s does not verify the TLS certificates of its upstreams", identifier,
+				),
+			})
+		}
+	}
+
+	warnings.sort()
+	return warnings
+}
+
+// publicPathWarnings returns a warning for every service which has a public
+// path rule matching all of its requests, which is probably a mistake
+func publicPathWarnings(services map[string]service.Service) Problems {
+	warnings := make(Problems, 0)
+
+	for identifier, svc := range services {
+		for index, publicPath := range svc.PublicPaths {
+			if publicPath.IsCatchAll() {
+				warnings = append(warnings, Problem{
+					Path: yamlIndex(yamlPath("services", identifier, "public_paths"), index),
+					Message: fmt.Sprintf(
+						"Service %s Public Path %d makes every path public", identifier, index,
+					),
+				})
+			}
+		}
+	}
+
+	warnings.sort()
+	return warnings
+}
+
+func upstreamPlaceholders(references int) []string {
+	placeholders := make([]string, references+1)
+	for index := range placeholders {
+		placeholders[index] = "capture"
+	}
+	return placeholders
+}
+
+// matcherProblems reports every matcher of a service which would match the
+// same host and path prefix as one of another service. Exact hosts always
+// take precedence over patterns, and longer path prefixes over shorter ones,
+// so only duplicate exact hosts and overlapping patterns with the same prefix
+// are ambiguous.
+func matcherProblems(services map[string]service.Service) Problems {
+	type owned struct {
+		service string
+		matcher service.Matcher
+	}
+
+	identifiers := make([]string, 0, len(services))
+	for identifier := range services {
+		identifiers = append(identifiers, identifier)
+	}
+	sort.Strings(identifiers)
+
+	problems := make(Problems, 0)
+	hosts := make(map[string]string)
+	patterns := make([]owned, 0)
+
+	for _, identifier := range identifiers {
+		for index, matcher := range services[identifier].Matchers {
+			path := yamlIndex(yamlPath("services", identifier, "matchers"), index)
+
+			if !matcher.IsPattern() {
+				if other, ok := hosts[matcher.String()]; ok {
+					problems = append(problems, Problem{
+						Path: path,
+						Message: fmt.Sprintf(
+							"Host %s is matched by both services %s and %s", matcher.String(), other, identifier,
+						),
+					})
+					continue
+				}
+				hosts[matcher.String()] = identifier
+				continue
+			}
+
+			// A pattern overlapping with several others is reported once
+			overlaps := make([]string, 0)
+			for _, other := range patterns {
+				if matcher.PathPrefix == other.matcher.PathPrefix &&
+					service.PatternsOverlap(matcher.Pattern, other.matcher.Pattern) {
+					overlaps = append(overlaps, fmt.Sprintf("%s of service %s", other.matcher.String(), other.service))
+				}
+			}
+			if len(overlaps) > 0 {
+				problems = append(problems, Problem{
+					Path: path,
+					Message: fmt.Sprintf(
+						"Host pattern %s of service %s overlaps with %s",
+						matcher.String(), identifier, strings.Join(overlaps, ", "),
+					),
+				})
+			}
+			patterns = append(patterns, owned{service: identifier, matcher: matcher})
+		}
+	}
+
+	return problems
+}
+
+func samplePattern(pattern *regexp.Regexp) (string, bool) {
+	parsed, err := syntax.Parse(pattern.String(), syntax.Perl)
+	if err != nil {
+		return "", false
+	}
+
+	var sample strings.Builder
+	writeSample(&sample, parsed.Simplify())
+
+	host := strings.ToLower(sample.String())
+	return host, pattern.MatchString(host)
+}
+
+func writeSample(sample *strings.Builder, re *syntax.Regexp) {
+	switch re.Op {
+	case syntax.OpLiteral:
+		sample.WriteString(string(re.Rune))
+	case syntax.OpCharClass:
+		if len(re.Rune) > 0 {
+			sample.WriteRune(sampleRune(re.Rune))
+		}
+	case syntax.OpAnyChar, syntax.OpAnyCharNotNL:
+		sample.WriteRune('a')
+	case syntax.OpCapture, syntax.OpPlus:
+		writeSample(sample, re.Sub[0])
+	case syntax.OpRepeat:
+		for i := 0; i < re.Min; i++ {
+			writeSample(sample, re.Sub[0])
+		}
+	case syntax.OpConcat:
+		for _, sub := range re.Sub {
+			writeSample(sample, sub)
+		}
+	case syntax.OpAlternate:
+		writeSample(sample, re.Sub[0])
+	}
+}
+
+// sampleRune prefers a letter or digit from the character class, so that
+// classes like [^.] produce something which looks like a host label
+func sampleRune(ranges []rune) rune {
+	for _, preferred := range "a0" {
+		for i := 0; i+1 < len(ranges); i += 2 {
+			if ranges[i] <= preferred && preferred <= ranges[i+1] {
+				return preferred
+			}
+		}
+	}
+
+	return ranges[0]
+}
@@ -190,3 +190,193 @@ var _ = Describe("Service Config", func() {
 		)))
 	})
 })
+
+var _ = Describe("Matcher Config patterns", func() {
+	It("Parses a wildcard host", func() {
+		cfg := MatcherConfig{Host: "*.preview.mydomain.com"}
+		validatedCfg, err := cfg.Validate()
+
+		Expect(err).NotTo(HaveOccurred())
+		Expect(validatedCfg.IsPattern()).To(BeTrue())
+
+		captures, ok := validatedCfg.Match("pr-1.preview.mydomain.com")
+		Expect(ok).To(BeTrue())
+		Expect(captures[1]).To(Equal("pr-1"))
+
+		_, ok = validatedCfg.Match("a.pr-1.preview.mydomain.com")
+		Expect(ok).To(BeFalse())
+	})
+
+	It("Parses a host pattern", func() {
+		cfg := MatcherConfig{HostPattern: `pr-(\d+)\.preview\.mydomain\.com`}
+		validatedCfg, err := cfg.Validate()
+
+		Expect(err).NotTo(HaveOccurred())
+
+		captures, ok := validatedCfg.Match("PR-42.preview.mydomain.com:443")
+		Expect(ok).To(BeTrue())
+		Expect(captures[1]).To(Equal("42"))
+
+		_, ok = validatedCfg.Match("pr-42.preview.mydomain.com.evil.com")
+		Expect(ok).To(BeFalse())
+	})
+
+	It("Does not validate a wildcard which is not the first label", func() {
+		cfg := MatcherConfig{Host: "preview.*.mydomain.com"}
+		_, err := cfg.Validate()
+
+		Expect(err).To(MatchError(ContainSubstring(
+			"Matcher Host can only have a wildcard as the first label",
+		)))
+	})
+
+	It("Does not validate an invalid host pattern", func() {
+		cfg := MatcherConfig{HostPattern: `pr-(\d+`}
+		_, err := cfg.Validate()
+
+		Expect(err).To(MatchError(ContainSubstring(
+			"Matcher HostPattern must be a valid regular expression",
+		)))
+	})
+
+	It("Does not validate a matcher with both a host and a host pattern", func() {
+		cfg := MatcherConfig{Host: "a.mydomain.com", HostPattern: `.*`}
+		_, err := cfg.Validate()
+
+		Expect(err).To(MatchError(ContainSubstring(
+			"Matcher cannot have both a Host and a HostPattern",
+		)))
+	})
+})
+
+var _ = Describe("Service Config upstream templates", func() {
+	It("Parses an upstream URI using capture groups", func() {
+		cfg := ServiceConfig{
+			UpstreamURI: "http://pr-$1.internal",
+			Matchers: []MatcherConfig{
+				MatcherConfig{HostPattern: `pr-(\d+)\.preview\.mydomain\.com`},
+			},
+		}
+
+		validatedCfg, err := cfg.Validate("review-apps")
+
+		Expect(err).NotTo(HaveOccurred())
+		Expect(validatedCfg.UpstreamTemplate).To(Equal("http://pr-$1.internal"))
+
+		upstreamURI, err := validatedCfg.Upstream([]string{"pr-7.preview.mydomain.com", "7"})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(upstreamURI.String()).To(Equal("http://pr-7.internal"))
+	})
+
+	It("Defaults the scheme of an upstream URI using capture groups", func() {
+		cfg := ServiceConfig{
+			UpstreamURI: "${1}.previews.internal",
+			Matchers: []MatcherConfig{
+				MatcherConfig{Host: "*.previews.mydomain.com"},
+			},
+		}
+
+		validatedCfg, err := cfg.Validate("previews")
+
+		Expect(err).NotTo(HaveOccurred())
+		Expect(validatedCfg.UpstreamTemplate).To(Equal("https://${1}.previews.internal"))
+	})
+
+	It("Does not validate an upstream URI referencing a missing capture group", func() {
+		cfg := ServiceConfig{
+			UpstreamURI: "http://pr-$2.internal",
+			Matchers: []MatcherConfig{
+				MatcherConfig{HostPattern: `pr-(\d+)\.preview\.mydomain\.com`},
+			},
+		}
+
+		_, err := cfg.Validate("review-apps")
+
+		Expect(err).To(MatchError(ContainSubstring(
+			"Service Matcher 0 does not capture $2 used by the Upstream URI",
+		)))
+	})
+
+	It("Does not validate an upstream URI using capture groups with an exact host", func() {
+		cfg := ServiceConfig{
+			UpstreamURI: "http://pr-$1.internal",
+			Matchers: []MatcherConfig{
+				MatcherConfig{Host: "pr.preview.mydomain.com"},
+			},
+		}
+
+		_, err := cfg.Validate("review-apps")
+
+		Expect(err).To(MatchError(ContainSubstring(
+			"Service Matcher 0 does not capture $1 used by the Upstream URI",
+		)))
+	})
+})
+
+var _ = Describe("Public Path Config", func() {
+	It("Parses a valid exact path", func() {
+		cfg := PublicPathConfig{Path: "/webhooks/github", Methods: []string{"post"}}
+		validatedCfg, err := cfg.Validate()
+
+		Expect(err).NotTo(HaveOccurred())
+		Expect(validatedCfg.Path).To(Equal("/webhooks/github"))
+		Expect(validatedCfg.Methods).To(Equal([]string{"POST"}))
+	})
+
+	It("Parses a valid prefix", func() {
+		cfg := PublicPathConfig{Prefix: "/.well-known/"}
+		validatedCfg, err := cfg.Validate()
+
+		Expect(err).NotTo(HaveOccurred())
+		Expect(validatedCfg.Prefix).To(Equal("/.well-known/"))
+		Expect(validatedCfg.Methods).To(HaveLen(0))
+	})
+
+	It("Does not validate an empty rule", func() {
+		cfg := PublicPathConfig{}
+		_, err := cfg.Validate()
+
+		Expect(err).To(MatchError(ContainSubstring(
+			"Public Path must have a Path or a Prefix",
+		)))
+	})
+
+	It("Does not validate a rule with both a path and a prefix", func() {
+		cfg := PublicPathConfig{Path: "/healthcheck", Prefix: "/health"}
+		_, err := cfg.Validate()
+
+		Expect(err).To(MatchError(ContainSubstring(
+			"Public Path cannot have both a Path and a Prefix",
+		)))
+	})
+
+	It("Does not validate a relative path", func() {
+		cfg := PublicPathConfig{Path: "healthcheck"}
+		_, err := cfg.Validate()
+
+		Expect(err).To(MatchError(ContainSubstring("must start with /")))
+	})
+
+	It("Does not validate a path with dot segments", func() {
+		cfg := PublicPathConfig{Prefix: "/public/../"}
+		_, err := cfg.Validate()
+
+		Expect(err).To(MatchError(ContainSubstring("must not contain dot segments")))
+	})
+
+	It("Does not validate a service with an invalid public path", func() {
+		cfg := ServiceConfig{
+			UpstreamURI: "my-service.local",
+			PublicPaths: []PublicPathConfig{
+				PublicPathConfig{Path: "/healthcheck"},
+				PublicPathConfig{},
+			},
+		}
+
+		_, err := cfg.Validate("my-service")
+
+		Expect(err).To(MatchError(ContainSubstring(
+			"Service Public Path 1 was not valid",
+		)))
+	})
+})
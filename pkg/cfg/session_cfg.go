@@ -0,0 +1,130 @@
+package cfg
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/alphagov/iap/pkg/service"
+)
+
+// Example configuration file
+// ---
+// session:
+//   cookie_name: iap_session
+//   cookie_domain: mydomain.com # shared by IAP and the hosts of the services
+//   expiration: 8h
+//
+// The session cookie is only sent to the host of the OIDC redirect URI unless
+// cookie_domain is given, so it is required as soon as a service has another
+// host, and has to contain the hosts of every service.
+
+// SessionConfig represents an unvalidated Session configuration
+type SessionConfig struct {
+	CookieName   string `json:"cookie_name"`
+	CookieDomain string `json:"cookie_domain"`
+	Expiration   string `json:"expiration"`
+}
+
+// ValidatedSessionConfig represents a validated Session configuration
+type ValidatedSessionConfig struct {
+	CookieName   string
+	CookieDomain string
+	Expiration   time.Duration
+}
+
+// Validate does validation of SessionConfig, returning a problem for every
+// field which is not valid
+func (c *SessionConfig) Validate() (ValidatedSessionConfig, error) {
+	problems := make(Problems, 0)
+
+	cookieName := c.CookieName
+	if cookieName == "" {
+		cookieName = "iap_session"
+	}
+
+	if strings.ContainsAny(cookieName, " \t\r\n;,=") {
+		problems = append(problems, Problem{
+			Path:    yamlPath("session", "cookie_name"),
+			Message: "Session CookieName must be a valid cookie name",
+		})
+	}
+
+	expiration, err := parseDuration(c.Expiration, 8*time.Hour)
+	if err != nil {
+		problems = append(problems, Problem{
+			Path:    yamlPath("session", "expiration"),
+			Message: fmt.Sprintf("Session Expiration %s", err),
+		})
+	}
+
+	if len(problems) > 0 {
+		return ValidatedSessionConfig{}, problems
+	}
+
+	return ValidatedSessionConfig{
+		CookieName:   cookieName,
+		CookieDomain: strings.TrimPrefix(c.CookieDomain, "."),
+		Expiration:   expiration,
+	}, nil
+}
+
+// cookieDomainProblems reports the hosts of services which would never be
+// sent the session cookie, as users would otherwise be sent back to log in
+// again and again. Hosts of patterns are checked with a sample host they
+// match.
+func cookieDomainProblems(oidc ValidatedOIDCConfig, session ValidatedSessionConfig, services map[string]service.Service) Problems {
+	problems := make(Problems, 0)
+	redirectHost := service.NormalizeHost(oidc.RedirectURI.Host)
+
+	if session.CookieDomain != "" && !withinDomain(redirectHost, session.CookieDomain) {
+		problems = append(problems, Problem{
+			Path: yamlPath("session", "cookie_domain"),
+			Message: fmt.Sprintf(
+				"Session CookieDomain %s must contain the OIDC redirect host %s",
+				session.CookieDomain, redirectHost,
+			),
+		})
+	}
+
+	identifiers := make([]string, 0, len(services))
+	for identifier := range services {
+		identifiers = append(identifiers, identifier)
+	}
+	sort.Strings(identifiers)
+
+	for _, identifier := range identifiers {
+		for index, matcher := range services[identifier].Matchers {
+			host := matcher.Host
+			if matcher.IsPattern() {
+				host, _ = samplePattern(matcher.Pattern)
+			}
+
+			switch {
+			case session.CookieDomain == "" && (matcher.IsPattern() || host != redirectHost):
+				return append(problems, Problem{
+					Path: yamlPath("session", "cookie_domain"),
+					Message: fmt.Sprintf(
+						"Session CookieDomain must be present as service %s has host %s, which is not the OIDC redirect host %s",
+						identifier, matcher.String(), redirectHost,
+					),
+				})
+			case session.CookieDomain != "" && !withinDomain(host, session.CookieDomain):
+				problems = append(problems, Problem{
+					Path: yamlIndex(yamlPath("services", identifier, "matchers"), index),
+					Message: fmt.Sprintf(
+						"Host %s is not within the session CookieDomain %s", matcher.String(), session.CookieDomain,
+					),
+				})
+			}
+		}
+	}
+
+	return problems
+}
+
+func withinDomain(host, domain string) bool {
+	domain = service.NormalizeHost(domain)
+	return host == domain || strings.HasSuffix(host, "."+domain)
+}
@@ -0,0 +1,97 @@
+package cfg
+
+import (
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Session Config", func() {
+	It("Parses a valid configuration and provides defaults", func() {
+		cfg := SessionConfig{CookieDomain: ".mydomain.com"}
+		validatedCfg, err := cfg.Validate()
+
+		Expect(err).NotTo(HaveOccurred())
+		Expect(validatedCfg.CookieName).To(Equal("iap_session"))
+		Expect(validatedCfg.CookieDomain).To(Equal("mydomain.com"))
+		Expect(validatedCfg.Expiration).To(Equal(8 * time.Hour))
+	})
+
+	It("Does not validate an invalid cookie name", func() {
+		cfg := SessionConfig{CookieName: "iap session"}
+		_, err := cfg.Validate()
+
+		Expect(err).To(MatchError(ContainSubstring("Session CookieName must be a valid cookie name")))
+	})
+
+	It("Does not validate an invalid expiration", func() {
+		cfg := SessionConfig{Expiration: "forever"}
+		_, err := cfg.Validate()
+
+		Expect(err).To(MatchError(ContainSubstring("Session Expiration must be a valid duration")))
+	})
+})
+
+var _ = Describe("Session cookie domain", func() {
+	validate := func(cookieDomain string, hosts ...string) error {
+		matchers := make([]MatcherConfig, 0, len(hosts))
+		for _, host := range hosts {
+			matchers = append(matchers, MatcherConfig{Host: host})
+		}
+
+		cfg := Config{
+			OIDCConfig: OIDCConfig{
+				RedirectURI: "https://iap.mydomain.com/oidc/callback",
+
+				AuthURI:  "https://accounts.google.com/o/oauth2/v2/auth",
+				TokenURI: "https://www.googleapis.com/oauth2/v4/token",
+
+				ClientID:     "my-client-id",
+				ClientSecret: "my-client-secret",
+			},
+			Session: SessionConfig{CookieDomain: cookieDomain},
+			Services: map[string]ServiceConfig{
+				"my-service": ServiceConfig{
+					UpstreamURI: "http://my-service.local",
+					Matchers:    matchers,
+				},
+			},
+		}
+
+		_, err := cfg.Validate()
+		return err
+	}
+
+	It("Is optional when services only have the host of the redirect URI", func() {
+		Expect(validate("", "iap.mydomain.com")).To(Succeed())
+	})
+
+	It("Is required when a service has another host", func() {
+		err := validate("", "iap.mydomain.com", "my-service.mydomain.com")
+		Expect(err).To(MatchError(ContainSubstring(
+			"session.cookie_domain: Session CookieDomain must be present as service my-service has host my-service.mydomain.com",
+		)))
+
+		err = validate("", "*.mydomain.com")
+		Expect(err).To(MatchError(ContainSubstring("session.cookie_domain: Session CookieDomain must be present")))
+	})
+
+	It("Accepts services within the cookie domain", func() {
+		Expect(validate("mydomain.com", "my-service.mydomain.com", "*.previews.mydomain.com")).To(Succeed())
+	})
+
+	It("Rejects services outside the cookie domain", func() {
+		err := validate("mydomain.com", "my-service.mydomain.com", "my-service.otherdomain.com")
+		Expect(err).To(MatchError(ContainSubstring(
+			"services.my-service.matchers[1]: Host my-service.otherdomain.com is not within the session CookieDomain mydomain.com",
+		)))
+	})
+
+	It("Rejects a cookie domain which does not contain the redirect host", func() {
+		err := validate("services.mydomain.com", "my-service.services.mydomain.com")
+		Expect(err).To(MatchError(ContainSubstring(
+			"session.cookie_domain: Session CookieDomain services.mydomain.com must contain the OIDC redirect host iap.mydomain.com",
+		)))
+	})
+})
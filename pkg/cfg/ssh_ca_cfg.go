@@ -0,0 +1,74 @@
+package cfg
+
+import (
+	"fmt"
+	"io/ioutil"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+
+	"github.com/alphagov/iap/pkg/sshca"
+)
+
+// Example configuration file
+// ---
+// ssh_ca:
+//   key_file: /etc/iap/ssh-ca # ssh-keygen -t ed25519 -f /etc/iap/ssh-ca
+//   validity: 1h              # at most 8h
+//
+// Hosts trust the CA with TrustedUserCAKeys, and let users log in as the
+// principals of their certificates, which are their roles.
+
+// SSHCAConfig represents an unvalidated SSH CA configuration
+type SSHCAConfig struct {
+	KeyFile  string `json:"key_file"`
+	Validity string `json:"validity"`
+}
+
+// ValidatedSSHCAConfig represents a validated SSH CA configuration
+type ValidatedSSHCAConfig struct {
+	Signer   ssh.Signer
+	Validity time.Duration
+}
+
+// Validate does validation of SSHCAConfig, loading the key of the CA
+func (c *SSHCAConfig) Validate() (ValidatedSSHCAConfig, error) {
+	return c.validate(true)
+}
+
+// validate does validation of SSHCAConfig, without a Signer unless the key
+// is loaded
+func (c *SSHCAConfig) validate(load bool) (ValidatedSSHCAConfig, error) {
+	cfg := ValidatedSSHCAConfig{}
+
+	if c.KeyFile == "" {
+		return cfg, fmt.Errorf("SSH CA KeyFile must be given")
+	}
+
+	var signer ssh.Signer
+	if load {
+		blob, err := ioutil.ReadFile(c.KeyFile)
+		if err != nil {
+			return cfg, fmt.Errorf("SSH CA KeyFile could not be read: %s", err)
+		}
+
+		signer, err = ssh.ParsePrivateKey(blob)
+		if err != nil {
+			return cfg, fmt.Errorf("SSH CA KeyFile must contain an unencrypted private key: %s", err)
+		}
+	}
+
+	validity, err := parseDuration(c.Validity, time.Hour)
+	if err != nil {
+		return cfg, fmt.Errorf("SSH CA Validity %s", err)
+	}
+
+	if validity > sshca.MaxValidity {
+		return cfg, fmt.Errorf("SSH CA Validity cannot be longer than %s", sshca.MaxValidity)
+	}
+
+	return ValidatedSSHCAConfig{
+		Signer:   signer,
+		Validity: validity,
+	}, nil
+}
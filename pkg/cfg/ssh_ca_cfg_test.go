@@ -0,0 +1,73 @@
+package cfg
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/pem"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"golang.org/x/crypto/ssh"
+)
+
+var _ = Describe("SSH CA Config", func() {
+	var (
+		dir     string
+		keyFile string
+	)
+
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "iap-ssh-ca")
+		Expect(err).NotTo(HaveOccurred())
+
+		_, key, err := ed25519.GenerateKey(rand.Reader)
+		Expect(err).NotTo(HaveOccurred())
+
+		block, err := ssh.MarshalPrivateKey(key, "iap")
+		Expect(err).NotTo(HaveOccurred())
+
+		keyFile = filepath.Join(dir, "ssh-ca")
+		Expect(ioutil.WriteFile(keyFile, pem.EncodeToMemory(block), 0600)).To(Succeed())
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(dir)
+	})
+
+	It("Parses a valid configuration with defaults", func() {
+		cfg := SSHCAConfig{KeyFile: keyFile}
+		validatedCfg, err := cfg.Validate()
+
+		Expect(err).NotTo(HaveOccurred())
+		Expect(validatedCfg.Signer.PublicKey().Type()).To(Equal(ssh.KeyAlgoED25519))
+		Expect(validatedCfg.Validity).To(Equal(time.Hour))
+	})
+
+	It("Does not validate a validity longer than the credentials", func() {
+		cfg := SSHCAConfig{KeyFile: keyFile, Validity: "24h"}
+		_, err := cfg.Validate()
+
+		Expect(err).To(MatchError(ContainSubstring("SSH CA Validity cannot be longer than 8h0m0s")))
+	})
+
+	It("Does not validate a file without a private key", func() {
+		certFile, _ := writeCertificate(dir)
+
+		cfg := SSHCAConfig{KeyFile: certFile}
+		_, err := cfg.Validate()
+
+		Expect(err).To(MatchError(ContainSubstring("SSH CA KeyFile must contain an unencrypted private key")))
+	})
+
+	It("Does not validate a configuration without a key file", func() {
+		cfg := SSHCAConfig{}
+		_, err := cfg.Validate()
+
+		Expect(err).To(MatchError(ContainSubstring("SSH CA KeyFile must be given")))
+	})
+})
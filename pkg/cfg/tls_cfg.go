@@ -0,0 +1,70 @@
+package cfg
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+)
+
+// Example configuration file
+// ---
+// services:
+//   my-service:
+//     upstream_uri: https://my-service.internal
+//     tls:
+//       ca_file: /etc/iap/internal-ca.pem
+//       cert_file: /etc/iap/iap-client.pem
+//       key_file: /etc/iap/iap-client-key.pem
+//       server_name: my-service.internal.mydomain.com
+//       insecure_skip_verify: false
+
+// UpstreamTLSConfig represents an unvalidated upstream TLS configuration
+type UpstreamTLSConfig struct {
+	CAFile             string `json:"ca_file"`
+	CertFile           string `json:"cert_file"`
+	KeyFile            string `json:"key_file"`
+	ServerName         string `json:"server_name"`
+	InsecureSkipVerify bool   `json:"insecure_skip_verify"`
+}
+
+// Validate does validation of UpstreamTLSConfig, loading the certificates
+func (c *UpstreamTLSConfig) Validate() (*tls.Config, error) {
+	return c.validate(true)
+}
+
+// validate does validation of UpstreamTLSConfig, without the CAs and client
+// certificate unless they are loaded
+func (c *UpstreamTLSConfig) validate(load bool) (*tls.Config, error) {
+	cfg := &tls.Config{
+		ServerName:         c.ServerName,
+		InsecureSkipVerify: c.InsecureSkipVerify,
+	}
+
+	if c.CAFile != "" && load {
+		blob, err := ioutil.ReadFile(c.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("TLS CAFile could not be read: %s", err)
+		}
+
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(blob) {
+			return nil, fmt.Errorf("TLS CAFile does not contain any PEM certificates")
+		}
+		cfg.RootCAs = pool
+	}
+
+	if (c.CertFile == "") != (c.KeyFile == "") {
+		return nil, fmt.Errorf("TLS CertFile and KeyFile must be given together")
+	}
+
+	if c.CertFile != "" && load {
+		certificate, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("TLS client certificate could not be loaded: %s", err)
+		}
+		cfg.Certificates = []tls.Certificate{certificate}
+	}
+
+	return cfg, nil
+}
@@ -0,0 +1,151 @@
+package cfg
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+// writeCertificate writes a self signed CA certificate and its key to the directory
+func writeCertificate(dir string) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	Expect(err).NotTo(HaveOccurred())
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "iap"},
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(time.Hour),
+
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	Expect(err).NotTo(HaveOccurred())
+
+	keyDer, err := x509.MarshalPKCS8PrivateKey(key)
+	Expect(err).NotTo(HaveOccurred())
+
+	certFile := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+
+	Expect(ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{
+		Type: "CERTIFICATE", Bytes: der,
+	}), 0600)).To(Succeed())
+	Expect(ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{
+		Type: "PRIVATE KEY", Bytes: keyDer,
+	}), 0600)).To(Succeed())
+
+	return certFile, keyFile
+}
+
+var _ = Describe("Upstream TLS Config", func() {
+	var (
+		dir      string
+		certFile string
+		keyFile  string
+	)
+
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "iap-tls")
+		Expect(err).NotTo(HaveOccurred())
+
+		certFile, keyFile = writeCertificate(dir)
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(dir)
+	})
+
+	It("Parses a valid configuration", func() {
+		cfg := UpstreamTLSConfig{
+			CAFile:     certFile,
+			CertFile:   certFile,
+			KeyFile:    keyFile,
+			ServerName: "my-service.internal",
+		}
+
+		validatedCfg, err := cfg.Validate()
+
+		Expect(err).NotTo(HaveOccurred())
+		Expect(validatedCfg.RootCAs).NotTo(BeNil())
+		Expect(validatedCfg.Certificates).To(HaveLen(1))
+		Expect(validatedCfg.ServerName).To(Equal("my-service.internal"))
+		Expect(validatedCfg.InsecureSkipVerify).To(BeFalse())
+	})
+
+	It("Does not validate a CA file without certificates", func() {
+		cfg := UpstreamTLSConfig{CAFile: keyFile}
+		_, err := cfg.Validate()
+
+		Expect(err).To(MatchError(ContainSubstring(
+			"TLS CAFile does not contain any PEM certificates",
+		)))
+	})
+
+	It("Does not validate a missing CA file", func() {
+		cfg := UpstreamTLSConfig{CAFile: filepath.Join(dir, "missing.pem")}
+		_, err := cfg.Validate()
+
+		Expect(err).To(MatchError(ContainSubstring("TLS CAFile could not be read")))
+	})
+
+	It("Does not validate a certificate without a key", func() {
+		cfg := UpstreamTLSConfig{CertFile: certFile}
+		_, err := cfg.Validate()
+
+		Expect(err).To(MatchError(ContainSubstring(
+			"TLS CertFile and KeyFile must be given together",
+		)))
+	})
+
+	It("Does not validate a mismatched certificate and key", func() {
+		cfg := UpstreamTLSConfig{CertFile: keyFile, KeyFile: certFile}
+		_, err := cfg.Validate()
+
+		Expect(err).To(MatchError(ContainSubstring(
+			"TLS client certificate could not be loaded",
+		)))
+	})
+
+	It("Warns about services which skip verification", func() {
+		cfg := Config{
+			OIDCConfig: OIDCConfig{
+				RedirectURI: "https://iap.mydomain.com/oidc/callback",
+
+				AuthURI:  "https://accounts.google.com/o/oauth2/v2/auth",
+				TokenURI: "https://www.googleapis.com/oauth2/v4/token",
+
+				ClientID:     "my-client-id",
+				ClientSecret: "my-client-secret",
+			},
+			Services: map[string]ServiceConfig{
+				"my-service": ServiceConfig{
+					UpstreamURI: "https://my-service.internal",
+					TLS:         &UpstreamTLSConfig{InsecureSkipVerify: true},
+				},
+			},
+		}
+
+		validatedCfg, err := cfg.Validate()
+
+		Expect(err).NotTo(HaveOccurred())
+		Expect(validatedCfg.Warnings).To(ConsistOf(
+			"services.my-service.tls.insecure_skip_verify: Service my-service does not verify the TLS certificates of its upstreams",
+		))
+	})
+})
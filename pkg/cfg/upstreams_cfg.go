@@ -0,0 +1,246 @@
+package cfg
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/goware/urlx"
+
+	"github.com/alphagov/iap/pkg/service"
+)
+
+// Example configuration file
+// ---
+// services:
+//   my-service:
+//     upstreams:
+//       - uri: http://my-service-1.local
+//         weight: 2
+//       - uri: http://my-service-2.local
+//     load_balancing: weighted # round_robin (default), least_connections or weighted
+//     health_check:
+//       path: /healthcheck
+//       interval: 10s
+//       timeout: 2s
+//       healthy_threshold: 2
+//       unhealthy_threshold: 3
+//     outlier_detection:
+//       consecutive_failures: 5
+//       ejection_duration: 30s
+//     timeouts:
+//       connect: 5s
+//       response_header: 30s
+//       idle: 90s
+//     retries: 2 # only for idempotent requests without a body
+//     circuit_breaker:
+//       consecutive_failures: 5
+//       open_duration: 30s
+
+// UpstreamConfig represents an unvalidated Upstream configuration
+type UpstreamConfig struct {
+	URI    string `json:"uri"`
+	Weight int    `json:"weight"`
+}
+
+// Validate does validation of UpstreamConfig
+func (c *UpstreamConfig) Validate() (service.Upstream, error) {
+	cfg := service.Upstream{}
+
+	uri, err := urlx.ParseWithDefaultScheme(c.URI, "https")
+	if err != nil {
+		return cfg, fmt.Errorf("Upstream URI must be a valid URI")
+	}
+
+	weight := c.Weight
+	if weight == 0 {
+		weight = 1
+	}
+
+	if weight < 0 {
+		return cfg, fmt.Errorf("Upstream Weight must be positive")
+	}
+
+	return service.Upstream{
+		URI:    *uri,
+		Weight: weight,
+	}, nil
+}
+
+// HealthCheckConfig represents an unvalidated HealthCheck configuration
+type HealthCheckConfig struct {
+	Path               string `json:"path"`
+	Interval           string `json:"interval"`
+	Timeout            string `json:"timeout"`
+	HealthyThreshold   int    `json:"healthy_threshold"`
+	UnhealthyThreshold int    `json:"unhealthy_threshold"`
+}
+
+// Validate does validation of HealthCheckConfig
+func (c *HealthCheckConfig) Validate() (service.HealthCheck, error) {
+	cfg := service.HealthCheck{}
+
+	if !strings.HasPrefix(c.Path, "/") {
+		return cfg, fmt.Errorf("Health Check Path must start with /")
+	}
+
+	interval, err := parseDuration(c.Interval, 10*time.Second)
+	if err != nil {
+		return cfg, fmt.Errorf("Health Check Interval %s", err)
+	}
+
+	timeout, err := parseDuration(c.Timeout, 2*time.Second)
+	if err != nil {
+		return cfg, fmt.Errorf("Health Check Timeout %s", err)
+	}
+
+	if timeout > interval {
+		return cfg, fmt.Errorf("Health Check Timeout cannot be longer than the Interval")
+	}
+
+	healthyThreshold, err := parseThreshold(c.HealthyThreshold, 2)
+	if err != nil {
+		return cfg, fmt.Errorf("Health Check HealthyThreshold %s", err)
+	}
+
+	unhealthyThreshold, err := parseThreshold(c.UnhealthyThreshold, 3)
+	if err != nil {
+		return cfg, fmt.Errorf("Health Check UnhealthyThreshold %s", err)
+	}
+
+	return service.HealthCheck{
+		Path:               c.Path,
+		Interval:           interval,
+		Timeout:            timeout,
+		HealthyThreshold:   healthyThreshold,
+		UnhealthyThreshold: unhealthyThreshold,
+	}, nil
+}
+
+// OutlierDetectionConfig represents an unvalidated OutlierDetection configuration
+type OutlierDetectionConfig struct {
+	ConsecutiveFailures int    `json:"consecutive_failures"`
+	EjectionDuration    string `json:"ejection_duration"`
+}
+
+// Validate does validation of OutlierDetectionConfig
+func (c *OutlierDetectionConfig) Validate() (service.OutlierDetection, error) {
+	cfg := service.OutlierDetection{}
+
+	consecutiveFailures, err := parseThreshold(c.ConsecutiveFailures, 5)
+	if err != nil {
+		return cfg, fmt.Errorf("Outlier Detection ConsecutiveFailures %s", err)
+	}
+
+	ejectionDuration, err := parseDuration(c.EjectionDuration, 30*time.Second)
+	if err != nil {
+		return cfg, fmt.Errorf("Outlier Detection EjectionDuration %s", err)
+	}
+
+	return service.OutlierDetection{
+		ConsecutiveFailures: consecutiveFailures,
+		EjectionDuration:    ejectionDuration,
+	}, nil
+}
+
+// TimeoutsConfig represents an unvalidated Timeouts configuration
+type TimeoutsConfig struct {
+	Connect        string `json:"connect"`
+	ResponseHeader string `json:"response_header"`
+	Idle           string `json:"idle"`
+}
+
+// Validate does validation of TimeoutsConfig
+func (c *TimeoutsConfig) Validate() (service.Timeouts, error) {
+	cfg := service.Timeouts{}
+
+	connect, err := parseDuration(c.Connect, 30*time.Second)
+	if err != nil {
+		return cfg, fmt.Errorf("Timeouts Connect %s", err)
+	}
+
+	responseHeader, err := parseDuration(c.ResponseHeader, time.Minute)
+	if err != nil {
+		return cfg, fmt.Errorf("Timeouts ResponseHeader %s", err)
+	}
+
+	idle, err := parseDuration(c.Idle, 90*time.Second)
+	if err != nil {
+		return cfg, fmt.Errorf("Timeouts Idle %s", err)
+	}
+
+	return service.Timeouts{
+		Connect:        connect,
+		ResponseHeader: responseHeader,
+		Idle:           idle,
+	}, nil
+}
+
+// CircuitBreakerConfig represents an unvalidated CircuitBreaker configuration
+type CircuitBreakerConfig struct {
+	ConsecutiveFailures int    `json:"consecutive_failures"`
+	OpenDuration        string `json:"open_duration"`
+}
+
+// Validate does validation of CircuitBreakerConfig
+func (c *CircuitBreakerConfig) Validate() (service.CircuitBreaker, error) {
+	cfg := service.CircuitBreaker{}
+
+	consecutiveFailures, err := parseThreshold(c.ConsecutiveFailures, 5)
+	if err != nil {
+		return cfg, fmt.Errorf("Circuit Breaker ConsecutiveFailures %s", err)
+	}
+
+	openDuration, err := parseDuration(c.OpenDuration, 30*time.Second)
+	if err != nil {
+		return cfg, fmt.Errorf("Circuit Breaker OpenDuration %s", err)
+	}
+
+	return service.CircuitBreaker{
+		ConsecutiveFailures: consecutiveFailures,
+		OpenDuration:        openDuration,
+	}, nil
+}
+
+func validateLoadBalancing(policy string) (string, error) {
+	switch policy {
+	case "":
+		return service.RoundRobin, nil
+	case service.RoundRobin, service.LeastConnections, service.Weighted:
+		return policy, nil
+	}
+
+	return "", fmt.Errorf(
+		"Service Load Balancing must be one of %s, %s or %s",
+		service.RoundRobin, service.LeastConnections, service.Weighted,
+	)
+}
+
+func parseDuration(duration string, defaultDuration time.Duration) (time.Duration, error) {
+	if duration == "" {
+		return defaultDuration, nil
+	}
+
+	parsed, err := time.ParseDuration(duration)
+	if err != nil {
+		return 0, fmt.Errorf("must be a valid duration: %s", err)
+	}
+
+	if parsed <= 0 {
+		return 0, fmt.Errorf("must be positive")
+	}
+
+	return parsed, nil
+}
+
+func parseThreshold(threshold int, defaultThreshold int) (int, error) {
+	if threshold == 0 {
+		return defaultThreshold, nil
+	}
+
+	if threshold < 0 {
+		return 0, fmt.Errorf("must be positive")
+	}
+
+	return threshold, nil
+}
@@ -0,0 +1,198 @@
+package cfg
+
+import (
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/alphagov/iap/pkg/service"
+)
+
+var _ = Describe("Upstream Config", func() {
+	It("Parses a valid configuration and provides defaults", func() {
+		cfg := UpstreamConfig{URI: "my-service-1.local"}
+		validatedCfg, err := cfg.Validate()
+
+		Expect(err).NotTo(HaveOccurred())
+		Expect(validatedCfg.URI.String()).To(Equal("https://my-service-1.local"))
+		Expect(validatedCfg.Weight).To(Equal(1))
+	})
+
+	It("Does not validate a negative weight", func() {
+		cfg := UpstreamConfig{URI: "my-service-1.local", Weight: -1}
+		_, err := cfg.Validate()
+
+		Expect(err).To(MatchError(ContainSubstring("Upstream Weight must be positive")))
+	})
+})
+
+var _ = Describe("Health Check Config", func() {
+	It("Parses a valid configuration and provides defaults", func() {
+		cfg := HealthCheckConfig{Path: "/healthcheck"}
+		validatedCfg, err := cfg.Validate()
+
+		Expect(err).NotTo(HaveOccurred())
+		Expect(validatedCfg.Interval).To(Equal(10 * time.Second))
+		Expect(validatedCfg.Timeout).To(Equal(2 * time.Second))
+		Expect(validatedCfg.HealthyThreshold).To(Equal(2))
+		Expect(validatedCfg.UnhealthyThreshold).To(Equal(3))
+	})
+
+	It("Does not validate a relative path", func() {
+		cfg := HealthCheckConfig{Path: "healthcheck"}
+		_, err := cfg.Validate()
+
+		Expect(err).To(MatchError(ContainSubstring("Health Check Path must start with /")))
+	})
+
+	It("Does not validate an invalid interval", func() {
+		cfg := HealthCheckConfig{Path: "/healthcheck", Interval: "often"}
+		_, err := cfg.Validate()
+
+		Expect(err).To(MatchError(ContainSubstring("Health Check Interval must be a valid duration")))
+	})
+
+	It("Does not validate a timeout longer than the interval", func() {
+		cfg := HealthCheckConfig{Path: "/healthcheck", Interval: "1s", Timeout: "5s"}
+		_, err := cfg.Validate()
+
+		Expect(err).To(MatchError(ContainSubstring(
+			"Health Check Timeout cannot be longer than the Interval",
+		)))
+	})
+})
+
+var _ = Describe("Outlier Detection Config", func() {
+	It("Parses a valid configuration and provides defaults", func() {
+		cfg := OutlierDetectionConfig{}
+		validatedCfg, err := cfg.Validate()
+
+		Expect(err).NotTo(HaveOccurred())
+		Expect(validatedCfg.ConsecutiveFailures).To(Equal(5))
+		Expect(validatedCfg.EjectionDuration).To(Equal(30 * time.Second))
+	})
+
+	It("Does not validate a negative number of failures", func() {
+		cfg := OutlierDetectionConfig{ConsecutiveFailures: -1}
+		_, err := cfg.Validate()
+
+		Expect(err).To(MatchError(ContainSubstring(
+			"Outlier Detection ConsecutiveFailures must be positive",
+		)))
+	})
+})
+
+var _ = Describe("Service Config upstreams", func() {
+	It("Parses a service with many upstreams", func() {
+		cfg := ServiceConfig{
+			Upstreams: []UpstreamConfig{
+				UpstreamConfig{URI: "http://my-service-1.local", Weight: 2},
+				UpstreamConfig{URI: "http://my-service-2.local"},
+			},
+			LoadBalancing:    "weighted",
+			HealthCheck:      &HealthCheckConfig{Path: "/healthcheck"},
+			OutlierDetection: &OutlierDetectionConfig{},
+		}
+
+		validatedCfg, err := cfg.Validate("my-service")
+
+		Expect(err).NotTo(HaveOccurred())
+		Expect(validatedCfg.Upstreams).To(HaveLen(2))
+		Expect(validatedCfg.UpstreamURI.String()).To(Equal("http://my-service-1.local"))
+		Expect(validatedCfg.LoadBalancing).To(Equal(service.Weighted))
+		Expect(validatedCfg.HealthCheck).NotTo(BeNil())
+		Expect(validatedCfg.OutlierDetection).NotTo(BeNil())
+	})
+
+	It("Parses a service with a single upstream uri as one upstream", func() {
+		cfg := ServiceConfig{UpstreamURI: "my-service.local"}
+
+		validatedCfg, err := cfg.Validate("my-service")
+
+		Expect(err).NotTo(HaveOccurred())
+		Expect(validatedCfg.Upstreams).To(HaveLen(1))
+		Expect(validatedCfg.LoadBalancing).To(Equal(service.RoundRobin))
+	})
+
+	It("Does not validate a service with both an upstream uri and upstreams", func() {
+		cfg := ServiceConfig{
+			UpstreamURI: "my-service.local",
+			Upstreams:   []UpstreamConfig{UpstreamConfig{URI: "my-service-1.local"}},
+		}
+
+		_, err := cfg.Validate("my-service")
+
+		Expect(err).To(MatchError(ContainSubstring(
+			"Service cannot have both an Upstream URI and Upstreams",
+		)))
+	})
+
+	It("Does not validate an unknown load balancing policy", func() {
+		cfg := ServiceConfig{UpstreamURI: "my-service.local", LoadBalancing: "random"}
+
+		_, err := cfg.Validate("my-service")
+
+		Expect(err).To(MatchError(ContainSubstring("Service Load Balancing must be one of")))
+	})
+
+	It("Does not validate health checks of an upstream uri using capture groups", func() {
+		cfg := ServiceConfig{
+			UpstreamURI: "http://pr-$1.internal",
+			Matchers: []MatcherConfig{
+				MatcherConfig{HostPattern: `pr-(\d+)\.preview\.mydomain\.com`},
+			},
+			HealthCheck: &HealthCheckConfig{Path: "/healthcheck"},
+		}
+
+		_, err := cfg.Validate("review-apps")
+
+		Expect(err).To(MatchError(ContainSubstring("cannot be health checked")))
+	})
+})
+
+var _ = Describe("Timeouts Config", func() {
+	It("Parses a valid configuration and provides defaults", func() {
+		cfg := TimeoutsConfig{Connect: "5s"}
+		validatedCfg, err := cfg.Validate()
+
+		Expect(err).NotTo(HaveOccurred())
+		Expect(validatedCfg.Connect).To(Equal(5 * time.Second))
+		Expect(validatedCfg.ResponseHeader).To(Equal(time.Minute))
+		Expect(validatedCfg.Idle).To(Equal(90 * time.Second))
+	})
+
+	It("Does not validate a negative timeout", func() {
+		cfg := TimeoutsConfig{Idle: "-5s"}
+		_, err := cfg.Validate()
+
+		Expect(err).To(MatchError(ContainSubstring("Timeouts Idle must be positive")))
+	})
+})
+
+var _ = Describe("Circuit Breaker Config", func() {
+	It("Parses a valid configuration and provides defaults", func() {
+		cfg := CircuitBreakerConfig{ConsecutiveFailures: 3}
+		validatedCfg, err := cfg.Validate()
+
+		Expect(err).NotTo(HaveOccurred())
+		Expect(validatedCfg.ConsecutiveFailures).To(Equal(3))
+		Expect(validatedCfg.OpenDuration).To(Equal(30 * time.Second))
+	})
+
+	It("Does not validate an invalid open duration", func() {
+		cfg := CircuitBreakerConfig{OpenDuration: "soon"}
+		_, err := cfg.Validate()
+
+		Expect(err).To(MatchError(ContainSubstring(
+			"Circuit Breaker OpenDuration must be a valid duration",
+		)))
+	})
+
+	It("Does not validate a service with negative retries", func() {
+		cfg := ServiceConfig{UpstreamURI: "my-service.local", Retries: -1}
+		_, err := cfg.Validate("my-service")
+
+		Expect(err).To(MatchError(ContainSubstring("Service Retries cannot be negative")))
+	})
+})
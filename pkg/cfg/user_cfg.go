@@ -17,6 +17,11 @@ import (
 //     roles:
 //       - superuser
 //		   - readonlyuser
+//
+// Anyone who logs in, sends a bearer token or a client certificate without
+// being one of the users is denied access to every service, unless
+// allow_unlisted_users is true, in which case they can access the services
+// which do not require any role.
 
 // UserConfig represents an unvalidated User configuration
 type UserConfig struct {
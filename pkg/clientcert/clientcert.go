@@ -0,0 +1,165 @@
+package clientcert
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"regexp"
+)
+
+// Fields of client certificates which can identify users
+const (
+	CommonName   = "common_name"
+	DNSName      = "dns_san"
+	EmailAddress = "email_san"
+	URI          = "uri_san"
+)
+
+// Mapping represents a validated mapping of a certificate field to the
+// identifier of a user
+type Mapping struct {
+	Field string
+
+	// Pattern has to match the whole value of the field, when nil every
+	// value matches
+	Pattern *regexp.Regexp
+
+	// Identifier can reference the capture groups of the Pattern, eg: $1,
+	// when empty the value of the field is the identifier
+	Identifier string
+}
+
+// Identify returns the identifier of the user for the first value of the field
+// matching the Pattern.
+func (m Mapping) Identify(cert *x509.Certificate) (string, bool) {
+	for _, value := range fieldValues(cert, m.Field) {
+		if value == "" {
+			continue
+		}
+
+		if m.Pattern == nil {
+			return value, true
+		}
+
+		captures := m.Pattern.FindStringSubmatchIndex(value)
+		if captures == nil || captures[0] != 0 || captures[1] != len(value) {
+			continue
+		}
+
+		if m.Identifier == "" {
+			return value, true
+		}
+
+		identifier := m.Pattern.ExpandString(nil, m.Identifier, value, captures)
+		if len(identifier) > 0 {
+			return string(identifier), true
+		}
+	}
+
+	return "", false
+}
+
+func fieldValues(cert *x509.Certificate, field string) []string {
+	switch field {
+	case CommonName:
+		return []string{cert.Subject.CommonName}
+	case DNSName:
+		return cert.DNSNames
+	case EmailAddress:
+		return cert.EmailAddresses
+	case URI:
+		values := make([]string, 0, len(cert.URIs))
+		for _, uri := range cert.URIs {
+			values = append(values, uri.String())
+		}
+		return values
+	}
+
+	return nil
+}
+
+// Identities represents validated client certificate authentication, the
+// certificates have to be issued by the CAs and are mapped to users by the
+// first matching Mapping
+type Identities struct {
+	CAs      []*x509.Certificate
+	Mappings []Mapping
+}
+
+// Identify returns the identifier of the user the certificate belongs to.
+func (i *Identities) Identify(cert *x509.Certificate) (string, bool) {
+	for _, mapping := range i.Mappings {
+		if identifier, ok := mapping.Identify(cert); ok {
+			return identifier, true
+		}
+	}
+
+	return "", false
+}
+
+// FromConnectionState returns the identifier of the user whose certificate was
+// verified during the TLS handshake. Certificates which were not issued by the
+// CAs are never trusted, even if the handshake trusted other CAs too.
+func (i *Identities) FromConnectionState(state *tls.ConnectionState) (string, bool) {
+	if state == nil || len(state.VerifiedChains) == 0 || len(state.PeerCertificates) == 0 {
+		return "", false
+	}
+
+	intermediates := x509.NewCertPool()
+	for _, cert := range state.PeerCertificates[1:] {
+		intermediates.AddCert(cert)
+	}
+
+	leaf := state.PeerCertificates[0]
+	_, err := leaf.Verify(x509.VerifyOptions{
+		Roots:         pool(i.CAs),
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	})
+	if err != nil {
+		return "", false
+	}
+
+	return i.Identify(leaf)
+}
+
+// Sources are the Identities trusted by a listener, eg: the certificates of an
+// internal CA along with the ones issued by IAP.
+type Sources []*Identities
+
+// FromConnectionState returns the identifier given by the first of the sources
+// which issued the verified certificate.
+func (s Sources) FromConnectionState(state *tls.ConnectionState) (string, bool) {
+	for _, identities := range s {
+		if identifier, ok := identities.FromConnectionState(state); ok {
+			return identifier, true
+		}
+	}
+
+	return "", false
+}
+
+// ServerConfig asks clients for a certificate issued by the CAs of any of the
+// sources, clients without one can still authenticate in other ways.
+func (s Sources) ServerConfig(config *tls.Config) *tls.Config {
+	config = config.Clone()
+	if len(s) == 0 {
+		return config
+	}
+
+	cas := make([]*x509.Certificate, 0)
+	for _, identities := range s {
+		cas = append(cas, identities.CAs...)
+	}
+
+	config.ClientCAs = pool(cas)
+	config.ClientAuth = tls.VerifyClientCertIfGiven
+	return config
+}
+
+func pool(cas []*x509.Certificate) *x509.CertPool {
+	pool := x509.NewCertPool()
+	for _, ca := range cas {
+		pool.AddCert(ca)
+	}
+	return pool
+}
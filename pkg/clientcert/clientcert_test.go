@@ -0,0 +1,199 @@
+package clientcert_test
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"time"
+
+	"github.com/alphagov/iap/pkg/clientcert"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+type authority struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+func newAuthority() authority {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	Expect(err).NotTo(HaveOccurred())
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "IAP Clients CA"},
+		NotBefore:             time.Now().Add(-time.Minute),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	Expect(err).NotTo(HaveOccurred())
+
+	cert, err := x509.ParseCertificate(der)
+	Expect(err).NotTo(HaveOccurred())
+
+	return authority{cert: cert, key: key}
+}
+
+func (a authority) issue(template *x509.Certificate) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	Expect(err).NotTo(HaveOccurred())
+
+	template.SerialNumber = big.NewInt(time.Now().UnixNano())
+	template.NotBefore = time.Now().Add(-time.Minute)
+	template.NotAfter = time.Now().Add(time.Hour)
+	template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, a.cert, &key.PublicKey, a.key)
+	Expect(err).NotTo(HaveOccurred())
+
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+var _ = Describe("Client certificates", func() {
+	var (
+		ca         authority
+		identities *clientcert.Identities
+	)
+
+	BeforeEach(func() {
+		ca = newAuthority()
+
+		identities = &clientcert.Identities{
+			CAs: []*x509.Certificate{ca.cert},
+			Mappings: []clientcert.Mapping{
+				{
+					Field:      clientcert.DNSName,
+					Pattern:    regexp.MustCompile(`(.+)\.machines\.mydomain\.com`),
+					Identifier: "$1@machines.mydomain.com",
+				},
+				{Field: clientcert.EmailAddress},
+			},
+		}
+	})
+
+	It("should map a SAN to an identifier with the pattern", func() {
+		cert, err := x509.ParseCertificate(ca.issue(&x509.Certificate{
+			DNSNames: []string{"other.mydomain.com", "deploy.machines.mydomain.com"},
+		}).Certificate[0])
+		Expect(err).NotTo(HaveOccurred())
+
+		identifier, ok := identities.Identify(cert)
+		Expect(ok).To(BeTrue())
+		Expect(identifier).To(Equal("deploy@machines.mydomain.com"))
+	})
+
+	It("should only match the whole value of the field", func() {
+		cert, err := x509.ParseCertificate(ca.issue(&x509.Certificate{
+			DNSNames: []string{"deploy.machines.mydomain.com.evil.com"},
+		}).Certificate[0])
+		Expect(err).NotTo(HaveOccurred())
+
+		_, ok := identities.Identify(cert)
+		Expect(ok).To(BeFalse())
+	})
+
+	It("should fall through to the next mapping", func() {
+		cert, err := x509.ParseCertificate(ca.issue(&x509.Certificate{
+			Subject:        pkix.Name{CommonName: "Fname Lname"},
+			EmailAddresses: []string{"fname.lname@mydomain.com"},
+		}).Certificate[0])
+		Expect(err).NotTo(HaveOccurred())
+
+		identifier, ok := identities.Identify(cert)
+		Expect(ok).To(BeTrue())
+		Expect(identifier).To(Equal("fname.lname@mydomain.com"))
+	})
+
+	It("should map the common name and URIs", func() {
+		spiffe, err := url.Parse("spiffe://mydomain.com/deploy")
+		Expect(err).NotTo(HaveOccurred())
+
+		cert, err := x509.ParseCertificate(ca.issue(&x509.Certificate{
+			Subject: pkix.Name{CommonName: "deploy-bot"},
+			URIs:    []*url.URL{spiffe},
+		}).Certificate[0])
+		Expect(err).NotTo(HaveOccurred())
+
+		identifier, ok := (&clientcert.Identities{
+			Mappings: []clientcert.Mapping{{Field: clientcert.CommonName}},
+		}).Identify(cert)
+		Expect(ok).To(BeTrue())
+		Expect(identifier).To(Equal("deploy-bot"))
+
+		identifier, ok = (&clientcert.Identities{
+			Mappings: []clientcert.Mapping{{Field: clientcert.URI}},
+		}).Identify(cert)
+		Expect(ok).To(BeTrue())
+		Expect(identifier).To(Equal("spiffe://mydomain.com/deploy"))
+	})
+
+	Context("when serving TLS", func() {
+		var server *httptest.Server
+
+		BeforeEach(func() {
+			server = httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				identifier, ok := identities.FromConnectionState(r.TLS)
+				fmt.Fprintf(w, "%s %t", identifier, ok)
+			}))
+			server.TLS = clientcert.Sources{identities}.ServerConfig(&tls.Config{})
+			server.StartTLS()
+		})
+
+		AfterEach(func() {
+			server.Close()
+		})
+
+		get := func(certificates ...tls.Certificate) (string, error) {
+			client := server.Client()
+			client.Transport.(*http.Transport).TLSClientConfig.Certificates = certificates
+
+			resp, err := client.Get(server.URL)
+			if err != nil {
+				return "", err
+			}
+			defer resp.Body.Close()
+
+			body, err := ioutil.ReadAll(resp.Body)
+			return string(body), err
+		}
+
+		It("should identify a client with a verified certificate", func() {
+			body, err := get(ca.issue(&x509.Certificate{
+				EmailAddresses: []string{"fname.lname@mydomain.com"},
+			}))
+
+			Expect(err).NotTo(HaveOccurred())
+			Expect(body).To(Equal("fname.lname@mydomain.com true"))
+		})
+
+		It("should accept a client without a certificate without identifying it", func() {
+			body, err := get()
+
+			Expect(err).NotTo(HaveOccurred())
+			Expect(body).To(Equal(" false"))
+		})
+
+		It("should refuse a certificate issued by another CA", func() {
+			_, err := get(newAuthority().issue(&x509.Certificate{
+				EmailAddresses: []string{"fname.lname@mydomain.com"},
+			}))
+
+			Expect(err).To(HaveOccurred())
+		})
+	})
+})
@@ -0,0 +1,144 @@
+package clientcert
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"fmt"
+	"math/big"
+	"time"
+
+	"github.com/alphagov/iap/pkg/auth"
+	"github.com/alphagov/iap/pkg/user"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// MaxValidity caps how long issued certificates are valid for, like the
+	// credentials generated for the proxies.
+	MaxValidity = auth.UserExpiration
+	// clockSkew backdates certificates, so they are valid straight away on
+	// hosts with a clock slightly behind
+	clockSkew = time.Minute
+	// minimumRSABits is the smallest RSA key which will be certified.
+	minimumRSABits = 2048
+)
+
+// ErrInvalidRequest is returned when the certificate request cannot be trusted.
+var ErrInvalidRequest = errors.New("Certificate request is not valid")
+
+// Issuer is a struct capable of issuing short-lived client certificates, which
+// carry the identifier of the user as their common name and their roles as
+// organizational units.
+type Issuer struct {
+	ca       *x509.Certificate
+	key      crypto.Signer
+	validity time.Duration
+	logger   *logrus.Logger
+	now      func() time.Time
+}
+
+// NewIssuer will construct the struct elsewhere.
+func NewIssuer(ca *x509.Certificate, key crypto.Signer, validity time.Duration, logger *logrus.Logger) *Issuer {
+	return &Issuer{
+		ca:       ca,
+		key:      key,
+		validity: validity,
+		logger:   logger,
+		now:      time.Now,
+	}
+}
+
+// CA returns the certificate of the CA issuing the client certificates.
+func (i *Issuer) CA() *x509.Certificate {
+	return i.ca
+}
+
+// Identities returns how the issued certificates identify users.
+func (i *Issuer) Identities() *Identities {
+	return &Identities{
+		CAs:      []*x509.Certificate{i.ca},
+		Mappings: []Mapping{{Field: CommonName}},
+	}
+}
+
+// Check makes sure certificates can still be issued, the CA must not have
+// expired and its key must be able to sign.
+func (i *Issuer) Check() error {
+	if i.now().After(i.ca.NotAfter) {
+		return fmt.Errorf("Client CA certificate expired at %s", i.ca.NotAfter.UTC().Format(time.RFC3339))
+	}
+
+	public, ok := i.key.Public().(interface{ Equal(crypto.PublicKey) bool })
+	if !ok || !public.Equal(i.ca.PublicKey) {
+		return fmt.Errorf("Client CA key does not match its certificate")
+	}
+
+	// Ed25519 keys sign the message itself rather than a digest of it
+	message, opts := []byte("iap client ca health check"), crypto.Hash(0)
+	if _, ok := i.key.Public().(ed25519.PublicKey); !ok {
+		digest := sha256.Sum256(message)
+		message, opts = digest[:], crypto.SHA256
+	}
+
+	if _, err := i.key.Sign(rand.Reader, message, opts); err != nil {
+		return fmt.Errorf("Could not sign with the client CA key: %s", err)
+	}
+
+	return nil
+}
+
+// Issue returns a DER encoded certificate for the key of the certificate
+// request. Only the key is taken from the request, which has to be signed by
+// it, the subject is always the user.
+func (i *Issuer) Issue(u user.User, csr *x509.CertificateRequest) ([]byte, error) {
+	if err := csr.CheckSignature(); err != nil {
+		return nil, ErrInvalidRequest
+	}
+
+	if rsaKey, ok := csr.PublicKey.(*rsa.PublicKey); ok && rsaKey.N.BitLen() < minimumRSABits {
+		return nil, ErrInvalidRequest
+	}
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, err
+	}
+
+	now := i.now()
+	notAfter := now.Add(i.validity)
+	if notAfter.After(i.ca.NotAfter) {
+		notAfter = i.ca.NotAfter
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject: pkix.Name{
+			CommonName:         u.Identifier,
+			OrganizationalUnit: u.Roles,
+		},
+		NotBefore:   now.Add(-clockSkew),
+		NotAfter:    notAfter,
+		KeyUsage:    x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, i.ca, csr.PublicKey, i.key)
+	if err != nil {
+		return nil, fmt.Errorf("Could not issue certificate: %s", err)
+	}
+
+	i.logger.WithFields(logrus.Fields{
+		"user":    u.Identifier,
+		"serial":  serial.String(),
+		"roles":   u.Roles,
+		"expires": notAfter.UTC().Format(time.RFC3339),
+	}).Info("issued client certificate")
+
+	return der, nil
+}
@@ -0,0 +1,126 @@
+package clientcert_test
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"regexp"
+	"time"
+
+	"github.com/alphagov/iap/pkg/clientcert"
+	"github.com/alphagov/iap/pkg/user"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/sirupsen/logrus"
+)
+
+var _ = Describe("Issuer", func() {
+	var (
+		ca     authority
+		issuer *clientcert.Issuer
+		key    *ecdsa.PrivateKey
+		csr    *x509.CertificateRequest
+		u      user.User
+	)
+
+	BeforeEach(func() {
+		ca = newAuthority()
+
+		logger := logrus.New()
+		logger.SetOutput(GinkgoWriter)
+
+		issuer = clientcert.NewIssuer(ca.cert, ca.key, time.Hour, logger)
+
+		var err error
+		key, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		Expect(err).NotTo(HaveOccurred())
+
+		der, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+			Subject: pkix.Name{CommonName: "someone.else@mydomain.com"},
+		}, key)
+		Expect(err).NotTo(HaveOccurred())
+
+		csr, err = x509.ParseCertificateRequest(der)
+		Expect(err).NotTo(HaveOccurred())
+
+		u = user.User{
+			Identifier: "fname.lname@mydomain.com",
+			Roles:      []string{"superuser", "readonlyuser"},
+		}
+	})
+
+	It("should issue a short-lived certificate carrying the identity and roles", func() {
+		der, err := issuer.Issue(u, csr)
+		Expect(err).NotTo(HaveOccurred())
+
+		cert, err := x509.ParseCertificate(der)
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(cert.Subject.CommonName).To(Equal("fname.lname@mydomain.com"))
+		Expect(cert.Subject.OrganizationalUnit).To(Equal([]string{"superuser", "readonlyuser"}))
+		Expect(cert.ExtKeyUsage).To(Equal([]x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}))
+		Expect(cert.NotAfter).To(BeTemporally("~", time.Now().Add(time.Hour), 5*time.Second))
+		Expect(cert.CheckSignatureFrom(ca.cert)).To(Succeed())
+	})
+
+	It("should identify users by the certificates it issued", func() {
+		der, err := issuer.Issue(u, csr)
+		Expect(err).NotTo(HaveOccurred())
+
+		cert, err := x509.ParseCertificate(der)
+		Expect(err).NotTo(HaveOccurred())
+
+		identifier, ok := clientcert.Sources{issuer.Identities()}.FromConnectionState(&tls.ConnectionState{
+			PeerCertificates: []*x509.Certificate{cert},
+			VerifiedChains:   [][]*x509.Certificate{{cert, ca.cert}},
+		})
+		Expect(ok).To(BeTrue())
+		Expect(identifier).To(Equal("fname.lname@mydomain.com"))
+	})
+
+	It("should not identify certificates of another source with its mappings", func() {
+		other := newAuthority()
+		cert, err := x509.ParseCertificate(other.issue(&x509.Certificate{
+			Subject:        pkix.Name{CommonName: "root@mydomain.com"},
+			EmailAddresses: []string{"fname.lname@mydomain.com"},
+		}).Certificate[0])
+		Expect(err).NotTo(HaveOccurred())
+
+		sources := clientcert.Sources{
+			issuer.Identities(),
+			{
+				CAs:      []*x509.Certificate{other.cert},
+				Mappings: []clientcert.Mapping{{Field: clientcert.EmailAddress, Pattern: regexp.MustCompile(`.+`)}},
+			},
+		}
+
+		identifier, ok := sources.FromConnectionState(&tls.ConnectionState{
+			PeerCertificates: []*x509.Certificate{cert},
+			VerifiedChains:   [][]*x509.Certificate{{cert, other.cert}},
+		})
+		Expect(ok).To(BeTrue())
+		Expect(identifier).To(Equal("fname.lname@mydomain.com"))
+	})
+
+	It("should refuse a request which is not signed by its key", func() {
+		csr.Signature[0] ^= 0xff
+
+		_, err := issuer.Issue(u, csr)
+		Expect(err).To(Equal(clientcert.ErrInvalidRequest))
+	})
+
+	It("should check its key can sign", func() {
+		Expect(issuer.Check()).To(Succeed())
+	})
+
+	It("should fail the check when its key does not match the CA", func() {
+		logger := logrus.New()
+		logger.SetOutput(GinkgoWriter)
+
+		other := clientcert.NewIssuer(ca.cert, newAuthority().key, time.Hour, logger)
+		Expect(other.Check()).To(MatchError(ContainSubstring("Client CA key does not match its certificate")))
+	})
+})
@@ -0,0 +1,162 @@
+package drain
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Server is anything serving connections which can be drained.
+type Server interface {
+	Serve() error
+	Shutdown(ctx context.Context) error
+}
+
+// Signals returns a channel receiving the signals which start draining.
+func Signals() <-chan os.Signal {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+	return signals
+}
+
+// Drainer runs servers until it is signalled to stop, then lets their active
+// requests and tunnels finish for up to the timeout. The servers keep
+// accepting new ones for the delay beforehand, so that load balancers have
+// time to notice the failing healthcheck.
+type Drainer struct {
+	timeout  time.Duration
+	delay    time.Duration
+	logger   *logrus.Logger
+	draining int32
+}
+
+// New will construct the Drainer.
+func New(timeout, delay time.Duration, logger *logrus.Logger) *Drainer {
+	return &Drainer{
+		timeout: timeout,
+		delay:   delay,
+		logger:  logger,
+	}
+}
+
+// Draining returns if the servers are shutting down, so that healthchecks can
+// report it to load balancers.
+func (d *Drainer) Draining() bool {
+	return atomic.LoadInt32(&d.draining) == 1
+}
+
+// Run serves until a signal is received or any of the servers fails, then
+// drains all of them. It returns the error of the failed server, if any.
+func (d *Drainer) Run(signals <-chan os.Signal, servers ...Server) error {
+	errs := make(chan error, len(servers))
+	for _, srv := range servers {
+		go func(srv Server) {
+			errs <- srv.Serve()
+		}(srv)
+	}
+
+	var err error
+	select {
+	case sig := <-signals:
+		atomic.StoreInt32(&d.draining, 1)
+		d.logger.WithFields(logrus.Fields{
+			"signal":  sig.String(),
+			"delay":   d.delay.String(),
+			"timeout": d.timeout.String(),
+		}).Info("draining connections before shutting down")
+
+		// A failing server or another signal cuts the delay short
+		select {
+		case <-time.After(d.delay):
+		case err = <-errs:
+		case <-signals:
+		}
+	case err = <-errs:
+		atomic.StoreInt32(&d.draining, 1)
+		d.logger.WithFields(logrus.Fields{
+			"error": err,
+		}).Error("server failed, shutting down")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), d.timeout)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	for _, srv := range servers {
+		wg.Add(1)
+		go func(srv Server) {
+			defer wg.Done()
+
+			if err := srv.Shutdown(ctx); err != nil {
+				d.logger.WithFields(logrus.Fields{
+					"error": err,
+				}).Warn("closed connections which did not drain in time")
+			}
+		}(srv)
+	}
+	wg.Wait()
+
+	d.logger.Info("shut down")
+	return err
+}
+
+// HTTPServer drains the requests of the HTTP server along with the
+// connections hijacked from it. It is served over TLS when it has a TLS
+// configuration.
+func HTTPServer(srv *http.Server, listener *Listener) Server {
+	return httpServer{srv: srv, listener: listener}
+}
+
+type httpServer struct {
+	srv      *http.Server
+	listener *Listener
+}
+
+func (s httpServer) Serve() error {
+	var err error
+	if s.srv.TLSConfig != nil {
+		err = s.srv.ServeTLS(s.listener, "", "")
+	} else {
+		err = s.srv.Serve(s.listener)
+	}
+
+	if err == http.ErrServerClosed {
+		return nil
+	}
+	return err
+}
+
+func (s httpServer) Shutdown(ctx context.Context) error {
+	err := s.srv.Shutdown(ctx)
+	if drainErr := s.listener.Drain(ctx); err == nil {
+		err = drainErr
+	}
+	return err
+}
+
+// ListenerServer drains the connections of a server accepting them from the
+// listener, which stops serving once the listener is closed.
+func ListenerServer(serve func(net.Listener) error, listener *Listener) Server {
+	return listenerServer{serve: serve, listener: listener}
+}
+
+type listenerServer struct {
+	serve    func(net.Listener) error
+	listener *Listener
+}
+
+func (s listenerServer) Serve() error {
+	return s.serve(s.listener)
+}
+
+func (s listenerServer) Shutdown(ctx context.Context) error {
+	return s.listener.Drain(ctx)
+}
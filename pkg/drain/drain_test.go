@@ -0,0 +1,158 @@
+package drain_test
+
+import (
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"syscall"
+	"time"
+
+	"github.com/alphagov/iap/pkg/drain"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/sirupsen/logrus"
+)
+
+var _ = Describe("Drainer", func() {
+	var (
+		logger  *logrus.Logger
+		signals chan os.Signal
+	)
+
+	BeforeEach(func() {
+		logger = logrus.New()
+		logger.SetOutput(GinkgoWriter)
+
+		signals = make(chan os.Signal, 1)
+	})
+
+	It("Lets in-flight requests finish once signalled", func() {
+		listener, err := drain.Listen("tcp", "127.0.0.1:0")
+		Expect(err).NotTo(HaveOccurred())
+
+		started := make(chan struct{})
+		srv := &http.Server{
+			Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				close(started)
+				time.Sleep(200 * time.Millisecond)
+				w.Write([]byte("finished"))
+			}),
+		}
+
+		drainer := drain.New(5*time.Second, 0, logger)
+		done := make(chan error)
+		go func() {
+			done <- drainer.Run(signals, drain.HTTPServer(srv, listener))
+		}()
+
+		responses := make(chan string)
+		go func() {
+			defer GinkgoRecover()
+
+			resp, err := http.Get("http://" + listener.Addr().String())
+			Expect(err).NotTo(HaveOccurred())
+			defer resp.Body.Close()
+
+			body, err := ioutil.ReadAll(resp.Body)
+			Expect(err).NotTo(HaveOccurred())
+			responses <- string(body)
+		}()
+
+		Eventually(started).Should(BeClosed())
+		Expect(drainer.Draining()).To(BeFalse())
+		signals <- syscall.SIGTERM
+
+		Eventually(drainer.Draining).Should(BeTrue())
+		Eventually(responses).Should(Receive(Equal("finished")))
+		Eventually(done).Should(Receive(BeNil()))
+
+		_, err = net.Dial("tcp", listener.Addr().String())
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("Keeps serving for the delay once signalled", func() {
+		listener, err := drain.Listen("tcp", "127.0.0.1:0")
+		Expect(err).NotTo(HaveOccurred())
+
+		srv := &http.Server{
+			Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Write([]byte("served"))
+			}),
+		}
+
+		drainer := drain.New(time.Second, 300*time.Millisecond, logger)
+		done := make(chan error)
+		go func() {
+			done <- drainer.Run(signals, drain.HTTPServer(srv, listener))
+		}()
+
+		signals <- syscall.SIGTERM
+		Eventually(drainer.Draining).Should(BeTrue())
+
+		resp, err := http.Get("http://" + listener.Addr().String())
+		Expect(err).NotTo(HaveOccurred())
+		body, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(string(body)).To(Equal("served"))
+
+		Consistently(done, 100*time.Millisecond).ShouldNot(Receive())
+		Eventually(done).Should(Receive(BeNil()))
+	})
+
+	It("Closes the tunnels which do not drain in time", func() {
+		listener, err := drain.Listen("tcp", "127.0.0.1:0")
+		Expect(err).NotTo(HaveOccurred())
+
+		serve := func(l net.Listener) error {
+			for {
+				conn, err := l.Accept()
+				if err != nil {
+					return err
+				}
+				go ioutil.ReadAll(conn)
+			}
+		}
+
+		drainer := drain.New(200*time.Millisecond, 0, logger)
+		done := make(chan error)
+		go func() {
+			done <- drainer.Run(signals, drain.ListenerServer(serve, listener))
+		}()
+
+		client, err := net.Dial("tcp", listener.Addr().String())
+		Expect(err).NotTo(HaveOccurred())
+		defer client.Close()
+
+		Eventually(listener.Active).Should(Equal(1))
+		signals <- syscall.SIGINT
+
+		Eventually(done, time.Second).Should(Receive(BeNil()))
+		Expect(listener.Active()).To(Equal(0))
+
+		client.SetReadDeadline(time.Now().Add(time.Second))
+		_, err = client.Read(make([]byte, 1))
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("Shuts every server down when one of them fails", func() {
+		listener, err := drain.Listen("tcp", "127.0.0.1:0")
+		Expect(err).NotTo(HaveOccurred())
+
+		failure := errors.New("failed")
+		failing := drain.ListenerServer(func(net.Listener) error {
+			return failure
+		}, listener)
+
+		other, err := drain.Listen("tcp", "127.0.0.1:0")
+		Expect(err).NotTo(HaveOccurred())
+
+		drainer := drain.New(time.Second, 0, logger)
+		Expect(drainer.Run(signals, failing, drain.HTTPServer(&http.Server{}, other))).To(Equal(failure))
+
+		_, err = net.Dial("tcp", other.Addr().String())
+		Expect(err).To(HaveOccurred())
+	})
+})
@@ -0,0 +1,111 @@
+package drain
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+)
+
+// pollInterval is how often the connections are counted while draining.
+const pollInterval = 100 * time.Millisecond
+
+// Listener tracks the connections it accepts until they are closed, so that
+// they can be drained, including the ones hijacked from HTTP servers such as
+// CONNECT tunnels and protocol upgrades.
+type Listener struct {
+	net.Listener
+
+	mu    sync.Mutex
+	conns map[*conn]struct{}
+}
+
+type conn struct {
+	net.Conn
+	listener *Listener
+	once     sync.Once
+}
+
+func (c *conn) Close() error {
+	c.once.Do(func() {
+		c.listener.remove(c)
+	})
+	return c.Conn.Close()
+}
+
+// Listen announces on the local network address.
+func Listen(network, addr string) (*Listener, error) {
+	listener, err := net.Listen(network, addr)
+	if err != nil {
+		return nil, err
+	}
+
+	return NewListener(listener), nil
+}
+
+// NewListener will construct the Listener tracking the connections of another.
+func NewListener(listener net.Listener) *Listener {
+	return &Listener{
+		Listener: listener,
+		conns:    make(map[*conn]struct{}),
+	}
+}
+
+// Accept waits for the next connection and tracks it.
+func (l *Listener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+
+	tracked := &conn{Conn: c, listener: l}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.conns[tracked] = struct{}{}
+	return tracked, nil
+}
+
+func (l *Listener) remove(c *conn) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	delete(l.conns, c)
+}
+
+// Active returns how many accepted connections are still open.
+func (l *Listener) Active() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return len(l.conns)
+}
+
+// Drain stops accepting connections and waits for the active ones to be
+// closed. The ones still open when the context is done are closed.
+func (l *Listener) Drain(ctx context.Context) error {
+	l.Listener.Close()
+
+	ticker := time.NewTicker(pollInterval)
+	defer ticker.Stop()
+
+	for {
+		if l.Active() == 0 {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			l.mu.Lock()
+			defer l.mu.Unlock()
+
+			for c := range l.conns {
+				c.Conn.Close()
+				delete(l.conns, c)
+			}
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,13 @@
+package extauthz_test
+
+import (
+	"testing"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+func TestExtAuthz(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "ExtAuthz Suite")
+}
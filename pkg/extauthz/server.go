@@ -0,0 +1,200 @@
+package extauthz
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	corev3 "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	authv3 "github.com/envoyproxy/go-control-plane/envoy/service/auth/v3"
+	typev3 "github.com/envoyproxy/go-control-plane/envoy/type/v3"
+	"github.com/sirupsen/logrus"
+	"google.golang.org/genproto/googleapis/rpc/status"
+	"google.golang.org/grpc/codes"
+
+	"github.com/alphagov/iap/pkg/router"
+	"github.com/alphagov/iap/pkg/tracing"
+)
+
+// Server is an Envoy external authorization (ext_authz v3) server, making the
+// same decisions as the forward authentication endpoint of the web command.
+type Server struct {
+	authv3.UnimplementedAuthorizationServer
+
+	forward atomic.Pointer[router.ForwardAuth]
+	logger  *logrus.Logger
+}
+
+// New will construct the server elsewhere, the forward authentication can be
+// given later on with Update.
+func New(forward *router.ForwardAuth, logger *logrus.Logger) *Server {
+	s := &Server{logger: logger}
+	s.forward.Store(forward)
+	return s
+}
+
+// Update makes the decisions of the following requests with the forward
+// authentication, eg: once the configuration was reloaded. Pending requests
+// finish with the previous one.
+func (s *Server) Update(forward *router.ForwardAuth) {
+	s.forward.Store(forward)
+}
+
+// Check authorizes the request described by Envoy. Allowed requests have the
+// identity headers added before they are sent upstream, and any identity
+// headers sent by the client removed.
+func (s *Server) Check(ctx context.Context, req *authv3.CheckRequest) (*authv3.CheckResponse, error) {
+	attributes := req.GetAttributes().GetRequest().GetHttp()
+
+	original, err := originalURL(attributes)
+	if err != nil {
+		s.logger.WithFields(logrus.Fields{
+			"host":  attributes.GetHost(),
+			"path":  attributes.GetPath(),
+			"error": err,
+		}).Warn("failed to read check request")
+		return denied(codes.InvalidArgument, http.StatusBadRequest, "invalid request"), nil
+	}
+
+	method := strings.ToUpper(attributes.GetMethod())
+	if method == "" {
+		method = http.MethodGet
+	}
+
+	// Envoy sends the traceparent of the request along with its headers
+	r := credentials(attributes)
+	r = r.WithContext(tracing.Extract(ctx, r.Header))
+	r.RemoteAddr = sourceAddress(req.GetAttributes().GetSource())
+
+	decision, err := s.forward.Load().Check(method, original, r)
+	if err != nil {
+		return denied(codes.Unavailable, http.StatusInternalServerError, "unable to authenticate request"), nil
+	}
+
+	switch decision.Status {
+	case http.StatusOK:
+		headers := make([]*corev3.HeaderValueOption, 0, 2)
+		if decision.User != nil {
+			headers = append(headers,
+				header(router.UserHeader, decision.User.Identifier),
+				header(router.RolesHeader, strings.Join(decision.User.Roles, ",")),
+			)
+		}
+
+		return &authv3.CheckResponse{
+			Status: &status.Status{Code: int32(codes.OK)},
+			HttpResponse: &authv3.CheckResponse_OkResponse{
+				OkResponse: &authv3.OkHttpResponse{
+					Headers:         headers,
+					HeadersToRemove: removedHeaders(decision),
+				},
+			},
+		}, nil
+	case http.StatusUnauthorized:
+		if decision.LoginURL == "" {
+			resp := denied(codes.Unauthenticated, http.StatusUnauthorized, decision.Message)
+			resp.GetDeniedResponse().Headers = append(
+				resp.GetDeniedResponse().Headers, header("WWW-Authenticate", `Bearer error="invalid_token"`),
+			)
+			return resp, nil
+		}
+
+		resp := denied(codes.Unauthenticated, http.StatusUnauthorized, "")
+		resp.GetDeniedResponse().Headers = append(
+			resp.GetDeniedResponse().Headers, header("Location", decision.LoginURL),
+		)
+		resp.GetDeniedResponse().Body = string(router.LoginBody(decision.LoginURL))
+		return resp, nil
+	}
+
+	return denied(codes.PermissionDenied, http.StatusForbidden, decision.Message), nil
+}
+
+// originalURL rebuilds the URL of the request, the path given by Envoy
+// includes the query string
+func originalURL(attributes *authv3.AttributeContext_HttpRequest) (*url.URL, error) {
+	requestURI, err := url.ParseRequestURI(attributes.GetPath())
+	if err != nil {
+		return nil, err
+	}
+
+	scheme := attributes.GetScheme()
+	if scheme == "" {
+		scheme = "https"
+	}
+
+	return &url.URL{
+		Scheme:   scheme,
+		Host:     attributes.GetHost(),
+		Path:     requestURI.Path,
+		RawPath:  requestURI.RawPath,
+		RawQuery: requestURI.RawQuery,
+	}, nil
+}
+
+// credentials returns a request carrying the headers of the original request,
+// which is all authentication needs
+func credentials(attributes *authv3.AttributeContext_HttpRequest) *http.Request {
+	r := &http.Request{
+		Method: attributes.GetMethod(),
+		Host:   attributes.GetHost(),
+		URL:    &url.URL{Path: attributes.GetPath()},
+		Header: make(http.Header),
+	}
+
+	for name, value := range attributes.GetHeaders() {
+		r.Header.Set(name, value)
+	}
+
+	return r
+}
+
+// sourceAddress returns the host:port the original request came from, for the
+// audit log
+func sourceAddress(source *authv3.AttributeContext_Peer) string {
+	address := source.GetAddress().GetSocketAddress()
+	if address.GetAddress() == "" {
+		return ""
+	}
+
+	return net.JoinHostPort(address.GetAddress(), strconv.Itoa(int(address.GetPortValue())))
+}
+
+// removedHeaders drops the identity headers sent by the client, unless they
+// are about to be overwritten with the identity of the user
+func removedHeaders(decision router.Decision) []string {
+	if decision.User != nil {
+		return nil
+	}
+
+	return []string{strings.ToLower(router.UserHeader), strings.ToLower(router.RolesHeader)}
+}
+
+func header(name, value string) *corev3.HeaderValueOption {
+	return &corev3.HeaderValueOption{
+		Header:       &corev3.HeaderValue{Key: name, Value: value},
+		AppendAction: corev3.HeaderValueOption_OVERWRITE_IF_EXISTS_OR_ADD,
+	}
+}
+
+func denied(code codes.Code, httpStatus int, message string) *authv3.CheckResponse {
+	body, _ := json.Marshal(map[string]string{
+		"error": message,
+	})
+
+	return &authv3.CheckResponse{
+		Status: &status.Status{Code: int32(code), Message: message},
+		HttpResponse: &authv3.CheckResponse_DeniedResponse{
+			DeniedResponse: &authv3.DeniedHttpResponse{
+				Status:  &typev3.HttpStatus{Code: typev3.StatusCode(httpStatus)},
+				Headers: []*corev3.HeaderValueOption{header("Content-Type", "application/json")},
+				Body:    string(body),
+			},
+		},
+	}
+}
@@ -0,0 +1,168 @@
+package extauthz_test
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/url"
+
+	authv3 "github.com/envoyproxy/go-control-plane/envoy/service/auth/v3"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+
+	"github.com/alphagov/iap/pkg/extauthz"
+	"github.com/alphagov/iap/pkg/router"
+	"github.com/alphagov/iap/pkg/service"
+	"github.com/alphagov/iap/pkg/user"
+)
+
+var _ = Describe("ExtAuthz server", func() {
+	var (
+		srv          *grpc.Server
+		server       *extauthz.Server
+		conn         *grpc.ClientConn
+		client       authv3.AuthorizationClient
+		logger       *logrus.Logger
+		authenticate router.Authenticator
+		login        func(string) string
+	)
+
+	BeforeEach(func() {
+		logger = logrus.New()
+		logger.SetOutput(GinkgoWriter)
+
+		r := router.New(map[string]service.Service{
+			"grafana": service.Service{
+				Identifier:  "grafana",
+				UpstreamURI: url.URL{Scheme: "http", Host: "grafana.internal"},
+				Roles:       []string{"superuser"},
+				Matchers: []service.Matcher{
+					service.Matcher{Host: "grafana.mydomain.com"},
+				},
+				PublicPaths: []service.PublicPath{
+					service.PublicPath{Path: "/healthcheck"},
+				},
+			},
+		}, logger)
+
+		authenticate = func(r *http.Request) (user.User, error) {
+			switch r.Header.Get("Cookie") {
+			case "iap_session=superuser":
+				return user.User{Identifier: "fname.lname@mydomain.com", Roles: []string{"superuser"}}, nil
+			case "iap_session=dev":
+				return user.User{Identifier: "dev@mydomain.com", Roles: []string{"dev"}}, nil
+			}
+			return user.User{}, router.ErrUnauthenticated
+		}
+
+		login = func(original string) string {
+			return "https://iap.mydomain.com/oidc/login?rd=" + url.QueryEscape(original)
+		}
+
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		Expect(err).NotTo(HaveOccurred())
+
+		srv = grpc.NewServer()
+		server = extauthz.New(router.NewForwardAuth(r, authenticate, login, nil, logger), logger)
+		authv3.RegisterAuthorizationServer(srv, server)
+		go srv.Serve(listener)
+
+		conn, err = grpc.NewClient(listener.Addr().String(), grpc.WithTransportCredentials(insecure.NewCredentials()))
+		Expect(err).NotTo(HaveOccurred())
+		client = authv3.NewAuthorizationClient(conn)
+	})
+
+	AfterEach(func() {
+		conn.Close()
+		srv.Stop()
+	})
+
+	check := func(path string, headers map[string]string) *authv3.CheckResponse {
+		resp, err := client.Check(context.Background(), &authv3.CheckRequest{
+			Attributes: &authv3.AttributeContext{
+				Request: &authv3.AttributeContext_Request{
+					Http: &authv3.AttributeContext_HttpRequest{
+						Method:  "GET",
+						Scheme:  "https",
+						Host:    "grafana.mydomain.com",
+						Path:    path,
+						Headers: headers,
+					},
+				},
+			},
+		})
+		Expect(err).NotTo(HaveOccurred())
+		return resp
+	}
+
+	headerValues := func(resp *authv3.CheckResponse) map[string]string {
+		values := make(map[string]string)
+		headers := resp.GetOkResponse().GetHeaders()
+		if resp.GetDeniedResponse() != nil {
+			headers = resp.GetDeniedResponse().GetHeaders()
+		}
+		for _, header := range headers {
+			values[header.GetHeader().GetKey()] = header.GetHeader().GetValue()
+		}
+		return values
+	}
+
+	It("should allow a user who can access the service with identity headers", func() {
+		resp := check("/dashboards?id=1", map[string]string{"cookie": "iap_session=superuser"})
+
+		Expect(resp.GetStatus().GetCode()).To(Equal(int32(codes.OK)))
+		Expect(headerValues(resp)).To(Equal(map[string]string{
+			router.UserHeader:  "fname.lname@mydomain.com",
+			router.RolesHeader: "superuser",
+		}))
+	})
+
+	It("should ask a user without a session to log in", func() {
+		resp := check("/dashboards?id=1", nil)
+
+		Expect(resp.GetStatus().GetCode()).To(Equal(int32(codes.Unauthenticated)))
+		Expect(resp.GetDeniedResponse().GetStatus().GetCode()).To(BeEquivalentTo(http.StatusUnauthorized))
+		Expect(headerValues(resp)).To(HaveKeyWithValue(
+			"Location",
+			"https://iap.mydomain.com/oidc/login?rd="+url.QueryEscape("https://grafana.mydomain.com/dashboards?id=1"),
+		))
+	})
+
+	It("should deny a user who cannot access the service", func() {
+		resp := check("/dashboards", map[string]string{"cookie": "iap_session=dev"})
+
+		Expect(resp.GetStatus().GetCode()).To(Equal(int32(codes.PermissionDenied)))
+		Expect(resp.GetDeniedResponse().GetStatus().GetCode()).To(BeEquivalentTo(http.StatusForbidden))
+		Expect(resp.GetDeniedResponse().GetBody()).To(MatchJSON(`{"error": "access denied"}`))
+	})
+
+	It("should allow a public path and remove identity headers sent by the client", func() {
+		resp := check("/healthcheck", map[string]string{"x-auth-request-user": "admin"})
+
+		Expect(resp.GetStatus().GetCode()).To(Equal(int32(codes.OK)))
+		Expect(resp.GetOkResponse().GetHeadersToRemove()).To(ContainElement("x-auth-request-user"))
+	})
+	It("should make the decisions with the updated forward authentication", func() {
+		r := router.New(map[string]service.Service{
+			"grafana": service.Service{
+				Identifier:  "grafana",
+				UpstreamURI: url.URL{Scheme: "http", Host: "grafana.internal"},
+				Roles:       []string{"dev"},
+				Matchers: []service.Matcher{
+					service.Matcher{Host: "grafana.mydomain.com"},
+				},
+			},
+		}, logger)
+		server.Update(router.NewForwardAuth(r, authenticate, login, nil, logger))
+
+		resp := check("/dashboards", map[string]string{"cookie": "iap_session=dev"})
+		Expect(resp.GetStatus().GetCode()).To(Equal(int32(codes.OK)))
+
+		resp = check("/healthcheck", nil)
+		Expect(resp.GetStatus().GetCode()).To(Equal(int32(codes.Unauthenticated)))
+	})
+})
@@ -0,0 +1,171 @@
+package health
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Timeout is how long a check is given before it is reported as failed.
+const Timeout = 5 * time.Second
+
+// Check returns why a dependency is not healthy, or nil when it is.
+type Check func() error
+
+// Result is the outcome of the latest run of a check, along with the last
+// error it returned, which is kept after the check recovers.
+type Result struct {
+	Healthy     bool       `json:"healthy"`
+	Optional    bool       `json:"optional,omitempty"`
+	LatencyMS   float64    `json:"latency_ms"`
+	Error       string     `json:"error,omitempty"`
+	LastError   string     `json:"last_error,omitempty"`
+	LastErrorAt *time.Time `json:"last_error_at,omitempty"`
+}
+
+// Report is the outcome of every check. It is ready when every check which is
+// not optional is healthy.
+type Report struct {
+	Ready  bool              `json:"ready"`
+	Checks map[string]Result `json:"checks"`
+}
+
+type check struct {
+	name     string
+	run      Check
+	optional bool
+}
+
+type lastError struct {
+	message string
+	at      time.Time
+}
+
+// Checker runs the checks of the dependencies of the servers.
+type Checker struct {
+	mu         sync.Mutex
+	checks     []check
+	lastErrors map[string]lastError
+	timeout    time.Duration
+	now        func() time.Time
+}
+
+// New will construct the Checker without any checks.
+func New() *Checker {
+	return &Checker{
+		lastErrors: make(map[string]lastError),
+		timeout:    Timeout,
+		now:        time.Now,
+	}
+}
+
+// Add a check which has to be healthy for the servers to be ready.
+func (c *Checker) Add(name string, run Check) {
+	c.add(check{name: name, run: run})
+}
+
+// AddOptional adds a check which is reported without affecting readiness, eg:
+// the health of the upstreams of a service.
+func (c *Checker) AddOptional(name string, run Check) {
+	c.add(check{name: name, run: run, optional: true})
+}
+
+// Remove the check and its last error, eg: when the service it checks was
+// removed from the configuration.
+func (c *Checker) Remove(name string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for index := range c.checks {
+		if c.checks[index].name == name {
+			c.checks = append(c.checks[:index], c.checks[index+1:]...)
+			break
+		}
+	}
+	delete(c.lastErrors, name)
+}
+
+func (c *Checker) add(ch check) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for index := range c.checks {
+		if c.checks[index].name == ch.name {
+			c.checks[index] = ch
+			return
+		}
+	}
+
+	c.checks = append(c.checks, ch)
+	sort.SliceStable(c.checks, func(i, j int) bool {
+		return c.checks[i].name < c.checks[j].name
+	})
+}
+
+// Run every check at the same time.
+func (c *Checker) Run() Report {
+	c.mu.Lock()
+	checks := append([]check(nil), c.checks...)
+	c.mu.Unlock()
+
+	results := make([]Result, len(checks))
+
+	var wg sync.WaitGroup
+	for index := range checks {
+		wg.Add(1)
+		go func(index int) {
+			defer wg.Done()
+			results[index] = c.run(checks[index])
+		}(index)
+	}
+	wg.Wait()
+
+	report := Report{Ready: true, Checks: make(map[string]Result, len(checks))}
+	for index, ch := range checks {
+		report.Checks[ch.name] = results[index]
+		if !results[index].Healthy && !ch.optional {
+			report.Ready = false
+		}
+	}
+
+	return report
+}
+
+func (c *Checker) run(ch check) Result {
+	started := c.now()
+
+	done := make(chan error, 1)
+	go func() {
+		done <- ch.run()
+	}()
+
+	var err error
+	select {
+	case err = <-done:
+	case <-time.After(c.timeout):
+		err = fmt.Errorf("check timed out after %s", c.timeout)
+	}
+
+	result := Result{
+		Healthy:   err == nil,
+		Optional:  ch.optional,
+		LatencyMS: float64(c.now().Sub(started)) / float64(time.Millisecond),
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if err != nil {
+		result.Error = err.Error()
+		c.lastErrors[ch.name] = lastError{message: err.Error(), at: c.now().UTC()}
+	}
+
+	if last, ok := c.lastErrors[ch.name]; ok {
+		at := last.at
+		result.LastError = last.message
+		result.LastErrorAt = &at
+	}
+
+	return result
+}
@@ -0,0 +1,97 @@
+package health_test
+
+import (
+	"errors"
+
+	"github.com/alphagov/iap/pkg/health"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Health", func() {
+	var checker *health.Checker
+
+	BeforeEach(func() {
+		checker = health.New()
+	})
+
+	It("Is ready when every check is healthy", func() {
+		checker.Add("redis", func() error { return nil })
+		checker.Add("config", func() error { return nil })
+
+		report := checker.Run()
+
+		Expect(report.Ready).To(BeTrue())
+		Expect(report.Checks).To(HaveLen(2))
+		Expect(report.Checks["redis"].Healthy).To(BeTrue())
+		Expect(report.Checks["redis"].LatencyMS).To(BeNumerically(">=", 0))
+		Expect(report.Checks["redis"].LastError).To(BeEmpty())
+	})
+
+	It("Is not ready when a check fails", func() {
+		checker.Add("redis", func() error { return errors.New("connection refused") })
+		checker.Add("config", func() error { return nil })
+
+		report := checker.Run()
+
+		Expect(report.Ready).To(BeFalse())
+		Expect(report.Checks["redis"].Healthy).To(BeFalse())
+		Expect(report.Checks["redis"].Error).To(Equal("connection refused"))
+		Expect(report.Checks["config"].Healthy).To(BeTrue())
+	})
+
+	It("Is still ready when an optional check fails", func() {
+		checker.Add("redis", func() error { return nil })
+		checker.AddOptional("upstream:grafana", func() error { return errors.New("0 of 2 upstreams are available") })
+
+		report := checker.Run()
+
+		Expect(report.Ready).To(BeTrue())
+		Expect(report.Checks["upstream:grafana"].Healthy).To(BeFalse())
+		Expect(report.Checks["upstream:grafana"].Optional).To(BeTrue())
+	})
+
+	It("Keeps the last error once the check recovers", func() {
+		failing := true
+		checker.Add("redis", func() error {
+			if failing {
+				return errors.New("connection refused")
+			}
+			return nil
+		})
+
+		checker.Run()
+		failing = false
+		report := checker.Run()
+
+		Expect(report.Ready).To(BeTrue())
+		Expect(report.Checks["redis"].Error).To(BeEmpty())
+		Expect(report.Checks["redis"].LastError).To(Equal("connection refused"))
+		Expect(report.Checks["redis"].LastErrorAt).NotTo(BeNil())
+	})
+
+	It("Replaces a check added again with the same name", func() {
+		checker.Add("redis", func() error { return errors.New("connection refused") })
+		checker.Add("redis", func() error { return nil })
+
+		report := checker.Run()
+
+		Expect(report.Ready).To(BeTrue())
+		Expect(report.Checks).To(HaveLen(1))
+	})
+	It("Removes a check along with its last error", func() {
+		checker.Add("redis", func() error { return nil })
+		checker.AddOptional("upstream:my-service", func() error { return errors.New("1 of 2 upstreams are available") })
+		checker.Run()
+
+		checker.Remove("upstream:my-service")
+		checker.AddOptional("upstream:my-service", func() error { return nil })
+		report := checker.Run()
+
+		Expect(report.Checks).To(HaveLen(2))
+		Expect(report.Checks["upstream:my-service"].LastError).To(BeEmpty())
+
+		checker.Remove("upstream:my-service")
+		Expect(checker.Run().Checks).To(HaveLen(1))
+	})
+})
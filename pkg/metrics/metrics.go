@@ -0,0 +1,139 @@
+package metrics
+
+import (
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "iap"
+
+// Results of validating credentials
+const (
+	Success = "success"
+	Failure = "failure"
+)
+
+// Kinds of credentials
+const (
+	Generated      = "generated"
+	ServiceAccount = "service_account"
+)
+
+// Proxies tunnelling connections
+const (
+	SOCKS5  = "socks5"
+	CONNECT = "connect"
+)
+
+var (
+	// Registry holds every series exposed by IAP, along with the ones of the
+	// Go runtime and process.
+	Registry = prometheus.NewRegistry()
+
+	// Logins counts the users who logged in with OIDC.
+	Logins = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "logins_total",
+		Help:      "Users who logged in with OIDC.",
+	})
+
+	// LoginFailures counts the OIDC logins which failed, by reason.
+	LoginFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "login_failures_total",
+		Help:      "OIDC logins which failed, by reason.",
+	}, []string{"reason"})
+
+	// CredentialsGenerated counts the proxy credentials generated for users.
+	CredentialsGenerated = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "credentials_generated_total",
+		Help:      "Proxy credentials generated for users.",
+	})
+
+	// CredentialsValidated counts the proxy credentials checked, by kind and
+	// result.
+	CredentialsValidated = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "credentials_validated_total",
+		Help:      "Proxy credentials checked, by kind and result.",
+	}, []string{"kind", "result"})
+
+	// AuthorizationDenials counts the requests denied access to a service.
+	AuthorizationDenials = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "authorization_denials_total",
+		Help:      "Requests denied access to a service, by reason.",
+	}, []string{"service", "reason"})
+
+	// ActiveTunnels is the number of tunnels currently open by the proxies.
+	ActiveTunnels = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "active_tunnels",
+		Help:      "Tunnels currently open by the SOCKS5 proxy and CONNECT requests.",
+	}, []string{"proxy"})
+
+	// TunnelBytes counts the bytes sent through the tunnels, towards the
+	// upstream or back downstream to the client.
+	TunnelBytes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "tunnel_bytes_total",
+		Help:      "Bytes sent through the tunnels, by direction.",
+	}, []string{"proxy", "direction"})
+
+	// UpstreamDuration observes how long upstreams take to respond with
+	// their headers, by service.
+	UpstreamDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "upstream_request_duration_seconds",
+		Help:      "Time taken by the upstreams to respond with their headers, by service.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"service"})
+
+	// RedisErrors counts the Redis commands which failed, by command.
+	RedisErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "redis_errors_total",
+		Help:      "Redis commands which failed, by command.",
+	}, []string{"command"})
+
+	// ConfigReloads counts the reloads of the configuration file, by result.
+	ConfigReloads = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "config_reloads_total",
+		Help:      "Reloads of the configuration file, by result.",
+	}, []string{"result"})
+)
+
+func init() {
+	Registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		Logins,
+		LoginFailures,
+		CredentialsGenerated,
+		CredentialsValidated,
+		AuthorizationDenials,
+		ActiveTunnels,
+		TunnelBytes,
+		UpstreamDuration,
+		RedisErrors,
+		ConfigReloads,
+	)
+}
+
+// Handler serves the series in the Prometheus text format.
+func Handler() http.Handler {
+	return promhttp.HandlerFor(Registry, promhttp.HandlerOpts{})
+}
+
+// Result returns the result label of a check.
+func Result(ok bool) string {
+	if ok {
+		return Success
+	}
+	return Failure
+}
@@ -0,0 +1,90 @@
+package metrics_test
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	"github.com/alicebob/miniredis"
+	"github.com/alphagov/iap/pkg/metrics"
+	"github.com/go-redis/redis"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+var _ = Describe("Metrics", func() {
+	It("Counts the tunnels and their bytes", func() {
+		active := metrics.ActiveTunnels.WithLabelValues(metrics.SOCKS5)
+		upstream := metrics.TunnelBytes.WithLabelValues(metrics.SOCKS5, "upstream")
+		downstream := metrics.TunnelBytes.WithLabelValues(metrics.SOCKS5, "downstream")
+
+		activeBefore := testutil.ToFloat64(active)
+		upstreamBefore := testutil.ToFloat64(upstream)
+		downstreamBefore := testutil.ToFloat64(downstream)
+
+		client, server := net.Pipe()
+		defer server.Close()
+
+		tunnel := metrics.Tunnel(client, metrics.SOCKS5)
+		Expect(testutil.ToFloat64(active)).To(Equal(activeBefore + 1))
+
+		go func() {
+			buffer := make([]byte, 5)
+			server.Read(buffer)
+			server.Write([]byte("hi"))
+		}()
+
+		_, err := tunnel.Write([]byte("hello"))
+		Expect(err).NotTo(HaveOccurred())
+
+		_, err = tunnel.Read(make([]byte, 2))
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(testutil.ToFloat64(upstream)).To(Equal(upstreamBefore + 5))
+		Expect(testutil.ToFloat64(downstream)).To(Equal(downstreamBefore + 2))
+
+		Expect(tunnel.Close()).To(Succeed())
+		tunnel.Close()
+		Expect(testutil.ToFloat64(active)).To(Equal(activeBefore))
+	})
+
+	It("Counts the Redis commands which fail", func() {
+		mr, err := miniredis.Run()
+		Expect(err).NotTo(HaveOccurred())
+
+		client := redis.NewClient(&redis.Options{
+			Addr:        mr.Addr(),
+			DialTimeout: time.Second,
+			MaxRetries:  0,
+		})
+		defer client.Close()
+		metrics.InstrumentRedis(client)
+
+		errors := metrics.RedisErrors.WithLabelValues("get")
+		before := testutil.ToFloat64(errors)
+
+		Expect(client.Get("missing").Err()).To(Equal(redis.Nil))
+		Expect(testutil.ToFloat64(errors)).To(Equal(before))
+
+		mr.Close()
+		Expect(client.Get("missing").Err()).To(HaveOccurred())
+		Expect(testutil.ToFloat64(errors)).To(Equal(before + 1))
+	})
+
+	It("Serves the series in the Prometheus text format", func() {
+		metrics.Logins.Inc()
+
+		rr := httptest.NewRecorder()
+		metrics.Handler().ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+
+		Expect(rr.Code).To(Equal(http.StatusOK))
+
+		body, err := ioutil.ReadAll(rr.Body)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(string(body)).To(ContainSubstring("iap_logins_total"))
+		Expect(string(body)).To(ContainSubstring("go_goroutines"))
+	})
+})
@@ -0,0 +1,31 @@
+package metrics
+
+import (
+	"github.com/go-redis/redis"
+)
+
+// InstrumentRedis counts the commands of the client which fail, a missing key
+// is not a failure.
+func InstrumentRedis(client *redis.Client) {
+	client.WrapProcess(func(process func(redis.Cmder) error) func(redis.Cmder) error {
+		return func(cmd redis.Cmder) error {
+			err := process(cmd)
+			if err != nil && err != redis.Nil {
+				RedisErrors.WithLabelValues(cmd.Name()).Inc()
+			}
+			return err
+		}
+	})
+
+	client.WrapProcessPipeline(func(process func([]redis.Cmder) error) func([]redis.Cmder) error {
+		return func(cmds []redis.Cmder) error {
+			err := process(cmds)
+			for _, cmd := range cmds {
+				if cmdErr := cmd.Err(); cmdErr != nil && cmdErr != redis.Nil {
+					RedisErrors.WithLabelValues(cmd.Name()).Inc()
+				}
+			}
+			return err
+		}
+	})
+}
@@ -0,0 +1,48 @@
+package metrics
+
+import (
+	"net"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Tunnel counts the connection to an upstream as an active tunnel of the
+// proxy until it is closed, along with the bytes sent through it.
+func Tunnel(conn net.Conn, proxy string) net.Conn {
+	active := ActiveTunnels.WithLabelValues(proxy)
+	active.Inc()
+
+	return &tunnel{
+		Conn:       conn,
+		active:     active,
+		upstream:   TunnelBytes.WithLabelValues(proxy, "upstream"),
+		downstream: TunnelBytes.WithLabelValues(proxy, "downstream"),
+	}
+}
+
+type tunnel struct {
+	net.Conn
+
+	active     prometheus.Gauge
+	upstream   prometheus.Counter
+	downstream prometheus.Counter
+	once       sync.Once
+}
+
+func (t *tunnel) Read(b []byte) (int, error) {
+	n, err := t.Conn.Read(b)
+	t.downstream.Add(float64(n))
+	return n, err
+}
+
+func (t *tunnel) Write(b []byte) (int, error) {
+	n, err := t.Conn.Write(b)
+	t.upstream.Add(float64(n))
+	return n, err
+}
+
+func (t *tunnel) Close() error {
+	t.once.Do(t.active.Dec)
+	return t.Conn.Close()
+}
@@ -0,0 +1,149 @@
+package oidc_test
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"time"
+
+	"github.com/alphagov/iap/pkg/cfg"
+	"github.com/alphagov/iap/pkg/oidc"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/sirupsen/logrus"
+)
+
+func idToken(claims map[string]interface{}) string {
+	payload, err := json.Marshal(claims)
+	Expect(err).NotTo(HaveOccurred())
+
+	return "e30." + base64.RawURLEncoding.EncodeToString(payload) + ".c2lnbmF0dXJl"
+}
+
+var _ = Describe("OIDC package", func() {
+	var (
+		provider *httptest.Server
+		client   *oidc.Client
+		claims   map[string]interface{}
+	)
+
+	BeforeEach(func() {
+		claims = map[string]interface{}{
+			"iss":            "https://accounts.mydomain.com",
+			"aud":            "my-client-id",
+			"exp":            time.Now().Add(time.Hour).Unix(),
+			"iat":            time.Now().Unix(),
+			"email":          "fname.lname@mydomain.com",
+			"email_verified": true,
+		}
+
+		provider = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			Expect(r.ParseForm()).To(Succeed())
+
+			if r.PostForm.Get("code") != "my-code" || r.PostForm.Get("client_secret") != "my-client-secret" {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+
+			fmt.Fprintf(w, `{"id_token": %q}`, idToken(claims))
+		}))
+
+		tokenURI, err := url.Parse(provider.URL + "/token")
+		Expect(err).NotTo(HaveOccurred())
+
+		logger := logrus.New()
+		logger.SetOutput(GinkgoWriter)
+
+		client = oidc.New(cfg.ValidatedOIDCConfig{
+			RedirectURI:     url.URL{Scheme: "https", Host: "iap.mydomain.com", Path: "/oidc/callback"},
+			AuthURI:         url.URL{Scheme: "https", Host: "accounts.mydomain.com", Path: "/auth"},
+			TokenURI:        *tokenURI,
+			Scopes:          []string{"openid", "email"},
+			IdentifierClaim: "email",
+			Issuer:          "https://accounts.mydomain.com",
+			ClientID:        "my-client-id",
+			ClientSecret:    "my-client-secret",
+		}, logger)
+
+		authURI, err := url.Parse(client.AuthCodeURL("my-state"))
+		Expect(err).NotTo(HaveOccurred())
+		claims["nonce"] = authURI.Query().Get("nonce")
+	})
+
+	AfterEach(func() {
+		provider.Close()
+	})
+
+	It("should send the user to the provider with the state", func() {
+		authURI, err := url.Parse(client.AuthCodeURL("my-state"))
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(authURI.Host).To(Equal("accounts.mydomain.com"))
+		Expect(authURI.Query().Get("state")).To(Equal("my-state"))
+		Expect(authURI.Query().Get("scope")).To(Equal("openid email"))
+		Expect(authURI.Query().Get("redirect_uri")).To(Equal("https://iap.mydomain.com/oidc/callback"))
+	})
+
+	It("should exchange a code for the identifier of the user", func() {
+		identifier, err := client.Exchange(context.Background(), "my-code", "my-state")
+
+		Expect(err).NotTo(HaveOccurred())
+		Expect(identifier).To(Equal("fname.lname@mydomain.com"))
+	})
+
+	It("should fail to exchange an invalid code", func() {
+		_, err := client.Exchange(context.Background(), "other-code", "my-state")
+
+		Expect(err).To(MatchError(ContainSubstring("token endpoint responded with 400")))
+	})
+
+	It("should refuse a token issued for another client", func() {
+		claims["aud"] = []interface{}{"other-client-id"}
+
+		_, err := client.Exchange(context.Background(), "my-code", "my-state")
+
+		Expect(err).To(MatchError(ContainSubstring("ID token was not issued for this client")))
+	})
+
+	It("should refuse an email which is not verified", func() {
+		claims["email_verified"] = false
+
+		_, err := client.Exchange(context.Background(), "my-code", "my-state")
+
+		Expect(err).To(MatchError(ContainSubstring("ID token email is not verified")))
+	})
+
+	It("should refuse a token issued by another provider", func() {
+		claims["iss"] = "https://other.mydomain.com"
+
+		_, err := client.Exchange(context.Background(), "my-code", "my-state")
+
+		Expect(err).To(MatchError(ContainSubstring("ID token was issued by https://other.mydomain.com")))
+	})
+
+	It("should refuse an expired token", func() {
+		claims["exp"] = time.Now().Add(-time.Hour).Unix()
+
+		_, err := client.Exchange(context.Background(), "my-code", "my-state")
+
+		Expect(err).To(MatchError(ContainSubstring("ID token has expired")))
+	})
+
+	It("should refuse a token issued in the future", func() {
+		claims["iat"] = time.Now().Add(time.Hour).Unix()
+
+		_, err := client.Exchange(context.Background(), "my-code", "my-state")
+
+		Expect(err).To(MatchError(ContainSubstring("ID token was issued in the future")))
+	})
+
+	It("should refuse a token issued for another login", func() {
+		_, err := client.Exchange(context.Background(), "my-code", "other-state")
+
+		Expect(err).To(MatchError(ContainSubstring("ID token was not issued for this login")))
+	})
+})
@@ -0,0 +1,414 @@
+package oidc
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/alphagov/iap/pkg/cfg"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// keysExpiration is how long the keys of the provider are cached for.
+	keysExpiration = time.Hour
+	// refreshInterval limits how often unknown key IDs can make us fetch the keys again.
+	refreshInterval = time.Minute
+	// leeway allows for clock skew between IAP and the provider.
+	leeway = time.Minute
+)
+
+// ErrInvalidToken is returned when a bearer token cannot be trusted.
+var ErrInvalidToken = errors.New("Bearer token is not valid")
+
+// Verifier is a struct capable of validating signed ID or access tokens against
+// the JSON Web Key Set of the provider.
+type Verifier struct {
+	jwksURI         string
+	issuer          string
+	audiences       []string
+	identifierClaim string
+
+	client *http.Client
+	logger *logrus.Logger
+	now    func() time.Time
+
+	mu      sync.Mutex
+	keys    map[string]crypto.PublicKey
+	fetched time.Time
+	// failed is when fetching the keys last failed, so that health checks
+	// do not fetch them on every run while the provider is down
+	failed  time.Time
+	failure error
+	// fetching is closed once the keys being fetched are stored, nil when
+	// they are not being fetched
+	fetching chan struct{}
+}
+
+// NewVerifier will construct the struct elsewhere. The config must have a JWKSURI.
+func NewVerifier(config cfg.ValidatedOIDCConfig, logger *logrus.Logger) *Verifier {
+	return &Verifier{
+		jwksURI:         config.JWKSURI.String(),
+		issuer:          config.Issuer,
+		audiences:       config.Audiences,
+		identifierClaim: config.IdentifierClaim,
+
+		client: &http.Client{Timeout: 10 * time.Second},
+		logger: logger,
+		now:    time.Now,
+	}
+}
+
+// Verify checks the signature, issuer, audience and lifetime of the token and
+// returns the identifier of the user, which is the value of the identifier claim.
+func (v *Verifier) Verify(token string) (string, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return "", ErrInvalidToken
+	}
+
+	var header struct {
+		Algorithm string `json:"alg"`
+		KeyID     string `json:"kid"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return "", ErrInvalidToken
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return "", ErrInvalidToken
+	}
+
+	key, err := v.key(header.KeyID)
+	if err != nil {
+		return "", err
+	}
+
+	if err := verifySignature(header.Algorithm, key, parts[0]+"."+parts[1], signature); err != nil {
+		v.logger.WithFields(logrus.Fields{
+			"kid":   header.KeyID,
+			"error": err,
+		}).Debug("bearer token signature is not valid")
+		return "", ErrInvalidToken
+	}
+
+	claims, err := decodeClaims(token)
+	if err != nil {
+		return "", ErrInvalidToken
+	}
+
+	if err := v.verifyClaims(claims); err != nil {
+		v.logger.WithField("error", err).Debug("bearer token claims are not valid")
+		return "", ErrInvalidToken
+	}
+
+	identifier, ok := claims[v.identifierClaim].(string)
+	if !ok || identifier == "" {
+		return "", ErrInvalidToken
+	}
+
+	// Access tokens do not always say if the email is verified, but it must
+	// not be used when they say it is not
+	if v.identifierClaim == "email" && claims["email_verified"] == false {
+		return "", ErrInvalidToken
+	}
+
+	return identifier, nil
+}
+
+func (v *Verifier) verifyClaims(claims map[string]interface{}) error {
+	now := v.now()
+
+	exp, ok := claims["exp"].(float64)
+	if !ok || now.After(time.Unix(int64(exp), 0).Add(leeway)) {
+		return fmt.Errorf("token has expired")
+	}
+
+	if nbf, ok := claims["nbf"].(float64); ok && now.Add(leeway).Before(time.Unix(int64(nbf), 0)) {
+		return fmt.Errorf("token is not valid yet")
+	}
+
+	if claims["iss"] != v.issuer {
+		return fmt.Errorf("token was issued by %v", claims["iss"])
+	}
+
+	for _, audience := range v.audiences {
+		if hasAudience(claims["aud"], audience) {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("token was issued for %v", claims["aud"])
+}
+
+// Check makes sure the signing keys of the provider are fresh, fetching them
+// again once they have expired. Keys which fail to be fetched are kept, but
+// reported until they can be fetched again.
+func (v *Verifier) Check() error {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	now := v.now()
+	if len(v.keys) > 0 && now.Sub(v.fetched) <= keysExpiration {
+		return nil
+	}
+
+	if v.failure != nil && now.Sub(v.failed) < refreshInterval {
+		return v.failure
+	}
+
+	return v.refresh()
+}
+
+// key returns the key with the ID, fetching the keys again when they have
+// expired or the key is unknown, as providers rotate their keys. They are not
+// fetched again more than once per refresh interval, whether fetching them
+// succeeded or failed, and an expired key is used meanwhile.
+func (v *Verifier) key(keyID string) (crypto.PublicKey, error) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	now := v.now()
+	key, ok := v.keys[keyID]
+	expired := now.Sub(v.fetched) > keysExpiration
+
+	if ok && !expired {
+		return key, nil
+	}
+
+	failing := v.failure != nil && now.Sub(v.failed) < refreshInterval
+	if failing || now.Sub(v.fetched) < refreshInterval {
+		switch {
+		case ok:
+			return key, nil
+		case failing:
+			return nil, v.failure
+		}
+		return nil, ErrInvalidToken
+	}
+
+	if err := v.refresh(); err != nil {
+		v.logger.WithFields(logrus.Fields{
+			"jwks_uri": v.jwksURI,
+			"error":    err,
+		}).Error("failed to fetch signing keys")
+
+		if ok {
+			return key, nil
+		}
+		return nil, err
+	}
+
+	if key, ok := v.keys[keyID]; ok {
+		return key, nil
+	}
+
+	return nil, ErrInvalidToken
+}
+
+// refresh fetches the keys again without holding the lock, which must be
+// held when called and is held again once it returns, so that tokens signed
+// with known keys are verified meanwhile. Callers refreshing at the same time
+// wait for the same fetch.
+func (v *Verifier) refresh() error {
+	if v.fetching != nil {
+		fetching := v.fetching
+		v.mu.Unlock()
+		<-fetching
+		v.mu.Lock()
+		return v.failure
+	}
+
+	fetching := make(chan struct{})
+	v.fetching = fetching
+	v.mu.Unlock()
+
+	keys, err := v.fetch()
+	if err == nil && len(keys) == 0 {
+		err = fmt.Errorf("JWKS does not contain any usable keys")
+	}
+
+	v.mu.Lock()
+	v.fetching = nil
+	close(fetching)
+
+	if err != nil {
+		v.failed, v.failure = v.now(), err
+		return err
+	}
+
+	v.keys = keys
+	v.fetched = v.now()
+	v.failure = nil
+	return nil
+}
+
+func (v *Verifier) fetch() (map[string]crypto.PublicKey, error) {
+	resp, err := v.client.Get(v.jwksURI)
+	if err != nil {
+		return nil, fmt.Errorf("Could not fetch JWKS: %s", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Could not fetch JWKS: responded with %d", resp.StatusCode)
+	}
+
+	var set struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&set); err != nil {
+		return nil, fmt.Errorf("Could not decode JWKS: %s", err)
+	}
+
+	keys := make(map[string]crypto.PublicKey)
+	for _, jwk := range set.Keys {
+		key, err := jwk.publicKey()
+		if err != nil {
+			v.logger.WithFields(logrus.Fields{
+				"kid":   jwk.KeyID,
+				"error": err,
+			}).Warn("ignoring signing key")
+			continue
+		}
+		keys[jwk.KeyID] = key
+	}
+
+	return keys, nil
+}
+
+type jsonWebKey struct {
+	KeyType string `json:"kty"`
+	KeyID   string `json:"kid"`
+	Use     string `json:"use"`
+
+	N string `json:"n"`
+	E string `json:"e"`
+
+	Curve string `json:"crv"`
+	X     string `json:"x"`
+	Y     string `json:"y"`
+}
+
+func (k jsonWebKey) publicKey() (crypto.PublicKey, error) {
+	if k.Use != "" && k.Use != "sig" {
+		return nil, fmt.Errorf("key is not for signatures")
+	}
+
+	switch k.KeyType {
+	case "RSA":
+		n, err := decodeInt(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeInt(k.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Curve {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve %s", k.Curve)
+		}
+		x, err := decodeInt(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decodeInt(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	}
+
+	return nil, fmt.Errorf("unsupported key type %s", k.KeyType)
+}
+
+// verifySignature only accepts asymmetric algorithms, so a token cannot be
+// signed with the public key or not signed at all
+func verifySignature(algorithm string, key crypto.PublicKey, signed string, signature []byte) error {
+	if len(algorithm) != 5 {
+		return fmt.Errorf("unsupported algorithm %s", algorithm)
+	}
+
+	var hash crypto.Hash
+	switch algorithm[2:] {
+	case "256":
+		hash = crypto.SHA256
+	case "384":
+		hash = crypto.SHA384
+	case "512":
+		hash = crypto.SHA512
+	default:
+		return fmt.Errorf("unsupported algorithm %s", algorithm)
+	}
+
+	h := hash.New()
+	h.Write([]byte(signed))
+	digest := h.Sum(nil)
+
+	switch key := key.(type) {
+	case *rsa.PublicKey:
+		switch {
+		case strings.HasPrefix(algorithm, "RS"):
+			return rsa.VerifyPKCS1v15(key, hash, digest, signature)
+		case strings.HasPrefix(algorithm, "PS"):
+			return rsa.VerifyPSS(key, hash, digest, signature, nil)
+		}
+	case *ecdsa.PublicKey:
+		if !strings.HasPrefix(algorithm, "ES") {
+			break
+		}
+
+		size := (key.Curve.Params().BitSize + 7) / 8
+		if len(signature) != 2*size {
+			return fmt.Errorf("signature has the wrong length")
+		}
+
+		r := new(big.Int).SetBytes(signature[:size])
+		s := new(big.Int).SetBytes(signature[size:])
+		if !ecdsa.Verify(key, digest, r, s) {
+			return fmt.Errorf("signature does not match")
+		}
+		return nil
+	}
+
+	return fmt.Errorf("algorithm %s does not match the key", algorithm)
+}
+
+func decodeSegment(segment string, v interface{}) error {
+	blob, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+
+	return json.Unmarshal(blob, v)
+}
+
+func decodeInt(value string) (*big.Int, error) {
+	blob, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return nil, fmt.Errorf("key is not valid: %s", err)
+	}
+
+	return new(big.Int).SetBytes(blob), nil
+}
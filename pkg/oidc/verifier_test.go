@@ -0,0 +1,258 @@
+package oidc_test
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"time"
+
+	"github.com/alphagov/iap/pkg/cfg"
+	"github.com/alphagov/iap/pkg/oidc"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/sirupsen/logrus"
+)
+
+func encodeSegment(v interface{}) string {
+	blob, err := json.Marshal(v)
+	Expect(err).NotTo(HaveOccurred())
+
+	return base64.RawURLEncoding.EncodeToString(blob)
+}
+
+func encodeInt(i *big.Int) string {
+	return base64.RawURLEncoding.EncodeToString(i.Bytes())
+}
+
+func signRS256(key *rsa.PrivateKey, kid string, claims map[string]interface{}) string {
+	signed := encodeSegment(map[string]string{"alg": "RS256", "kid": kid}) + "." + encodeSegment(claims)
+	digest := sha256.Sum256([]byte(signed))
+
+	signature, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	Expect(err).NotTo(HaveOccurred())
+
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func signES256(key *ecdsa.PrivateKey, kid string, claims map[string]interface{}) string {
+	signed := encodeSegment(map[string]string{"alg": "ES256", "kid": kid}) + "." + encodeSegment(claims)
+	digest := sha256.Sum256([]byte(signed))
+
+	r, s, err := ecdsa.Sign(rand.Reader, key, digest[:])
+	Expect(err).NotTo(HaveOccurred())
+
+	signature := make([]byte, 64)
+	r.FillBytes(signature[:32])
+	s.FillBytes(signature[32:])
+
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+var _ = Describe("Verifier", func() {
+	var (
+		rsaKey   *rsa.PrivateKey
+		ecKey    *ecdsa.PrivateKey
+		provider *httptest.Server
+		fetches  int
+		verifier *oidc.Verifier
+		claims   map[string]interface{}
+	)
+
+	BeforeEach(func() {
+		var err error
+
+		rsaKey, err = rsa.GenerateKey(rand.Reader, 2048)
+		Expect(err).NotTo(HaveOccurred())
+
+		ecKey, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		Expect(err).NotTo(HaveOccurred())
+
+		fetches = 0
+		provider = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			fetches++
+
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"keys": []map[string]string{
+					{
+						"kty": "RSA",
+						"kid": "rsa-key",
+						"use": "sig",
+						"n":   encodeInt(rsaKey.N),
+						"e":   encodeInt(big.NewInt(int64(rsaKey.E))),
+					},
+					{
+						"kty": "EC",
+						"kid": "ec-key",
+						"crv": "P-256",
+						"x":   encodeInt(ecKey.X),
+						"y":   encodeInt(ecKey.Y),
+					},
+				},
+			})
+		}))
+
+		jwksURI, err := url.Parse(provider.URL + "/keys")
+		Expect(err).NotTo(HaveOccurred())
+
+		logger := logrus.New()
+		logger.SetOutput(GinkgoWriter)
+
+		verifier = oidc.NewVerifier(cfg.ValidatedOIDCConfig{
+			IdentifierClaim: "email",
+			JWKSURI:         jwksURI,
+			Issuer:          "https://accounts.mydomain.com",
+			Audiences:       []string{"my-client-id", "my-api"},
+		}, logger)
+
+		claims = map[string]interface{}{
+			"iss":   "https://accounts.mydomain.com",
+			"aud":   "my-api",
+			"exp":   time.Now().Add(time.Hour).Unix(),
+			"email": "fname.lname@mydomain.com",
+		}
+	})
+
+	AfterEach(func() {
+		provider.Close()
+	})
+
+	It("should verify a token signed with an RSA key", func() {
+		identifier, err := verifier.Verify(signRS256(rsaKey, "rsa-key", claims))
+
+		Expect(err).NotTo(HaveOccurred())
+		Expect(identifier).To(Equal("fname.lname@mydomain.com"))
+	})
+
+	It("should verify a token signed with an EC key", func() {
+		identifier, err := verifier.Verify(signES256(ecKey, "ec-key", claims))
+
+		Expect(err).NotTo(HaveOccurred())
+		Expect(identifier).To(Equal("fname.lname@mydomain.com"))
+	})
+
+	It("should only fetch the keys once", func() {
+		for i := 0; i < 3; i++ {
+			_, err := verifier.Verify(signRS256(rsaKey, "rsa-key", claims))
+			Expect(err).NotTo(HaveOccurred())
+		}
+
+		Expect(fetches).To(Equal(1))
+	})
+
+	It("should not fetch the keys again straight away for an unknown key", func() {
+		_, err := verifier.Verify(signRS256(rsaKey, "rsa-key", claims))
+		Expect(err).NotTo(HaveOccurred())
+
+		_, err = verifier.Verify(signRS256(rsaKey, "unknown-key", claims))
+		Expect(err).To(Equal(oidc.ErrInvalidToken))
+		Expect(fetches).To(Equal(1))
+	})
+
+	It("should refuse a token signed with another key", func() {
+		otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+		Expect(err).NotTo(HaveOccurred())
+
+		_, err = verifier.Verify(signRS256(otherKey, "rsa-key", claims))
+		Expect(err).To(Equal(oidc.ErrInvalidToken))
+	})
+
+	It("should refuse an unsigned token", func() {
+		token := encodeSegment(map[string]string{"alg": "none", "kid": "rsa-key"}) + "." + encodeSegment(claims) + "."
+
+		_, err := verifier.Verify(token)
+		Expect(err).To(Equal(oidc.ErrInvalidToken))
+	})
+
+	It("should refuse an expired token", func() {
+		claims["exp"] = time.Now().Add(-time.Hour).Unix()
+
+		_, err := verifier.Verify(signRS256(rsaKey, "rsa-key", claims))
+		Expect(err).To(Equal(oidc.ErrInvalidToken))
+	})
+
+	It("should refuse a token which is not valid yet", func() {
+		claims["nbf"] = time.Now().Add(time.Hour).Unix()
+
+		_, err := verifier.Verify(signRS256(rsaKey, "rsa-key", claims))
+		Expect(err).To(Equal(oidc.ErrInvalidToken))
+	})
+
+	It("should refuse a token from another issuer", func() {
+		claims["iss"] = "https://accounts.otherdomain.com"
+
+		_, err := verifier.Verify(signRS256(rsaKey, "rsa-key", claims))
+		Expect(err).To(Equal(oidc.ErrInvalidToken))
+	})
+
+	It("should refuse a token issued for another audience", func() {
+		claims["aud"] = []interface{}{"other-api"}
+
+		_, err := verifier.Verify(signRS256(rsaKey, "rsa-key", claims))
+		Expect(err).To(Equal(oidc.ErrInvalidToken))
+	})
+
+	It("should refuse a token without the identifier claim", func() {
+		delete(claims, "email")
+
+		_, err := verifier.Verify(signRS256(rsaKey, "rsa-key", claims))
+		Expect(err).To(Equal(oidc.ErrInvalidToken))
+	})
+
+	It("should refuse an email which is not verified", func() {
+		claims["email_verified"] = false
+
+		_, err := verifier.Verify(signRS256(rsaKey, "rsa-key", claims))
+		Expect(err).To(Equal(oidc.ErrInvalidToken))
+	})
+
+	It("should check the signing keys are fresh without fetching them again", func() {
+		Expect(verifier.Check()).To(Succeed())
+		Expect(verifier.Check()).To(Succeed())
+		Expect(fetches).To(Equal(1))
+	})
+
+	It("should fail the check when the signing keys cannot be fetched", func() {
+		provider.Close()
+
+		Expect(verifier.Check()).To(MatchError(ContainSubstring("Could not fetch JWKS")))
+	})
+
+	It("should not fetch the keys again straight away when they cannot be fetched", func() {
+		failures := 0
+		failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			failures++
+			w.WriteHeader(http.StatusInternalServerError)
+		}))
+		defer failing.Close()
+
+		jwksURI, err := url.Parse(failing.URL + "/keys")
+		Expect(err).NotTo(HaveOccurred())
+
+		logger := logrus.New()
+		logger.SetOutput(GinkgoWriter)
+
+		verifier := oidc.NewVerifier(cfg.ValidatedOIDCConfig{
+			IdentifierClaim: "email",
+			JWKSURI:         jwksURI,
+			Issuer:          "https://accounts.mydomain.com",
+			Audiences:       []string{"my-api"},
+		}, logger)
+
+		for i := 0; i < 3; i++ {
+			_, err := verifier.Verify(signRS256(rsaKey, "rsa-key", claims))
+			Expect(err).To(MatchError(ContainSubstring("responded with 500")))
+		}
+		Expect(verifier.Check()).To(MatchError(ContainSubstring("responded with 500")))
+
+		Expect(failures).To(Equal(1))
+	})
+})
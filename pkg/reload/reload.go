@@ -0,0 +1,223 @@
+package reload
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/alphagov/iap/pkg/cfg"
+	"github.com/alphagov/iap/pkg/metrics"
+	"github.com/sirupsen/logrus"
+)
+
+// Interval is how often the configuration file is checked for changes.
+const Interval = 10 * time.Second
+
+// Signals returns a channel receiving the signals which force a reload.
+func Signals() <-chan os.Signal {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+	return signals
+}
+
+// Status is what is known about the configuration being served, the last
+// error is kept until the file is reloaded successfully.
+type Status struct {
+	Path         string     `json:"path"`
+	Hash         string     `json:"hash"`
+	Reloads      int        `json:"reloads"`
+	Failures     int        `json:"failures"`
+	LastError    string     `json:"last_error,omitempty"`
+	LastReloadAt *time.Time `json:"last_reload_at,omitempty"`
+}
+
+// Watcher holds the latest valid configuration read from a file, which is
+// swapped when the file changes so that the servers do not need a restart.
+type Watcher struct {
+	path   string
+	logger *logrus.Logger
+	config atomic.Pointer[cfg.ValidatedConfig]
+
+	// mu is held for the whole of a reload, so that listeners are called
+	// with one configuration at a time
+	mu        sync.Mutex
+	status    Status
+	failed    string
+	listeners []func(cfg.ValidatedConfig)
+	now       func() time.Time
+}
+
+// Load reads the configuration, which must be valid to start with.
+func Load(path string, logger *logrus.Logger) (*Watcher, error) {
+	w := &Watcher{
+		path:   path,
+		logger: logger,
+		status: Status{Path: path},
+		now:    time.Now,
+	}
+
+	blob, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("Could not read config: %s", err)
+	}
+
+	config, err := w.parse(blob)
+	if err != nil {
+		return nil, err
+	}
+
+	w.config.Store(&config)
+	w.status.Hash = hashOf(blob)
+	return w, nil
+}
+
+// Config returns the latest valid configuration.
+func (w *Watcher) Config() cfg.ValidatedConfig {
+	return *w.config.Load()
+}
+
+// Status returns what is known about the configuration being served, nil when
+// there is no watcher as no configuration file was given.
+func (w *Watcher) Status() *Status {
+	if w == nil {
+		return nil
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	status := w.status
+	return &status
+}
+
+// OnReload calls the listener with every configuration swapped in after it
+// was added.
+func (w *Watcher) OnReload(listener func(cfg.ValidatedConfig)) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.listeners = append(w.listeners, listener)
+}
+
+// Reload reads the configuration again, returning if it was swapped. It is
+// only swapped when its content changed, and kept when the new one cannot be
+// read or is not valid.
+func (w *Watcher) Reload() (bool, error) {
+	return w.reload(true)
+}
+
+// reload skips reading the file again when it has not changed since it last
+// failed, unless forced, so that a broken file is only reported once.
+func (w *Watcher) reload(force bool) (bool, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	blob, err := ioutil.ReadFile(w.path)
+	if err != nil {
+		return false, w.fail(err.Error(), fmt.Errorf("Could not read config: %s", err), force)
+	}
+
+	hash := hashOf(blob)
+	if hash == w.status.Hash {
+		return false, nil
+	}
+
+	config, err := w.parse(blob)
+	if err != nil {
+		return false, w.fail(hash, err, force)
+	}
+
+	w.config.Store(&config)
+
+	at := w.now().UTC()
+	w.failed = ""
+	w.status.Hash = hash
+	w.status.Reloads++
+	w.status.LastError = ""
+	w.status.LastReloadAt = &at
+	metrics.ConfigReloads.WithLabelValues(metrics.Success).Inc()
+
+	for _, listener := range w.listeners {
+		listener(config)
+	}
+
+	return true, nil
+}
+
+// fail records why the configuration was kept, unless it is the same failure
+// as last time.
+func (w *Watcher) fail(key string, err error, force bool) error {
+	if key == w.failed && !force {
+		return nil
+	}
+
+	w.failed = key
+	w.status.Failures++
+	w.status.LastError = err.Error()
+	metrics.ConfigReloads.WithLabelValues(metrics.Failure).Inc()
+	return err
+}
+
+// Watch reloads the configuration every interval, or as soon as a signal is
+// received, until stopped.
+func (w *Watcher) Watch(interval time.Duration, signals <-chan os.Signal, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		forced := false
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		case <-signals:
+			forced = true
+			w.logger.WithField("path", w.path).Info("reloading configuration on signal")
+		}
+
+		reloaded, err := w.reload(forced)
+		if err != nil {
+			w.logger.WithFields(logrus.Fields{
+				"path":  w.path,
+				"error": err,
+			}).Error("failed to reload configuration, keeping the current one")
+			continue
+		}
+		if reloaded {
+			w.logger.WithFields(logrus.Fields{
+				"path": w.path,
+				"hash": w.Status().Hash,
+			}).Info("reloaded configuration")
+		} else if forced {
+			w.logger.WithField("path", w.path).Info("configuration unchanged")
+		}
+	}
+}
+
+// parse validates the configuration, logging any warnings.
+func (w *Watcher) parse(blob []byte) (cfg.ValidatedConfig, error) {
+	config, err := cfg.ParseAndValidateConfig(string(blob))
+	if err != nil {
+		return cfg.ValidatedConfig{}, err
+	}
+
+	for _, warning := range config.Warnings {
+		w.logger.WithFields(logrus.Fields{
+			"path": w.path,
+		}).Warn(warning)
+	}
+
+	return config, nil
+}
+
+func hashOf(blob []byte) string {
+	sum := sha256.Sum256(blob)
+	return hex.EncodeToString(sum[:])
+}
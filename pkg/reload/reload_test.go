@@ -0,0 +1,195 @@
+package reload_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"github.com/alphagov/iap/pkg/cfg"
+	"github.com/alphagov/iap/pkg/reload"
+	"github.com/lithammer/dedent"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/sirupsen/logrus"
+)
+
+func configWithService(host string) string {
+	return dedent.Dedent(`
+    oidc:
+      redirect_uri: https://iap.mydomain.com/oidc/callback
+      auth_uri: https://accounts.google.com/o/oauth2/v2/auth
+      token_uri: https://www.googleapis.com/oauth2/v4/token
+      scopes: [openid, email]
+      identifier_claim: email
+      client_id: foo-0000-1111.apps.googleusercontent.com
+      client_secret: abcd-0000-1111
+    session:
+      cookie_domain: mydomain.com
+    roles:
+      - superuser
+    services:
+      my-service:
+        upstream_uri: http://my-service.local
+        matchers:
+          - host: ` + host + `
+        roles:
+          - superuser
+    users:
+      fname.lname@mydomain.com:
+        roles:
+          - superuser
+	`)
+}
+
+var _ = Describe("Reload", func() {
+	var (
+		dir  string
+		path string
+	)
+
+	// write replaces the file at once, as the watcher could otherwise read it
+	// half written
+	write := func(content string) {
+		tmp := path + ".tmp"
+		Expect(ioutil.WriteFile(tmp, []byte(content), 0600)).To(Succeed())
+		Expect(os.Rename(tmp, path)).To(Succeed())
+	}
+
+	host := func(config cfg.ValidatedConfig) string {
+		return config.Services["my-service"].Matchers[0].Host
+	}
+
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "reload")
+		Expect(err).NotTo(HaveOccurred())
+		path = filepath.Join(dir, "config.yaml")
+		write(configWithService("old.mydomain.com"))
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(dir)
+	})
+
+	It("Requires a valid configuration to start with", func() {
+		write("roles: [")
+
+		_, err := reload.Load(path, logrus.New())
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("Swaps the configuration when it changed", func() {
+		watcher, err := reload.Load(path, logrus.New())
+		Expect(err).NotTo(HaveOccurred())
+		Expect(host(watcher.Config())).To(Equal("old.mydomain.com"))
+		initial := watcher.Status()
+
+		reloaded := make([]cfg.ValidatedConfig, 0, 1)
+		watcher.OnReload(func(config cfg.ValidatedConfig) {
+			reloaded = append(reloaded, config)
+		})
+
+		write(configWithService("new.mydomain.com"))
+		ok, err := watcher.Reload()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(ok).To(BeTrue())
+
+		Expect(host(watcher.Config())).To(Equal("new.mydomain.com"))
+		Expect(reloaded).To(HaveLen(1))
+		Expect(host(reloaded[0])).To(Equal("new.mydomain.com"))
+
+		status := watcher.Status()
+		Expect(status.Path).To(Equal(path))
+		Expect(status.Hash).To(HaveLen(64))
+		Expect(status.Hash).NotTo(Equal(initial.Hash))
+		Expect(status.Reloads).To(Equal(1))
+		Expect(status.LastReloadAt).NotTo(BeNil())
+	})
+
+	It("Does not swap the configuration when it did not change", func() {
+		watcher, err := reload.Load(path, logrus.New())
+		Expect(err).NotTo(HaveOccurred())
+
+		ok, err := watcher.Reload()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(ok).To(BeFalse())
+		Expect(watcher.Status().Reloads).To(Equal(0))
+	})
+
+	It("Keeps the configuration when the new one is not valid", func() {
+		watcher, err := reload.Load(path, logrus.New())
+		Expect(err).NotTo(HaveOccurred())
+		watcher.OnReload(func(cfg.ValidatedConfig) {
+			Fail("the configuration should not be swapped")
+		})
+
+		write(configWithService(""))
+		ok, err := watcher.Reload()
+		Expect(err).To(HaveOccurred())
+		Expect(ok).To(BeFalse())
+
+		Expect(host(watcher.Config())).To(Equal("old.mydomain.com"))
+		status := watcher.Status()
+		Expect(status.Failures).To(Equal(1))
+		Expect(status.LastError).NotTo(BeEmpty())
+	})
+
+	It("Clears the last error once the configuration is valid again", func() {
+		watcher, err := reload.Load(path, logrus.New())
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(os.Remove(path)).To(Succeed())
+		_, err = watcher.Reload()
+		Expect(err).To(MatchError(ContainSubstring("Could not read config")))
+
+		write(configWithService("new.mydomain.com"))
+		ok, err := watcher.Reload()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(ok).To(BeTrue())
+
+		status := watcher.Status()
+		Expect(status.Failures).To(Equal(1))
+		Expect(status.LastError).To(BeEmpty())
+	})
+
+	It("Reloads when the file changes or on a signal until stopped", func() {
+		watcher, err := reload.Load(path, logrus.New())
+		Expect(err).NotTo(HaveOccurred())
+
+		signals := make(chan os.Signal, 1)
+		stop := make(chan struct{})
+		stopped := make(chan struct{})
+		go func() {
+			watcher.Watch(10*time.Millisecond, signals, stop)
+			close(stopped)
+		}()
+
+		write(configWithService("new.mydomain.com"))
+		Eventually(func() string {
+			return host(watcher.Config())
+		}).Should(Equal("new.mydomain.com"))
+
+		write("roles: [")
+		Eventually(func() int {
+			return watcher.Status().Failures
+		}).Should(Equal(1))
+		Consistently(func() int {
+			return watcher.Status().Failures
+		}, 50*time.Millisecond).Should(Equal(1))
+
+		signals <- syscall.SIGHUP
+		Eventually(func() int {
+			return watcher.Status().Failures
+		}).Should(Equal(2))
+
+		close(stop)
+		Eventually(stopped).Should(BeClosed())
+	})
+
+	It("Has no status without a configuration file", func() {
+		var watcher *reload.Watcher
+		Expect(watcher.Status()).To(BeNil())
+	})
+})
@@ -0,0 +1,387 @@
+package router
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/alphagov/iap/pkg/audit"
+	"github.com/alphagov/iap/pkg/metrics"
+	"github.com/alphagov/iap/pkg/service"
+	"github.com/alphagov/iap/pkg/tracing"
+	"github.com/alphagov/iap/pkg/user"
+	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+const (
+	// UserHeader carries the identifier of the authenticated user.
+	UserHeader = "X-Auth-Request-User"
+	// RolesHeader carries the comma separated roles of the authenticated user.
+	RolesHeader = "X-Auth-Request-Roles"
+)
+
+// ErrUnauthenticated is returned by an Authenticator when the request does not identify a user.
+var ErrUnauthenticated = errors.New("Request is not authenticated")
+
+// ErrUnlistedUser is returned by an Authenticator, along with the user, when
+// the user is identified but is not allowed to access any service as they are
+// not one of the configured users.
+var ErrUnlistedUser = errors.New("User is not one of the configured users")
+
+// Authenticator identifies the user making the request.
+type Authenticator func(r *http.Request) (user.User, error)
+
+// Chain combines authenticators, trying each in turn until one identifies the
+// user. Any error other than ErrUnauthenticated stops the chain.
+func Chain(authenticators ...Authenticator) Authenticator {
+	return func(r *http.Request) (user.User, error) {
+		for _, authenticate := range authenticators {
+			u, err := authenticate(r)
+			if err != ErrUnauthenticated {
+				return u, err
+			}
+		}
+
+		return user.User{}, ErrUnauthenticated
+	}
+}
+
+// BearerToken returns the token from the Authorization header of the request,
+// or an empty string if there is none.
+func BearerToken(r *http.Request) string {
+	scheme, token, ok := strings.Cut(r.Header.Get("Authorization"), " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") {
+		return ""
+	}
+
+	return strings.TrimSpace(token)
+}
+
+// LoginURL returns where the user should log in before returning to the original URL.
+type LoginURL func(original string) string
+
+// NewAuthorizer will construct an Authorizer letting through the users who can
+// access the service. Browsers without a session are redirected to log in,
+// while clients sending a bearer token which is not valid are not. Denied
+// requests are recorded by the auditor, allowed ones by the Proxy.
+func NewAuthorizer(authenticate Authenticator, loginURL LoginURL, auditor *audit.Logger, logger *logrus.Logger) Authorizer {
+	return func(w http.ResponseWriter, r *http.Request, svc *service.Service) bool {
+		deny := func(user, reason string) {
+			auditor.Record(audit.Event{
+				Type:        audit.ReverseProxyRequest,
+				User:        user,
+				Source:      sourceIP(r),
+				Destination: r.Host,
+				Service:     svc.Identifier,
+				Decision:    audit.Deny,
+				Reason:      reason,
+			})
+		}
+
+		u, err := authenticate(r)
+		if err == ErrUnauthenticated && BearerToken(r) != "" {
+			metrics.AuthorizationDenials.WithLabelValues(svc.Identifier, "invalid_token").Inc()
+			deny("", "invalid_token")
+			writeInvalidToken(w)
+			return false
+		}
+		if err == ErrUnauthenticated {
+			original := externalURI(r)
+			original.Path = r.URL.Path
+			original.RawQuery = r.URL.RawQuery
+
+			login := loginURL(original.String())
+			deny("", "login_required")
+
+			if r.Method == http.MethodGet || r.Method == http.MethodHead {
+				http.Redirect(w, r, login, http.StatusFound)
+				return false
+			}
+
+			writeLoginRequired(w, login)
+			return false
+		}
+		if err == ErrUnlistedUser {
+			metrics.AuthorizationDenials.WithLabelValues(svc.Identifier, "unlisted_user").Inc()
+			deny(u.Identifier, "unlisted_user")
+			writeError(w, http.StatusForbidden, "access denied")
+			return false
+		}
+		if err != nil {
+			logger.WithField("error", err).Error("failed to authenticate request")
+			deny("", "authentication_failed")
+			writeError(w, http.StatusInternalServerError, "unable to authenticate request")
+			return false
+		}
+
+		if !svc.IsAccessible(u.Roles) {
+			metrics.AuthorizationDenials.WithLabelValues(svc.Identifier, "access_denied").Inc()
+			deny(u.Identifier, "access_denied")
+			writeError(w, http.StatusForbidden, "access denied")
+			return false
+		}
+
+		setIdentity(r.Header, u)
+		return true
+	}
+}
+
+// ForwardAuth answers the authorization subrequests of other reverse proxies,
+// such as nginx auth_request, Traefik ForwardAuth or Caddy forward_auth.
+type ForwardAuth struct {
+	router       *Router
+	authenticate Authenticator
+	loginURL     LoginURL
+	auditor      *audit.Logger
+	logger       *logrus.Logger
+}
+
+// NewForwardAuth will construct the forward authentication endpoint elsewhere.
+func NewForwardAuth(router *Router, authenticate Authenticator, loginURL LoginURL, auditor *audit.Logger, logger *logrus.Logger) *ForwardAuth {
+	return &ForwardAuth{
+		router:       router,
+		authenticate: authenticate,
+		loginURL:     loginURL,
+		auditor:      auditor,
+		logger:       logger,
+	}
+}
+
+// Decision is the outcome of authorizing a request on behalf of another proxy.
+// Status is 200 when the request is allowed, along with the User unless the
+// path is public, 401 along with the LoginURL unless the request carried a
+// bearer token which was not valid, or 403.
+type Decision struct {
+	Status   int
+	Service  string
+	User     *user.User
+	LoginURL string
+	Message  string
+}
+
+// Check applies the same routing, session and role checks as the reverse proxy
+// to the original request. The credentials of the user are read from r.
+func (f *ForwardAuth) Check(method string, original *url.URL, r *http.Request) (Decision, error) {
+	ctx, span := tracing.Start(r.Context(), "forward_auth",
+		attribute.String("http.method", method),
+		attribute.String("http.host", original.Host),
+		attribute.String("http.target", original.Path),
+	)
+	decision, reason, err := f.check(method, original, r.WithContext(ctx))
+	span.SetAttributes(
+		attribute.String("iap.service", decision.Service),
+		attribute.Int("iap.status", decision.Status),
+		attribute.String("iap.reason", reason),
+	)
+	tracing.End(span, err)
+
+	event := audit.Event{
+		Type:        audit.ForwardAuth,
+		Source:      sourceIP(r),
+		Destination: original.Host,
+		Service:     decision.Service,
+		Decision:    audit.Decision(err == nil && decision.Status == http.StatusOK),
+		Reason:      reason,
+	}
+	if decision.User != nil {
+		event.User = decision.User.Identifier
+	}
+	f.auditor.Record(event)
+
+	return decision, err
+}
+
+// check returns the decision along with the reason for it
+func (f *ForwardAuth) check(method string, original *url.URL, r *http.Request) (Decision, string, error) {
+	logger := f.logger.WithFields(logrus.Fields{
+		"method": method,
+		"host":   original.Host,
+		"path":   original.Path,
+	})
+
+	_, span := tracing.Start(r.Context(), "router.match")
+	match, err := f.router.Match(original.Host, original.Path)
+	tracing.End(span, err)
+	if err != nil {
+		logger.WithField("error", err).Warn("denied request for unknown service")
+		return Decision{Status: http.StatusForbidden, Message: "no service for this host"}, "unknown_service", nil
+	}
+
+	logger = logger.WithField("service", match.Service.Identifier)
+	decision := Decision{Service: match.Service.Identifier}
+
+	if match.Service.IsPublic(method, original.Path) {
+		decision.Status = http.StatusOK
+		return decision, "public", nil
+	}
+
+	u, err := f.authenticate(r)
+	if err == ErrUnauthenticated && BearerToken(r) != "" {
+		logger.Info("denied request with invalid bearer token")
+		metrics.AuthorizationDenials.WithLabelValues(match.Service.Identifier, "invalid_token").Inc()
+		decision.Status = http.StatusUnauthorized
+		decision.Message = "invalid bearer token"
+		return decision, "invalid_token", nil
+	}
+	if err == ErrUnauthenticated {
+		logger.Debug("request requires login")
+		decision.Status = http.StatusUnauthorized
+		decision.LoginURL = f.loginURL(original.String())
+		decision.Message = "authentication required"
+		return decision, "login_required", nil
+	}
+	if err == ErrUnlistedUser {
+		logger.WithField("user", u.Identifier).Info("denied request of unlisted user")
+		metrics.AuthorizationDenials.WithLabelValues(match.Service.Identifier, "unlisted_user").Inc()
+		decision.Status = http.StatusForbidden
+		decision.Message = "access denied"
+		return decision, "unlisted_user", nil
+	}
+	if err != nil {
+		logger.WithField("error", err).Error("failed to authenticate request")
+		return decision, "authentication_failed", err
+	}
+
+	logger = logger.WithField("user", u.Identifier)
+
+	if !match.Service.IsAccessible(u.Roles) {
+		logger.Info("denied request")
+		metrics.AuthorizationDenials.WithLabelValues(match.Service.Identifier, "access_denied").Inc()
+		decision.Status = http.StatusForbidden
+		decision.Message = "access denied"
+		return decision, "access_denied", nil
+	}
+
+	logger.Debug("allowed request")
+	decision.Status = http.StatusOK
+	decision.User = &u
+	return decision, "authorized", nil
+}
+
+// ServeHTTP responds with 200 and the identity headers when the original
+// request is allowed, 401 with the login URL when the user has to log in, or
+// 403 when the user cannot access the service.
+func (f *ForwardAuth) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	method, original, err := forwardedRequest(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	decision, err := f.Check(method, original, r)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "unable to authenticate request")
+		return
+	}
+
+	switch decision.Status {
+	case http.StatusOK:
+		if decision.User != nil {
+			setIdentity(w.Header(), *decision.User)
+		}
+		w.WriteHeader(http.StatusOK)
+	case http.StatusUnauthorized:
+		if decision.LoginURL == "" {
+			writeInvalidToken(w)
+			return
+		}
+		writeLoginRequired(w, decision.LoginURL)
+	default:
+		writeError(w, decision.Status, decision.Message)
+	}
+}
+
+// forwardedRequest reads the original request from the headers set by the
+// reverse proxy, either a complete X-Original-URL or its parts
+func forwardedRequest(r *http.Request) (string, *url.URL, error) {
+	method := firstHeader(r, "X-Forwarded-Method", "X-Original-Method")
+	if method == "" {
+		method = http.MethodGet
+	}
+
+	if originalURL := r.Header.Get("X-Original-URL"); originalURL != "" {
+		original, err := url.Parse(originalURL)
+		if err != nil || !original.IsAbs() || original.Host == "" {
+			return "", nil, fmt.Errorf("X-Original-URL must be an absolute URL")
+		}
+
+		return strings.ToUpper(method), original, nil
+	}
+
+	host := firstHeader(r, "X-Forwarded-Host", "X-Original-Host")
+	if host == "" {
+		return "", nil, fmt.Errorf("X-Forwarded-Host or X-Original-URL must be set")
+	}
+
+	scheme := firstHeader(r, "X-Forwarded-Proto")
+	if scheme == "" {
+		scheme = "https"
+	}
+
+	uri := firstHeader(r, "X-Forwarded-Uri", "X-Original-URI")
+	if uri == "" {
+		uri = "/"
+	}
+
+	original, err := url.Parse(scheme + "://" + host + uri)
+	if err != nil {
+		return "", nil, fmt.Errorf("Forwarded host and URI must form a valid URL")
+	}
+
+	return strings.ToUpper(method), original, nil
+}
+
+func firstHeader(r *http.Request, names ...string) string {
+	for _, name := range names {
+		if value := r.Header.Get(name); value != "" {
+			return value
+		}
+	}
+
+	return ""
+}
+
+// sourceIP returns the IP address the request came from, without its port
+func sourceIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+
+	return host
+}
+
+func setIdentity(header http.Header, u user.User) {
+	header.Set(UserHeader, u.Identifier)
+	header.Set(RolesHeader, strings.Join(u.Roles, ","))
+}
+
+// LoginBody returns the JSON body of the 401 response asking the user to log in.
+func LoginBody(login string) []byte {
+	blob, _ := json.Marshal(map[string]string{
+		"error":     "authentication required",
+		"login_url": login,
+	})
+	return blob
+}
+
+// writeLoginRequired responds with 401, the login URL is both in the Location
+// header for reverse proxies to redirect to, and in the body for API clients
+func writeLoginRequired(w http.ResponseWriter, login string) {
+	w.Header().Set("Location", login)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusUnauthorized)
+	w.Write(LoginBody(login))
+}
+
+// writeInvalidToken responds with 401 without a login URL, as API clients
+// sending bearer tokens cannot follow it
+func writeInvalidToken(w http.ResponseWriter) {
+	w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+	writeError(w, http.StatusUnauthorized, "invalid bearer token")
+}
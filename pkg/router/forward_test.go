@@ -0,0 +1,252 @@
+package router
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+
+	"github.com/alphagov/iap/pkg/audit"
+	"github.com/alphagov/iap/pkg/service"
+	"github.com/alphagov/iap/pkg/user"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/sirupsen/logrus"
+)
+
+var _ = Describe("ForwardAuth", func() {
+	var (
+		forward      *ForwardAuth
+		current      *user.User
+		unlisted     bool
+		authenticate Authenticator
+		login        LoginURL
+		events       *bytes.Buffer
+	)
+
+	BeforeEach(func() {
+		current = nil
+		unlisted = false
+		events = &bytes.Buffer{}
+
+		logger := logrus.New()
+		logger.SetOutput(GinkgoWriter)
+
+		r := New(map[string]service.Service{
+			"grafana": service.Service{
+				Identifier:  "grafana",
+				UpstreamURI: url.URL{Scheme: "http", Host: "grafana.internal"},
+				Roles:       []string{"superuser"},
+				Matchers: []service.Matcher{
+					service.Matcher{Host: "grafana.mydomain.com"},
+				},
+				PublicPaths: []service.PublicPath{
+					service.PublicPath{Path: "/healthcheck"},
+				},
+			},
+		}, logger)
+
+		authenticate = func(r *http.Request) (user.User, error) {
+			if current == nil {
+				return user.User{}, ErrUnauthenticated
+			}
+			if unlisted {
+				return *current, ErrUnlistedUser
+			}
+			return *current, nil
+		}
+
+		login = func(original string) string {
+			return "https://iap.mydomain.com/oidc/login?rd=" + url.QueryEscape(original)
+		}
+
+		auditor := audit.New([]audit.Sink{audit.NewWriterSink(events)}, logger)
+		forward = NewForwardAuth(r, authenticate, login, auditor, logger)
+	})
+
+	serve := func(headers map[string]string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "http://iap.mydomain.com/auth/forward", nil)
+		for header, value := range headers {
+			req.Header.Set(header, value)
+		}
+
+		rr := httptest.NewRecorder()
+		forward.ServeHTTP(rr, req)
+		return rr
+	}
+
+	nginx := map[string]string{
+		"X-Original-URL":    "https://grafana.mydomain.com/dashboards?id=1",
+		"X-Original-Method": "GET",
+	}
+
+	traefik := map[string]string{
+		"X-Forwarded-Method": "POST",
+		"X-Forwarded-Proto":  "https",
+		"X-Forwarded-Host":   "grafana.mydomain.com",
+		"X-Forwarded-Uri":    "/api/dashboards",
+	}
+
+	It("should allow a user who can access the service with identity headers", func() {
+		current = &user.User{Identifier: "fname.lname@mydomain.com", Roles: []string{"superuser", "dev"}}
+
+		for _, headers := range []map[string]string{nginx, traefik} {
+			rr := serve(headers)
+
+			Expect(rr.Code).To(Equal(http.StatusOK))
+			Expect(rr.Header().Get(UserHeader)).To(Equal("fname.lname@mydomain.com"))
+			Expect(rr.Header().Get(RolesHeader)).To(Equal("superuser,dev"))
+		}
+	})
+
+	It("should ask a user without a session to log in", func() {
+		rr := serve(nginx)
+
+		loginURL := "https://iap.mydomain.com/oidc/login?rd=" + url.QueryEscape("https://grafana.mydomain.com/dashboards?id=1")
+
+		Expect(rr.Code).To(Equal(http.StatusUnauthorized))
+		Expect(rr.Header().Get("Location")).To(Equal(loginURL))
+		Expect(rr.Body.String()).To(MatchJSON(`{
+			"error": "authentication required",
+			"login_url": "` + loginURL + `"
+		}`))
+	})
+
+	It("should deny a user who cannot access the service", func() {
+		current = &user.User{Identifier: "fname.lname@mydomain.com", Roles: []string{"dev"}}
+
+		rr := serve(traefik)
+
+		Expect(rr.Code).To(Equal(http.StatusForbidden))
+		Expect(rr.Header().Get(UserHeader)).To(BeEmpty())
+	})
+
+	It("should deny a user who is not one of the configured users", func() {
+		current = &user.User{Identifier: "someone@elsewhere.com"}
+		unlisted = true
+
+		rr := serve(traefik)
+
+		Expect(rr.Code).To(Equal(http.StatusForbidden))
+		Expect(rr.Header().Get(UserHeader)).To(BeEmpty())
+		Expect(events.String()).To(ContainSubstring(`"decision":"deny","reason":"unlisted_user"`))
+	})
+
+	It("should record every decision in the audit log", func() {
+		serve(nginx)
+
+		current = &user.User{Identifier: "fname.lname@mydomain.com", Roles: []string{"superuser"}}
+		serve(nginx)
+
+		Expect(events.String()).To(ContainSubstring(`"type":"forward_auth"`))
+		Expect(events.String()).To(ContainSubstring(`"service":"grafana","decision":"deny","reason":"login_required"`))
+		Expect(events.String()).To(ContainSubstring(`"user":"fname.lname@mydomain.com","source":"192.0.2.1"`))
+		Expect(events.String()).To(ContainSubstring(`"decision":"allow","reason":"authorized"`))
+	})
+
+	It("should allow a public path without a session", func() {
+		rr := serve(map[string]string{
+			"X-Forwarded-Host": "grafana.mydomain.com",
+			"X-Forwarded-Uri":  "/healthcheck",
+		})
+
+		Expect(rr.Code).To(Equal(http.StatusOK))
+	})
+
+	It("should deny a request for an unknown service", func() {
+		rr := serve(map[string]string{
+			"X-Original-URL": "https://unknown.mydomain.com/",
+		})
+
+		Expect(rr.Code).To(Equal(http.StatusForbidden))
+	})
+
+	It("should refuse a request without the original host", func() {
+		rr := serve(map[string]string{
+			"X-Forwarded-Uri": "/dashboards",
+		})
+
+		Expect(rr.Code).To(Equal(http.StatusBadRequest))
+	})
+
+	It("should use the first authenticator identifying the user", func() {
+		bearer := func(r *http.Request) (user.User, error) {
+			if BearerToken(r) != "my-token" {
+				return user.User{}, ErrUnauthenticated
+			}
+			return user.User{Identifier: "my-client"}, nil
+		}
+		session := func(r *http.Request) (user.User, error) {
+			return user.User{Identifier: "fname.lname@mydomain.com"}, nil
+		}
+
+		req := httptest.NewRequest("GET", "http://grafana.mydomain.com/", nil)
+		u, err := Chain(bearer, session)(req)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(u.Identifier).To(Equal("fname.lname@mydomain.com"))
+
+		req.Header.Set("Authorization", "bearer my-token")
+		u, err = Chain(bearer, session)(req)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(u.Identifier).To(Equal("my-client"))
+	})
+
+	Context("when authorizing reverse proxied requests", func() {
+		var authorize Authorizer
+
+		BeforeEach(func() {
+			logger := logrus.New()
+			logger.SetOutput(GinkgoWriter)
+
+			authorize = NewAuthorizer(authenticate, login, nil, logger)
+		})
+
+		svc := &service.Service{Identifier: "grafana", Roles: []string{"superuser"}}
+
+		It("should redirect a browser without a session to log in", func() {
+			req := httptest.NewRequest("GET", "http://grafana.mydomain.com/dashboards", nil)
+			req.Header.Set("X-Forwarded-Proto", "https")
+			rr := httptest.NewRecorder()
+
+			Expect(authorize(rr, req, svc)).To(BeFalse())
+			Expect(rr.Code).To(Equal(http.StatusFound))
+			Expect(rr.Header().Get("Location")).To(Equal(
+				"https://iap.mydomain.com/oidc/login?rd=" + url.QueryEscape("https://grafana.mydomain.com/dashboards"),
+			))
+		})
+
+		It("should not redirect a client with an invalid bearer token", func() {
+			req := httptest.NewRequest("GET", "http://grafana.mydomain.com/api", nil)
+			req.Header.Set("Authorization", "Bearer my-token")
+			rr := httptest.NewRecorder()
+
+			Expect(authorize(rr, req, svc)).To(BeFalse())
+			Expect(rr.Code).To(Equal(http.StatusUnauthorized))
+			Expect(rr.Header().Get("WWW-Authenticate")).To(ContainSubstring("invalid_token"))
+			Expect(rr.Header().Get("Location")).To(BeEmpty())
+		})
+
+		It("should deny a user who is not one of the configured users", func() {
+			current = &user.User{Identifier: "someone@elsewhere.com"}
+			unlisted = true
+
+			req := httptest.NewRequest("GET", "http://grafana.mydomain.com/dashboards", nil)
+			rr := httptest.NewRecorder()
+
+			Expect(authorize(rr, req, &service.Service{Identifier: "open"})).To(BeFalse())
+			Expect(rr.Code).To(Equal(http.StatusForbidden))
+			Expect(req.Header.Get(UserHeader)).To(BeEmpty())
+		})
+
+		It("should set the identity of an allowed user on the request", func() {
+			current = &user.User{Identifier: "fname.lname@mydomain.com", Roles: []string{"superuser"}}
+
+			req := httptest.NewRequest("POST", "http://grafana.mydomain.com/api", nil)
+			rr := httptest.NewRecorder()
+
+			Expect(authorize(rr, req, svc)).To(BeTrue())
+			Expect(req.Header.Get(UserHeader)).To(Equal("fname.lname@mydomain.com"))
+		})
+	})
+})
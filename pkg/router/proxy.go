@@ -0,0 +1,310 @@
+package router
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httputil"
+	"strings"
+	"time"
+
+	"github.com/alphagov/iap/pkg/audit"
+	"github.com/alphagov/iap/pkg/metrics"
+	"github.com/alphagov/iap/pkg/service"
+	"github.com/alphagov/iap/pkg/tracing"
+	"github.com/alphagov/iap/pkg/upstream"
+	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// Authorizer decides if a request is allowed to reach the service. It is called
+// before anything is forwarded upstream, including protocol upgrade requests.
+// When the request is denied, the Authorizer is responsible for the response.
+type Authorizer func(w http.ResponseWriter, r *http.Request, svc *service.Service) bool
+
+// Proxy is a reverse proxy forwarding requests to the upstream of their route.
+type Proxy struct {
+	router        *Router
+	authorize     Authorizer
+	sessionCookie string
+	auditor       *audit.Logger
+	logger        *logrus.Logger
+}
+
+// NewProxy will construct the reverse proxy elsewhere. The session cookie is
+// never forwarded, as upstreams could otherwise use it to impersonate the
+// user. The auditor records the requests which are allowed, denied ones are
+// left to the Authorizer.
+func NewProxy(router *Router, authorize Authorizer, sessionCookie string, auditor *audit.Logger, logger *logrus.Logger) *Proxy {
+	return &Proxy{
+		router:        router,
+		authorize:     authorize,
+		sessionCookie: sessionCookie,
+		auditor:       auditor,
+		logger:        logger,
+	}
+}
+
+// Handles returns if there is a service for the host and path of the request.
+func (p *Proxy) Handles(r *http.Request) bool {
+	_, err := p.router.Match(r.Host, r.URL.Path)
+	return err == nil
+}
+
+// ServeHTTP routes, authorizes and forwards the request.
+func (p *Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	_, span := tracing.Start(r.Context(), "router.match")
+	match, err := p.router.Match(r.Host, r.URL.Path)
+	if err == nil {
+		span.SetAttributes(attribute.String("iap.service", match.Service.Identifier))
+	}
+	tracing.End(span, err)
+	if err != nil {
+		p.logger.WithFields(logrus.Fields{
+			"host":  r.Host,
+			"path":  r.URL.Path,
+			"error": err,
+		}).Warn("failed to route request")
+		writeError(w, http.StatusNotFound, "no service for this host")
+		return
+	}
+
+	public := match.Service.IsPublic(r.Method, r.URL.Path)
+
+	// The identity of the user is only ever set by the Authorizer
+	r.Header.Del(UserHeader)
+	r.Header.Del(RolesHeader)
+
+	logger := p.logger.WithFields(logrus.Fields{
+		"service": match.Service.Identifier,
+		"method":  r.Method,
+		"path":    r.URL.Path,
+		"public":  public,
+		"upgrade": isUpgrade(r),
+	})
+
+	if !public && !p.authorize(w, r, &match.Service) {
+		logger.Info("denied request")
+		return
+	}
+
+	reason := "authorized"
+	if public {
+		reason = "public"
+	}
+	p.auditor.Record(audit.Event{
+		Type:        audit.ReverseProxyRequest,
+		User:        r.Header.Get(UserHeader),
+		Source:      sourceIP(r),
+		Destination: r.Host,
+		Service:     match.Service.Identifier,
+		Decision:    audit.Allow,
+		Reason:      reason,
+	})
+
+	logger.Debug("forwarding request")
+
+	// Requests are forwarded with the cleaned path, which is the one used to
+	// route and authorize them. The escaping the client used is kept, eg: %2F,
+	// as long as it still encodes that path once rewritten.
+	requestPath := service.CleanPath(r.URL.Path)
+	escapedPath := service.CleanPath(r.URL.EscapedPath())
+	external := externalURI(r)
+
+	attempts := 1
+	if isRetryable(r) {
+		attempts += match.Service.Retries
+	}
+
+	// The route which produced the response is released once it has been
+	// fully sent, so that least connections balancing counts streams too
+	var current *Route
+	failed := false
+	defer func() {
+		if current != nil {
+			current.Release(failed)
+		}
+	}()
+
+	roundTrip := func(req *http.Request) (*http.Response, error) {
+		breaker := p.router.breakers[match.Service.Identifier]
+
+		for attempt := 1; ; attempt++ {
+			if err := breaker.Allow(); err != nil {
+				return nil, err
+			}
+
+			route, err := p.router.Upstream(match)
+			if err != nil {
+				breaker.Record(true)
+				return nil, err
+			}
+
+			req.URL.Scheme = route.UpstreamURI.Scheme
+			req.URL.Host = route.UpstreamURI.Host
+			req.URL.Path = match.Service.PathRewrite.Rewrite(route.UpstreamURI.Path, requestPath)
+			req.URL.RawPath = match.Service.PathRewrite.Rewrite(route.UpstreamURI.EscapedPath(), escapedPath)
+			req.Host = route.UpstreamURI.Host
+
+			// Every attempt has a span of its own, which the upstream
+			// continues through the traceparent header
+			ctx, span := tracing.Start(req.Context(), "upstream",
+				attribute.String("iap.service", match.Service.Identifier),
+				attribute.String("iap.upstream", route.UpstreamURI.Host),
+				attribute.Int("iap.attempt", attempt),
+			)
+			tracing.Inject(ctx, req.Header)
+
+			started := time.Now()
+			resp, err := route.Transport.RoundTrip(req.WithContext(ctx))
+			metrics.UpstreamDuration.WithLabelValues(match.Service.Identifier).Observe(time.Since(started).Seconds())
+			if err == nil {
+				span.SetAttributes(attribute.Int("http.status_code", resp.StatusCode))
+			}
+			tracing.End(span, err)
+			failed = err != nil || resp.StatusCode >= http.StatusInternalServerError
+			breaker.Record(failed)
+
+			if attempt < attempts && (err != nil || isRetryableStatus(resp.StatusCode)) {
+				if resp != nil {
+					resp.Body.Close()
+				}
+				route.Release(true)
+
+				logger.WithFields(logrus.Fields{
+					"upstream": route.UpstreamURI.Host,
+					"attempt":  attempt,
+					"error":    err,
+				}).Warn("retrying request")
+				continue
+			}
+
+			current = &route
+			return resp, err
+		}
+	}
+
+	proxy := &httputil.ReverseProxy{
+		Director: func(req *http.Request) {
+			if !match.Service.ForwardAuthorization && BearerToken(req) != "" {
+				req.Header.Del("Authorization")
+			}
+			removeCookie(req.Header, p.sessionCookie)
+
+			for header, value := range match.Service.Headers {
+				req.Header.Set(header, value)
+			}
+		},
+		Transport: roundTripper(roundTrip),
+		// Flush straight away, so streamed responses such as server-sent
+		// events reach the client as they are produced
+		FlushInterval: -1,
+		ModifyResponse: func(resp *http.Response) error {
+			rewriteLocation(resp, current, external)
+			rewriteCookies(resp, current, external)
+
+			if isStreamed(resp) {
+				clearDeadlines(w)
+			}
+			return nil
+		},
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			logger.WithField("error", err).Error("failed to reach upstream")
+
+			if err == upstream.ErrCircuitOpen || err == upstream.ErrNoHealthyUpstream {
+				writeError(w, http.StatusServiceUnavailable, fmt.Sprintf(
+					"%s is currently unavailable", match.Service.Identifier,
+				))
+				return
+			}
+
+			writeError(w, http.StatusBadGateway, fmt.Sprintf(
+				"%s could not be reached", match.Service.Identifier,
+			))
+		},
+	}
+
+	proxy.ServeHTTP(w, r)
+}
+
+// removeCookie removes the cookie from the Cookie headers, leaving the other
+// cookies as they were sent.
+func removeCookie(header http.Header, name string) {
+	values := header.Values("Cookie")
+	if len(values) == 0 {
+		return
+	}
+
+	header.Del("Cookie")
+	for _, value := range values {
+		kept := make([]string, 0)
+		for _, cookie := range strings.Split(value, ";") {
+			cookie = strings.TrimSpace(cookie)
+			if cookie == "" || strings.SplitN(cookie, "=", 2)[0] == name {
+				continue
+			}
+			kept = append(kept, cookie)
+		}
+
+		if len(kept) > 0 {
+			header.Add("Cookie", strings.Join(kept, "; "))
+		}
+	}
+}
+
+type roundTripper func(*http.Request) (*http.Response, error)
+
+func (f roundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+// writeError responds in the same JSON format as the rest of IAP, so errors
+// produced by IAP can be told apart from the ones of the upstreams
+func writeError(w http.ResponseWriter, code int, message string) {
+	blob, _ := json.Marshal(map[string]string{
+		"error": message,
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	w.Write(blob)
+}
+
+func isUpgrade(r *http.Request) bool {
+	return r.Header.Get("Upgrade") != ""
+}
+
+// isRetryable returns if the request can safely be sent more than once, which
+// is only the case for idempotent methods without a body
+func isRetryable(r *http.Request) bool {
+	if isUpgrade(r) || (r.Body != nil && r.Body != http.NoBody && r.ContentLength != 0) {
+		return false
+	}
+
+	switch r.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace, http.MethodPut, http.MethodDelete:
+		return true
+	}
+
+	return false
+}
+
+func isRetryableStatus(code int) bool {
+	return code == http.StatusBadGateway ||
+		code == http.StatusServiceUnavailable ||
+		code == http.StatusGatewayTimeout
+}
+
+// isStreamed returns if the response is hijacked for a protocol upgrade, or
+// is sent without knowing its length up front, eg: server-sent events
+func isStreamed(resp *http.Response) bool {
+	return resp.StatusCode == http.StatusSwitchingProtocols || resp.ContentLength == -1
+}
+
+// clearDeadlines removes the server read and write timeouts, which are meant
+// for ordinary requests and would otherwise cut long lived connections
+func clearDeadlines(w http.ResponseWriter) {
+	rc := http.NewResponseController(w)
+	rc.SetReadDeadline(time.Time{})
+	rc.SetWriteDeadline(time.Time{})
+}
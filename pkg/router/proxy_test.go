@@ -0,0 +1,531 @@
+package router
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/alphagov/iap/pkg/service"
+	"github.com/alphagov/iap/pkg/tracing"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace/noop"
+)
+
+var _ = Describe("Proxy", func() {
+	var (
+		upstream *httptest.Server
+		frontend *httptest.Server
+		allowed  bool
+	)
+
+	BeforeEach(func() {
+		allowed = true
+
+		upstreamMux := http.NewServeMux()
+		upstreamMux.HandleFunc("/hello", func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprintf(w, "hello %s", r.Header.Get("X-Upstream-Secret"))
+		})
+		upstreamMux.HandleFunc("/authorization", func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprint(w, r.Header.Get("Authorization"))
+		})
+		upstreamMux.HandleFunc("/cookie", func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprint(w, strings.Join(r.Header.Values("Cookie"), "\n"))
+		})
+		upstreamMux.HandleFunc("/traceparent", func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprint(w, r.Header.Get("Traceparent"))
+		})
+		upstreamMux.HandleFunc("/healthcheck", func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprint(w, "ok")
+		})
+		upstreamMux.HandleFunc("/events", func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "text/event-stream")
+			fmt.Fprint(w, "data: first\n\n")
+			w.(http.Flusher).Flush()
+
+			time.Sleep(500 * time.Millisecond)
+
+			fmt.Fprint(w, "data: second\n\n")
+		})
+		upstreamMux.HandleFunc("/echo", func(w http.ResponseWriter, r *http.Request) {
+			conn, rw, err := w.(http.Hijacker).Hijack()
+			Expect(err).NotTo(HaveOccurred())
+			defer conn.Close()
+
+			fmt.Fprint(rw, "HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: echo\r\n\r\n")
+			rw.Flush()
+
+			for {
+				line, err := rw.ReadString('\n')
+				if err != nil {
+					return
+				}
+				rw.WriteString(line)
+				rw.Flush()
+			}
+		})
+		upstream = httptest.NewServer(upstreamMux)
+
+		upstreamURI, err := url.Parse(upstream.URL)
+		Expect(err).NotTo(HaveOccurred())
+
+		logger := logrus.New()
+		logger.SetOutput(GinkgoWriter)
+
+		r := New(map[string]service.Service{
+			"my-service": service.Service{
+				Identifier:  "my-service",
+				UpstreamURI: *upstreamURI,
+				Headers:     map[string]string{"X-Upstream-Secret": "secret"},
+				Matchers: []service.Matcher{
+					service.Matcher{Host: "my-service.mydomain.com"},
+				},
+				PublicPaths: []service.PublicPath{
+					service.PublicPath{Path: "/healthcheck"},
+				},
+			},
+			"my-api": service.Service{
+				Identifier:  "my-api",
+				UpstreamURI: *upstreamURI,
+				Matchers: []service.Matcher{
+					service.Matcher{Host: "my-api.mydomain.com"},
+				},
+				ForwardAuthorization: true,
+			},
+		}, logger)
+
+		authorize := func(w http.ResponseWriter, r *http.Request, svc *service.Service) bool {
+			if !allowed {
+				w.WriteHeader(http.StatusForbidden)
+			}
+			return allowed
+		}
+
+		frontend = httptest.NewUnstartedServer(NewProxy(r, authorize, "iap_session", nil, logger))
+		frontend.Config.ReadTimeout = 200 * time.Millisecond
+		frontend.Config.WriteTimeout = 200 * time.Millisecond
+		frontend.Start()
+	})
+
+	AfterEach(func() {
+		frontend.Close()
+		upstream.Close()
+	})
+
+	get := func(path string) *http.Response {
+		req, err := http.NewRequest("GET", frontend.URL+path, nil)
+		Expect(err).NotTo(HaveOccurred())
+		req.Host = "my-service.mydomain.com"
+
+		resp, err := http.DefaultClient.Do(req)
+		Expect(err).NotTo(HaveOccurred())
+		return resp
+	}
+
+	It("should continue the trace of the client upstream", func() {
+		exporter := tracetest.NewInMemoryExporter()
+		provider := tracing.Setup(exporter, 1)
+		defer otel.SetTracerProvider(noop.NewTracerProvider())
+
+		// The web command starts the span of the request
+		traced := httptest.NewServer(tracing.Handler("web", frontend.Config.Handler))
+		defer traced.Close()
+
+		req, err := http.NewRequest("GET", traced.URL+"/traceparent", nil)
+		Expect(err).NotTo(HaveOccurred())
+		req.Host = "my-service.mydomain.com"
+		req.Header.Set("Traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+
+		resp, err := http.DefaultClient.Do(req)
+		Expect(err).NotTo(HaveOccurred())
+		defer resp.Body.Close()
+
+		body, err := ioutil.ReadAll(resp.Body)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(string(body)).To(HavePrefix("00-4bf92f3577b34da6a3ce929d0e0e4736-"))
+		Expect(string(body)).NotTo(ContainSubstring("00f067aa0ba902b7"))
+
+		// The span of the request ends once the response has been sent
+		names := func() []string {
+			Expect(provider.ForceFlush(context.Background())).To(Succeed())
+
+			names := []string{}
+			for _, span := range exporter.GetSpans() {
+				Expect(span.SpanContext.TraceID().String()).To(Equal("4bf92f3577b34da6a3ce929d0e0e4736"))
+				names = append(names, span.Name)
+			}
+			return names
+		}
+		Eventually(names).Should(ConsistOf("web", "router.match", "upstream"))
+	})
+
+	It("should forward an authorized request with the service headers", func() {
+		resp := get("/hello")
+		defer resp.Body.Close()
+
+		body, err := ioutil.ReadAll(resp.Body)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(resp.StatusCode).To(Equal(http.StatusOK))
+		Expect(string(body)).To(Equal("hello secret"))
+	})
+
+	It("should not forward a request which is denied", func() {
+		allowed = false
+
+		resp := get("/hello")
+		defer resp.Body.Close()
+
+		Expect(resp.StatusCode).To(Equal(http.StatusForbidden))
+	})
+
+	It("should forward a request for a public path without authorization", func() {
+		allowed = false
+
+		resp := get("/healthcheck")
+		defer resp.Body.Close()
+
+		Expect(resp.StatusCode).To(Equal(http.StatusOK))
+	})
+
+	It("should not forward a request for an unknown host", func() {
+		resp, err := http.Get(frontend.URL + "/hello")
+		Expect(err).NotTo(HaveOccurred())
+		defer resp.Body.Close()
+
+		Expect(resp.StatusCode).To(Equal(http.StatusNotFound))
+	})
+
+	It("should remove bearer tokens before forwarding", func() {
+		req, err := http.NewRequest("GET", frontend.URL+"/authorization", nil)
+		Expect(err).NotTo(HaveOccurred())
+		req.Host = "my-service.mydomain.com"
+		req.Header.Set("Authorization", "Bearer my-token")
+
+		resp, err := http.DefaultClient.Do(req)
+		Expect(err).NotTo(HaveOccurred())
+		defer resp.Body.Close()
+
+		body, err := ioutil.ReadAll(resp.Body)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(string(body)).To(BeEmpty())
+	})
+
+	It("should remove the session cookie before forwarding", func() {
+		req, err := http.NewRequest("GET", frontend.URL+"/cookie", nil)
+		Expect(err).NotTo(HaveOccurred())
+		req.Host = "my-service.mydomain.com"
+		req.Header.Add("Cookie", "theme=dark; iap_session=my-session")
+		req.Header.Add("Cookie", "iap_session=my-session")
+
+		resp, err := http.DefaultClient.Do(req)
+		Expect(err).NotTo(HaveOccurred())
+		defer resp.Body.Close()
+
+		body, err := ioutil.ReadAll(resp.Body)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(string(body)).To(Equal("theme=dark"))
+	})
+
+	It("should forward bearer tokens when the service opts in", func() {
+		req, err := http.NewRequest("GET", frontend.URL+"/authorization", nil)
+		Expect(err).NotTo(HaveOccurred())
+		req.Host = "my-api.mydomain.com"
+		req.Header.Set("Authorization", "Bearer my-token")
+
+		resp, err := http.DefaultClient.Do(req)
+		Expect(err).NotTo(HaveOccurred())
+		defer resp.Body.Close()
+
+		body, err := ioutil.ReadAll(resp.Body)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(string(body)).To(Equal("Bearer my-token"))
+	})
+
+	It("should flush streamed responses immediately", func() {
+		resp := get("/events")
+		defer resp.Body.Close()
+
+		started := time.Now()
+		reader := bufio.NewReader(resp.Body)
+
+		line, err := reader.ReadString('\n')
+		Expect(err).NotTo(HaveOccurred())
+		Expect(line).To(Equal("data: first\n"))
+		Expect(time.Since(started)).To(BeNumerically("<", 400*time.Millisecond))
+
+		By("streaming beyond the server write timeout")
+		body, err := ioutil.ReadAll(reader)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(string(body)).To(Equal("\ndata: second\n\n"))
+	})
+
+	It("should fail fast when no upstream is available", func() {
+		deadURI, err := url.Parse(upstream.URL)
+		Expect(err).NotTo(HaveOccurred())
+		upstream.Close()
+
+		logger := logrus.New()
+		logger.SetOutput(GinkgoWriter)
+
+		r := New(map[string]service.Service{
+			"my-service": service.Service{
+				Identifier: "my-service",
+				Upstreams:  []service.Upstream{service.Upstream{URI: *deadURI, Weight: 1}},
+				Matchers: []service.Matcher{
+					service.Matcher{Host: "my-service.mydomain.com"},
+				},
+				OutlierDetection: &service.OutlierDetection{
+					ConsecutiveFailures: 1,
+					EjectionDuration:    time.Minute,
+				},
+			},
+		}, logger)
+
+		authorize := func(w http.ResponseWriter, r *http.Request, svc *service.Service) bool {
+			return true
+		}
+
+		req := httptest.NewRequest("GET", "http://my-service.mydomain.com/hello", nil)
+		rr := httptest.NewRecorder()
+		NewProxy(r, authorize, "iap_session", nil, logger).ServeHTTP(rr, req)
+		Expect(rr.Code).To(Equal(http.StatusBadGateway))
+
+		rr = httptest.NewRecorder()
+		NewProxy(r, authorize, "iap_session", nil, logger).ServeHTTP(rr, req)
+		Expect(rr.Code).To(Equal(http.StatusServiceUnavailable))
+	})
+
+	Context("with retries and a circuit breaker", func() {
+		var (
+			r       *Router
+			proxy   *Proxy
+			flaky   *httptest.Server
+			failing int
+		)
+
+		BeforeEach(func() {
+			failing = 0
+			flaky = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if failing > 0 {
+					failing--
+					w.WriteHeader(http.StatusServiceUnavailable)
+					return
+				}
+				fmt.Fprint(w, "ok")
+			}))
+
+			flakyURI, err := url.Parse(flaky.URL)
+			Expect(err).NotTo(HaveOccurred())
+
+			logger := logrus.New()
+			logger.SetOutput(GinkgoWriter)
+
+			r = New(map[string]service.Service{
+				"my-service": service.Service{
+					Identifier: "my-service",
+					Upstreams:  []service.Upstream{service.Upstream{URI: *flakyURI, Weight: 1}},
+					Matchers: []service.Matcher{
+						service.Matcher{Host: "my-service.mydomain.com"},
+					},
+					Retries: 2,
+					CircuitBreaker: &service.CircuitBreaker{
+						ConsecutiveFailures: 3,
+						OpenDuration:        time.Minute,
+					},
+				},
+			}, logger)
+
+			proxy = NewProxy(r, func(w http.ResponseWriter, r *http.Request, svc *service.Service) bool {
+				return true
+			}, "iap_session", nil, logger)
+		})
+
+		AfterEach(func() {
+			flaky.Close()
+		})
+
+		serve := func(method string) *httptest.ResponseRecorder {
+			rr := httptest.NewRecorder()
+			proxy.ServeHTTP(rr, httptest.NewRequest(method, "http://my-service.mydomain.com/", nil))
+			return rr
+		}
+
+		It("should retry idempotent requests", func() {
+			failing = 2
+
+			rr := serve("GET")
+			Expect(rr.Code).To(Equal(http.StatusOK))
+			Expect(rr.Body.String()).To(Equal("ok"))
+		})
+
+		It("should not retry requests which are not idempotent", func() {
+			failing = 1
+
+			rr := serve("POST")
+			Expect(rr.Code).To(Equal(http.StatusServiceUnavailable))
+			Expect(failing).To(Equal(0))
+		})
+
+		It("should fail fast once the circuit breaker is open", func() {
+			failing = 3
+
+			rr := serve("GET")
+			Expect(rr.Code).To(Equal(http.StatusServiceUnavailable))
+			Expect(failing).To(Equal(0))
+
+			rr = serve("GET")
+			Expect(rr.Code).To(Equal(http.StatusServiceUnavailable))
+			Expect(rr.Body.String()).To(MatchJSON(`{"error": "my-service is currently unavailable"}`))
+		})
+	})
+
+	Context("with path rewriting", func() {
+		var (
+			proxy   *Proxy
+			mounted *httptest.Server
+		)
+
+		BeforeEach(func() {
+			mounted = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				switch r.URL.Path {
+				case "/app/login":
+					http.SetCookie(w, &http.Cookie{
+						Name:   "session",
+						Value:  "abc",
+						Path:   "/app",
+						Domain: strings.Split(r.Host, ":")[0],
+					})
+					w.Header().Set("Location", "http://"+r.Host+"/app/home?tab=1")
+					w.WriteHeader(http.StatusFound)
+				case "/app/logout":
+					w.Header().Set("Location", "/app/login")
+					w.WriteHeader(http.StatusFound)
+				case "/app/moved/a/b":
+					w.Header().Set("Location", "/app/repos/a%2Fb")
+					w.WriteHeader(http.StatusFound)
+				default:
+					fmt.Fprint(w, r.URL.EscapedPath())
+				}
+			}))
+
+			mountedURI, err := url.Parse(mounted.URL + "/app")
+			Expect(err).NotTo(HaveOccurred())
+
+			logger := logrus.New()
+			logger.SetOutput(GinkgoWriter)
+
+			r := New(map[string]service.Service{
+				"grafana": service.Service{
+					Identifier:  "grafana",
+					UpstreamURI: *mountedURI,
+					Matchers: []service.Matcher{
+						service.Matcher{Host: "tools.mydomain.com", PathPrefix: "/grafana"},
+					},
+					PathRewrite: service.PathRewrite{StripPrefix: "/grafana"},
+				},
+			}, logger)
+
+			proxy = NewProxy(r, func(w http.ResponseWriter, r *http.Request, svc *service.Service) bool {
+				return true
+			}, "iap_session", nil, logger)
+		})
+
+		AfterEach(func() {
+			mounted.Close()
+		})
+
+		serve := func(path string) *httptest.ResponseRecorder {
+			req := httptest.NewRequest("GET", "https://tools.mydomain.com"+path, nil)
+			req.Header.Set("X-Forwarded-Proto", "https")
+
+			rr := httptest.NewRecorder()
+			proxy.ServeHTTP(rr, req)
+			return rr
+		}
+
+		It("should strip the prefix and add the upstream path", func() {
+			rr := serve("/grafana/dashboards/")
+			Expect(rr.Body.String()).To(Equal("/app/dashboards/"))
+		})
+
+		It("should keep escaped slashes when rewriting the path", func() {
+			rr := serve("/grafana/repos/a%2Fb/")
+			Expect(rr.Body.String()).To(Equal("/app/repos/a%2Fb/"))
+
+			rr = serve("/grafana/moved/a/b")
+			Expect(rr.Header().Get("Location")).To(Equal("/grafana/repos/a%2Fb"))
+		})
+
+		It("should not forward paths escaping the prefix", func() {
+			rr := serve("/grafana/../admin")
+			Expect(rr.Code).To(Equal(http.StatusNotFound))
+		})
+
+		It("should rewrite absolute redirects and cookies to the external location", func() {
+			rr := serve("/grafana/login")
+
+			Expect(rr.Code).To(Equal(http.StatusFound))
+			Expect(rr.Header().Get("Location")).To(Equal("https://tools.mydomain.com/grafana/home?tab=1"))
+			Expect(rr.Header().Get("Set-Cookie")).To(Equal(
+				"session=abc; Path=/grafana; Domain=tools.mydomain.com",
+			))
+		})
+
+		It("should rewrite relative redirects", func() {
+			rr := serve("/grafana/logout")
+
+			Expect(rr.Header().Get("Location")).To(Equal("/grafana/login"))
+		})
+	})
+
+	upgrade := func() (net.Conn, *bufio.Reader) {
+		conn, err := net.Dial("tcp", frontend.Listener.Addr().String())
+		Expect(err).NotTo(HaveOccurred())
+
+		fmt.Fprint(conn, "GET /echo HTTP/1.1\r\nHost: my-service.mydomain.com\r\nConnection: Upgrade\r\nUpgrade: echo\r\n\r\n")
+
+		reader := bufio.NewReader(conn)
+		resp, err := http.ReadResponse(reader, nil)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(resp.StatusCode).To(Equal(http.StatusSwitchingProtocols))
+
+		return conn, reader
+	}
+
+	It("should forward upgraded connections beyond the server timeouts", func() {
+		conn, reader := upgrade()
+		defer conn.Close()
+
+		time.Sleep(500 * time.Millisecond)
+
+		fmt.Fprint(conn, "ping\n")
+		line, err := reader.ReadString('\n')
+		Expect(err).NotTo(HaveOccurred())
+		Expect(line).To(Equal("ping\n"))
+	})
+
+	It("should not upgrade a connection which is denied", func() {
+		allowed = false
+
+		conn, err := net.Dial("tcp", frontend.Listener.Addr().String())
+		Expect(err).NotTo(HaveOccurred())
+		defer conn.Close()
+
+		fmt.Fprint(conn, "GET /echo HTTP/1.1\r\nHost: my-service.mydomain.com\r\nConnection: Upgrade\r\nUpgrade: echo\r\n\r\n")
+
+		resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(resp.StatusCode).To(Equal(http.StatusForbidden))
+	})
+})
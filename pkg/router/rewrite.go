@@ -0,0 +1,84 @@
+package router
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// externalURI returns the scheme and host the client used for the request
+func externalURI(r *http.Request) url.URL {
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	if proto := r.Header.Get("X-Forwarded-Proto"); proto != "" {
+		scheme = proto
+	}
+
+	return url.URL{Scheme: scheme, Host: r.Host}
+}
+
+// rewriteLocation points redirects to the upstream back at IAP, and maps
+// their path back to the one the client used
+func rewriteLocation(resp *http.Response, route *Route, external url.URL) {
+	location := resp.Header.Get("Location")
+	if route == nil || location == "" {
+		return
+	}
+
+	uri, err := url.Parse(location)
+	if err != nil {
+		return
+	}
+
+	switch {
+	case uri.IsAbs():
+		if !strings.EqualFold(uri.Host, route.UpstreamURI.Host) {
+			return
+		}
+		uri.Scheme = external.Scheme
+		uri.Host = external.Host
+	case uri.Host != "" || !strings.HasPrefix(uri.Path, "/"):
+		// protocol relative and relative paths are left alone
+		return
+	}
+
+	escapedPath := uri.EscapedPath()
+	uri.Path = route.Service.PathRewrite.Reverse(route.UpstreamURI.Path, uri.Path)
+	uri.RawPath = route.Service.PathRewrite.Reverse(route.UpstreamURI.EscapedPath(), escapedPath)
+	resp.Header.Set("Location", uri.String())
+}
+
+// rewriteCookies maps the path and domain of the cookies set by the upstream
+// back to the ones the client used, otherwise browsers would not send them back
+func rewriteCookies(resp *http.Response, route *Route, external url.URL) {
+	lines := resp.Header["Set-Cookie"]
+	if route == nil || len(lines) == 0 {
+		return
+	}
+
+	upstreamHost := route.UpstreamURI.Hostname()
+	rewritten := make([]string, 0, len(lines))
+
+	for _, line := range lines {
+		cookies := (&http.Response{Header: http.Header{"Set-Cookie": {line}}}).Cookies()
+		if len(cookies) != 1 {
+			rewritten = append(rewritten, line)
+			continue
+		}
+		cookie := cookies[0]
+
+		if cookie.Path != "" {
+			cookie.Path = route.Service.PathRewrite.Reverse(route.UpstreamURI.Path, cookie.Path)
+		}
+
+		if strings.EqualFold(strings.TrimPrefix(cookie.Domain, "."), upstreamHost) {
+			cookie.Domain = external.Hostname()
+		}
+
+		rewritten = append(rewritten, cookie.String())
+	}
+
+	resp.Header["Set-Cookie"] = rewritten
+}
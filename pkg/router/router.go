@@ -0,0 +1,195 @@
+package router
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+
+	"github.com/alphagov/iap/pkg/service"
+	"github.com/alphagov/iap/pkg/upstream"
+	"github.com/sirupsen/logrus"
+)
+
+// Match represents a service matched for a particular host and path
+type Match struct {
+	Service  service.Service
+	captures []string
+}
+
+// Route represents a matched service along with the upstream picked for the request
+type Route struct {
+	Service     service.Service
+	UpstreamURI url.URL
+	Transport   http.RoundTripper
+
+	pool    *upstream.Pool
+	backend *upstream.Backend
+}
+
+// Release gives the upstream back to the load balancer once the request is done,
+// recording if it failed.
+func (r Route) Release(failed bool) {
+	if r.pool != nil {
+		r.pool.Release(r.backend, failed)
+	}
+}
+
+// Router resolves hosts and paths to the services which should handle them.
+// Exact hosts are always preferred over host patterns, then the longest
+// path prefix wins.
+type Router struct {
+	hosts      map[string][]serviceMatcher
+	patterns   []serviceMatcher
+	services   map[string]service.Service
+	pools      map[string]*upstream.Pool
+	transports map[string]http.RoundTripper
+	breakers   map[string]*upstream.Breaker
+}
+
+type serviceMatcher struct {
+	service string
+	matcher service.Matcher
+}
+
+// New will construct the router from validated services.
+func New(services map[string]service.Service, logger *logrus.Logger) *Router {
+	r := &Router{
+		hosts:      make(map[string][]serviceMatcher),
+		patterns:   make([]serviceMatcher, 0),
+		services:   services,
+		pools:      make(map[string]*upstream.Pool),
+		transports: make(map[string]http.RoundTripper),
+		breakers:   make(map[string]*upstream.Breaker),
+	}
+
+	identifiers := make([]string, 0, len(services))
+	for identifier := range services {
+		identifiers = append(identifiers, identifier)
+	}
+	sort.Strings(identifiers)
+
+	for _, identifier := range identifiers {
+		transport := upstream.NewTransport(services[identifier], logger)
+		r.transports[identifier] = transport
+		r.breakers[identifier] = upstream.NewBreaker(services[identifier], logger)
+
+		if len(services[identifier].Upstreams) > 0 {
+			r.pools[identifier] = upstream.NewPool(services[identifier], transport, logger)
+		}
+
+		for _, matcher := range services[identifier].Matchers {
+			m := serviceMatcher{service: identifier, matcher: matcher}
+
+			if matcher.IsPattern() {
+				r.patterns = append(r.patterns, m)
+				continue
+			}
+
+			host := service.NormalizeHost(matcher.Host)
+			r.hosts[host] = append(r.hosts[host], m)
+		}
+	}
+
+	for _, matchers := range r.hosts {
+		sortByPathPrefix(matchers)
+	}
+	sortByPathPrefix(r.patterns)
+
+	return r
+}
+
+// sortByPathPrefix puts the longest path prefixes first, keeping the order of
+// the matchers with prefixes of the same length
+func sortByPathPrefix(matchers []serviceMatcher) {
+	sort.SliceStable(matchers, func(i, j int) bool {
+		return len(matchers[i].matcher.PathPrefix) > len(matchers[j].matcher.PathPrefix)
+	})
+}
+
+// RunHealthChecks starts checking the upstreams of every service which has
+// health checks configured, until stopped.
+func (r *Router) RunHealthChecks(stop <-chan struct{}) {
+	for _, pool := range r.pools {
+		go pool.Run(stop)
+	}
+}
+
+// CheckUpstreams returns an error when any of the upstreams of the service is
+// unhealthy or ejected. Services with a single upstream are never checked.
+func (r *Router) CheckUpstreams(identifier string) error {
+	pool, ok := r.pools[identifier]
+	if !ok {
+		return nil
+	}
+
+	available, total := pool.Available()
+	if available < total {
+		return fmt.Errorf("%d of %d upstreams are available", available, total)
+	}
+
+	return nil
+}
+
+// Match finds the service for the host and path.
+func (r *Router) Match(host, requestPath string) (Match, error) {
+	host = service.NormalizeHost(host)
+
+	for _, m := range r.hosts[host] {
+		if m.matcher.MatchesPath(requestPath) {
+			return Match{Service: r.services[m.service]}, nil
+		}
+	}
+
+	for _, pattern := range r.patterns {
+		if !pattern.matcher.MatchesPath(requestPath) {
+			continue
+		}
+
+		if captures, ok := pattern.matcher.Match(host); ok {
+			return Match{Service: r.services[pattern.service], captures: captures}, nil
+		}
+	}
+
+	return Match{}, fmt.Errorf("No service matches host %s and path %s", host, requestPath)
+}
+
+// Upstream picks the upstream the matched request should be sent to.
+func (r *Router) Upstream(m Match) (Route, error) {
+	pool, ok := r.pools[m.Service.Identifier]
+	if !ok {
+		upstreamURI, err := m.Service.Upstream(m.captures)
+		if err != nil {
+			return Route{}, err
+		}
+
+		return Route{
+			Service:     m.Service,
+			UpstreamURI: upstreamURI,
+			Transport:   r.transports[m.Service.Identifier],
+		}, nil
+	}
+
+	backend, err := pool.Pick()
+	if err != nil {
+		return Route{}, err
+	}
+
+	return Route{
+		Service:     m.Service,
+		UpstreamURI: backend.URI,
+		Transport:   r.transports[m.Service.Identifier],
+		pool:        pool,
+		backend:     backend,
+	}, nil
+}
+
+// Route finds the service for the host and path and picks its upstream.
+func (r *Router) Route(host, requestPath string) (Route, error) {
+	m, err := r.Match(host, requestPath)
+	if err != nil {
+		return Route{}, err
+	}
+
+	return r.Upstream(m)
+}
@@ -0,0 +1,115 @@
+package router
+
+import (
+	"net/url"
+	"regexp"
+
+	"github.com/alphagov/iap/pkg/service"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/sirupsen/logrus"
+)
+
+var _ = Describe("Router", func() {
+	var r *Router
+
+	BeforeEach(func() {
+		r = New(map[string]service.Service{
+			"docs": service.Service{
+				Identifier:  "docs",
+				UpstreamURI: url.URL{Scheme: "http", Host: "docs.internal"},
+				Matchers: []service.Matcher{
+					service.Matcher{Host: "docs.preview.mydomain.com"},
+				},
+			},
+			"tools": service.Service{
+				Identifier:  "tools",
+				UpstreamURI: url.URL{Scheme: "http", Host: "tools.internal"},
+				Matchers: []service.Matcher{
+					service.Matcher{Host: "tools.mydomain.com"},
+				},
+			},
+			"grafana": service.Service{
+				Identifier:  "grafana",
+				UpstreamURI: url.URL{Scheme: "http", Host: "grafana.internal"},
+				Matchers: []service.Matcher{
+					service.Matcher{Host: "tools.mydomain.com", PathPrefix: "/grafana"},
+				},
+			},
+			"review-apps": service.Service{
+				Identifier:       "review-apps",
+				UpstreamTemplate: "http://pr-$1.internal",
+				Matchers: []service.Matcher{
+					service.Matcher{
+						Pattern: regexp.MustCompile(`^pr-(\d+)\.preview\.mydomain\.com$`),
+					},
+				},
+			},
+			"previews": service.Service{
+				Identifier:       "previews",
+				UpstreamTemplate: "http://$1.previews.internal",
+				Matchers: []service.Matcher{
+					service.Matcher{
+						Pattern: regexp.MustCompile(`^(.+)\.previews\.mydomain\.com$`),
+					},
+				},
+			},
+		}, logrus.New())
+	})
+
+	It("should route an exact host", func() {
+		route, err := r.Route("docs.preview.mydomain.com:443", "/")
+
+		Expect(err).NotTo(HaveOccurred())
+		Expect(route.Service.Identifier).To(Equal("docs"))
+		Expect(route.UpstreamURI.String()).To(Equal("http://docs.internal"))
+	})
+
+	It("should route a host pattern using its capture groups", func() {
+		route, err := r.Route("pr-123.preview.mydomain.com", "/")
+
+		Expect(err).NotTo(HaveOccurred())
+		Expect(route.Service.Identifier).To(Equal("review-apps"))
+		Expect(route.UpstreamURI.String()).To(Equal("http://pr-123.internal"))
+	})
+
+	It("should refuse captured values which would change the upstream", func() {
+		_, err := r.Route("evil.com#.previews.mydomain.com", "/")
+
+		Expect(err).To(MatchError(ContainSubstring("cannot be used in an upstream URI")))
+	})
+
+	It("should fail to route an unknown host", func() {
+		_, err := r.Route("unknown.mydomain.com", "/")
+
+		Expect(err).To(MatchError(ContainSubstring("No service matches host unknown.mydomain.com")))
+	})
+
+	It("should route the longest path prefix of a shared host", func() {
+		route, err := r.Route("tools.mydomain.com", "/grafana/dashboards")
+
+		Expect(err).NotTo(HaveOccurred())
+		Expect(route.Service.Identifier).To(Equal("grafana"))
+
+		route, err = r.Route("tools.mydomain.com", "/grafanas")
+
+		Expect(err).NotTo(HaveOccurred())
+		Expect(route.Service.Identifier).To(Equal("tools"))
+	})
+
+	It("should fail to route a path outside of every path prefix", func() {
+		r = New(map[string]service.Service{
+			"grafana": service.Service{
+				Identifier: "grafana",
+				Matchers: []service.Matcher{
+					service.Matcher{Host: "tools.mydomain.com", PathPrefix: "/grafana"},
+				},
+			},
+		}, logrus.New())
+
+		_, err := r.Route("tools.mydomain.com", "/prometheus")
+
+		Expect(err).To(MatchError(ContainSubstring("No service matches host tools.mydomain.com and path /prometheus")))
+	})
+})
@@ -0,0 +1,209 @@
+package servertls
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"math/big"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// ReloadInterval is how often the certificates are checked for changes.
+const ReloadInterval = 10 * time.Second
+
+// SelfSignedValidity is how long the certificates generated for development
+// are valid for, they only ever live in memory.
+const SelfSignedValidity = 365 * 24 * time.Hour
+
+// KeyPair represents the files of a certificate and its key
+type KeyPair struct {
+	CertFile string
+	KeyFile  string
+}
+
+// Certificates is a struct capable of serving certificates which are reloaded
+// from disk when they change, so they can be renewed without a restart.
+type Certificates struct {
+	pairs  []KeyPair
+	logger *logrus.Logger
+
+	mu           sync.RWMutex
+	certificates []tls.Certificate
+	modified     []time.Time
+}
+
+// Load reads the certificates, which must all be valid to start with.
+func Load(pairs []KeyPair, logger *logrus.Logger) (*Certificates, error) {
+	if len(pairs) == 0 {
+		return nil, fmt.Errorf("At least one certificate must be given")
+	}
+
+	c := &Certificates{
+		pairs:  pairs,
+		logger: logger,
+	}
+
+	if _, err := c.Reload(); err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// SelfSigned generates a certificate for the host names and IP addresses,
+// which is only meant for development as clients have no way to trust it.
+// Empty names, such as a host which is not set, are skipped.
+func SelfSigned(names []string, logger *logrus.Logger) (*Certificates, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: "IAP self-signed"},
+		NotBefore:    now.Add(-time.Minute),
+		NotAfter:     now.Add(SelfSignedValidity),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+
+	for _, name := range names {
+		if name == "" {
+			continue
+		}
+		if ip := net.ParseIP(name); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+			continue
+		}
+		template.DNSNames = append(template.DNSNames, name)
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return nil, err
+	}
+
+	logger.WithField("names", names).Warn("serving a self-signed TLS certificate, which is only meant for development")
+
+	return &Certificates{
+		logger: logger,
+		certificates: []tls.Certificate{{
+			Certificate: [][]byte{der},
+			PrivateKey:  key,
+		}},
+	}, nil
+}
+
+// Reload reads the certificates again if any of their files has changed,
+// returning if they were reloaded. When any of them cannot be loaded, all of
+// the current certificates are kept. Self-signed certificates never change.
+func (c *Certificates) Reload() (bool, error) {
+	modified := make([]time.Time, 0, len(c.pairs))
+	for _, pair := range c.pairs {
+		for _, file := range []string{pair.CertFile, pair.KeyFile} {
+			info, err := os.Stat(file)
+			if err != nil {
+				return false, fmt.Errorf("Could not read the TLS certificate: %s", err)
+			}
+			modified = append(modified, info.ModTime())
+		}
+	}
+
+	if !c.changed(modified) {
+		return false, nil
+	}
+
+	certificates := make([]tls.Certificate, 0, len(c.pairs))
+	for _, pair := range c.pairs {
+		certificate, err := tls.LoadX509KeyPair(pair.CertFile, pair.KeyFile)
+		if err != nil {
+			return false, fmt.Errorf("Could not load the TLS certificate %s: %s", pair.CertFile, err)
+		}
+		certificates = append(certificates, certificate)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.certificates = certificates
+	c.modified = modified
+	return true, nil
+}
+
+func (c *Certificates) changed(modified []time.Time) bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	if len(modified) != len(c.modified) {
+		return true
+	}
+
+	for index := range modified {
+		if !modified[index].Equal(c.modified[index]) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Watch reloads the certificates when they change, until stopped.
+func (c *Certificates) Watch(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			reloaded, err := c.Reload()
+			if err != nil {
+				c.logger.WithField("error", err).Error("failed to reload TLS certificates, keeping the current ones")
+				continue
+			}
+			if reloaded {
+				c.logger.Info("reloaded TLS certificates")
+			}
+		}
+	}
+}
+
+// GetCertificate returns the first certificate supporting the server name
+// requested by the client, otherwise the first certificate.
+func (c *Certificates) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	for index := range c.certificates {
+		if hello.SupportsCertificate(&c.certificates[index]) == nil {
+			return &c.certificates[index], nil
+		}
+	}
+
+	return &c.certificates[0], nil
+}
+
+// ServerConfig returns a TLS configuration serving the certificates.
+func (c *Certificates) ServerConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: c.GetCertificate,
+	}
+}
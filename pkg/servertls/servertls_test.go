@@ -0,0 +1,220 @@
+package servertls_test
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/alphagov/iap/pkg/servertls"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/sirupsen/logrus"
+)
+
+// writeKeyPair writes a self signed certificate for the name and its key to
+// the directory, moving their modification time forward by the offset
+func writeKeyPair(dir, name string, offset time.Duration) servertls.KeyPair {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	Expect(err).NotTo(HaveOccurred())
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	Expect(err).NotTo(HaveOccurred())
+
+	keyDer, err := x509.MarshalPKCS8PrivateKey(key)
+	Expect(err).NotTo(HaveOccurred())
+
+	pair := servertls.KeyPair{
+		CertFile: filepath.Join(dir, name+".crt"),
+		KeyFile:  filepath.Join(dir, name+".key"),
+	}
+
+	Expect(ioutil.WriteFile(pair.CertFile, pem.EncodeToMemory(&pem.Block{
+		Type: "CERTIFICATE", Bytes: der,
+	}), 0600)).To(Succeed())
+	Expect(ioutil.WriteFile(pair.KeyFile, pem.EncodeToMemory(&pem.Block{
+		Type: "PRIVATE KEY", Bytes: keyDer,
+	}), 0600)).To(Succeed())
+
+	touch(pair, offset)
+	return pair
+}
+
+func touch(pair servertls.KeyPair, offset time.Duration) {
+	modified := time.Now().Add(offset)
+	Expect(os.Chtimes(pair.CertFile, modified, modified)).To(Succeed())
+	Expect(os.Chtimes(pair.KeyFile, modified, modified)).To(Succeed())
+}
+
+func hello(serverName string) *tls.ClientHelloInfo {
+	return &tls.ClientHelloInfo{
+		ServerName:        serverName,
+		SupportedVersions: []uint16{tls.VersionTLS13},
+		SignatureSchemes:  []tls.SignatureScheme{tls.ECDSAWithP256AndSHA256},
+	}
+}
+
+func commonName(certificate *tls.Certificate) string {
+	leaf, err := x509.ParseCertificate(certificate.Certificate[0])
+	Expect(err).NotTo(HaveOccurred())
+	return leaf.Subject.CommonName
+}
+
+var _ = Describe("Certificates", func() {
+	var (
+		dir    string
+		logger *logrus.Logger
+	)
+
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "iap-servertls")
+		Expect(err).NotTo(HaveOccurred())
+
+		logger = logrus.New()
+		logger.SetOutput(GinkgoWriter)
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(dir)
+	})
+
+	It("Requires at least one certificate", func() {
+		_, err := servertls.Load(nil, logger)
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("Fails to load missing certificates", func() {
+		_, err := servertls.Load([]servertls.KeyPair{{
+			CertFile: filepath.Join(dir, "missing.crt"),
+			KeyFile:  filepath.Join(dir, "missing.key"),
+		}}, logger)
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("Serves the certificate", func() {
+		certificates, err := servertls.Load([]servertls.KeyPair{
+			writeKeyPair(dir, "iap.local", -time.Hour),
+		}, logger)
+		Expect(err).NotTo(HaveOccurred())
+
+		certificate, err := certificates.GetCertificate(hello("iap.local"))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(commonName(certificate)).To(Equal("iap.local"))
+	})
+
+	It("Serves the certificate matching the server name", func() {
+		certificates, err := servertls.Load([]servertls.KeyPair{
+			writeKeyPair(dir, "iap.local", -time.Hour),
+			writeKeyPair(dir, "proxy.local", -time.Hour),
+		}, logger)
+		Expect(err).NotTo(HaveOccurred())
+
+		certificate, err := certificates.GetCertificate(hello("proxy.local"))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(commonName(certificate)).To(Equal("proxy.local"))
+
+		certificate, err = certificates.GetCertificate(hello("unknown.local"))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(commonName(certificate)).To(Equal("iap.local"))
+	})
+
+	It("Generates a self-signed certificate", func() {
+		certificates, err := servertls.SelfSigned([]string{"localhost", "", "127.0.0.1"}, logger)
+		Expect(err).NotTo(HaveOccurred())
+
+		certificate, err := certificates.GetCertificate(hello("localhost"))
+		Expect(err).NotTo(HaveOccurred())
+
+		leaf, err := x509.ParseCertificate(certificate.Certificate[0])
+		Expect(err).NotTo(HaveOccurred())
+		Expect(leaf.DNSNames).To(Equal([]string{"localhost"}))
+		Expect(leaf.IPAddresses).To(HaveLen(1))
+		Expect(leaf.IPAddresses[0].String()).To(Equal("127.0.0.1"))
+
+		reloaded, err := certificates.Reload()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(reloaded).To(BeFalse())
+	})
+
+	Context("Reloading", func() {
+		var (
+			pair         servertls.KeyPair
+			certificates *servertls.Certificates
+			original     *tls.Certificate
+		)
+
+		BeforeEach(func() {
+			pair = writeKeyPair(dir, "iap.local", -time.Hour)
+
+			var err error
+			certificates, err = servertls.Load([]servertls.KeyPair{pair}, logger)
+			Expect(err).NotTo(HaveOccurred())
+
+			original, err = certificates.GetCertificate(hello("iap.local"))
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		It("Does not reload unchanged certificates", func() {
+			reloaded, err := certificates.Reload()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(reloaded).To(BeFalse())
+		})
+
+		It("Reloads renewed certificates", func() {
+			writeKeyPair(dir, "iap.local", 0)
+
+			reloaded, err := certificates.Reload()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(reloaded).To(BeTrue())
+
+			certificate, err := certificates.GetCertificate(hello("iap.local"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(certificate.Certificate[0]).NotTo(Equal(original.Certificate[0]))
+		})
+
+		It("Keeps the current certificate when the new one is invalid", func() {
+			Expect(ioutil.WriteFile(pair.CertFile, []byte("not a certificate"), 0600)).To(Succeed())
+			touch(pair, 0)
+
+			_, err := certificates.Reload()
+			Expect(err).To(HaveOccurred())
+
+			certificate, err := certificates.GetCertificate(hello("iap.local"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(certificate.Certificate[0]).To(Equal(original.Certificate[0]))
+		})
+
+		It("Reloads the certificates while watching them", func() {
+			stop := make(chan struct{})
+			defer close(stop)
+			go certificates.Watch(10*time.Millisecond, stop)
+
+			writeKeyPair(dir, "iap.local", 0)
+
+			Eventually(func() []byte {
+				certificate, err := certificates.GetCertificate(hello("iap.local"))
+				Expect(err).NotTo(HaveOccurred())
+				return certificate.Certificate[0]
+			}).ShouldNot(Equal(original.Certificate[0]))
+		})
+	})
+})
@@ -0,0 +1,116 @@
+package service
+
+import (
+	"regexp"
+	"regexp/syntax"
+)
+
+// PatternsOverlap tells if any host is matched by both patterns, searching
+// the product of their compiled programs for a host accepted by both. Hosts
+// being ASCII, only printable ASCII characters are tried. Word boundaries are
+// assumed to hold anywhere, so patterns using them can be reported as
+// overlapping when they are not, but never the other way around.
+func PatternsOverlap(a, b *regexp.Regexp) bool {
+	progA, err := compilePattern(a)
+	if err != nil {
+		return true
+	}
+	progB, err := compilePattern(b)
+	if err != nil {
+		return true
+	}
+
+	type state struct {
+		a, b  uint32
+		start bool
+	}
+
+	initial := state{a: uint32(progA.Start), b: uint32(progB.Start), start: true}
+	seen := map[state]bool{initial: true}
+	queue := []state{initial}
+
+	for len(queue) > 0 {
+		current := queue[0]
+		queue = queue[1:]
+
+		empty := syntax.EmptyWordBoundary | syntax.EmptyNoWordBoundary
+		if current.start {
+			empty |= syntax.EmptyBeginText | syntax.EmptyBeginLine
+		}
+
+		_, matchA := closure(progA, current.a, empty|syntax.EmptyEndText|syntax.EmptyEndLine)
+		_, matchB := closure(progB, current.b, empty|syntax.EmptyEndText|syntax.EmptyEndLine)
+		if matchA && matchB {
+			return true
+		}
+
+		runesA, _ := closure(progA, current.a, empty)
+		runesB, _ := closure(progB, current.b, empty)
+		for r := ' '; r <= '~'; r++ {
+			for _, pcA := range runesA {
+				if !progA.Inst[pcA].MatchRune(r) {
+					continue
+				}
+				for _, pcB := range runesB {
+					if !progB.Inst[pcB].MatchRune(r) {
+						continue
+					}
+
+					next := state{a: progA.Inst[pcA].Out, b: progB.Inst[pcB].Out}
+					if !seen[next] {
+						seen[next] = true
+						queue = append(queue, next)
+					}
+				}
+			}
+		}
+	}
+
+	return false
+}
+
+func compilePattern(pattern *regexp.Regexp) (*syntax.Prog, error) {
+	parsed, err := syntax.Parse(pattern.String(), syntax.Perl)
+	if err != nil {
+		return nil, err
+	}
+
+	return syntax.Compile(parsed.Simplify())
+}
+
+// closure follows the instructions not consuming any character from pc,
+// where the empty-width assertions allowed hold, and returns the ones
+// consuming a character along with if the program can match.
+func closure(prog *syntax.Prog, pc uint32, allowed syntax.EmptyOp) ([]uint32, bool) {
+	runes := make([]uint32, 0)
+	match := false
+	visited := make(map[uint32]bool)
+	stack := []uint32{pc}
+
+	for len(stack) > 0 {
+		pc := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		if visited[pc] {
+			continue
+		}
+		visited[pc] = true
+
+		inst := prog.Inst[pc]
+		switch inst.Op {
+		case syntax.InstAlt, syntax.InstAltMatch:
+			stack = append(stack, inst.Out, inst.Arg)
+		case syntax.InstCapture, syntax.InstNop:
+			stack = append(stack, inst.Out)
+		case syntax.InstEmptyWidth:
+			if syntax.EmptyOp(inst.Arg)&^allowed == 0 {
+				stack = append(stack, inst.Out)
+			}
+		case syntax.InstMatch:
+			match = true
+		case syntax.InstRune, syntax.InstRune1, syntax.InstRuneAny, syntax.InstRuneAnyNotNL:
+			runes = append(runes, pc)
+		}
+	}
+
+	return runes, match
+}
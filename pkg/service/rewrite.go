@@ -0,0 +1,72 @@
+package service
+
+import (
+	"regexp"
+	"strings"
+)
+
+// PathRewrite represents validated rewriting of request paths
+//
+// The StripPrefix is removed first, then the Pattern is replaced and finally
+// the AddPrefix is added.
+type PathRewrite struct {
+	StripPrefix string
+	AddPrefix   string
+	Pattern     *regexp.Regexp
+	Replacement string
+}
+
+// Rewrite returns the path the request should be sent to, under the base path of the upstream
+func (p *PathRewrite) Rewrite(base, requestPath string) string {
+	rewritten := requestPath
+
+	if p.StripPrefix != "" && HasPathPrefix(rewritten, p.StripPrefix) {
+		rewritten = strings.TrimPrefix(rewritten, strings.TrimSuffix(p.StripPrefix, "/"))
+	}
+
+	if p.Pattern != nil {
+		rewritten = p.Pattern.ReplaceAllString(rewritten, p.Replacement)
+	}
+
+	return JoinPaths(base, p.AddPrefix, rewritten)
+}
+
+// Reverse returns the path a client should use for a path of the upstream, so
+// redirects and cookies of upstreams unaware of their external path keep
+// working. Paths outside of the base path and prefix are returned unchanged.
+// The Pattern cannot be reversed, so it is not taken into account.
+func (p *PathRewrite) Reverse(base, upstreamPath string) string {
+	internal := JoinPaths(base, p.AddPrefix)
+
+	if !HasPathPrefix(upstreamPath, internal) {
+		return upstreamPath
+	}
+
+	rest := strings.TrimPrefix(upstreamPath, strings.TrimSuffix(internal, "/"))
+	return JoinPaths(p.StripPrefix, rest)
+}
+
+// JoinPaths joins the paths with a single slash, keeping the trailing slash
+// of the last non empty path
+func JoinPaths(paths ...string) string {
+	segments := make([]string, 0, len(paths))
+	trailing := false
+
+	for _, p := range paths {
+		if p == "" {
+			continue
+		}
+
+		trailing = strings.HasSuffix(p, "/")
+		if trimmed := strings.Trim(p, "/"); trimmed != "" {
+			segments = append(segments, trimmed)
+		}
+	}
+
+	joined := "/" + strings.Join(segments, "/")
+	if trailing && joined != "/" {
+		joined += "/"
+	}
+
+	return joined
+}
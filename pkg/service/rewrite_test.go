@@ -0,0 +1,47 @@
+package service
+
+import (
+	"regexp"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Service Path Rewrite", func() {
+	It("Joins the request path to the upstream path", func() {
+		p := PathRewrite{}
+
+		Expect(p.Rewrite("", "/users")).To(Equal("/users"))
+		Expect(p.Rewrite("/app", "/users/")).To(Equal("/app/users/"))
+		Expect(p.Rewrite("/app/", "/")).To(Equal("/app/"))
+	})
+
+	It("Strips a prefix only on a segment boundary", func() {
+		p := PathRewrite{StripPrefix: "/grafana"}
+
+		Expect(p.Rewrite("", "/grafana/dashboards")).To(Equal("/dashboards"))
+		Expect(p.Rewrite("", "/grafana")).To(Equal("/"))
+		Expect(p.Rewrite("", "/grafanas")).To(Equal("/grafanas"))
+	})
+
+	It("Adds a prefix and replaces a pattern", func() {
+		p := PathRewrite{
+			StripPrefix: "/api",
+			AddPrefix:   "/v2",
+			Pattern:     regexp.MustCompile(`^/users/([0-9]+)$`),
+			Replacement: "/people/$1",
+		}
+
+		Expect(p.Rewrite("/app", "/api/users/12")).To(Equal("/app/v2/people/12"))
+		Expect(p.Rewrite("/app", "/api/teams")).To(Equal("/app/v2/teams"))
+	})
+
+	It("Reverses upstream paths to the external path", func() {
+		p := PathRewrite{StripPrefix: "/grafana", AddPrefix: "/v2"}
+
+		Expect(p.Reverse("/app", "/app/v2/login")).To(Equal("/grafana/login"))
+		Expect(p.Reverse("/app", "/app/v2")).To(Equal("/grafana"))
+		Expect(p.Reverse("/app", "/elsewhere")).To(Equal("/elsewhere"))
+		Expect((&PathRewrite{}).Reverse("", "/login")).To(Equal("/login"))
+	})
+})
@@ -1,12 +1,141 @@
 package service
 
 import (
+	"crypto/tls"
+	"fmt"
 	"net/url"
+	"path"
+	"regexp"
+	"strings"
+	"time"
+)
+
+const (
+	// RoundRobin load balancing sends requests to each upstream in turn.
+	RoundRobin = "round_robin"
+	// LeastConnections load balancing sends requests to the least busy upstream.
+	LeastConnections = "least_connections"
+	// Weighted load balancing sends requests proportionally to the upstream weights.
+	Weighted = "weighted"
 )
 
 // Matcher represents a validated Matcher
+//
+// A Matcher either matches a single exact Host, or a Pattern whose capture
+// groups can be referenced from the upstream URI of the service.
+// When PathPrefix is set, only requests under it are matched.
 type Matcher struct {
-	Host string
+	Host       string
+	Pattern    *regexp.Regexp
+	PathPrefix string
+}
+
+// Match returns if the host is matched, along with any captured groups
+func (m *Matcher) Match(host string) ([]string, bool) {
+	host = NormalizeHost(host)
+
+	if m.Pattern == nil {
+		return nil, host == NormalizeHost(m.Host)
+	}
+
+	captures := m.Pattern.FindStringSubmatch(host)
+	if captures == nil {
+		return nil, false
+	}
+
+	return captures, true
+}
+
+// MatchesPath returns if the request path is under the path prefix of the matcher
+func (m *Matcher) MatchesPath(requestPath string) bool {
+	return m.PathPrefix == "" || HasPathPrefix(CleanPath(requestPath), m.PathPrefix)
+}
+
+// IsPattern returns if the matcher matches more than a single exact host
+func (m *Matcher) IsPattern() bool {
+	return m.Pattern != nil
+}
+
+// String returns a human readable representation of the matcher
+func (m *Matcher) String() string {
+	if m.Pattern == nil {
+		return m.Host + m.PathPrefix
+	}
+
+	return m.Pattern.String() + m.PathPrefix
+}
+
+// PublicPath represents a validated rule for requests which skip authentication
+//
+// Either Path matches a single exact path, or Prefix matches every path
+// under it. When Methods is empty every method is matched.
+type PublicPath struct {
+	Path    string
+	Prefix  string
+	Methods []string
+}
+
+// Match returns if the request method and path are covered by the rule
+func (p *PublicPath) Match(method, requestPath string) bool {
+	if len(p.Methods) > 0 {
+		allowed := false
+		for _, m := range p.Methods {
+			if strings.EqualFold(m, method) {
+				allowed = true
+			}
+		}
+
+		if !allowed {
+			return false
+		}
+	}
+
+	requestPath = CleanPath(requestPath)
+
+	if p.Path != "" {
+		return requestPath == p.Path
+	}
+
+	return HasPathPrefix(requestPath, p.Prefix)
+}
+
+// IsCatchAll returns if the rule makes every path of the service public
+func (p *PublicPath) IsCatchAll() bool {
+	return p.Path == "" && len(p.Methods) == 0 && strings.TrimSuffix(p.Prefix, "/") == ""
+}
+
+// Upstream represents a validated Upstream
+type Upstream struct {
+	URI    url.URL
+	Weight int
+}
+
+// HealthCheck represents validated active health checking of the upstreams
+type HealthCheck struct {
+	Path               string
+	Interval           time.Duration
+	Timeout            time.Duration
+	HealthyThreshold   int
+	UnhealthyThreshold int
+}
+
+// OutlierDetection represents validated passive health checking of the upstreams
+type OutlierDetection struct {
+	ConsecutiveFailures int
+	EjectionDuration    time.Duration
+}
+
+// Timeouts represents validated timeouts for reaching the upstreams
+type Timeouts struct {
+	Connect        time.Duration
+	ResponseHeader time.Duration
+	Idle           time.Duration
+}
+
+// CircuitBreaker represents validated failing fast of a consistently failing service
+type CircuitBreaker struct {
+	ConsecutiveFailures int
+	OpenDuration        time.Duration
 }
 
 // Service represents a validated Service
@@ -14,8 +143,37 @@ type Service struct {
 	Headers     map[string]string
 	Identifier  string
 	Matchers    []Matcher
+	PublicPaths []PublicPath
 	Roles       []string
 	UpstreamURI url.URL
+
+	// Upstreams always contains at least the UpstreamURI, unless the service
+	// uses an UpstreamTemplate
+	Upstreams        []Upstream
+	LoadBalancing    string
+	HealthCheck      *HealthCheck
+	OutlierDetection *OutlierDetection
+
+	// PathRewrite is applied to request paths before they are joined to the
+	// path of the upstream URI
+	PathRewrite PathRewrite
+
+	// Retries is the number of extra attempts made for idempotent requests
+	Retries        int
+	Timeouts       Timeouts
+	CircuitBreaker *CircuitBreaker
+
+	// TLS is used when connecting to https upstreams, when nil the system
+	// certificate pool is trusted
+	TLS *tls.Config
+
+	// ForwardAuthorization keeps the bearer token of the user in the requests
+	// sent upstream, otherwise the Authorization header is removed
+	ForwardAuthorization bool
+
+	// UpstreamTemplate is only set when the upstream URI references capture
+	// groups of the matchers, eg: http://pr-$1.internal
+	UpstreamTemplate string
 }
 
 // IsAccessible returns if service should be accessed by any one of the roles
@@ -34,3 +192,105 @@ func (s *Service) IsAccessible(roles []string) bool {
 
 	return false
 }
+
+// IsPublic returns if the request should skip authentication
+func (s *Service) IsPublic(method, requestPath string) bool {
+	for _, publicPath := range s.PublicPaths {
+		if publicPath.Match(method, requestPath) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Upstream returns the upstream URI with capture groups expanded
+func (s *Service) Upstream(captures []string) (url.URL, error) {
+	if s.UpstreamTemplate == "" {
+		return s.UpstreamURI, nil
+	}
+
+	for index, capture := range captures {
+		if index > 0 && !safeCapture.MatchString(capture) {
+			return url.URL{}, fmt.Errorf("Captured value %q cannot be used in an upstream URI", capture)
+		}
+	}
+
+	expanded := ExpandUpstream(s.UpstreamTemplate, captures)
+
+	upstreamURI, err := url.Parse(expanded)
+	if err != nil {
+		return url.URL{}, fmt.Errorf("Upstream URI %s is not valid: %s", expanded, err)
+	}
+
+	return *upstreamURI, nil
+}
+
+// NormalizeHost strips the port and lowercases the host
+func NormalizeHost(host string) string {
+	host = strings.ToLower(host)
+
+	if i := strings.LastIndex(host, ":"); i != -1 && !strings.HasSuffix(host, "]") {
+		host = host[:i]
+	}
+
+	return strings.TrimSuffix(host, ".")
+}
+
+// CleanPath resolves dot segments so that a public prefix cannot be used to
+// reach a path outside of it, eg: /.well-known/../admin
+func CleanPath(requestPath string) string {
+	if requestPath == "" {
+		return "/"
+	}
+
+	cleaned := path.Clean("/" + requestPath)
+	if strings.HasSuffix(requestPath, "/") && cleaned != "/" {
+		cleaned += "/"
+	}
+
+	return cleaned
+}
+
+// HasPathPrefix returns if the path is the prefix or is under it
+func HasPathPrefix(requestPath, prefix string) bool {
+	prefix = strings.TrimSuffix(prefix, "/")
+	return requestPath == prefix || strings.HasPrefix(requestPath, prefix+"/")
+}
+
+var safeCapture = regexp.MustCompile(`^[a-zA-Z0-9._-]*$`)
+
+var upstreamReference = regexp.MustCompile(`\$(\d+|\{\d+\})`)
+
+// ExpandUpstream replaces $1 or ${1} style references with the captures
+func ExpandUpstream(template string, captures []string) string {
+	return upstreamReference.ReplaceAllStringFunc(template, func(ref string) string {
+		index := referencedCapture(ref)
+		if index < len(captures) {
+			return captures[index]
+		}
+
+		return ""
+	})
+}
+
+// UpstreamReferences returns the highest capture group referenced by the template
+// or zero when the template does not reference any
+func UpstreamReferences(template string) int {
+	highest := 0
+
+	for _, ref := range upstreamReference.FindAllString(template, -1) {
+		if index := referencedCapture(ref); index > highest {
+			highest = index
+		}
+	}
+
+	return highest
+}
+
+// referencedCapture returns the capture group index of a $1 or ${1} reference
+func referencedCapture(ref string) int {
+	index := 0
+	fmt.Sscanf(strings.Trim(ref, "${}"), "%d", &index)
+	return index
+}
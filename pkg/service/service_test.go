@@ -1,6 +1,9 @@
 package service
 
 import (
+	"net/url"
+	"regexp"
+
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
 )
@@ -60,3 +63,82 @@ var _ = Describe("Service Roles", func() {
 		Expect(s.IsAccessible(roles)).To(Equal(true))
 	})
 })
+
+var _ = Describe("Service Matchers", func() {
+	It("An exact matcher matches the host regardless of case and port", func() {
+		m := Matcher{Host: "my-service.mydomain.com"}
+
+		_, ok := m.Match("My-Service.mydomain.com:8080")
+		Expect(ok).To(Equal(true))
+
+		_, ok = m.Match("my-other-service.mydomain.com")
+		Expect(ok).To(Equal(false))
+	})
+
+	It("A pattern matcher returns its capture groups", func() {
+		m := Matcher{Pattern: regexp.MustCompile(`^pr-(\d+)\.mydomain\.com$`)}
+
+		captures, ok := m.Match("pr-12.mydomain.com")
+		Expect(ok).To(Equal(true))
+		Expect(captures).To(Equal([]string{"pr-12.mydomain.com", "12"}))
+	})
+})
+
+var _ = Describe("Service Upstream", func() {
+	It("A service without a template returns the upstream URI", func() {
+		s := Service{UpstreamURI: url.URL{Scheme: "https", Host: "my-service.local"}}
+
+		upstreamURI, err := s.Upstream(nil)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(upstreamURI.String()).To(Equal("https://my-service.local"))
+	})
+
+	It("A service with a template expands the capture groups", func() {
+		s := Service{UpstreamTemplate: "http://pr-${1}.internal/$2"}
+
+		upstreamURI, err := s.Upstream([]string{"", "12", "docs"})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(upstreamURI.String()).To(Equal("http://pr-12.internal/docs"))
+	})
+
+	It("A service with a template refuses unsafe capture groups", func() {
+		s := Service{UpstreamTemplate: "http://pr-$1.internal"}
+
+		_, err := s.Upstream([]string{"", "evil.com/"})
+		Expect(err).To(HaveOccurred())
+	})
+})
+
+var _ = Describe("Service Public Paths", func() {
+	s := Service{
+		PublicPaths: []PublicPath{
+			PublicPath{Path: "/healthcheck"},
+			PublicPath{Prefix: "/.well-known/"},
+			PublicPath{Path: "/webhooks/github", Methods: []string{"POST"}},
+		},
+	}
+
+	It("A request to an exact public path is public", func() {
+		Expect(s.IsPublic("GET", "/healthcheck")).To(Equal(true))
+		Expect(s.IsPublic("GET", "/healthcheck/more")).To(Equal(false))
+	})
+
+	It("A request under a public prefix is public", func() {
+		Expect(s.IsPublic("GET", "/.well-known/security.txt")).To(Equal(true))
+		Expect(s.IsPublic("GET", "/.well-known-other")).To(Equal(false))
+	})
+
+	It("A request escaping a public prefix is not public", func() {
+		Expect(s.IsPublic("GET", "/.well-known/../admin")).To(Equal(false))
+		Expect(s.IsPublic("GET", "//healthcheck")).To(Equal(true))
+	})
+
+	It("A request with a method which is not allowed is not public", func() {
+		Expect(s.IsPublic("POST", "/webhooks/github")).To(Equal(true))
+		Expect(s.IsPublic("GET", "/webhooks/github")).To(Equal(false))
+	})
+
+	It("A request to another path is not public", func() {
+		Expect(s.IsPublic("GET", "/")).To(Equal(false))
+	})
+})
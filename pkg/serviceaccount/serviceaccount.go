@@ -0,0 +1,202 @@
+package serviceaccount
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"net"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/alphagov/iap/pkg/metrics"
+	"github.com/alphagov/iap/pkg/user"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// IdentifierPrefix tells service accounts apart from users identified by OIDC.
+	IdentifierPrefix = "service-account:"
+	// HashPrefix is the only supported format of hashed API keys.
+	HashPrefix = "sha256:"
+)
+
+var (
+	// ErrInvalidKey is returned when the API key does not belong to the service account.
+	ErrInvalidKey = errors.New("API key is not valid")
+	// ErrExpired is returned when the service account can no longer be used.
+	ErrExpired = errors.New("Service account has expired")
+	// ErrSourceNotAllowed is returned when the service account is used from an unexpected address.
+	ErrSourceNotAllowed = errors.New("Service account cannot be used from this address")
+)
+
+// ServiceAccount represents a validated ServiceAccount, used by non-human
+// callers authenticating with API keys
+type ServiceAccount struct {
+	Name  string
+	Roles []string
+
+	// KeyHashes are the SHA-256 digests of the API keys, more than one can be
+	// valid while keys are rotated
+	KeyHashes [][]byte
+
+	// ExpiresAt is zero when the service account does not expire
+	ExpiresAt time.Time
+
+	// SourceCIDRs are empty when the service account can be used from anywhere
+	SourceCIDRs []*net.IPNet
+}
+
+// User returns the identity of the service account, as used for authorization and auditing.
+func (a ServiceAccount) User() user.User {
+	return user.User{
+		Identifier: IdentifierPrefix + a.Name,
+		Roles:      a.Roles,
+	}
+}
+
+// Expired returns if the service account has expired at the time.
+func (a ServiceAccount) Expired(now time.Time) bool {
+	return !a.ExpiresAt.IsZero() && !now.Before(a.ExpiresAt)
+}
+
+// AllowsSource returns if the service account can be used from the address.
+func (a ServiceAccount) AllowsSource(ip net.IP) bool {
+	if len(a.SourceCIDRs) == 0 {
+		return true
+	}
+
+	for _, cidr := range a.SourceCIDRs {
+		if ip != nil && cidr.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// HasKey returns if the API key is one of the keys of the service account.
+func (a ServiceAccount) HasKey(key string) bool {
+	digest := sha256.Sum256([]byte(key))
+
+	found := 0
+	for _, hash := range a.KeyHashes {
+		found |= subtle.ConstantTimeCompare(digest[:], hash)
+	}
+
+	return found == 1
+}
+
+// HashKey returns the hashed form of an API key, as written in the configuration.
+func HashKey(key string) string {
+	digest := sha256.Sum256([]byte(key))
+	return HashPrefix + hex.EncodeToString(digest[:])
+}
+
+// ParseKeyHash returns the digest of a hashed API key.
+func ParseKeyHash(hash string) ([]byte, error) {
+	if !strings.HasPrefix(hash, HashPrefix) {
+		return nil, errors.New("API key hash must start with " + HashPrefix)
+	}
+
+	digest, err := hex.DecodeString(strings.TrimPrefix(hash, HashPrefix))
+	if err != nil || len(digest) != sha256.Size {
+		return nil, errors.New("API key hash must be a hex encoded SHA-256 digest")
+	}
+
+	return digest, nil
+}
+
+// Store is a struct capable of authenticating service accounts by their API keys.
+type Store struct {
+	accounts map[string]ServiceAccount
+	names    []string
+	logger   *logrus.Logger
+	now      func() time.Time
+}
+
+// New will construct the struct elsewhere.
+func New(accounts map[string]ServiceAccount, logger *logrus.Logger) *Store {
+	names := make([]string, 0, len(accounts))
+	for name := range accounts {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return &Store{
+		accounts: accounts,
+		names:    names,
+		logger:   logger,
+		now:      time.Now,
+	}
+}
+
+// Lookup returns the service account with the name.
+func (s *Store) Lookup(name string) (ServiceAccount, bool) {
+	account, ok := s.accounts[name]
+	return account, ok
+}
+
+// Authenticate returns the identity of the service account the API key belongs
+// to, when it is used from the source address. The name is empty when only the
+// key is known, eg: when it is given as a bearer token.
+func (s *Store) Authenticate(name, key string, source net.IP) (user.User, error) {
+	account, err := s.match(name, key)
+	if err != nil {
+		validated(false)
+		return user.User{}, err
+	}
+
+	if !account.AllowsSource(source) {
+		s.logger.WithFields(logrus.Fields{
+			"service_account": account.Name,
+			"source":          source.String(),
+		}).Warn("service account used from an address which is not allowed")
+		validated(false)
+		return user.User{}, ErrSourceNotAllowed
+	}
+
+	validated(true)
+	return account.User(), nil
+}
+
+// Valid checks the API key of the service account without its source address,
+// which has to be checked separately, eg: by the rules of the SOCKS5 server.
+func (s *Store) Valid(name, key string) bool {
+	_, err := s.match(name, key)
+	validated(err == nil)
+	return err == nil
+}
+
+func validated(ok bool) {
+	metrics.CredentialsValidated.WithLabelValues(metrics.ServiceAccount, metrics.Result(ok)).Inc()
+}
+
+func (s *Store) match(name, key string) (ServiceAccount, error) {
+	if key == "" {
+		return ServiceAccount{}, ErrInvalidKey
+	}
+
+	names := s.names
+	if name != "" {
+		names = []string{name}
+	}
+
+	for _, n := range names {
+		account, ok := s.accounts[n]
+		if !ok || !account.HasKey(key) {
+			continue
+		}
+
+		if account.Expired(s.now()) {
+			s.logger.WithField("service_account", account.Name).Warn("expired service account used")
+			return ServiceAccount{}, ErrExpired
+		}
+
+		s.logger.WithField("service_account", account.Name).Debug("authenticated service account")
+		return account, nil
+	}
+
+	return ServiceAccount{}, ErrInvalidKey
+}
@@ -0,0 +1,91 @@
+package serviceaccount_test
+
+import (
+	"net"
+	"time"
+
+	"github.com/alphagov/iap/pkg/serviceaccount"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/sirupsen/logrus"
+)
+
+var _ = Describe("Service accounts", func() {
+	var store *serviceaccount.Store
+
+	digest := func(key string) []byte {
+		hash, err := serviceaccount.ParseKeyHash(serviceaccount.HashKey(key))
+		Expect(err).NotTo(HaveOccurred())
+		return hash
+	}
+
+	BeforeEach(func() {
+		_, internal, err := net.ParseCIDR("10.0.0.0/8")
+		Expect(err).NotTo(HaveOccurred())
+
+		logger := logrus.New()
+		logger.SetOutput(GinkgoWriter)
+
+		store = serviceaccount.New(map[string]serviceaccount.ServiceAccount{
+			"deploy-bot": serviceaccount.ServiceAccount{
+				Name:      "deploy-bot",
+				Roles:     []string{"superuser"},
+				KeyHashes: [][]byte{digest("old-key"), digest("deploy-key")},
+			},
+			"backup-bot": serviceaccount.ServiceAccount{
+				Name:        "backup-bot",
+				KeyHashes:   [][]byte{digest("backup-key")},
+				SourceCIDRs: []*net.IPNet{internal},
+			},
+			"old-bot": serviceaccount.ServiceAccount{
+				Name:      "old-bot",
+				KeyHashes: [][]byte{digest("expired-key")},
+				ExpiresAt: time.Now().Add(-time.Minute),
+			},
+		}, logger)
+	})
+
+	It("should authenticate a service account by its name and key", func() {
+		u, err := store.Authenticate("deploy-bot", "deploy-key", net.ParseIP("192.168.1.1"))
+
+		Expect(err).NotTo(HaveOccurred())
+		Expect(u.Identifier).To(Equal("service-account:deploy-bot"))
+		Expect(u.Roles).To(Equal([]string{"superuser"}))
+	})
+
+	It("should authenticate a service account by its key alone", func() {
+		u, err := store.Authenticate("", "old-key", nil)
+
+		Expect(err).NotTo(HaveOccurred())
+		Expect(u.Identifier).To(Equal("service-account:deploy-bot"))
+	})
+
+	It("should refuse the key of another service account", func() {
+		_, err := store.Authenticate("deploy-bot", "backup-key", nil)
+		Expect(err).To(Equal(serviceaccount.ErrInvalidKey))
+
+		Expect(store.Valid("deploy-bot", "backup-key")).To(BeFalse())
+		Expect(store.Valid("deploy-bot", "deploy-key")).To(BeTrue())
+	})
+
+	It("should refuse an unknown key", func() {
+		_, err := store.Authenticate("", "unknown-key", nil)
+		Expect(err).To(Equal(serviceaccount.ErrInvalidKey))
+	})
+
+	It("should refuse an expired service account", func() {
+		_, err := store.Authenticate("old-bot", "expired-key", nil)
+		Expect(err).To(Equal(serviceaccount.ErrExpired))
+	})
+
+	It("should only allow a service account from its source CIDRs", func() {
+		_, err := store.Authenticate("backup-bot", "backup-key", net.ParseIP("10.1.2.3"))
+		Expect(err).NotTo(HaveOccurred())
+
+		_, err = store.Authenticate("backup-bot", "backup-key", net.ParseIP("192.168.1.1"))
+		Expect(err).To(Equal(serviceaccount.ErrSourceNotAllowed))
+
+		_, err = store.Authenticate("backup-bot", "backup-key", nil)
+		Expect(err).To(Equal(serviceaccount.ErrSourceNotAllowed))
+	})
+})
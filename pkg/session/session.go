@@ -0,0 +1,198 @@
+package session
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/alphagov/iap/pkg/tracing"
+	"github.com/go-redis/redis"
+	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+const (
+	// SessionKey defines the Redis key format that will be later formatted into the session token.
+	SessionKey = "iap:session:%s"
+	// StateKey defines the Redis key format that will be later formatted into the OIDC state.
+	StateKey = "iap:oidc:state:%s"
+	// StateExpiration is time duration the user has to finish logging in with the OIDC provider.
+	StateExpiration = time.Minute * 10
+)
+
+// ErrNotFound is returned when the session or state does not exist or has expired.
+var ErrNotFound = errors.New("Session not found")
+
+// Store is a struct capable of storing and looking up user sessions in Redis.
+type Store struct {
+	store  *redis.Client
+	logger *logrus.Logger
+
+	cookieName   string
+	cookieDomain string
+	secure       bool
+	expiration   time.Duration
+}
+
+// Options describe the cookie holding the session token.
+type Options struct {
+	CookieName   string
+	CookieDomain string
+	Secure       bool
+	Expiration   time.Duration
+}
+
+// New will construct the struct elsewhere.
+func New(store *redis.Client, logger *logrus.Logger, options Options) *Store {
+	return &Store{
+		store:  store,
+		logger: logger,
+
+		cookieName:   options.CookieName,
+		cookieDomain: options.CookieDomain,
+		secure:       options.Secure,
+		expiration:   options.Expiration,
+	}
+}
+
+// Create starts a new session for the user and returns its token.
+func (s *Store) Create(identifier string) (string, error) {
+	token, err := randomToken()
+	if err != nil {
+		return "", err
+	}
+
+	err = s.store.Set(fmt.Sprintf(SessionKey, token), identifier, s.expiration).Err()
+	if err != nil {
+		return "", err
+	}
+
+	return token, nil
+}
+
+// Lookup returns the identifier of the user the session belongs to.
+func (s *Store) Lookup(token string) (string, error) {
+	identifier, err := s.store.Get(fmt.Sprintf(SessionKey, token)).Result()
+	if err == redis.Nil {
+		return "", ErrNotFound
+	}
+	if err != nil {
+		return "", err
+	}
+
+	return identifier, nil
+}
+
+// FromRequest looks up the session of the cookie sent with the request.
+func (s *Store) FromRequest(r *http.Request) (string, error) {
+	cookie, err := r.Cookie(s.cookieName)
+	if err != nil || cookie.Value == "" {
+		return "", ErrNotFound
+	}
+
+	_, span := tracing.Start(r.Context(), "session.lookup")
+	identifier, err := s.Lookup(cookie.Value)
+	span.SetAttributes(attribute.Bool("iap.session.found", err == nil))
+	if err == ErrNotFound {
+		tracing.End(span, nil)
+	} else {
+		tracing.End(span, err)
+	}
+
+	return identifier, err
+}
+
+// Cookie returns the cookie which should hold the session token.
+func (s *Store) Cookie(token string) *http.Cookie {
+	return &http.Cookie{
+		Name:     s.cookieName,
+		Value:    token,
+		Path:     "/",
+		Domain:   s.cookieDomain,
+		MaxAge:   int(s.expiration.Seconds()),
+		Secure:   s.secure,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	}
+}
+
+// CreateState remembers where the user should return to once they have
+// logged in, and returns the state to send to the OIDC provider.
+func (s *Store) CreateState(returnTo string) (string, error) {
+	state, err := randomToken()
+	if err != nil {
+		return "", err
+	}
+
+	err = s.store.Set(fmt.Sprintf(StateKey, state), returnTo, StateExpiration).Err()
+	if err != nil {
+		return "", err
+	}
+
+	return state, nil
+}
+
+// StateCookie returns the cookie which ties the state to the browser which
+// started logging in, so that a login started elsewhere cannot be finished in
+// it. It is only sent back to IAP, and only for as long as the state lasts.
+func (s *Store) StateCookie(state string) *http.Cookie {
+	return &http.Cookie{
+		Name:     s.cookieName + "_state",
+		Value:    state,
+		Path:     "/",
+		MaxAge:   int(StateExpiration.Seconds()),
+		Secure:   s.secure,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	}
+}
+
+// ClearStateCookie returns the cookie removing the state once it was used.
+func (s *Store) ClearStateCookie() *http.Cookie {
+	cookie := s.StateCookie("")
+	cookie.MaxAge = -1
+	return cookie
+}
+
+// MatchesState returns if the state cookie sent with the request is the
+// state, in constant time.
+func (s *Store) MatchesState(r *http.Request, state string) bool {
+	cookie, err := r.Cookie(s.cookieName + "_state")
+	if err != nil || cookie.Value == "" || state == "" {
+		return false
+	}
+
+	return subtle.ConstantTimeCompare([]byte(cookie.Value), []byte(state)) == 1
+}
+
+// ConsumeState returns where the user should return to, the state can only be used once.
+func (s *Store) ConsumeState(state string) (string, error) {
+	key := fmt.Sprintf(StateKey, state)
+
+	returnTo, err := s.store.Get(key).Result()
+	if err == redis.Nil {
+		return "", ErrNotFound
+	}
+	if err != nil {
+		return "", err
+	}
+
+	if err := s.store.Del(key).Err(); err != nil {
+		return "", err
+	}
+
+	return returnTo, nil
+}
+
+func randomToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
@@ -0,0 +1,113 @@
+package session_test
+
+import (
+	"net/http/httptest"
+	"time"
+
+	"github.com/alicebob/miniredis"
+	"github.com/alphagov/iap/pkg/session"
+	"github.com/go-redis/redis"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/sirupsen/logrus"
+)
+
+var _ = Describe("Session package", func() {
+	var (
+		s  *session.Store
+		r  *redis.Client
+		mr *miniredis.Miniredis
+	)
+
+	BeforeSuite(func() {
+		var err error
+		mr, err = miniredis.Run()
+		Expect(err).NotTo(HaveOccurred())
+
+		r = redis.NewClient(&redis.Options{
+			Addr: mr.Addr(),
+
+			ReadTimeout:  time.Second * 2,
+			WriteTimeout: time.Second * 1,
+			DialTimeout:  time.Second * 1,
+		})
+
+		logger := logrus.New()
+		logger.SetOutput(GinkgoWriter)
+
+		s = session.New(r, logger, session.Options{
+			CookieName:   "iap_session",
+			CookieDomain: "mydomain.com",
+			Secure:       true,
+			Expiration:   time.Hour,
+		})
+	})
+
+	AfterSuite(func() {
+		r.Close()
+		mr.Close()
+	})
+
+	It("should look up the user of a session", func() {
+		token, err := s.Create("fname.lname@mydomain.com")
+		Expect(err).NotTo(HaveOccurred())
+
+		identifier, err := s.Lookup(token)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(identifier).To(Equal("fname.lname@mydomain.com"))
+	})
+
+	It("should look up the session from the cookie of a request", func() {
+		token, err := s.Create("fname.lname@mydomain.com")
+		Expect(err).NotTo(HaveOccurred())
+
+		req := httptest.NewRequest("GET", "https://my-service.mydomain.com/", nil)
+		req.AddCookie(s.Cookie(token))
+
+		identifier, err := s.FromRequest(req)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(identifier).To(Equal("fname.lname@mydomain.com"))
+
+		_, err = s.FromRequest(httptest.NewRequest("GET", "https://my-service.mydomain.com/", nil))
+		Expect(err).To(Equal(session.ErrNotFound))
+	})
+
+	It("should not find an expired session", func() {
+		token, err := s.Create("fname.lname@mydomain.com")
+		Expect(err).NotTo(HaveOccurred())
+
+		mr.FastForward(2 * time.Hour)
+
+		_, err = s.Lookup(token)
+		Expect(err).To(Equal(session.ErrNotFound))
+	})
+
+	It("should only consume a state once", func() {
+		state, err := s.CreateState("https://my-service.mydomain.com/path")
+		Expect(err).NotTo(HaveOccurred())
+
+		returnTo, err := s.ConsumeState(state)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(returnTo).To(Equal("https://my-service.mydomain.com/path"))
+
+		_, err = s.ConsumeState(state)
+		Expect(err).To(Equal(session.ErrNotFound))
+	})
+
+	It("should only match the state of the cookie", func() {
+		state, err := s.CreateState("https://my-service.mydomain.com/path")
+		Expect(err).NotTo(HaveOccurred())
+
+		req := httptest.NewRequest("GET", "https://iap.mydomain.com/oidc/callback", nil)
+		Expect(s.MatchesState(req, state)).To(BeFalse())
+
+		cookie := s.StateCookie(state)
+		Expect(cookie.HttpOnly).To(BeTrue())
+		Expect(cookie.Domain).To(BeEmpty())
+		req.AddCookie(cookie)
+
+		Expect(s.MatchesState(req, state)).To(BeTrue())
+		Expect(s.MatchesState(req, "another-state")).To(BeFalse())
+		Expect(s.MatchesState(req, "")).To(BeFalse())
+	})
+})
@@ -0,0 +1,153 @@
+package sshca
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/alphagov/iap/pkg/auth"
+	"github.com/alphagov/iap/pkg/user"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	// MaxValidity caps how long certificates are valid for, like the
+	// credentials generated for the proxies.
+	MaxValidity = auth.UserExpiration
+	// clockSkew backdates certificates, so they are valid straight away on
+	// hosts with a clock slightly behind
+	clockSkew = time.Minute
+	// minimumRSABits is the smallest RSA key which will be certified.
+	minimumRSABits = 2048
+)
+
+// ErrNoPrincipals is returned when the user has no roles to log in as.
+var ErrNoPrincipals = errors.New("User does not have any roles to use as principals")
+
+// Authority is a struct capable of issuing short-lived SSH user certificates.
+type Authority struct {
+	signer   ssh.Signer
+	validity time.Duration
+	logger   *logrus.Logger
+	now      func() time.Time
+}
+
+// New will construct the struct elsewhere.
+func New(signer ssh.Signer, validity time.Duration, logger *logrus.Logger) *Authority {
+	return &Authority{
+		signer:   signer,
+		validity: validity,
+		logger:   logger,
+		now:      time.Now,
+	}
+}
+
+// PublicKey returns the key of the CA, which hosts trust with TrustedUserCAKeys.
+func (a *Authority) PublicKey() ssh.PublicKey {
+	return a.signer.PublicKey()
+}
+
+// Sign issues a certificate for the public key of the user. The principals of
+// the certificate are the roles of the user and its key ID contains their
+// identifier, so that hosts log who logged in.
+func (a *Authority) Sign(u user.User, publicKey ssh.PublicKey) (*ssh.Certificate, error) {
+	if len(u.Roles) == 0 {
+		return nil, ErrNoPrincipals
+	}
+
+	if err := ValidatePublicKey(publicKey); err != nil {
+		return nil, err
+	}
+
+	serial, err := randomSerial()
+	if err != nil {
+		return nil, err
+	}
+
+	now := a.now()
+	cert := &ssh.Certificate{
+		Key:             publicKey,
+		Serial:          serial,
+		CertType:        ssh.UserCert,
+		KeyId:           fmt.Sprintf("%s:%d", u.Identifier, serial),
+		ValidPrincipals: append([]string(nil), u.Roles...),
+		ValidAfter:      uint64(now.Add(-clockSkew).Unix()),
+		ValidBefore:     uint64(now.Add(a.validity).Unix()),
+		Permissions: ssh.Permissions{
+			Extensions: map[string]string{
+				"permit-agent-forwarding": "",
+				"permit-port-forwarding":  "",
+				"permit-pty":              "",
+				"permit-user-rc":          "",
+			},
+		},
+	}
+
+	if err := cert.SignCert(rand.Reader, a.signer); err != nil {
+		return nil, fmt.Errorf("Could not sign certificate: %s", err)
+	}
+
+	a.logger.WithFields(logrus.Fields{
+		"user":       u.Identifier,
+		"serial":     serial,
+		"principals": cert.ValidPrincipals,
+		"expires":    time.Unix(int64(cert.ValidBefore), 0).UTC().Format(time.RFC3339),
+	}).Info("issued ssh certificate")
+
+	return cert, nil
+}
+
+// Check signs a probe with the key of the CA, to make sure certificates can
+// still be issued.
+func (a *Authority) Check() error {
+	probe := []byte("iap ssh ca health check")
+
+	signature, err := a.signer.Sign(rand.Reader, probe)
+	if err != nil {
+		return fmt.Errorf("Could not sign with the SSH CA key: %s", err)
+	}
+
+	if err := a.signer.PublicKey().Verify(probe, signature); err != nil {
+		return fmt.Errorf("Could not verify the SSH CA signature: %s", err)
+	}
+
+	return nil
+}
+
+// ValidatePublicKey refuses certificates, which cannot be certified again, and
+// keys which are too weak.
+func ValidatePublicKey(publicKey ssh.PublicKey) error {
+	if _, ok := publicKey.(*ssh.Certificate); ok {
+		return fmt.Errorf("Public key must not be a certificate")
+	}
+
+	switch publicKey.Type() {
+	case ssh.KeyAlgoDSA:
+		return fmt.Errorf("Public key must not be a DSA key")
+	case ssh.KeyAlgoRSA:
+		cryptoKey, ok := publicKey.(ssh.CryptoPublicKey)
+		if !ok {
+			return fmt.Errorf("Public key is not valid")
+		}
+
+		rsaKey, ok := cryptoKey.CryptoPublicKey().(*rsa.PublicKey)
+		if !ok || rsaKey.N.BitLen() < minimumRSABits {
+			return fmt.Errorf("Public key must be an RSA key of at least %d bits", minimumRSABits)
+		}
+	}
+
+	return nil
+}
+
+func randomSerial() (uint64, error) {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return 0, err
+	}
+
+	return binary.BigEndian.Uint64(b), nil
+}
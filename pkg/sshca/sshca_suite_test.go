@@ -0,0 +1,13 @@
+package sshca_test
+
+import (
+	"testing"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+func TestSSHCA(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "SSH CA Suite")
+}
@@ -0,0 +1,124 @@
+package sshca_test
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"strings"
+	"time"
+
+	"github.com/alphagov/iap/pkg/sshca"
+	"github.com/alphagov/iap/pkg/user"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/crypto/ssh"
+)
+
+var _ = Describe("SSH CA", func() {
+	var (
+		authority *sshca.Authority
+		userKey   ssh.PublicKey
+		checker   *ssh.CertChecker
+		u         user.User
+	)
+
+	BeforeEach(func() {
+		_, caKey, err := ed25519.GenerateKey(rand.Reader)
+		Expect(err).NotTo(HaveOccurred())
+
+		signer, err := ssh.NewSignerFromKey(caKey)
+		Expect(err).NotTo(HaveOccurred())
+
+		logger := logrus.New()
+		logger.SetOutput(GinkgoWriter)
+
+		authority = sshca.New(signer, time.Hour, logger)
+
+		publicKey, _, err := ed25519.GenerateKey(rand.Reader)
+		Expect(err).NotTo(HaveOccurred())
+
+		userKey, err = ssh.NewPublicKey(publicKey)
+		Expect(err).NotTo(HaveOccurred())
+
+		checker = &ssh.CertChecker{
+			IsUserAuthority: func(auth ssh.PublicKey) bool {
+				return string(auth.Marshal()) == string(authority.PublicKey().Marshal())
+			},
+		}
+
+		u = user.User{
+			Identifier: "fname.lname@mydomain.com",
+			Roles:      []string{"superuser", "readonlyuser"},
+		}
+	})
+
+	It("should issue a certificate trusted for the roles of the user", func() {
+		cert, err := authority.Sign(u, userKey)
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(checker.CheckCert("superuser", cert)).To(Succeed())
+		Expect(checker.CheckCert("readonlyuser", cert)).To(Succeed())
+		Expect(checker.CheckCert("root", cert)).To(MatchError(ContainSubstring("not in the set of valid principals")))
+
+		Expect(cert.CertType).To(Equal(uint32(ssh.UserCert)))
+		Expect(cert.Key.Marshal()).To(Equal(userKey.Marshal()))
+		Expect(cert.Permissions.Extensions).To(HaveKey("permit-pty"))
+	})
+
+	It("should put the identifier of the user in the key ID", func() {
+		cert, err := authority.Sign(u, userKey)
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(strings.HasPrefix(cert.KeyId, "fname.lname@mydomain.com:")).To(BeTrue())
+	})
+
+	It("should issue short-lived certificates", func() {
+		cert, err := authority.Sign(u, userKey)
+		Expect(err).NotTo(HaveOccurred())
+
+		validBefore := time.Unix(int64(cert.ValidBefore), 0)
+		Expect(validBefore).To(BeTemporally("~", time.Now().Add(time.Hour), 5*time.Second))
+
+		checker.Clock = func() time.Time { return time.Now().Add(2 * time.Hour) }
+		Expect(checker.CheckCert("superuser", cert)).To(MatchError(ContainSubstring("cert has expired")))
+	})
+
+	It("should issue certificates with unique serials", func() {
+		first, err := authority.Sign(u, userKey)
+		Expect(err).NotTo(HaveOccurred())
+
+		second, err := authority.Sign(u, userKey)
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(first.Serial).NotTo(Equal(second.Serial))
+	})
+
+	It("should refuse a user without roles", func() {
+		_, err := authority.Sign(user.User{Identifier: "fname.lname@mydomain.com"}, userKey)
+		Expect(err).To(Equal(sshca.ErrNoPrincipals))
+	})
+
+	It("should refuse to certify a certificate", func() {
+		cert, err := authority.Sign(u, userKey)
+		Expect(err).NotTo(HaveOccurred())
+
+		_, err = authority.Sign(u, cert)
+		Expect(err).To(MatchError(ContainSubstring("must not be a certificate")))
+	})
+
+	It("should refuse a weak RSA key", func() {
+		rsaKey, err := rsa.GenerateKey(rand.Reader, 1024)
+		Expect(err).NotTo(HaveOccurred())
+
+		weakKey, err := ssh.NewPublicKey(&rsaKey.PublicKey)
+		Expect(err).NotTo(HaveOccurred())
+
+		_, err = authority.Sign(u, weakKey)
+		Expect(err).To(MatchError(ContainSubstring("at least 2048 bits")))
+	})
+
+	It("should check its key can sign", func() {
+		Expect(authority.Check()).To(Succeed())
+	})
+})
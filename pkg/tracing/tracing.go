@@ -0,0 +1,146 @@
+package tracing
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Name of the tracer and of the service the spans belong to.
+const Name = "iap"
+
+// propagator reads and writes the W3C traceparent and tracestate headers.
+var propagator = propagation.TraceContext{}
+
+// NewExporter returns an exporter sending spans to the OTLP/HTTP endpoint of a
+// collector, eg: http://otel-collector:4318.
+func NewExporter(endpoint url.URL) (sdktrace.SpanExporter, error) {
+	return otlptracehttp.New(
+		context.Background(),
+		otlptracehttp.WithEndpointURL(endpoint.String()),
+	)
+}
+
+// Setup sends the spans of a ratio of the traces to the exporter, any trace
+// sampled by the caller is always sent. Until then spans are not recorded,
+// although the traceparent sent by clients is still propagated. The returned
+// provider has to be shut down to send the remaining spans.
+func Setup(exporter sdktrace.SpanExporter, ratio float64) *sdktrace.TracerProvider {
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(ratio))),
+		sdktrace.WithResource(resource.NewSchemaless(attribute.String("service.name", Name))),
+	)
+
+	otel.SetTracerProvider(provider)
+	return provider
+}
+
+// Start a span as a child of the span in the context, if there is one.
+func Start(ctx context.Context, name string, attributes ...attribute.KeyValue) (context.Context, trace.Span) {
+	return otel.Tracer(Name).Start(ctx, name, trace.WithAttributes(attributes...))
+}
+
+// End the span, marking it as failed when there is an error.
+func End(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// Extract returns the context of the trace the request belongs to, from its
+// traceparent header.
+func Extract(ctx context.Context, header http.Header) context.Context {
+	return propagator.Extract(ctx, propagation.HeaderCarrier(header))
+}
+
+// Inject sets the traceparent header of a request sent upstream, so that its
+// spans belong to the same trace.
+func Inject(ctx context.Context, header http.Header) {
+	propagator.Inject(ctx, propagation.HeaderCarrier(header))
+}
+
+// Handler starts a span for every request, continuing the trace of the client.
+func Handler(name string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx, span := otel.Tracer(Name).Start(
+			Extract(r.Context(), r.Header), name,
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(
+				attribute.String("http.method", r.Method),
+				attribute.String("http.host", r.Host),
+				attribute.String("http.target", r.URL.Path),
+			),
+		)
+		defer span.End()
+
+		recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(recorder, r.WithContext(ctx))
+
+		span.SetAttributes(attribute.Int("http.status_code", recorder.status))
+		if recorder.status >= http.StatusInternalServerError {
+			span.SetStatus(codes.Error, http.StatusText(recorder.status))
+		}
+	})
+}
+
+// RoundTripper starts a span for every request sent upstream, and propagates
+// the trace to the upstream.
+func RoundTripper(name string, next http.RoundTripper) http.RoundTripper {
+	return roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		ctx, span := otel.Tracer(Name).Start(
+			req.Context(), name,
+			trace.WithSpanKind(trace.SpanKindClient),
+			trace.WithAttributes(
+				attribute.String("http.method", req.Method),
+				attribute.String("http.host", req.URL.Host),
+			),
+		)
+		Inject(ctx, req.Header)
+
+		resp, err := next.RoundTrip(req.WithContext(ctx))
+		if err == nil {
+			span.SetAttributes(attribute.Int("http.status_code", resp.StatusCode))
+			if resp.StatusCode >= http.StatusInternalServerError {
+				span.SetStatus(codes.Error, http.StatusText(resp.StatusCode))
+			}
+		}
+
+		End(span, err)
+		return resp, err
+	})
+}
+
+type roundTripperFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+// statusRecorder remembers the status of the response. It unwraps to the
+// original writer, so that the connection can still be hijacked for protocol
+// upgrades and flushed while streaming.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *statusRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
@@ -0,0 +1,111 @@
+package tracing_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+
+	"github.com/alphagov/iap/pkg/tracing"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace/noop"
+)
+
+const (
+	traceID     = "4bf92f3577b34da6a3ce929d0e0e4736"
+	traceparent = "00-" + traceID + "-00f067aa0ba902b7-01"
+)
+
+var _ = Describe("Tracing", func() {
+	var (
+		exporter *tracetest.InMemoryExporter
+		provider *sdktrace.TracerProvider
+	)
+
+	BeforeEach(func() {
+		exporter = tracetest.NewInMemoryExporter()
+		provider = tracing.Setup(exporter, 1)
+	})
+
+	AfterEach(func() {
+		otel.SetTracerProvider(noop.NewTracerProvider())
+	})
+
+	spans := func() tracetest.SpanStubs {
+		Expect(provider.ForceFlush(context.Background())).To(Succeed())
+		return exporter.GetSpans()
+	}
+
+	It("Continues the trace of the client", func() {
+		handler := tracing.Handler("web", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			_, span := tracing.Start(r.Context(), "session.lookup")
+			tracing.End(span, nil)
+			w.WriteHeader(http.StatusTeapot)
+		}))
+
+		req := httptest.NewRequest("GET", "http://iap.mydomain.com/hello", nil)
+		req.Header.Set("Traceparent", traceparent)
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+
+		Expect(rr.Code).To(Equal(http.StatusTeapot))
+
+		recorded := spans()
+		Expect(recorded).To(HaveLen(2))
+		Expect(recorded[0].Name).To(Equal("session.lookup"))
+		Expect(recorded[1].Name).To(Equal("web"))
+		Expect(recorded[0].Parent.SpanID()).To(Equal(recorded[1].SpanContext.SpanID()))
+		Expect(recorded[1].Parent.SpanID().String()).To(Equal("00f067aa0ba902b7"))
+		Expect(recorded[1].SpanContext.TraceID().String()).To(Equal(traceID))
+	})
+
+	It("Propagates the trace upstream", func() {
+		upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprint(w, r.Header.Get("Traceparent"))
+		}))
+		defer upstream.Close()
+
+		ctx := tracing.Extract(context.Background(), http.Header{"Traceparent": {traceparent}})
+		req, err := http.NewRequestWithContext(ctx, "GET", upstream.URL, nil)
+		Expect(err).NotTo(HaveOccurred())
+
+		resp, err := tracing.RoundTripper("upstream", http.DefaultTransport).RoundTrip(req)
+		Expect(err).NotTo(HaveOccurred())
+		defer resp.Body.Close()
+
+		recorded := spans()
+		Expect(recorded).To(HaveLen(1))
+
+		body, err := ioutil.ReadAll(resp.Body)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(string(body)).To(Equal(fmt.Sprintf(
+			"00-%s-%s-01", traceID, recorded[0].SpanContext.SpanID(),
+		)))
+	})
+
+	It("Marks the span as failed with the error", func() {
+		_, span := tracing.Start(context.Background(), "oidc.exchange")
+		tracing.End(span, errors.New("token endpoint responded with 500"))
+
+		recorded := spans()
+		Expect(recorded).To(HaveLen(1))
+		Expect(recorded[0].Status.Code).To(Equal(codes.Error))
+		Expect(recorded[0].Status.Description).To(Equal("token endpoint responded with 500"))
+	})
+
+	It("Does not record traces out of the sample", func() {
+		tracing.Setup(exporter, 0)
+
+		_, span := tracing.Start(context.Background(), "session.lookup")
+		tracing.End(span, nil)
+
+		Expect(span.SpanContext().IsSampled()).To(BeFalse())
+	})
+})
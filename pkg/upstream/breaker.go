@@ -0,0 +1,95 @@
+package upstream
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/alphagov/iap/pkg/service"
+	"github.com/sirupsen/logrus"
+)
+
+// ErrCircuitOpen is returned while requests to a consistently failing service are refused.
+var ErrCircuitOpen = errors.New("Circuit breaker is open")
+
+// Breaker stops sending requests to a service after consecutive failures. Once
+// open for long enough a single trial request is let through, its result
+// decides if the circuit closes again.
+type Breaker struct {
+	mu        sync.Mutex
+	failures  int
+	openUntil time.Time
+	trial     bool
+
+	service string
+	config  *service.CircuitBreaker
+	logger  *logrus.Logger
+	now     func() time.Time
+}
+
+// NewBreaker will construct the circuit breaker for the service, it lets every
+// request through when the service does not have one configured.
+func NewBreaker(svc service.Service, logger *logrus.Logger) *Breaker {
+	return &Breaker{
+		service: svc.Identifier,
+		config:  svc.CircuitBreaker,
+		logger:  logger,
+		now:     time.Now,
+	}
+}
+
+// Allow returns ErrCircuitOpen when the request should not be attempted.
+// Every allowed request has to be reported back to Record.
+func (b *Breaker) Allow() error {
+	if b.config == nil {
+		return nil
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.failures < b.config.ConsecutiveFailures {
+		return nil
+	}
+
+	if b.trial || b.now().Before(b.openUntil) {
+		return ErrCircuitOpen
+	}
+
+	b.trial = true
+	return nil
+}
+
+// Record reports the result of an allowed request.
+func (b *Breaker) Record(failed bool) {
+	if b.config == nil {
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	wasOpen := b.failures >= b.config.ConsecutiveFailures
+	b.trial = false
+
+	if !failed {
+		b.failures = 0
+
+		if wasOpen {
+			b.logger.WithField("service", b.service).Info("closed circuit breaker")
+		}
+		return
+	}
+
+	b.failures++
+	if b.failures < b.config.ConsecutiveFailures {
+		return
+	}
+
+	b.openUntil = b.now().Add(b.config.OpenDuration)
+
+	b.logger.WithFields(logrus.Fields{
+		"service": b.service,
+		"until":   b.openUntil,
+	}).Warn("opened circuit breaker")
+}
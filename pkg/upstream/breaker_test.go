@@ -0,0 +1,78 @@
+package upstream
+
+import (
+	"time"
+
+	"github.com/alphagov/iap/pkg/service"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/sirupsen/logrus"
+)
+
+var _ = Describe("Circuit Breaker", func() {
+	var (
+		b   *Breaker
+		now time.Time
+	)
+
+	BeforeEach(func() {
+		logger := logrus.New()
+		logger.SetOutput(GinkgoWriter)
+
+		now = time.Now()
+		b = NewBreaker(service.Service{
+			CircuitBreaker: &service.CircuitBreaker{
+				ConsecutiveFailures: 2,
+				OpenDuration:        time.Minute,
+			},
+		}, logger)
+		b.now = func() time.Time { return now }
+	})
+
+	fail := func() {
+		Expect(b.Allow()).To(Succeed())
+		b.Record(true)
+	}
+
+	It("should let every request through without a configured breaker", func() {
+		b := NewBreaker(service.Service{}, logrus.New())
+		for i := 0; i < 10; i++ {
+			Expect(b.Allow()).To(Succeed())
+			b.Record(true)
+		}
+	})
+
+	It("should open after consecutive failures", func() {
+		fail()
+		Expect(b.Allow()).To(Succeed())
+		b.Record(false)
+
+		fail()
+		fail()
+		Expect(b.Allow()).To(Equal(ErrCircuitOpen))
+	})
+
+	It("should let a single trial request through once open for long enough", func() {
+		fail()
+		fail()
+
+		now = now.Add(2 * time.Minute)
+		Expect(b.Allow()).To(Succeed())
+		Expect(b.Allow()).To(Equal(ErrCircuitOpen))
+
+		By("closing when the trial succeeds")
+		b.Record(false)
+		Expect(b.Allow()).To(Succeed())
+	})
+
+	It("should open again when the trial request fails", func() {
+		fail()
+		fail()
+
+		now = now.Add(2 * time.Minute)
+		fail()
+
+		Expect(b.Allow()).To(Equal(ErrCircuitOpen))
+	})
+})
@@ -0,0 +1,40 @@
+package upstream
+
+import (
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/alphagov/iap/pkg/service"
+	"github.com/sirupsen/logrus"
+)
+
+// NewTransport will construct the transport used to reach the upstreams of the service.
+func NewTransport(svc service.Service, logger *logrus.Logger) *http.Transport {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+
+	if svc.Timeouts.Connect > 0 {
+		transport.DialContext = (&net.Dialer{
+			Timeout:   svc.Timeouts.Connect,
+			KeepAlive: 30 * time.Second,
+		}).DialContext
+	}
+
+	transport.ResponseHeaderTimeout = svc.Timeouts.ResponseHeader
+
+	if svc.Timeouts.Idle > 0 {
+		transport.IdleConnTimeout = svc.Timeouts.Idle
+	}
+
+	if svc.TLS != nil {
+		transport.TLSClientConfig = svc.TLS.Clone()
+
+		if svc.TLS.InsecureSkipVerify {
+			logger.WithFields(logrus.Fields{
+				"service": svc.Identifier,
+			}).Warn("upstream TLS certificates will not be verified")
+		}
+	}
+
+	return transport
+}
@@ -0,0 +1,159 @@
+package upstream
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	"github.com/alphagov/iap/pkg/service"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/sirupsen/logrus"
+)
+
+func issueCertificate(template *x509.Certificate, parent *tls.Certificate) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	Expect(err).NotTo(HaveOccurred())
+
+	template.SerialNumber = big.NewInt(time.Now().UnixNano())
+	template.NotBefore = time.Now().Add(-time.Hour)
+	template.NotAfter = time.Now().Add(time.Hour)
+
+	parentCert, parentKey := template, interface{}(key)
+	if parent != nil {
+		parentCert, parentKey = parent.Leaf, parent.PrivateKey
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, parentCert, &key.PublicKey, parentKey)
+	Expect(err).NotTo(HaveOccurred())
+
+	leaf, err := x509.ParseCertificate(der)
+	Expect(err).NotTo(HaveOccurred())
+
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}
+}
+
+var _ = Describe("Upstream Transport", func() {
+	var (
+		ca       tls.Certificate
+		client   tls.Certificate
+		server   *httptest.Server
+		rootCAs  *x509.CertPool
+		logger   *logrus.Logger
+		upstream string
+	)
+
+	BeforeEach(func() {
+		logger = logrus.New()
+		logger.SetOutput(GinkgoWriter)
+
+		ca = issueCertificate(&x509.Certificate{
+			Subject:               pkix.Name{CommonName: "internal ca"},
+			IsCA:                  true,
+			BasicConstraintsValid: true,
+			KeyUsage:              x509.KeyUsageCertSign,
+		}, nil)
+
+		serverCert := issueCertificate(&x509.Certificate{
+			Subject:     pkix.Name{CommonName: "my-service.internal"},
+			DNSNames:    []string{"my-service.internal"},
+			ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		}, &ca)
+
+		client = issueCertificate(&x509.Certificate{
+			Subject:     pkix.Name{CommonName: "iap"},
+			ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		}, &ca)
+
+		rootCAs = x509.NewCertPool()
+		rootCAs.AddCert(ca.Leaf)
+
+		server = httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(r.TLS.PeerCertificates[0].Subject.CommonName))
+		}))
+		server.TLS = &tls.Config{
+			Certificates: []tls.Certificate{serverCert},
+			ClientCAs:    rootCAs,
+			ClientAuth:   tls.RequireAndVerifyClientCert,
+		}
+		server.StartTLS()
+		upstream = server.URL
+	})
+
+	AfterEach(func() {
+		server.Close()
+	})
+
+	get := func(config *tls.Config) error {
+		transport := NewTransport(service.Service{TLS: config}, logger)
+		defer transport.CloseIdleConnections()
+
+		resp, err := (&http.Client{Transport: transport}).Get(upstream)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+
+		Expect(resp.StatusCode).To(Equal(http.StatusOK))
+		return nil
+	}
+
+	It("should connect with a private CA, client certificate and server name", func() {
+		Expect(get(&tls.Config{
+			RootCAs:      rootCAs,
+			Certificates: []tls.Certificate{client},
+			ServerName:   "my-service.internal",
+		})).To(Succeed())
+	})
+
+	It("should not connect without the server name of the certificate", func() {
+		Expect(get(&tls.Config{
+			RootCAs:      rootCAs,
+			Certificates: []tls.Certificate{client},
+		})).NotTo(Succeed())
+	})
+
+	It("should not connect without trusting the private CA", func() {
+		Expect(get(&tls.Config{
+			Certificates: []tls.Certificate{client},
+			ServerName:   "my-service.internal",
+		})).NotTo(Succeed())
+	})
+
+	It("should not connect without a client certificate", func() {
+		Expect(get(&tls.Config{
+			RootCAs:    rootCAs,
+			ServerName: "my-service.internal",
+		})).NotTo(Succeed())
+	})
+
+	It("should give up waiting for slow response headers", func() {
+		slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			time.Sleep(500 * time.Millisecond)
+		}))
+		defer slow.Close()
+
+		transport := NewTransport(service.Service{
+			Timeouts: service.Timeouts{ResponseHeader: 100 * time.Millisecond},
+		}, logger)
+		defer transport.CloseIdleConnections()
+
+		_, err := (&http.Client{Transport: transport}).Get(slow.URL)
+		Expect(err).To(MatchError(ContainSubstring("timeout awaiting response headers")))
+	})
+
+	It("should connect without verification when asked to", func() {
+		Expect(get(&tls.Config{
+			Certificates:       []tls.Certificate{client},
+			InsecureSkipVerify: true,
+		})).To(Succeed())
+	})
+})
@@ -0,0 +1,256 @@
+package upstream
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/alphagov/iap/pkg/service"
+	"github.com/sirupsen/logrus"
+)
+
+// ErrNoHealthyUpstream is returned when every upstream of a pool is unhealthy or ejected.
+var ErrNoHealthyUpstream = errors.New("No healthy upstream available")
+
+// Backend is a single upstream of a pool along with its health.
+type Backend struct {
+	URI    url.URL
+	Weight int
+
+	healthy             bool
+	consecutiveSuccess  int
+	consecutiveFailures int
+	passiveFailures     int
+	ejectedUntil        time.Time
+	active              int
+	currentWeight       int
+}
+
+// Pool balances requests between the upstreams of a service.
+type Pool struct {
+	mu       sync.Mutex
+	backends []*Backend
+	next     int
+
+	service string
+	policy  string
+	health  *service.HealthCheck
+	outlier *service.OutlierDetection
+	client  *http.Client
+	logger  *logrus.Logger
+	now     func() time.Time
+}
+
+// NewPool will construct the pool for the upstreams of the service, health
+// checks are sent through the same transport as the requests.
+func NewPool(svc service.Service, transport http.RoundTripper, logger *logrus.Logger) *Pool {
+	p := &Pool{
+		backends: make([]*Backend, 0, len(svc.Upstreams)),
+		service:  svc.Identifier,
+		policy:   svc.LoadBalancing,
+		health:   svc.HealthCheck,
+		outlier:  svc.OutlierDetection,
+		logger:   logger,
+		now:      time.Now,
+	}
+
+	for _, upstream := range svc.Upstreams {
+		p.backends = append(p.backends, &Backend{
+			URI:     upstream.URI,
+			Weight:  upstream.Weight,
+			healthy: true,
+		})
+	}
+
+	if p.health != nil {
+		p.client = &http.Client{
+			Transport: transport,
+			Timeout:   p.health.Timeout,
+			CheckRedirect: func(req *http.Request, via []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		}
+	}
+
+	return p
+}
+
+// Pick selects an available upstream according to the load balancing policy.
+// Every picked backend has to be given back to Release once the request is done.
+func (p *Pool) Pick() (*Backend, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	available := make([]*Backend, 0, len(p.backends))
+	for _, backend := range p.backends {
+		if p.isAvailable(backend) {
+			available = append(available, backend)
+		}
+	}
+
+	if len(available) == 0 {
+		return nil, ErrNoHealthyUpstream
+	}
+
+	var picked *Backend
+
+	switch p.policy {
+	case service.LeastConnections:
+		start := p.next % len(available)
+		for i := range available {
+			backend := available[(start+i)%len(available)]
+			if picked == nil || backend.active < picked.active {
+				picked = backend
+			}
+		}
+		p.next++
+	case service.Weighted:
+		// smooth weighted round robin, so heavier upstreams are not picked in bursts
+		total := 0
+		for _, backend := range available {
+			backend.currentWeight += backend.Weight
+			total += backend.Weight
+			if picked == nil || backend.currentWeight > picked.currentWeight {
+				picked = backend
+			}
+		}
+		picked.currentWeight -= total
+	default:
+		picked = available[p.next%len(available)]
+		p.next++
+	}
+
+	picked.active++
+	return picked, nil
+}
+
+// Release gives the backend back to the pool, recording if the request failed
+// because of a connection error or a 5xx response.
+func (p *Pool) Release(backend *Backend, failed bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	backend.active--
+
+	if p.outlier == nil {
+		return
+	}
+
+	if !failed {
+		backend.passiveFailures = 0
+		return
+	}
+
+	backend.passiveFailures++
+	if backend.passiveFailures < p.outlier.ConsecutiveFailures {
+		return
+	}
+
+	backend.passiveFailures = 0
+	backend.ejectedUntil = p.now().Add(p.outlier.EjectionDuration)
+
+	p.logger.WithFields(logrus.Fields{
+		"service":  p.service,
+		"upstream": backend.URI.String(),
+		"until":    backend.ejectedUntil,
+	}).Warn("ejected failing upstream")
+}
+
+// Check runs one round of active health checks against every upstream.
+func (p *Pool) Check() {
+	if p.health == nil {
+		return
+	}
+
+	var wg sync.WaitGroup
+	for _, backend := range p.backends {
+		wg.Add(1)
+		go func(backend *Backend) {
+			defer wg.Done()
+			p.record(backend, p.probe(backend))
+		}(backend)
+	}
+	wg.Wait()
+}
+
+// Run keeps checking the health of the upstreams until stopped.
+func (p *Pool) Run(stop <-chan struct{}) {
+	if p.health == nil {
+		return
+	}
+
+	ticker := time.NewTicker(p.health.Interval)
+	defer ticker.Stop()
+
+	for {
+		p.Check()
+
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return
+		}
+	}
+}
+
+func (p *Pool) probe(backend *Backend) bool {
+	checkURI := backend.URI
+	checkURI.Path = p.health.Path
+
+	resp, err := p.client.Get(checkURI.String())
+	if err != nil {
+		return false
+	}
+	resp.Body.Close()
+
+	return resp.StatusCode >= 200 && resp.StatusCode < 400
+}
+
+func (p *Pool) record(backend *Backend, success bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if success {
+		backend.consecutiveFailures = 0
+		backend.consecutiveSuccess++
+	} else {
+		backend.consecutiveSuccess = 0
+		backend.consecutiveFailures++
+	}
+
+	switch {
+	case !backend.healthy && backend.consecutiveSuccess >= p.health.HealthyThreshold:
+		backend.healthy = true
+	case backend.healthy && backend.consecutiveFailures >= p.health.UnhealthyThreshold:
+		backend.healthy = false
+	default:
+		return
+	}
+
+	p.logger.WithFields(logrus.Fields{
+		"service":  p.service,
+		"upstream": backend.URI.String(),
+		"healthy":  backend.healthy,
+	}).Warn("upstream health changed")
+}
+
+// Available returns how many of the upstreams are healthy and not ejected.
+func (p *Pool) Available() (int, int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	available := 0
+	for _, backend := range p.backends {
+		if p.isAvailable(backend) {
+			available++
+		}
+	}
+
+	return available, len(p.backends)
+}
+
+func (p *Pool) isAvailable(backend *Backend) bool {
+	return backend.healthy && !p.now().Before(backend.ejectedUntil)
+}
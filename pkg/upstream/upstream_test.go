@@ -0,0 +1,170 @@
+package upstream
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"time"
+
+	"github.com/alphagov/iap/pkg/service"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/sirupsen/logrus"
+)
+
+var _ = Describe("Upstream Pool", func() {
+	var logger *logrus.Logger
+
+	BeforeEach(func() {
+		logger = logrus.New()
+		logger.SetOutput(GinkgoWriter)
+	})
+
+	upstreams := func(weights ...int) []service.Upstream {
+		result := make([]service.Upstream, 0)
+		for index, weight := range weights {
+			result = append(result, service.Upstream{
+				URI:    url.URL{Scheme: "http", Host: string(rune('a'+index)) + ".local"},
+				Weight: weight,
+			})
+		}
+		return result
+	}
+
+	pick := func(p *Pool, times int) []string {
+		hosts := make([]string, 0)
+		for i := 0; i < times; i++ {
+			backend, err := p.Pick()
+			Expect(err).NotTo(HaveOccurred())
+			hosts = append(hosts, backend.URI.Host)
+			p.Release(backend, false)
+		}
+		return hosts
+	}
+
+	It("should pick upstreams in turn with round robin", func() {
+		p := NewPool(service.Service{
+			Upstreams:     upstreams(1, 1, 1),
+			LoadBalancing: service.RoundRobin,
+		}, http.DefaultTransport, logger)
+
+		Expect(pick(p, 4)).To(Equal([]string{"a.local", "b.local", "c.local", "a.local"}))
+	})
+
+	It("should pick upstreams proportionally to their weight", func() {
+		p := NewPool(service.Service{
+			Upstreams:     upstreams(3, 1),
+			LoadBalancing: service.Weighted,
+		}, http.DefaultTransport, logger)
+
+		Expect(pick(p, 4)).To(ConsistOf("a.local", "a.local", "a.local", "b.local"))
+	})
+
+	It("should pick the upstream with the least connections", func() {
+		p := NewPool(service.Service{
+			Upstreams:     upstreams(1, 1),
+			LoadBalancing: service.LeastConnections,
+		}, http.DefaultTransport, logger)
+
+		busy, err := p.Pick()
+		Expect(err).NotTo(HaveOccurred())
+
+		for i := 0; i < 3; i++ {
+			backend, err := p.Pick()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(backend).NotTo(BeIdenticalTo(busy))
+			p.Release(backend, false)
+		}
+	})
+
+	It("should eject an upstream after consecutive failures", func() {
+		now := time.Now()
+
+		p := NewPool(service.Service{
+			Upstreams: upstreams(1, 1),
+			OutlierDetection: &service.OutlierDetection{
+				ConsecutiveFailures: 2,
+				EjectionDuration:    time.Minute,
+			},
+		}, http.DefaultTransport, logger)
+		p.now = func() time.Time { return now }
+
+		for i := 0; i < 4; i++ {
+			backend, err := p.Pick()
+			Expect(err).NotTo(HaveOccurred())
+			p.Release(backend, backend.URI.Host == "a.local")
+		}
+
+		Expect(pick(p, 3)).To(Equal([]string{"b.local", "b.local", "b.local"}))
+
+		available, total := p.Available()
+		Expect(available).To(Equal(1))
+		Expect(total).To(Equal(2))
+
+		By("bringing it back after the ejection")
+		now = now.Add(2 * time.Minute)
+		Expect(pick(p, 4)).To(ContainElement("a.local"))
+
+		available, _ = p.Available()
+		Expect(available).To(Equal(2))
+	})
+
+	It("should fail when every upstream is unavailable", func() {
+		p := NewPool(service.Service{
+			Upstreams: upstreams(1),
+			OutlierDetection: &service.OutlierDetection{
+				ConsecutiveFailures: 1,
+				EjectionDuration:    time.Minute,
+			},
+		}, http.DefaultTransport, logger)
+
+		backend, err := p.Pick()
+		Expect(err).NotTo(HaveOccurred())
+		p.Release(backend, true)
+
+		_, err = p.Pick()
+		Expect(err).To(Equal(ErrNoHealthyUpstream))
+	})
+
+	It("should remove unhealthy upstreams and bring them back once healthy", func() {
+		healthy := true
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			Expect(r.URL.Path).To(Equal("/healthcheck"))
+			if !healthy {
+				w.WriteHeader(http.StatusServiceUnavailable)
+			}
+		}))
+		defer server.Close()
+
+		serverURI, err := url.Parse(server.URL)
+		Expect(err).NotTo(HaveOccurred())
+
+		p := NewPool(service.Service{
+			Upstreams: []service.Upstream{service.Upstream{URI: *serverURI, Weight: 1}},
+			HealthCheck: &service.HealthCheck{
+				Path:               "/healthcheck",
+				Interval:           time.Second,
+				Timeout:            time.Second,
+				HealthyThreshold:   2,
+				UnhealthyThreshold: 2,
+			},
+		}, http.DefaultTransport, logger)
+
+		healthy = false
+		p.Check()
+		Expect(pick(p, 1)).To(HaveLen(1))
+
+		p.Check()
+		_, err = p.Pick()
+		Expect(err).To(Equal(ErrNoHealthyUpstream))
+
+		healthy = true
+		p.Check()
+		_, err = p.Pick()
+		Expect(err).To(Equal(ErrNoHealthyUpstream))
+
+		p.Check()
+		Expect(pick(p, 1)).To(HaveLen(1))
+	})
+})